@@ -0,0 +1,160 @@
+//
+// cmtp, Common Multiplexing Transport Proxy (CMTP) client/server
+//
+// client: cmtp client --listen 127.0.0.1:8080 --peer server:9999 --dest 10.0.0.1:80 --token 1234
+// udp client: cmtp client --udplisten 127.0.0.1:5353 --peer server:9999 --udpdest 8.8.8.8:53 --token 1234
+// proxy client: cmtp client --socks 127.0.0.1:1080 --http 127.0.0.1:3128 --peer server:9999 --token 1234
+// server: cmtp server --listen 0.0.0.0:9999 --token 1234
+// or: cmtp client --config cmtp.toml
+//
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/wheelcomplex/preinit/cmtp"
+	"github.com/wheelcomplex/preinit/getopt"
+)
+
+// config return *cmtp.Config_t load from --config and override by options in args/env
+func config(op *getopt.Opts_t) (*cmtp.Config_t, error) {
+	cfg := &cmtp.Config_t{}
+	if path := op.GetString("--config"); path != "" {
+		var err error
+		if cfg, err = cmtp.LoadConfig(path); err != nil {
+			return nil, err
+		}
+	}
+	given := func(flag string) bool {
+		src := op.Source(flag)
+		return src == "argv" || src == "env"
+	}
+	if given("--token") || cfg.Token == 0 {
+		token, err := strconv.ParseUint(op.GetString("--token"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --token: %s", err.Error())
+		}
+		cfg.Token = token
+	}
+	if given("--listen") || cfg.Listen == "" {
+		cfg.Listen = op.GetString("--listen")
+	}
+	if given("--codec") || len(cfg.Codec) == 0 {
+		cfg.Codec = op.GetStringList("--codec")
+	}
+	if given("--checksum") || len(cfg.Checksum) == 0 {
+		cfg.Checksum = op.GetStringList("--checksum")
+	}
+	if given("--handshake") || cfg.Handshake == 0 {
+		cfg.Handshake = op.GetInt("--handshake")
+	}
+	if given("--scheduler") || cfg.Scheduler == "" {
+		cfg.Scheduler = op.GetString("--scheduler")
+	}
+	if given("--idle") || cfg.Idle == 0 {
+		cfg.Idle = op.GetInt("--idle")
+	}
+	if given("--udpidle") || cfg.UDPIdle == 0 {
+		cfg.UDPIdle = op.GetInt("--udpidle")
+	}
+	if op.Name() != "client" {
+		return cfg, nil
+	}
+	if given("--peer") || len(cfg.Peers) == 0 {
+		cfg.Peers = op.GetStringList("--peer")
+	}
+	if given("--links") || cfg.Links == 0 {
+		cfg.Links = op.GetInt("--links")
+	}
+	if given("--dest") || cfg.Dest == "" {
+		cfg.Dest = op.GetString("--dest")
+	}
+	if given("--udplisten") || cfg.UDPListen == "" {
+		cfg.UDPListen = op.GetString("--udplisten")
+	}
+	if given("--udpdest") || cfg.UDPDest == "" {
+		cfg.UDPDest = op.GetString("--udpdest")
+	}
+	if given("--socks") || cfg.SOCKS == "" {
+		cfg.SOCKS = op.GetString("--socks")
+	}
+	if given("--http") || cfg.HTTP == "" {
+		cfg.HTTP = op.GetString("--http")
+	}
+	return cfg, nil
+}
+
+// wait wait for exit signal and close tf
+func wait(tf *cmtp.CodecMixer) error {
+	fmt.Printf("cmtp running at %v\n", tf.Addrs())
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	<-ch
+	tf.Close()
+	return nil
+}
+
+func runClient(op *getopt.Opts_t) error {
+	cfg, err := config(op)
+	if err != nil {
+		return err
+	}
+	tf, err := cmtp.NewClient(cfg)
+	if err != nil {
+		return err
+	}
+	return wait(tf)
+}
+
+func runServer(op *getopt.Opts_t) error {
+	cfg, err := config(op)
+	if err != nil {
+		return err
+	}
+	tf, err := cmtp.NewServer(cfg)
+	if err != nil {
+		return err
+	}
+	return wait(tf)
+}
+
+func main() {
+	op := getopt.NewOpts(os.Args[1:])
+	op.SetVersion("cmtp 0.1")
+	op.SetDescription("Common Multiplexing Transport Proxy, forward tcp connection and udp flow over multiple links")
+	op.SetEnvPrefix("CMTP_", "--")
+	op.SetOpt("--config", "", "toml config file, options in args/env override config file")
+	op.SetOpt("--token", "0", "shared token of client and server, required")
+	op.SetOpt("--listen", "", "listen address, local connection for client, client links for server")
+	op.SetOpts("--codec", []string{"snappy+aesgcm"}, "accepted codec, ordered by preference(snappy+aesgcm, aesgcm, snappy, noop), codec without aesgcm is not encrypted")
+	op.SetOpts("--checksum", []string{"xxhash"}, "accepted frame header checksum, ordered by preference(xxhash, murmur3, noop)")
+	op.SetOpt("--handshake", "10", "handshake timeout in seconds")
+	op.SetOpt("--idle", "300", "idle session timeout in seconds")
+	op.SetOpt("--scheduler", "throughput", "link scheduler(roundrobin, throughput, rtt)")
+	op.SetOpt("--udpidle", "60", "idle udp flow timeout in seconds")
+	op.SetHint("--config", getopt.HINT_FILE)
+	op.Required("--token")
+
+	client := op.AddCommand("client", "listen for local connection and forward to server")
+	client.SetOpts("--peer", []string{}, "address of server, eg,. server:9999")
+	client.SetOpt("--links", strconv.Itoa(cmtp.CMTP_DEFAULT_LINKS), "links to each server")
+	client.SetOpt("--dest", "", "destination host:port connect by server")
+	client.SetOpt("--udplisten", "", "local udp listen address, eg,. 127.0.0.1:5353")
+	client.SetOpt("--udpdest", "", "udp destination host:port of datagram flow, eg,. 8.8.8.8:53")
+	client.SetOpt("--socks", "", "local SOCKS5 listen address, destination is taken from request, eg,. 127.0.0.1:1080")
+	client.SetOpt("--http", "", "local HTTP CONNECT listen address, destination is taken from request, eg,. 127.0.0.1:3128")
+	client.SetHandler(runClient)
+
+	server := op.AddCommand("server", "accept client links and connect to destination")
+	server.SetHandler(runServer)
+
+	if err := op.Dispatch(); err != nil {
+		fmt.Fprintf(os.Stderr, "cmtp: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
@@ -60,6 +60,12 @@ const CMTP_SMALL_PKG_SIZE uint64 = 1024
 // max buffer size for ReadFrom/WriteTo
 const CMTP_BUF_MAX int = 512 * 1024
 
+// max payload size of frame
+const CMTP_FRAME_MAX int = CMTP_BUF_MAX * 4
+
+// keep closed ssid for CMTP_SSID_LINGER, frames of closed session will not open new session
+const CMTP_SSID_LINGER time.Duration = 60e9
+
 // uuid source
 var uuidCh = misc.NewUUIDChan().C
 
@@ -84,6 +90,7 @@ const (
 	FRAME_MSGERR         // sending CMsg
 	FRAME_MSGNEWSSID     // sending CMsg
 	FRAME_MSGDELSSID     // sending CMsg
+	FRAME_MSGWINDOW      // sending CMsg, flow window of session
 	FRAME_MSGLAST        // CMsg mark
 	FRAME_LINKSTART      // link mark
 	FRAME_LINKNOOP       // sending CMsg
@@ -122,6 +129,8 @@ const (
 	IO_ERR_READ
 	IO_ERR_WRITE
 	IO_ERR_CLOSED
+	IO_ERR_OVERFLOW
+	IO_ERR_IDLE
 )
 
 // error code fo encode/decode
@@ -225,6 +234,8 @@ type mixerFrame struct {
 	iobuf      []byte // io buffer use fo WriteTo
 	ioptr      int    // current opration position for WriteTo
 	iolen      int    // pre-io length
+	codec      Codec  // codec of session for encode, frame queued before session closed is still sent
+	resend     bool   // retransmit of frame from failed link
 }
 
 func newMixerFrame() *mixerFrame {
@@ -253,6 +264,17 @@ func (mf *mixerFrame) headerInit(frametype, ssid, index uint64) {
 	mf.bodylen = uint64(mf.ioptr)
 }
 
+// aad return header fields authenticated by FrameCodec
+// payloadlen is authenticated by AEAD itself, hdrsum is computed from header
+func (mf *mixerFrame) aad() []byte {
+	aad := make([]byte, 32)
+	CMTP_ENDIAN.PutUint64(aad, mf.frametype)
+	CMTP_ENDIAN.PutUint64(aad[8:], mf.ssid)
+	CMTP_ENDIAN.PutUint64(aad[16:], mf.index)
+	CMTP_ENDIAN.PutUint64(aad[24:], mf.bodylen)
+	return aad
+}
+
 // MarshalHeader
 func (mf *mixerFrame) MarshalHeader(checksum Checksum, count int) {
 	//
@@ -386,12 +408,24 @@ func (mf *mixerFrame) UnMarshalHeader(checksum Checksum, count int) error {
 	}
 	offset += binary.Size(mf.bodylen)
 	//
-	mf.hdrsum = checksum.Checksum32(mf.framebuf[:mf.sumlen])
+	sum := checksum.Checksum32(mf.framebuf[:mf.sumlen])
 	//
 	err = binary.Read(misc.NewBRWC(mf.framebuf[offset:]), CMTP_ENDIAN, &mf.hdrsum)
 	if err != nil {
 		panic(fmt.Sprintf("decodeLoop#%d, %d, index %d, unmarshal hdrsum failed: %s", count, mf.ssid, mf.index, err.Error()))
 	}
+	if mf.hdrsum != sum {
+		return &CMsg{
+			Code: uint64(UNMARSHAL_ERR_HDR),
+			Err:  fmt.Errorf("decodeLoop#%d, %d, index %d, unmarshal header failed: checksum mismatch, %x != %x", count, mf.ssid, mf.index, mf.hdrsum, sum),
+		}
+	}
+	if mf.payloadlen > uint64(CMTP_FRAME_MAX) {
+		return &CMsg{
+			Code: uint64(UNMARSHAL_ERR_TOOLARGE),
+			Err:  fmt.Errorf("decodeLoop#%d, %d, index %d, unmarshal header failed: payload too large, %d > %d", count, mf.ssid, mf.index, mf.payloadlen, CMTP_FRAME_MAX),
+		}
+	}
 	return nil
 }
 
@@ -450,6 +484,12 @@ type CodecMixer struct {
 	token          uint64                      // token id
 	aes            *keyaes.AES                 // crypter for handshake
 	key            []byte                      //
+	nonce          []byte                      // random nonce of mixer, exchanged in handshake for session secret
+	sssecret       []byte                      // session secret from handshake, check sessionKeys
+	hsServer       bool                        // server side of handshake, use server key of session to encode
+	hsVersion      uint64                      // max protocol version offered in handshake, CMTP_VERSION by default
+	ctrl           *ctrlAEAD                   // seal control frame, keyed by session secret, check ctrlSealer
+	version        uint64                      // protocol version negotiated with peer mixer, check CMTP_VERSION
 	ioFreeCh       chan *mixerFrame            // idle frame
 	encodeCh       chan *mixerFrame            // encode frame
 	decodeCh       chan *mixerFrame            // decode frame
@@ -463,11 +503,31 @@ type CodecMixer struct {
 	closed         chan string                 // closed goroutine
 	cpus           int                         // number of using cpus
 	exitMsg        chan CMsg                   // goroutine exit msg
-	mixerCh        chan io.ReadWriteCloser     // underlay io.ReadWriteCloser
-	ssmutex        map[uint64]*sync.Mutex      // lock for session index by ssid
+	mixerCh        chan *mixerLink             // new link
 	ssindex        map[uint64]uint64           // index for session index by ssid
 	sscodecList    map[uint64]Codec            // codec map to ssid
 	ssWriteCh      map[uint64]chan *mixerFrame // disassemble write frame
+	ssclosing      map[uint64]chan struct{}    // close notify of session
+	ssclosed       map[uint64]time.Time        // closed ssid, check CMTP_SSID_LINGER
+	sscredit       map[uint64]*flowCredit      // send credit of session granted by peer
+	ssdone         map[uint64]int              // half-closed direction of session, check SESSION_*_DONE
+	ssactive       map[uint64]time.Time        // last frame time of session, check idleTimeout
+	idleTimeout    time.Duration               // idle session is reset after idleTimeout
+	passive        bool                        // accept new session from peer(server side)
+	listeners      []net.Listener              // listener of acceptClient/acceptClientUDP/acceptPeer
+	links          []*mixerLink                // running peer links, ordered by id
+	linkReady      chan struct{}               // link added/removed or queue of link dequeued
+	scheduler      Scheduler                   // pick link for frame
+	linkid         int                         // link id counter
+	keepalive      time.Duration               // interval of FRAME_LINKNOOP
+	keeptimeout    time.Duration               // dead link timeout
+	hsTimeout      time.Duration               // timeout for peer handshake
+	reorderWindow  uint64                      // window of reorder buffer
+	reorderTimeout time.Duration               // missing frame timeout of reorder buffer
+	codecs         []string                    // codec names accepted in handshake
+	checksums      []string                    // checksum names accepted in handshake
+	peers          map[string]*CodecMixer      // peer mixer of server by client mixer, check peerMixer
+	unlinked       time.Time                   // last link removed, check CMTP_PEER_LINGER
 }
 
 // newCodecMixer return *CodecMixer
@@ -484,6 +544,7 @@ func newCodecMixer(token uint64, codec Codec, checksum Checksum, filter Filter)
 		token:          token,
 		aes:            keyaes.NewAES(key, nil),
 		key:            key,
+		nonce:          newNonce(),
 		ioFreeCh:       make(chan *mixerFrame, chansize*2),
 		encodeCh:       make(chan *mixerFrame, chansize),
 		decodeCh:       make(chan *mixerFrame, chansize),
@@ -494,19 +555,38 @@ func newCodecMixer(token uint64, codec Codec, checksum Checksum, filter Filter)
 		checksum:       checksum,
 		filter:         filter,
 		state:          MIXER_STATE_RESET,
-		closing:        make(chan struct{}, cpus*10),
+		closing:        make(chan struct{}),
 		closed:         make(chan string, cpus*10),
 		cpus:           cpus,
 		exitMsg:        make(chan CMsg, cpus*10),
-		mixerCh:        make(chan io.ReadWriteCloser, cpus*5),
+		mixerCh:        make(chan *mixerLink, cpus*5),
 		sscodecList:    make(map[uint64]Codec),
-		ssmutex:        make(map[uint64]*sync.Mutex),
 		ssindex:        make(map[uint64]uint64),
+		ssclosing:      make(map[uint64]chan struct{}),
+		ssclosed:       make(map[uint64]time.Time),
+		sscredit:       make(map[uint64]*flowCredit),
+		ssdone:         make(map[uint64]int),
+		ssactive:       make(map[uint64]time.Time),
+		peers:          make(map[string]*CodecMixer),
+		idleTimeout:    CMTP_IDLE_TIMEOUT,
+		linkReady:      make(chan struct{}, 1),
+		scheduler:      NewThroughputScheduler(),
+		keepalive:      CMTP_LINK_KEEPALIVE,
+		keeptimeout:    CMTP_LINK_TIMEOUT,
+		hsTimeout:      HANDSHAKE_TIMEOUT,
+		hsVersion:      CMTP_VERSION,
+		version:        CMTP_VERSION,
+	}
+	if name := codecName(codec); name != "" {
+		tf.codecs = []string{name}
+	}
+	if name := checksumName(checksum); name != "" {
+		tf.checksums = []string{name}
 	}
-	tf.sscodecList[INIT_SSID] = tf.codec.New()
-	tf.ssmutex[INIT_SSID] = &sync.Mutex{}
+	tf.sscodecList[INIT_SSID] = tf.newSessionCodec(INIT_SSID)
 	tf.ssindex[INIT_SSID] = INIT_INDEX
 	tf.ssWriteCh[INIT_SSID] = make(chan *mixerFrame, CHANNEL_BUFFER_SIZE)
+	tf.ssclosing[INIT_SSID] = make(chan struct{})
 	for i := 0; i < cpus; i++ {
 		tf.ioFreeCh <- newMixerFrame()
 	}
@@ -517,11 +597,31 @@ func newCodecMixer(token uint64, codec Codec, checksum Checksum, filter Filter)
 	}
 	// launch ReadWriter goroutine for back2back connection
 	go tf.runReadWriter()
+	go tf.scheduleLoop()
+	go tf.idleLoop()
 	return tf
 }
 
+// NewCodecMixer return *CodecMixer use token for handshake
+// filter is used to create Filter for new session, check TCPFilter
+func NewCodecMixer(token uint64, codec Codec, checksum Checksum, filter Filter) *CodecMixer {
+	return newCodecMixer(token, codec, checksum, filter)
+}
+
+// Key return aes key expended from token, use for NewTCPFilter
+func (tf *CodecMixer) Key() []byte {
+	return tf.key
+}
+
 // initssid
 func (tf *CodecMixer) initssid(ssid uint64) uint64 {
+	ssid, _ = tf.createssid(ssid)
+	return ssid
+}
+
+// createssid create session state of ssid, 0 for new ssid
+// return false if session already exist
+func (tf *CodecMixer) createssid(ssid uint64) (uint64, bool) {
 	tf.mutex.Lock()
 	defer tf.mutex.Unlock()
 	if ssid == 0 {
@@ -529,19 +629,30 @@ func (tf *CodecMixer) initssid(ssid uint64) uint64 {
 		ssid = tf.ssid
 	}
 	if _, ok := tf.sscodecList[ssid]; ok {
-		return ssid
+		return ssid, false
 	}
-	tf.sscodecList[ssid] = tf.codec.New()
-	tf.ssmutex[ssid] = &sync.Mutex{}
+	tf.sscodecList[ssid] = tf.newSessionCodec(ssid)
 	tf.ssindex[ssid] = INIT_INDEX
-	tf.ssWriteCh[ssid] = make(chan *mixerFrame, tf.cpus*5+1024)
-	return ssid
+	// frames in flight never exceed flow window, double it for duplicated frames
+	tf.ssWriteCh[ssid] = make(chan *mixerFrame, CMTP_FLOW_WINDOW*2)
+	tf.ssclosing[ssid] = make(chan struct{})
+	tf.sscredit[ssid] = newFlowCredit(CMTP_FLOW_WINDOW)
+	tf.ssdone[ssid] = 0
+	tf.ssactive[ssid] = time.Now()
+	return ssid, true
 }
 
 // clearssid
+// ssWriteCh is not closed for decodeLoop may sending, ssclosing is closed instead
 func (tf *CodecMixer) clearssid(ssid uint64) {
 	tf.mutex.Lock()
 	defer tf.mutex.Unlock()
+	tf.clearssidLocked(ssid)
+}
+
+// clearssidLocked clear session state of ssid
+// caller should hold tf.mutex
+func (tf *CodecMixer) clearssidLocked(ssid uint64) {
 	if ssid == 0 {
 		return
 	}
@@ -549,68 +660,327 @@ func (tf *CodecMixer) clearssid(ssid uint64) {
 		return
 	}
 	delete(tf.sscodecList, ssid)
-	delete(tf.ssmutex, ssid)
 	delete(tf.ssindex, ssid)
-	close(tf.ssWriteCh[ssid])
 	delete(tf.ssWriteCh, ssid)
+	delete(tf.sscredit, ssid)
+	delete(tf.ssdone, ssid)
+	delete(tf.ssactive, ssid)
+	close(tf.ssclosing[ssid])
+	delete(tf.ssclosing, ssid)
+	now := time.Now()
+	for id, t := range tf.ssclosed {
+		if now.Sub(t) > CMTP_SSID_LINGER {
+			delete(tf.ssclosed, id)
+		}
+	}
+	tf.ssclosed[ssid] = now
+}
+
+// newSessionCodec return new codec of ssid, keyed by session secret for FrameCodec
+// caller should hold tf.mutex
+func (tf *CodecMixer) newSessionCodec(ssid uint64) Codec {
+	codec := tf.codec.New()
+	fc, ok := codec.(FrameCodec)
+	if ok == false {
+		return codec
+	}
+	enckey, deckey := sessionKeys(tf.sssecret, ssid)
+	if tf.hsServer {
+		enckey, deckey = deckey, enckey
+	}
+	fc, err := fc.Session(ssid, enckey, deckey)
+	if err != nil {
+		panic(fmt.Sprintf("session %d, key codec failed: %s", ssid, err.Error()))
+	}
+	return fc
 }
 
 // growindex
 func (tf *CodecMixer) growindex(ssid uint64) uint64 {
-	tf.ssmutex[ssid].Lock()
+	tf.mutex.Lock()
+	defer tf.mutex.Unlock()
 	tf.ssindex[ssid]++
-	defer tf.ssmutex[ssid].Unlock()
+	tf.ssactive[ssid] = time.Now()
 	return tf.ssindex[ssid]
 }
 
+// sessionCodec return codec of session, nil if session closed
+func (tf *CodecMixer) sessionCodec(ssid uint64) Codec {
+	tf.mutex.Lock()
+	defer tf.mutex.Unlock()
+	return tf.sscodecList[ssid]
+}
+
+// sessionCh return write channel and close notify of session
+// return false if session closed
+func (tf *CodecMixer) sessionCh(ssid uint64) (chan *mixerFrame, chan struct{}, bool) {
+	tf.mutex.Lock()
+	defer tf.mutex.Unlock()
+	ch, ok := tf.ssWriteCh[ssid]
+	return ch, tf.ssclosing[ssid], ok
+}
+
+// frameChecksum return checksum for frame header
+func (tf *CodecMixer) frameChecksum() Checksum {
+	tf.mutex.Lock()
+	defer tf.mutex.Unlock()
+	return tf.checksum
+}
+
+// getFrame return idle *mixerFrame, new one if no idle
+func (tf *CodecMixer) getFrame() *mixerFrame {
+	select {
+	case mf := <-tf.ioFreeCh:
+		// keep iolen for buffer expand
+		mf.frametype = FRAME_MAGIC_UNSET
+		mf.ioptr = 0
+		mf.frameptr = 0
+		mf.codec = nil
+		mf.resend = false
+		return mf
+	default:
+		return newMixerFrame()
+	}
+}
+
+// putFrame put *mixerFrame back to idle list, drop it if idle list full
+func (tf *CodecMixer) putFrame(mf *mixerFrame) {
+	select {
+	case tf.ioFreeCh <- mf:
+	default:
+	}
+}
+
 // acceptClient (assamble side), running in goroutine, call newSession for new client
 func (tf *CodecMixer) acceptClient(nl *net.TCPListener) {
+	for {
+		rw, err := nl.AcceptTCP()
+		if err != nil {
+			fmt.Printf("acceptClient, %s, exit for accept failed: %s\n", nl.Addr().String(), err.Error())
+			return
+		}
+		if err := tf.newSession(rw, tf.filter); err != nil {
+			fmt.Printf("acceptClient, %s, new session failed: %s\n", rw.RemoteAddr().String(), err.Error())
+			rw.Close()
+		}
+	}
 }
 
 // newSession, create ssid for new client session
 // call ReadFrom to read plain data from new client
 // call WriteTo to write session data from peer to new client
 // ReadFrom/WriteTo run in goroutine
-func (tf *CodecMixer) newSession(rw *net.TCPConn) error {
+func (tf *CodecMixer) newSession(rw net.Conn, proto Filter) error {
+	if proto == nil {
+		return errors.New("newSession failed: no filter for CodecMixer")
+	}
+	ssid := tf.initssid(0)
+	filter := proto.New(ssid, rw)
+	tf.setDialReply(filter)
+	tf.sendCtrl(FRAME_MSGNEWSSID, ssid, &CMsg{Err: fmt.Errorf("open from %s", rw.RemoteAddr().String())}, nil)
+	go tf.readFrom(filter, ssid)
+	go tf.WriteTo(filter, ssid)
 	return nil
 }
 
+// acceptClientUDP (assamble side), running in goroutine, call newSession for new datagram flow
+func (tf *CodecMixer) acceptClientUDP(ul *udpListener, filter *UDPFilter) {
+	for {
+		rw, err := ul.Accept()
+		if err != nil {
+			fmt.Printf("acceptClientUDP, %s, exit for accept failed: %s\n", ul.Addr().String(), err.Error())
+			return
+		}
+		if err := tf.newSession(rw, filter); err != nil {
+			fmt.Printf("acceptClientUDP, %s, new session failed: %s\n", rw.RemoteAddr().String(), err.Error())
+			rw.Close()
+		}
+	}
+}
+
+// acceptSession create session opened by remote peer(disassemble side)
+// session is created only at passive side, and not for closed ssid
+// return false if frame should be dropped
+func (tf *CodecMixer) acceptSession(ssid uint64) bool {
+	if _, _, ok := tf.sessionCh(ssid); ok {
+		return true
+	}
+	tf.mutex.Lock()
+	_, closed := tf.ssclosed[ssid]
+	passive := tf.passive
+	tf.mutex.Unlock()
+	if passive == false || closed || ssid == INIT_SSID || tf.filter == nil {
+		return false
+	}
+	if _, isNew := tf.createssid(ssid); isNew {
+		filter := tf.filter.New(ssid, nil)
+		tf.setDialReply(filter)
+		go tf.readFrom(filter, ssid)
+		go tf.WriteTo(filter, ssid)
+	}
+	return true
+}
+
 // acceptPeer, running in goroutine, accept new peer connection
 // call newPeer for new peer connection
 func (tf *CodecMixer) acceptPeer(nl *net.TCPListener) {
+	for {
+		rw, err := nl.AcceptTCP()
+		if err != nil {
+			fmt.Printf("acceptPeer, %s, exit for accept failed: %s\n", nl.Addr().String(), err.Error())
+			return
+		}
+		go func() {
+			if err := tf.newPeer(rw, true, ""); err != nil {
+				fmt.Printf("acceptPeer, %s, handshake failed: %s\n", rw.RemoteAddr().String(), err.Error())
+			}
+		}()
+	}
+}
+
+// listen listen on addr and save listener for Close
+func (tf *CodecMixer) listen(addr string) (*net.TCPListener, error) {
+	laddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	nl, err := net.ListenTCP("tcp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	tf.mutex.Lock()
+	tf.listeners = append(tf.listeners, nl)
+	tf.mutex.Unlock()
+	return nl, nil
+}
+
+// ListenClient listen on addr for client connection(assemble side)
+// new session is created for each client and forward to peer
+func (tf *CodecMixer) ListenClient(addr string) (net.Addr, error) {
+	nl, err := tf.listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	go tf.acceptClient(nl)
+	return nl.Addr(), nil
+}
+
+// ListenClientUDP listen on addr for datagram flow(assemble side)
+// new session is created for each client addr:port and forward to peer by filter
+func (tf *CodecMixer) ListenClientUDP(addr string, filter *UDPFilter) (net.Addr, error) {
+	ul, err := listenUDP(addr, filter.udpIdle)
+	if err != nil {
+		return nil, err
+	}
+	tf.mutex.Lock()
+	tf.listeners = append(tf.listeners, ul)
+	tf.mutex.Unlock()
+	go tf.acceptClientUDP(ul, filter)
+	return ul.Addr(), nil
+}
+
+// ListenPeer listen on addr for peer connection(disassemble side)
+// session opened by remote peer is accepted
+func (tf *CodecMixer) ListenPeer(addr string) (net.Addr, error) {
+	nl, err := tf.listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	tf.mutex.Lock()
+	tf.passive = true
+	tf.mutex.Unlock()
+	go tf.acceptPeer(nl)
+	return nl.Addr(), nil
+}
+
+// DialPeer connect to peer listening at addr and add it to mixer link after handshake
+func (tf *CodecMixer) DialPeer(addr string) error {
+	rw, err := net.DialTimeout("tcp", addr, MAX_DIALTIME)
+	if err != nil {
+		return &CMsg{Code: IO_ERR_DIAL, Err: fmt.Errorf("dial peer %s failed: %s", addr, err.Error())}
+	}
+	return tf.newPeer(rw, false, addr)
 }
 
 // newPeer, do handshake to match token,
 // call ReadFrom to read frame from peer
 // call WriteTo to write frame to peer
 // ReadFrom/WriteTo run in goroutine
-func (tf *CodecMixer) newPeer(rw *net.TCPConn, isActive bool) error {
-	if isActive {
-		if err := tf.peerServerHandshake(rw); err != nil {
-			return err
-		}
-	} else {
-		if err := tf.peerClientHandshake(rw); err != nil {
+// isActive is true for accepted connection(server side), link is added to peer mixer of client mixer
+// addr is address for redial, empty for accepted connection
+// rw is closed if handshake failed
+func (tf *CodecMixer) newPeer(rw net.Conn, isActive bool, addr string) error {
+	if isActive == false {
+		hs, err := tf.peerClientHandshake(rw)
+		if err != nil {
 			return err
 		}
+		tf.addMixerIO(rw, addr, hs)
+		return nil
+	}
+	hs, err := tf.acceptHandshake(rw)
+	if err != nil {
+		return err
 	}
+	peer := tf.peerMixer(rw, hs)
+	if peer == nil {
+		rw.Close()
+		return &CMsg{Code: IO_ERR_CLOSED, Err: fmt.Errorf("mixer closed")}
+	}
+	peer.useCodec(hs)
+	peer.addMixerIO(rw, addr, hs)
 	return nil
 }
 
+// acceptHandshake waitting for token msg and write ack back to remote peer, codec is not changed
+func (tf *CodecMixer) acceptHandshake(rw net.Conn) (*handshakeInfo, error) {
+	timeout, codecs, checksums := tf.hsConfig()
+	rw.SetDeadline(time.Now().Add(timeout))
+	hs, err := tf.serverHandshake(rw, codecs, checksums)
+	if err != nil {
+		return nil, handshakeFailed(rw, err)
+	}
+	rw.SetDeadline(time.Time{})
+	return hs, nil
+}
+
 // peerServerHandshake waitting for token msg and write ack back to remote peer
-func (tf *CodecMixer) peerServerHandshake(rw *net.TCPConn) error {
-	return nil
+func (tf *CodecMixer) peerServerHandshake(rw net.Conn) (*handshakeInfo, error) {
+	hs, err := tf.acceptHandshake(rw)
+	if err != nil {
+		return nil, err
+	}
+	tf.useCodec(hs)
+	return hs, nil
 }
 
 // peerClientHandshake write token msg to remote peer and wait for ack msg
-func (tf *CodecMixer) peerClientHandshake(rw *net.TCPConn) error {
-	return nil
+func (tf *CodecMixer) peerClientHandshake(rw net.Conn) (*handshakeInfo, error) {
+	timeout, codecs, checksums := tf.hsConfig()
+	rw.SetDeadline(time.Now().Add(timeout))
+	hs, err := tf.clientHandshake(rw, codecs, checksums)
+	if err != nil {
+		return nil, handshakeFailed(rw, err)
+	}
+	rw.SetDeadline(time.Time{})
+	tf.useCodec(hs)
+	return hs, nil
 }
 
-//
-func (tf *CodecMixer) addMixerIO(rw io.ReadWriteCloser) {
+// addMixerIO add rw to running links
+// addr is address for redial after link failed, hs is handshake result of link
+func (tf *CodecMixer) addMixerIO(rw io.ReadWriteCloser, addr string, hs *handshakeInfo) {
 	println("addMixerIO", misc.GetXID(rw), "...")
-	tf.mixerCh <- rw
+	aead := tf.linkAEAD(hs)
+	tf.mutex.Lock()
+	tf.linkid++
+	link := newMixerLink(tf.linkid, rw, addr)
+	link.noAck = tf.version < 3
+	link.aead = aead
+	tf.links = append(tf.links, link)
+	tf.mutex.Unlock()
+	tf.notifyLink()
+	tf.mixerCh <- link
 }
 
 //
@@ -626,30 +996,49 @@ func (tf *CodecMixer) sendExitCMsg(code uint64, err error) {
 //
 func (tf *CodecMixer) runReadWriter() {
 	// one goroutine/mixer io
-	var rw io.ReadWriteCloser
-	var count int
+	var link *mixerLink
 	for {
 		select {
-		case rw = <-tf.mixerCh:
-			println("runReadWriter", misc.GetXID(rw), "running ...")
+		case link = <-tf.mixerCh:
+			println("runReadWriter", misc.GetXID(link.rw), "running ...")
+		case <-tf.closing:
+			return
 		default:
 			println("block, runReadWriter", "waiting for new mixer channel ...")
-			rw = <-tf.mixerCh
-			println("unblock, runReadWriter", misc.GetXID(rw), "running ...")
+			select {
+			case link = <-tf.mixerCh:
+			case <-tf.closing:
+				return
+			}
+			println("unblock, runReadWriter", misc.GetXID(link.rw), "running ...")
 		}
-		count++
-		go tf.writeLoop(rw, count)
-		go tf.readLoop(rw, count)
+		go tf.writeLoop(link)
+		go tf.readLoop(link)
+		go tf.keepLoop(link)
 	}
 
 }
 
-// writeLoop fetch *mixerFrame from assembleFastCh+assembleCh and write to rw io.ReadWriteCloser
+// writeLoop fetch *mixerFrame from ctrlCh+fastCh+dataCh of link and write to link
 // no ordering contorl
-// if write to rw io.ReadWriteCloser failed, put *mixerFrame back to assembleFastCh and exit
-// put *mixerFrame back to assembleCh after write done
-func (tf *CodecMixer) writeLoop(rw io.ReadWriteCloser, count int) {
-	defer rw.Close()
+// if write to link failed, exit and put *mixerFrame back to assembleFastCh/assembleCh
+// written *mixerFrame is kept until acked by peer, and retransmitted after link failed
+// link dialed by DialPeer is redialed after failed
+func (tf *CodecMixer) writeLoop(link *mixerLink) {
+	rw, count := link.rw, link.id
+	// frame failed to write, requeue after link removed
+	var failed *mixerFrame
+	defer func() {
+		tf.delLink(link)
+		// requeue may wait for new link
+		if link.addr != "" {
+			go tf.redial(link.addr)
+		}
+		if failed != nil {
+			tf.requeue(failed, true)
+		}
+		tf.resend(link)
+	}()
 	fmt.Printf("writeLoop#%d, %s, running ...\n", count, misc.GetXID(rw))
 
 	var mf *mixerFrame
@@ -657,11 +1046,28 @@ func (tf *CodecMixer) writeLoop(rw io.ReadWriteCloser, count int) {
 	var err error
 	var ioptr, iobytes, emptyio int
 	for {
-		// send fast channel first
+		// send link channel and fast channel first
+		queued := true
 		select {
-		case mf, ok = <-tf.assembleFastCh:
+		case mf, ok = <-link.ctrlCh:
+			queued = false
 		default:
-			mf, ok = <-tf.assembleCh
+			select {
+			case mf, ok = <-link.ctrlCh:
+				queued = false
+			case mf, ok = <-link.fastCh:
+			default:
+				select {
+				case mf, ok = <-link.ctrlCh:
+					queued = false
+				case mf, ok = <-link.fastCh:
+				case mf, ok = <-link.dataCh:
+				case <-link.closed:
+					ok = false
+				case <-tf.closing:
+					ok = false
+				}
+			}
 		}
 		if ok == false {
 			err = fmt.Errorf("writeLoop#%d, %s, exit for input channel closed", count, misc.GetXID(rw))
@@ -669,14 +1075,19 @@ func (tf *CodecMixer) writeLoop(rw io.ReadWriteCloser, count int) {
 			tf.sendExitCMsg(0, err)
 			return
 		}
+		if queued {
+			link.dequeued(mf)
+			tf.notifyLink()
+		}
 		iobytes = 0
 		ioptr = 0
 		emptyio = 0
+		start := time.Now()
 		// writing
 		for {
-			iobytes, err = rw.Write(mf.iobuf[ioptr:mf.ioptr])
+			iobytes, err = rw.Write(mf.framebuf[ioptr:mf.frameptr])
 			if err != nil {
-				tf.assembleFastCh <- mf
+				failed = mf
 				err = fmt.Errorf("writeLoop#%d, %s, index %d, write failed: %s", count, misc.GetXID(rw), mf.index, err.Error())
 				fmt.Printf("%s\n", err.Error())
 				tf.sendExitCMsg(0, err)
@@ -685,27 +1096,33 @@ func (tf *CodecMixer) writeLoop(rw io.ReadWriteCloser, count int) {
 			if iobytes < 1 {
 				emptyio++
 				if emptyio > CMTP_MAX_EMPTY_IO {
-					tf.assembleFastCh <- mf
+					failed = mf
 					err = fmt.Errorf("writeLoop#%d, %s, index %d, write failed: too many empty io(%d > %d)", count, misc.GetXID(rw), mf.index, emptyio, CMTP_MAX_EMPTY_IO)
 					fmt.Printf("%s\n", err.Error())
 					tf.sendExitCMsg(0, err)
 					return
 				}
-				emptyio++
 				// delay 10ms
 				time.Sleep(1e7)
 			}
 			ioptr += iobytes
-			if ioptr < mf.ioptr {
+			if ioptr < mf.frameptr {
 				// part write, retry
-				fmt.Printf("writeLoop#%d, %s, part writing index %d, total %d - out %d = pending %d\n", count, misc.GetXID(rw), mf.index, mf.ioptr, ioptr, mf.ioptr-ioptr)
+				fmt.Printf("writeLoop#%d, %s, part writing index %d, total %d - out %d = pending %d\n", count, misc.GetXID(rw), mf.index, mf.frameptr, ioptr, mf.frameptr-ioptr)
 				continue
 			}
 			// write done
 			break
 		}
-		fmt.Printf("writeLoop#%d, %s, done writing index %d, total %d - out %d = pending %d\n", count, misc.GetXID(rw), mf.index, mf.ioptr, ioptr, mf.ioptr-ioptr)
-		tf.ioFreeCh <- mf
+		fmt.Printf("writeLoop#%d, %s, done writing index %d, total %d - out %d = pending %d\n", count, misc.GetXID(rw), mf.index, mf.frameptr, ioptr, mf.frameptr-ioptr)
+		if mf.frametype == FRAME_PAYLOADLAST {
+			// doneSession may send close frame, do not block writeLoop
+			go tf.doneSession(mf.ssid, SESSION_READ_DONE)
+		}
+		// mf may be recycled by ack after written
+		if link.written(mf, time.Since(start)) == false {
+			tf.putFrame(mf)
+		}
 	}
 }
 
@@ -720,9 +1137,12 @@ func (tf *CodecMixer) encodeLoop(count int) {
 	var err error
 	var maxcodeclen int
 	var payloadbuf []byte
-	hash := tf.checksum.New(0)
 	for {
-		mf, ok = <-tf.encodeCh
+		select {
+		case mf, ok = <-tf.encodeCh:
+		case <-tf.closing:
+			ok = false
+		}
 		if ok == false {
 			err = fmt.Errorf("encodeLoop#%d, exit for input channel closed", count)
 			fmt.Printf("%s\n", err.Error())
@@ -730,7 +1150,15 @@ func (tf *CodecMixer) encodeLoop(count int) {
 			return
 		}
 		// tf.sscodecList[mf.ssid] is created by initssid()
-		codec := tf.sscodecList[mf.ssid]
+		codec := mf.codec
+		if codec == nil {
+			codec = tf.sessionCodec(mf.ssid)
+		}
+		if codec == nil {
+			// session closed
+			tf.putFrame(mf)
+			continue
+		}
 		// encode body
 		maxcodeclen = codec.MaxEncodedLen(int(mf.bodylen))
 		// expend if need
@@ -738,7 +1166,11 @@ func (tf *CodecMixer) encodeLoop(count int) {
 			mf.framebuf = make([]byte, maxcodeclen+mf.hdrlen)
 		}
 		// already make sure dst buffer have enough space
-		payloadbuf, err = codec.Encode(mf.framebuf[mf.hdrlen:], mf.iobuf[:mf.ioptr])
+		if fc, ok := codec.(FrameCodec); ok {
+			payloadbuf, err = fc.EncodeFrame(mf.framebuf[mf.hdrlen:], mf.iobuf[:mf.ioptr], mf.aad(), mf.index)
+		} else {
+			payloadbuf, err = codec.Encode(mf.framebuf[mf.hdrlen:], mf.iobuf[:mf.ioptr])
+		}
 		// can not recover from encoder failed
 		if err != nil {
 			panic(fmt.Sprintf("encodeLoop#%d, %s, index %d, encode failed: %s", count, misc.GetXID(codec), mf.index, err.Error()))
@@ -747,7 +1179,7 @@ func (tf *CodecMixer) encodeLoop(count int) {
 		mf.frameptr = int(mf.payloadlen) + mf.hdrlen
 		fmt.Printf("encodeLoop#%d, %s, done encode index %d, frame %d - payload %d = header %d\n", count, misc.GetXID(codec), mf.index, mf.frameptr, mf.payloadlen, mf.frameptr-int(mf.payloadlen))
 		//
-		mf.MarshalHeader(hash, count)
+		mf.MarshalHeader(tf.frameChecksum(), count)
 		//
 		if mf.payloadlen < CMTP_SMALL_PKG_SIZE {
 			tf.assembleFastCh <- mf
@@ -762,28 +1194,46 @@ func (tf *CodecMixer) encodeLoop(count int) {
 // marshal frame read from io.ReadWriteCloser and write to underlay io.Writer
 // return to caller until read EOF or error
 func (tf *CodecMixer) ReadFrom(rw Filter) (written int, err error) {
-	defer rw.Close()
-
 	// 0 for new ssid
-	ssid := tf.initssid(0)
-	defer tf.clearssid(ssid)
+	return tf.readFrom(rw, tf.initssid(0))
+}
+
+// readFrom read from rw and send frame of ssid
+// rw is closed by WriteTo after session cleared
+// on EOF, FRAME_PAYLOADLAST is sent for half-close, session is reset on other error
+func (tf *CodecMixer) readFrom(rw Filter, ssid uint64) (written int, err error) {
+	defer func() {
+		if err == io.EOF {
+			tf.sendLast(ssid)
+		} else {
+			tf.resetSession(ssid, IO_ERR_READ, err)
+		}
+	}()
 	//
+	codec := tf.sessionCodec(ssid)
+	if codec == nil {
+		return 0, fmt.Errorf("ReadFrom#%d, session closed", ssid)
+	}
 	emptyio := 0
 	// start to read body/frame
 	var er error
 	var nr int
 	for {
-		mf, ok := <-tf.ioFreeCh
-		if ok == false {
-			return 0, errors.New("CodecMixer(ioFreeCh) already closed")
+		// stall until peer grant window for next frame
+		if tf.waitCredit(ssid) == false {
+			er = fmt.Errorf("ReadFrom#%d, exit for session closed", ssid)
+			fmt.Printf("%s\n", er.Error())
+			break
 		}
+		mf := tf.getFrame()
 		// expand buff for fast link
-		if mf.iolen < CMTP_BUF_MAX && mf.iolen == len(mf.iobuf[mf.hdrlen:]) {
+		if len(mf.iobuf) < CMTP_BUF_MAX && mf.iolen == len(mf.iobuf) {
 			mf.iobuf = make([]byte, mf.iolen+mf.iolen)
 			println("expand mf.iobuf to", mf.iolen+mf.iolen)
 		}
-		nr, er = rw.Read(mf.iobuf[mf.hdrlen:])
+		nr, er = rw.Read(mf.iobuf)
 		if nr <= 0 {
+			tf.putFrame(mf)
 			if er == nil {
 				if emptyio < CMTP_MAX_EMPTY_IO {
 					emptyio++
@@ -791,17 +1241,19 @@ func (tf *CodecMixer) ReadFrom(rw Filter) (written int, err error) {
 					time.Sleep(1e7)
 					continue
 				} else {
-					er = fmt.Errorf("ReadFrom#%d, %s, index %d, write failed: too many empty io(%d > %d)", ssid, misc.GetXID(rw), mf.index, emptyio, CMTP_MAX_EMPTY_IO)
+					er = fmt.Errorf("ReadFrom#%d, %s, write failed: too many empty io(%d > %d)", ssid, misc.GetXID(rw), emptyio, CMTP_MAX_EMPTY_IO)
 					fmt.Printf("%s\n", er.Error())
 				}
 			}
 			break
 		}
+		emptyio = 0
 		written += nr
 		mf.iolen = nr
-		mf.ioptr = nr + mf.hdrlen
+		mf.ioptr = nr
 		//
 		mf.headerInit(FRAME_PAYLOADENCODED, ssid, tf.growindex(ssid))
+		mf.codec = codec
 		//
 		tf.encodeCh <- mf
 		if er != nil {
@@ -814,96 +1266,77 @@ func (tf *CodecMixer) ReadFrom(rw Filter) (written int, err error) {
 // readLoop fetch *mixerFrame from ioFreeCh and read from rw io.ReadWriteCloser
 // no ordering contorl
 // if read to rw io.ReadWriteCloser failed, put *mixerFrame back to ioFreeCh and exit
-// put *mixerFrame back to encodeCh after read done
-func (tf *CodecMixer) readLoop(rw io.ReadWriteCloser, count int) {
-	defer rw.Close()
+// put *mixerFrame to decodeCh after read done
+// stream can not recover from invalid header, link is closed
+// frames read is acked to peer by FRAME_LINKACK
+func (tf *CodecMixer) readLoop(link *mixerLink) {
+	rw, count := link.rw, link.id
+	defer tf.delLink(link)
 	fmt.Printf("readLoop#%d, %s, running ...\n", count, misc.GetXID(rw))
 
 	var mf *mixerFrame
-	var ok bool
 	var err error
-	var iobytes, emptyio, errorCount int
-	hash := tf.checksum.New(0)
 	for {
-		mf, ok = <-tf.ioFreeCh
-		if ok == false {
-			err = fmt.Errorf("readLoop#%d, %s, exit for input channel closed", count, misc.GetXID(rw))
+		mf = tf.getFrame()
+		// read header
+		_, err = io.ReadFull(rw, mf.framebuf[:mf.hdrlen])
+		if err != nil {
+			tf.putFrame(mf)
+			err = fmt.Errorf("readLoop#%d, %s, read header failed: %s", count, misc.GetXID(rw), err.Error())
 			fmt.Printf("%s\n", err.Error())
-			tf.sendExitCMsg(0, err)
+			tf.sendExitCMsg(IO_ERR_READ, err)
 			return
 		}
-		mf.frametype = FRAME_MAGIC_UNSET
-		iobytes = 0
-		mf.frameptr = 0
-		emptyio = 0
-		// reading
-		for {
-			if mf.frametype == FRAME_MAGIC_UNSET {
-				// read header
-				iobytes, err = rw.Read(mf.framebuf[mf.frameptr:mf.hdrlen])
-			} else {
-				// read payload
-				iobytes, err = rw.Read(mf.framebuf[mf.frameptr:mf.payloadlen])
-			}
-			if err != nil {
-				tf.ioFreeCh <- mf
-				err = fmt.Errorf("readLoop#%d, %s, index %d, read failed: %s", count, misc.GetXID(rw), mf.index, err.Error())
-				fmt.Printf("%s\n", err.Error())
-				tf.sendExitCMsg(1, err)
-				return
-			}
-			if iobytes < 1 {
-				emptyio++
-				time.Sleep(1e7)
-				if emptyio > CMTP_MAX_EMPTY_IO {
-					tf.ioFreeCh <- mf
-					err = fmt.Errorf("readLoop#%d, %s, index %d, read failed: too many empty io(%d > %d)", count, misc.GetXID(rw), mf.index, emptyio, CMTP_MAX_EMPTY_IO)
-					fmt.Printf("%s\n", err.Error())
-					tf.sendExitCMsg(1, err)
-					return
-				}
-			}
-			mf.frameptr += iobytes
-			//
-			if mf.frametype == FRAME_MAGIC_UNSET {
-				// need for header
-				unerr := mf.UnMarshalHeader(hash, count)
-				if unerr != nil {
-					if unerr.(CMsg).Code == uint64(UNMARSHAL_ERR_HDRLEN) {
-						// read more
-						continue
-					} else {
-						fmt.Printf("readLoop#%d, %s, error UnMarshalHeader index %d, total %d: %v\n", count, misc.GetXID(rw), mf.index, mf.frameptr, mf.framebuf[:mf.hdrlen])
-						mf.frametype = FRAME_MAGIC_UNSET
-						errorCount++
-						if errorCount > CMTP_MAX_UNMARSHAL_ERR {
-							tf.ioFreeCh <- mf
-							err = fmt.Errorf("readLoop#%d, %s, index %d, read failed: too many unmarshal header failed(%d > %d)", count, misc.GetXID(rw), mf.index, errorCount, CMTP_MAX_UNMARSHAL_ERR)
-							fmt.Printf("%s\n", err.Error())
-							tf.sendExitCMsg(1, err)
-							return
-						}
-						break
-					}
-				}
-				// header is ok
-				tf.initssid(mf.ssid)
-				continue
-			}
-			// reading payload
-			if uint64(mf.frameptr) >= mf.payloadlen {
-				// read done
-				break
-			}
-			// read more payload
+		mf.frameptr = mf.hdrlen
+		if unerr := mf.UnMarshalHeader(tf.frameChecksum(), count); unerr != nil {
+			tf.putFrame(mf)
+			err = fmt.Errorf("readLoop#%d, %s, error UnMarshalHeader: %s", count, misc.GetXID(rw), unerr.Error())
+			fmt.Printf("%s\n", err.Error())
+			tf.sendExitCMsg(unerr.(*CMsg).Code, err)
+			return
 		}
-		if mf.frametype == FRAME_MAGIC_UNSET {
-			fmt.Printf("readLoop#%d, %s, error reading index %d, total %d\n", count, misc.GetXID(rw), mf.index, mf.frameptr)
-			tf.ioFreeCh <- mf
-		} else {
-			fmt.Printf("readLoop#%d, %s, done reading index %d, total %d\n", count, misc.GetXID(rw), mf.index, mf.frameptr)
-			tf.encodeCh <- mf
+		// read payload
+		mf.frameptr = mf.hdrlen + int(mf.payloadlen)
+		if mf.frameptr > len(mf.framebuf) {
+			buf := make([]byte, mf.frameptr)
+			copy(buf, mf.framebuf[:mf.hdrlen])
+			mf.framebuf = buf
+		}
+		_, err = io.ReadFull(rw, mf.framebuf[mf.hdrlen:mf.frameptr])
+		if err != nil {
+			tf.putFrame(mf)
+			err = fmt.Errorf("readLoop#%d, %s, index %d, read payload failed: %s", count, misc.GetXID(rw), mf.index, err.Error())
+			fmt.Printf("%s\n", err.Error())
+			tf.sendExitCMsg(IO_ERR_READ, err)
+			return
+		}
+		// frame is counted before dropped, peer keep it until acked
+		if link.recv(mf) {
+			tf.sendAck(link, 0)
 		}
+		if (isLinkFrame(mf.frametype) || mf.frametype > FRAME_MSGSTART && mf.frametype < FRAME_MSGLAST) && tf.openCtrl(link, mf, count) == false {
+			tf.putFrame(mf)
+			continue
+		}
+		if isLinkFrame(mf.frametype) {
+			tf.recvLink(link, mf)
+			tf.putFrame(mf)
+			continue
+		}
+		if mf.frametype > FRAME_MSGSTART && mf.frametype < FRAME_MSGLAST {
+			// control frame, not encoded by session codec
+			tf.recvCtrl(mf, count)
+			tf.putFrame(mf)
+			continue
+		}
+		if tf.acceptSession(mf.ssid) == false {
+			fmt.Printf("readLoop#%d, %s, drop index %d of closed session %d\n", count, misc.GetXID(rw), mf.index, mf.ssid)
+			tf.putFrame(mf)
+			continue
+		}
+		tf.touchssid(mf.ssid)
+		fmt.Printf("readLoop#%d, %s, done reading index %d, total %d\n", count, misc.GetXID(rw), mf.index, mf.frameptr)
+		tf.decodeCh <- mf
 	}
 }
 
@@ -918,7 +1351,11 @@ func (tf *CodecMixer) decodeLoop(count int) {
 	var maxcodeclen int
 	var payloadbuf []byte
 	for {
-		mf, ok = <-tf.decodeCh
+		select {
+		case mf, ok = <-tf.decodeCh:
+		case <-tf.closing:
+			ok = false
+		}
 		if ok == false {
 			err = fmt.Errorf("decodeLoop#%d, exit for input channel closed", count)
 			fmt.Printf("%s\n", err.Error())
@@ -926,12 +1363,26 @@ func (tf *CodecMixer) decodeLoop(count int) {
 			return
 		}
 		// tf.sscodecList[mf.ssid] is created by initssid()
-		codec := tf.sscodecList[mf.ssid]
+		codec := tf.sessionCodec(mf.ssid)
+		if codec == nil {
+			// session closed
+			tf.putFrame(mf)
+			continue
+		}
 		// decode body
-		maxcodeclen, err = codec.MaxDecodedLen(mf.framebuf[mf.hdrlen:mf.frameptr])
+		fc, isFrame := codec.(FrameCodec)
+		if isFrame {
+			// decoded length is unknown before decrypt, it should be bodylen
+			maxcodeclen, err = int(mf.bodylen), nil
+			if mf.bodylen > uint64(CMTP_FRAME_MAX) {
+				err = fmt.Errorf("body too large, %d > %d", mf.bodylen, CMTP_FRAME_MAX)
+			}
+		} else {
+			maxcodeclen, err = codec.MaxDecodedLen(mf.framebuf[mf.hdrlen:mf.frameptr])
+		}
 		if err != nil {
-			fmt.Printf("decodeLoop#%d, %s, ssid %d index %d, decode failed: %s", count, misc.GetXID(codec), mf.ssid, mf.index, err.Error())
-			tf.ioFreeCh <- mf
+			fmt.Printf("decodeLoop#%d, %s, ssid %d index %d, decode failed: %s\n", count, misc.GetXID(codec), mf.ssid, mf.index, err.Error())
+			tf.putFrame(mf)
 			continue
 		}
 		// expend if need
@@ -939,99 +1390,186 @@ func (tf *CodecMixer) decodeLoop(count int) {
 			mf.iobuf = make([]byte, maxcodeclen)
 		}
 		// already make sure dst buffer have enough space
-		payloadbuf, err = codec.Decode(mf.iobuf, mf.framebuf[mf.hdrlen:mf.frameptr])
+		if isFrame {
+			payloadbuf, err = fc.DecodeFrame(mf.iobuf, mf.framebuf[mf.hdrlen:mf.frameptr], mf.aad(), mf.index)
+		} else {
+			payloadbuf, err = codec.Decode(mf.iobuf, mf.framebuf[mf.hdrlen:mf.frameptr])
+		}
 		// can not recover from decoder failed
 		if err != nil {
-			fmt.Printf("decodeLoop#%d, %s, ssid %d index %d, decode failed: %s", count, misc.GetXID(codec), mf.ssid, mf.index, err.Error())
-			tf.ioFreeCh <- mf
+			fmt.Printf("decodeLoop#%d, %s, ssid %d index %d, decode failed: %s\n", count, misc.GetXID(codec), mf.ssid, mf.index, err.Error())
+			tf.putFrame(mf)
 			continue
 		}
 		mf.ioptr = len(payloadbuf)
 		if uint64(mf.ioptr) != mf.bodylen {
 			fmt.Printf("decodeLoop#%d, %d, decoded body lenght mismatch, index %d, header %d, decoded %d\n", count, mf.ssid, mf.index, mf.bodylen, mf.ioptr)
-			tf.ioFreeCh <- mf
+			tf.putFrame(mf)
 			continue
 		}
 		fmt.Printf("decodeLoop#%d, %s, done decode index %d, frame %d - payload %d = header %d\n", count, misc.GetXID(codec), mf.index, mf.frameptr, mf.payloadlen, mf.frameptr-int(mf.payloadlen))
 		//
 		// tf.ssWriteCh[mf.ssid] is created by initssid()
-		tf.ssWriteCh[mf.ssid] <- mf
+		ch, closing, ok := tf.sessionCh(mf.ssid)
+		if ok == false {
+			tf.putFrame(mf)
+			continue
+		}
+		select {
+		case ch <- mf:
+		case <-closing:
+			tf.putFrame(mf)
+		default:
+			if tf.flowControl() == false {
+				// peer without flow window, block as before version 2
+				select {
+				case ch <- mf:
+				case <-closing:
+					tf.putFrame(mf)
+				}
+				continue
+			}
+			// never block other sessions, reset session violating flow window
+			err = &CMsg{Code: IO_ERR_OVERFLOW, Err: fmt.Errorf("decodeLoop#%d, %d, index %d, flow window overflow", count, mf.ssid, mf.index)}
+			fmt.Printf("%s\n", err.Error())
+			tf.putFrame(mf)
+			tf.resetSession(mf.ssid, IO_ERR_OVERFLOW, err)
+		}
 	}
 }
 
 // WriteTo associate a frontend io.ReadWriteCloser with one ssid
-// return to caller until Write error
+// frames are reordered by index, only contiguous data is written to rw
+// FRAME_PAYLOADLAST from peer is propagated to rw by CloseWrite
+// return to caller until session closed, session is reset on Write error or missing frame timeout
 func (tf *CodecMixer) WriteTo(rw Filter, ssid uint64) (written int, err error) {
 	defer rw.Close()
-
 	//
-	defer tf.clearssid(ssid)
-	//
-	emptyio := 0
-	// start to read body/frame
 	// tf.ssWriteCh[ssid] is created by initssid()
-	framesource := tf.ssWriteCh[ssid]
-	var nr int
+	framesource, closing, ok := tf.sessionCh(ssid)
+	if ok == false {
+		return 0, fmt.Errorf("WriteTo ssid %d, session closed", ssid)
+	}
+	tf.mutex.Lock()
+	rb := newReorderBuffer(tf.reorderWindow, tf.reorderTimeout)
+	tf.mutex.Unlock()
+	defer func() {
+		for _, mf := range rb.reset() {
+			tf.putFrame(mf)
+		}
+	}()
+	// first index not granted to peer
+	granted := rb.next
+	gapTimer := time.NewTimer(rb.timeout)
+	gapTimer.Stop()
+	defer gapTimer.Stop()
+	var nw int
 	for {
 		//
-		mf, ok := <-framesource
-		if ok == false {
-			err = fmt.Errorf("WriteTo ssid %d, exit for input channel closed", ssid)
+		var mf *mixerFrame
+		select {
+		case mf = <-framesource:
+		case <-gapTimer.C:
+			if err = rb.expired(time.Now()); err != nil {
+				fmt.Printf("WriteTo ssid %d, exit for %s\n", ssid, err.Error())
+				tf.resetSession(ssid, IO_ERR_READ, err)
+				return
+			}
+			continue
+		case <-closing:
+			err = fmt.Errorf("WriteTo ssid %d, exit for session closed", ssid)
 			fmt.Printf("%s\n", err.Error())
-			tf.sendExitCMsg(0, err)
 			return
 		}
-		//
-		// expand buff for fast link
-		if mf.iolen < CMTP_BUF_MAX && mf.iolen == len(mf.iobuf[mf.hdrlen:]) {
-			mf.iobuf = make([]byte, mf.iolen+mf.iolen)
-			println("expand mf.iobuf to", mf.iolen+mf.iolen)
+		now := time.Now()
+		if rb.push(mf, now) == false {
+			// duplicated or out of window
+			fmt.Printf("WriteTo ssid %d, discard index %d, next %d, dups %d, overflows %d\n", ssid, mf.index, rb.next, rb.dups, rb.overflows)
+			tf.putFrame(mf)
+			continue
 		}
-		nr, err = rw.Read(mf.iobuf[mf.hdrlen:])
-		if nr <= 0 {
-			if err == nil {
-				if emptyio < CMTP_MAX_EMPTY_IO {
-					emptyio++
-					// delay 10ms
-					time.Sleep(1e7)
-					continue
-				} else {
-					err = fmt.Errorf("ReadFrom#%d, %s, index %d, write failed: too many empty io(%d > %d)", ssid, misc.GetXID(rw), mf.index, emptyio, CMTP_MAX_EMPTY_IO)
-					fmt.Printf("%s\n", err.Error())
+		for mf = rb.pop(now); mf != nil; mf = rb.pop(now) {
+			if mf.frametype == FRAME_PAYLOADLAST {
+				// peer half-closed
+				tf.putFrame(mf)
+				if hc, ok := rw.(halfCloser); ok {
+					if err = hc.CloseWrite(); err != nil {
+						fmt.Printf("WriteTo ssid %d, half-close failed: %s\n", ssid, err.Error())
+					}
 				}
+				tf.doneSession(ssid, SESSION_WRITE_DONE)
+				continue
 			}
-			break
+			for ptr := 0; ptr < mf.ioptr; ptr += nw {
+				nw, err = rw.Write(mf.iobuf[ptr:mf.ioptr])
+				written += nw
+				if err != nil {
+					tf.putFrame(mf)
+					fmt.Printf("WriteTo ssid %d, index %d, write failed: %s\n", ssid, mf.index, err.Error())
+					tf.resetSession(ssid, IO_ERR_WRITE, err)
+					return
+				}
+			}
+			tf.putFrame(mf)
 		}
-		written += nr
-		mf.iolen = nr
-		mf.ioptr = nr + mf.hdrlen
-		//
-		mf.headerInit(FRAME_PAYLOADENCODED, ssid, tf.growindex(ssid))
-		//
-		tf.encodeCh <- mf
-		if err != nil {
-			break
+		// replenish flow window for drained frames
+		if rb.next-granted >= CMTP_FLOW_WINDOW/2 {
+			if err = tf.sendWindow(ssid, rb.next-1+CMTP_FLOW_WINDOW, closing); err != nil {
+				fmt.Printf("WriteTo ssid %d, exit for %s\n", ssid, err.Error())
+				return
+			}
+			granted = rb.next
+		}
+		// wait for missing frame
+		gapTimer.Stop()
+		if deadline := rb.deadline(); deadline.IsZero() == false {
+			gapTimer.Reset(deadline.Sub(now))
 		}
 	}
-	return written, err
+}
+
+// SetReorder set window and missing frame timeout of reorder buffer for new session
+// window is max frames hold for one session, 0 for CMTP_REORDER_WINDOW
+// window less than CMTP_FLOW_WINDOW is raised to CMTP_FLOW_WINDOW
+// timeout <= 0 for CMTP_REORDER_TIMEOUT
+func (tf *CodecMixer) SetReorder(window uint64, timeout time.Duration) {
+	tf.mutex.Lock()
+	defer tf.mutex.Unlock()
+	tf.reorderWindow = window
+	tf.reorderTimeout = timeout
+}
+
+// Addrs return address of listeners
+func (tf *CodecMixer) Addrs() []net.Addr {
+	tf.mutex.Lock()
+	defer tf.mutex.Unlock()
+	addrs := make([]net.Addr, 0, len(tf.listeners))
+	for _, nl := range tf.listeners {
+		addrs = append(addrs, nl.Addr())
+	}
+	return addrs
 }
 
 // Close discard all internal resource
 // will close underlay io.ReadWriteCloser
 func (tf *CodecMixer) Close() {
+	tf.mutex.Lock()
+	defer tf.mutex.Unlock()
+	if tf.state == MIXER_STATE_CLOSED {
+		return
+	}
 	tf.state = MIXER_STATE_CLOSED
+	close(tf.closing)
+	for _, nl := range tf.listeners {
+		nl.Close()
+	}
+	for _, link := range tf.links {
+		link.close()
+	}
+	for ssid, _ := range tf.sscodecList {
+		tf.clearssidLocked(ssid)
+	}
+	for _, peer := range tf.peers {
+		peer.Close()
+	}
 }
-
-//
-//
-//
-//
-//
-//
-//
-//
-//
-//
-//
-
-//
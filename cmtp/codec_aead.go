@@ -0,0 +1,325 @@
+//
+// authenticated encryption Codec for Common Multiplexing Transport Proxy (CMTP)
+//
+// AESGCMCodec encrypt frame payload by AES-GCM with per-session key,
+// session key is derived from handshake secret, check sessionKeys,
+// header(frametype, ssid, index, bodylen) is authenticated as associated data,
+// nonce is made from ssid and index, frame replayed to other index/session is rejected
+//
+// control frame(FRAME_MSG*) and link frame(FRAME_LINK*) are sealed by ctrlAEAD when codec is FrameCodec,
+// control frame by control key of mixer pair, link frame by key of link from handshake nonce,
+// payload = uint64(sequence) + sealed CMsg, sequence is nonce, header is associated data
+//
+
+//
+package cmtp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/wheelcomplex/preinit/misc"
+)
+
+// length of AES-256 session key
+const AEAD_KEYLEN int = 32
+
+// FrameCodec is Codec bound to session and frame, check AESGCMCodec
+// EncodeFrame/DecodeFrame is used instead of Encode/Decode for session codec implemented FrameCodec
+type FrameCodec interface {
+	Codec
+
+	// Session return a new FrameCodec of ssid, encode with enckey and decode with deckey
+	Session(ssid uint64, enckey, deckey []byte) (FrameCodec, error)
+
+	// EncodeFrame encode src of frame index into dst, aad is authenticated
+	// if len(dst) < MaxEncodedLen(len(src)), return error with code ENCODE_ERR_BUFLEN
+	// src is not changed
+	EncodeFrame(dst, src, aad []byte, index uint64) (p []byte, err error)
+
+	// DecodeFrame decode src of frame index into dst, return error if src or aad modified
+	// if len(dst) < decoded length, return error with code DECODE_ERR_BUFLEN
+	// src is used as buffer and changed
+	DecodeFrame(dst, src, aad []byte, index uint64) (p []byte, err error)
+}
+
+// wrapCodec is Codec wrapping other Codec, check codecName
+type wrapCodec interface {
+	Inner() Codec
+}
+
+// AESGCMCodec implemented FrameCodec with AES-GCM, payload is encoded by inner codec before encrypt
+type AESGCMCodec struct {
+	inner Codec       // encode before encrypt, decode after decrypt
+	ssid  uint64      // session of key
+	enc   cipher.AEAD // encrypt frame to peer
+	dec   cipher.AEAD // decrypt frame from peer
+}
+
+// NewAESGCMCodec return new *AESGCMCodec without session key
+// inner is used to encode before encrypt, nil for NoopCodec
+func NewAESGCMCodec(inner Codec) *AESGCMCodec {
+	if inner == nil {
+		inner = NewNoopCodec()
+	}
+	return &AESGCMCodec{inner: inner}
+}
+
+// New return new Codec without session key
+func (ac *AESGCMCodec) New() Codec {
+	return NewAESGCMCodec(ac.inner.New())
+}
+
+// Inner return inner codec
+func (ac *AESGCMCodec) Inner() Codec {
+	return ac.inner
+}
+
+// Session return new *AESGCMCodec keyed for ssid
+func (ac *AESGCMCodec) Session(ssid uint64, enckey, deckey []byte) (FrameCodec, error) {
+	enc, err := newGCM(enckey)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := newGCM(deckey)
+	if err != nil {
+		return nil, err
+	}
+	return &AESGCMCodec{inner: ac.inner.New(), ssid: ssid, enc: enc, dec: dec}, nil
+}
+
+// newGCM return AES-GCM AEAD of key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// nonce return nonce of frame index, 4 bytes ssid + 8 bytes index
+func (ac *AESGCMCodec) nonce(index uint64) []byte {
+	nonce := make([]byte, 12)
+	CMTP_ENDIAN.PutUint32(nonce, uint32(ac.ssid))
+	CMTP_ENDIAN.PutUint64(nonce[4:], index)
+	return nonce
+}
+
+// return max length of decoded []byte when decode src
+// decoded length is unknown before decrypt, check DecodeFrame
+func (ac *AESGCMCodec) MaxDecodedLen(src []byte) (int, error) {
+	return 0, &misc.CommError{Code: DECODE_ERR_NIL, Err: errors.New("AESGCMCodec need frame, use DecodeFrame")}
+}
+
+// Decode always return error, frame is needed for nonce
+func (ac *AESGCMCodec) Decode(dst, src []byte) (p []byte, err error) {
+	return nil, &misc.CommError{Code: DECODE_ERR_NIL, Err: errors.New("AESGCMCodec need frame, use DecodeFrame")}
+}
+
+// return max length of encoded []byte when encode src
+func (ac *AESGCMCodec) MaxEncodedLen(srcLen int) int {
+	// gcm overhead is fixed
+	return ac.inner.MaxEncodedLen(srcLen) + 16
+}
+
+// Encode always return error, frame is needed for nonce
+func (ac *AESGCMCodec) Encode(dst, src []byte) (p []byte, err error) {
+	return nil, &misc.CommError{Code: ENCODE_ERR_NIL, Err: errors.New("AESGCMCodec need frame, use EncodeFrame")}
+}
+
+// EncodeFrame encode src by inner codec and encrypt it in dst
+func (ac *AESGCMCodec) EncodeFrame(dst, src, aad []byte, index uint64) (p []byte, err error) {
+	if ac.enc == nil {
+		return nil, &misc.CommError{Code: ENCODE_ERR_NIL, Err: errors.New("AESGCMCodec without session key")}
+	}
+	if len(dst) < ac.MaxEncodedLen(len(src)) {
+		return nil, &misc.CommError{Code: ENCODE_ERR_BUFLEN, Err: errors.New("dst buffer len too small for encode")}
+	}
+	plain, err := ac.inner.Encode(dst[:len(dst)-ac.enc.Overhead()], src)
+	if err != nil {
+		return nil, err
+	}
+	// seal in place, dst have room for overhead
+	return ac.enc.Seal(plain[:0], ac.nonce(index), plain, aad), nil
+}
+
+// DecodeFrame decrypt src in place and decode it by inner codec into dst
+func (ac *AESGCMCodec) DecodeFrame(dst, src, aad []byte, index uint64) (p []byte, err error) {
+	if ac.dec == nil {
+		return nil, &misc.CommError{Code: DECODE_ERR_NIL, Err: errors.New("AESGCMCodec without session key")}
+	}
+	plain, err := ac.dec.Open(src[:0], ac.nonce(index), src, aad)
+	if err != nil {
+		return nil, &misc.CommError{Code: DECODE_ERR_NIL, Err: fmt.Errorf("ssid %d index %d, decrypt failed: %s", ac.ssid, index, err.Error())}
+	}
+	size, err := ac.inner.MaxDecodedLen(plain)
+	if err != nil {
+		return nil, err
+	}
+	if len(dst) < size {
+		return nil, &misc.CommError{Code: DECODE_ERR_BUFLEN, Err: errors.New("dst buffer len too small for decode")}
+	}
+	return ac.inner.Decode(dst, plain)
+}
+
+// sessionSecret return secret of mixer pair, client and server are nonce of mixer exchanged in handshake
+func sessionSecret(key, client, server []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("session"))
+	mac.Write(client)
+	mac.Write(server)
+	return mac.Sum(nil)
+}
+
+// sessionKeys return AEAD_KEYLEN key for frame sent by client/server side of ssid
+func sessionKeys(secret []byte, ssid uint64) (client, server []byte) {
+	derive := func(role string) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(role))
+		fmt.Fprintf(mac, "%d", ssid)
+		return mac.Sum(nil)[:AEAD_KEYLEN]
+	}
+	return derive("client"), derive("server")
+}
+
+// controlKeys return AEAD_KEYLEN key for control frame sent by client/server side
+// ssid of control frame is authenticated by header
+func controlKeys(secret []byte) (client, server []byte) {
+	return deriveKeys(secret, []byte("control"))
+}
+
+// linkKeys return AEAD_KEYLEN key for link frame sent by client/server side of link
+// cnonce and snonce are handshake nonce of link
+func linkKeys(secret, cnonce, snonce []byte) (client, server []byte) {
+	return deriveKeys(secret, []byte("link"), cnonce, snonce)
+}
+
+// deriveKeys return AEAD_KEYLEN key for client/server side, context is mixed into key
+func deriveKeys(secret []byte, context ...[]byte) (client, server []byte) {
+	derive := func(role string) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(role))
+		for _, c := range context {
+			mac.Write(c)
+		}
+		return mac.Sum(nil)[:AEAD_KEYLEN]
+	}
+	return derive("client"), derive("server")
+}
+
+// overhead of sealed control frame, sequence + gcm tag
+const CTRL_SEAL_OVERHEAD int = 8 + 16
+
+// width of replay window of control/link frame
+// control frame is reordered across links, and retransmitted after link failed in CMTP_LINK_TIMEOUT,
+// window cover control frames sealed in this time, a retransmit older than window is rejected
+const CTRL_REPLAY_WINDOW uint64 = 1 << 16
+
+// ctrlAEAD seal and open control/link frame
+type ctrlAEAD struct {
+	mutex  sync.Mutex
+	enc    cipher.AEAD // seal frame to peer
+	dec    cipher.AEAD // open frame from peer
+	seq    uint64      // sequence of last sealed frame
+	replay bool        // reject replayed sequence
+	recv   uint64      // max sequence opened
+	window []uint64    // bitmap of opened sequence in window, bit of seq is seq % CTRL_REPLAY_WINDOW
+}
+
+// newCtrlAEAD return *ctrlAEAD seal with enckey and open with deckey
+// replay is true to reject sequence opened or older than CTRL_REPLAY_WINDOW
+func newCtrlAEAD(enckey, deckey []byte, replay bool) (*ctrlAEAD, error) {
+	enc, err := newGCM(enckey)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := newGCM(deckey)
+	if err != nil {
+		return nil, err
+	}
+	return &ctrlAEAD{enc: enc, dec: dec, replay: replay}, nil
+}
+
+// ctrlNonce return nonce of sequence
+func ctrlNonce(seq uint64) []byte {
+	nonce := make([]byte, 12)
+	CMTP_ENDIAN.PutUint64(nonce[4:], seq)
+	return nonce
+}
+
+// seal append sequence and sealed plain to dst, aad is authenticated
+func (ca *ctrlAEAD) seal(dst, plain, aad []byte) []byte {
+	ca.mutex.Lock()
+	ca.seq++
+	seq := ca.seq
+	ca.mutex.Unlock()
+	var buf [8]byte
+	CMTP_ENDIAN.PutUint64(buf[:], seq)
+	dst = append(dst, buf[:]...)
+	return ca.enc.Seal(dst, ctrlNonce(seq), plain, aad)
+}
+
+// open authenticate and decrypt src in place, return error if src or aad modified, or sequence replayed
+func (ca *ctrlAEAD) open(src, aad []byte) ([]byte, error) {
+	if len(src) < CTRL_SEAL_OVERHEAD {
+		return nil, errors.New("sealed frame too short")
+	}
+	seq := CMTP_ENDIAN.Uint64(src)
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	if ca.replay && ca.replayed(seq) {
+		return nil, fmt.Errorf("sequence %d replayed", seq)
+	}
+	plain, err := ca.dec.Open(src[8:8], ctrlNonce(seq), src[8:], aad)
+	if err != nil {
+		return nil, err
+	}
+	if ca.replay {
+		ca.mark(seq)
+	}
+	return plain, nil
+}
+
+// replayed return true if seq opened or older than replay window
+// caller should hold ca.mutex
+func (ca *ctrlAEAD) replayed(seq uint64) bool {
+	if seq == 0 {
+		return true
+	}
+	if seq > ca.recv {
+		return false
+	}
+	if ca.recv-seq >= CTRL_REPLAY_WINDOW || ca.window == nil {
+		return true
+	}
+	bit := seq % CTRL_REPLAY_WINDOW
+	return ca.window[bit/64]&(1<<(bit%64)) != 0
+}
+
+// mark record seq opened, bits of sequence moved out of window are cleared
+// caller should hold ca.mutex
+func (ca *ctrlAEAD) mark(seq uint64) {
+	if ca.window == nil {
+		ca.window = make([]uint64, CTRL_REPLAY_WINDOW/64)
+	}
+	if seq > ca.recv {
+		if seq-ca.recv >= CTRL_REPLAY_WINDOW {
+			for i := range ca.window {
+				ca.window[i] = 0
+			}
+		} else {
+			for s := ca.recv + 1; s < seq; s++ {
+				bit := s % CTRL_REPLAY_WINDOW
+				ca.window[bit/64] &^= 1 << (bit % 64)
+			}
+		}
+		ca.recv = seq
+	}
+	bit := seq % CTRL_REPLAY_WINDOW
+	ca.window[bit/64] |= 1 << (bit % 64)
+}
@@ -0,0 +1,219 @@
+package cmtp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// aeadPair return encode/decode codec of ssid
+func aeadPair(t *testing.T, inner Codec, ssid uint64) (FrameCodec, FrameCodec) {
+	client, server := sessionKeys(sessionSecret([]byte("key"), []byte("client"), []byte("server")), ssid)
+	enc, err := NewAESGCMCodec(inner).Session(ssid, client, server)
+	if err != nil {
+		t.Fatalf("session codec failed: %s", err)
+	}
+	dec, err := NewAESGCMCodec(inner).Session(ssid, server, client)
+	if err != nil {
+		t.Fatalf("session codec failed: %s", err)
+	}
+	return enc, dec
+}
+
+func TestAESGCMCodec(t *testing.T) {
+	for _, inner := range []Codec{NewNoopCodec(), NewSnappyCodec()} {
+		enc, dec := aeadPair(t, inner, 3)
+		plain := bytes.Repeat([]byte("cmtp frame payload "), 100)
+		aad := []byte("header")
+		buf := make([]byte, enc.MaxEncodedLen(len(plain)))
+		p, err := enc.EncodeFrame(buf, plain, aad, 7)
+		if err != nil {
+			t.Fatalf("encode failed: %s", err)
+		}
+		if bytes.Contains(p, []byte("cmtp frame")) {
+			t.Fatalf("payload not encrypted")
+		}
+		if _, ok := inner.(*SnappyCodec); ok && len(p) >= len(plain) {
+			t.Fatalf("payload not compressed before encrypt: %d >= %d", len(p), len(plain))
+		}
+		frame := append([]byte(nil), p...)
+		out := make([]byte, len(plain))
+		got, err := dec.DecodeFrame(out, append([]byte(nil), frame...), aad, 7)
+		if err != nil || bytes.Equal(got, plain) == false {
+			t.Fatalf("decode failed: %v", err)
+		}
+		// frame replayed to other index
+		if _, err := dec.DecodeFrame(out, append([]byte(nil), frame...), aad, 8); err == nil {
+			t.Fatalf("frame with other index should be rejected")
+		}
+		// header modified
+		if _, err := dec.DecodeFrame(out, append([]byte(nil), frame...), []byte("HEADER"), 7); err == nil {
+			t.Fatalf("frame with modified header should be rejected")
+		}
+		// payload modified
+		frame[0] ^= 1
+		if _, err := dec.DecodeFrame(out, append([]byte(nil), frame...), aad, 7); err == nil {
+			t.Fatalf("modified frame should be rejected")
+		}
+		frame[0] ^= 1
+		// frame replayed to other session
+		_, other := aeadPair(t, inner, 4)
+		if _, err := other.DecodeFrame(out, append([]byte(nil), frame...), aad, 7); err == nil {
+			t.Fatalf("frame of other session should be rejected")
+		}
+		// own frame reflected back
+		if _, err := enc.DecodeFrame(out, append([]byte(nil), frame...), aad, 7); err == nil {
+			t.Fatalf("reflected frame should be rejected")
+		}
+	}
+}
+
+func TestAESGCMCodecName(t *testing.T) {
+	if name := codecName(NewAESGCMCodec(NewSnappyCodec())); name != "snappy+aesgcm" {
+		t.Fatalf("codec name %s, should be snappy+aesgcm", name)
+	}
+	if name := codecName(NewAESGCMCodec(nil)); name != "aesgcm" {
+		t.Fatalf("codec name %s, should be aesgcm", name)
+	}
+}
+
+// peerPair return handshake result of server and client over pipe
+func peerPair(t *testing.T, server, client *CodecMixer) (*handshakeInfo, *handshakeInfo) {
+	sc, cc := net.Pipe()
+	defer sc.Close()
+	defer cc.Close()
+	hsCh := make(chan *handshakeInfo, 1)
+	go func() {
+		hs, _ := server.peerServerHandshake(sc)
+		hsCh <- hs
+	}()
+	chs, err := client.peerClientHandshake(cc)
+	shs := <-hsCh
+	if err != nil || shs == nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	return shs, chs
+}
+
+// reopen open copy of sealed frame on link
+func reopen(tf *CodecMixer, link *mixerLink, mf *mixerFrame, sealed []byte) bool {
+	copy(mf.framebuf, sealed)
+	mf.frameptr = len(sealed)
+	return tf.openCtrl(link, mf, 0)
+}
+
+func TestCtrlAEAD(t *testing.T) {
+	server := newCodecMixer(1234, NewAESGCMCodec(NewSnappyCodec()), NewXxhash(0), nil)
+	client := newCodecMixer(1234, NewAESGCMCodec(NewSnappyCodec()), NewXxhash(0), nil)
+	defer server.Close()
+	defer client.Close()
+	shs, chs := peerPair(t, server, client)
+	slink, clink := newMixerLink(1, nil, ""), newMixerLink(1, nil, "")
+	slink.aead, clink.aead = server.linkAEAD(shs), client.linkAEAD(chs)
+
+	// control frame sealed by control key
+	mf, err := client.ctrlFrame(FRAME_MSGWINDOW, 5, 0, &CMsg{Id: 100}, client.ctrl)
+	if err != nil {
+		t.Fatalf("ctrlFrame failed: %s", err)
+	}
+	sealed := append([]byte(nil), mf.framebuf[:mf.frameptr]...)
+	if reopen(server, slink, mf, sealed) == false {
+		t.Fatalf("sealed control frame rejected")
+	}
+	mc := &CMsg{}
+	if _, err := mc.UnMarshal(mf.framebuf[mf.hdrlen:mf.frameptr]); err != nil || mc.Id != 100 {
+		t.Fatalf("opened control frame mismatch: %v, %v", mc, err)
+	}
+	// replayed control frame
+	if reopen(server, slink, mf, sealed) {
+		t.Fatalf("replayed control frame accepted")
+	}
+	// control frame reordered across links, or retransmitted after link failed
+	first, _ := client.ctrlFrame(FRAME_MSGWINDOW, 5, 0, &CMsg{Id: 200}, client.ctrl)
+	resent := append([]byte(nil), first.framebuf[:first.frameptr]...)
+	for i := 0; i < int(CMTP_ACK_FRAMES)*4; i++ {
+		mf, _ = client.ctrlFrame(FRAME_MSGWINDOW, 5, 0, &CMsg{Id: 300}, client.ctrl)
+		if server.openCtrl(slink, mf, 0) == false {
+			t.Fatalf("sealed control frame rejected")
+		}
+	}
+	if reopen(server, slink, first, resent) == false {
+		t.Fatalf("retransmitted control frame not opened rejected")
+	}
+	if reopen(server, slink, first, resent) {
+		t.Fatalf("retransmitted control frame opened accepted")
+	}
+	mf, _ = client.ctrlFrame(FRAME_MSGWINDOW, 5, 0, &CMsg{Id: 100}, client.ctrl)
+	sealed = append([]byte(nil), mf.framebuf[:mf.frameptr]...)
+	// header is authenticated
+	mf.ssid = 6
+	if reopen(server, slink, mf, sealed) {
+		t.Fatalf("control frame with modified ssid accepted")
+	}
+	mf.ssid = 5
+	sealed[len(sealed)-1] ^= 1
+	if reopen(server, slink, mf, sealed) {
+		t.Fatalf("modified control frame accepted")
+	}
+	// unauthenticated
+	mf, _ = client.ctrlFrame(FRAME_MSGDELSSID, 5, 0, &CMsg{Code: IO_ERR_IDLE}, nil)
+	if server.openCtrl(slink, mf, 0) {
+		t.Fatalf("plain control frame accepted with FrameCodec")
+	}
+
+	// link frame sealed by key of link
+	mf, _ = client.ctrlFrame(FRAME_LINKACK, INIT_SSID, 0, &CMsg{Id: 32}, clink.aead)
+	sealed = append([]byte(nil), mf.framebuf[:mf.frameptr]...)
+	if reopen(server, slink, mf, sealed) == false {
+		t.Fatalf("sealed link frame rejected")
+	}
+	if reopen(server, slink, mf, sealed) {
+		t.Fatalf("replayed link frame accepted")
+	}
+	// link frame of other link
+	shs, chs = peerPair(t, server, client)
+	other := newMixerLink(2, nil, "")
+	other.aead = server.linkAEAD(shs)
+	mf, _ = client.ctrlFrame(FRAME_LINKACK, INIT_SSID, 0, &CMsg{Id: 32}, clink.aead)
+	sealed = append([]byte(nil), mf.framebuf[:mf.frameptr]...)
+	if reopen(server, other, mf, sealed) {
+		t.Fatalf("link frame of other link accepted")
+	}
+	if reopen(server, slink, mf, sealed) == false {
+		t.Fatalf("link frame reordered in window rejected")
+	}
+
+	// plain codec, not sealed
+	plain := newCodecMixer(1234, NewSnappyCodec(), NewXxhash(0), nil)
+	defer plain.Close()
+	mf, _ = plain.ctrlFrame(FRAME_MSGWINDOW, 5, 0, &CMsg{Id: 100}, nil)
+	if plain.openCtrl(newMixerLink(1, nil, ""), mf, 0) == false {
+		t.Fatalf("plain control frame rejected without FrameCodec")
+	}
+}
+
+func TestCtrlReplayWindow(t *testing.T) {
+	ca := &ctrlAEAD{replay: true}
+	for _, seq := range []uint64{1, 3, 2, 70, 10} {
+		if ca.replayed(seq) {
+			t.Fatalf("sequence %d should be accepted", seq)
+		}
+		ca.mark(seq)
+	}
+	for _, seq := range []uint64{0, 1, 3, 70, 10} {
+		if ca.replayed(seq) == false {
+			t.Fatalf("sequence %d should be rejected", seq)
+		}
+	}
+	if ca.replayed(5) || ca.replayed(9) || ca.replayed(71) {
+		t.Fatalf("sequence in window not opened should be accepted")
+	}
+	// window moved, opened bit of same slot is cleared
+	ca.mark(CTRL_REPLAY_WINDOW + 70)
+	if ca.replayed(70) == false || ca.replayed(71) {
+		t.Fatalf("sequence %d out of window accepted, or %d in window rejected", 70, 71)
+	}
+	if ca.replayed(CTRL_REPLAY_WINDOW+10) || ca.replayed(CTRL_REPLAY_WINDOW+70) == false {
+		t.Fatalf("bit of sequence out of window not cleared")
+	}
+}
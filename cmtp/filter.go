@@ -8,9 +8,12 @@ package cmtp
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/wheelcomplex/preinit/keyaes"
@@ -32,9 +35,37 @@ const (
 	FILTER_STATE_FILLTAIL
 	FILTER_STATE_FILLBODY
 	FILTER_STATE_CLOSED
+	FILTER_STATE_SENDREPLY
+	FILTER_STATE_FAILED
 	FILTER_STATE_LAST
 )
 
+// reason of dial failure, carried in Id of dial reply CMsg
+const (
+	DIAL_ERR_UNKNOWN uint64 = iota
+	DIAL_ERR_REFUSED
+	DIAL_ERR_HOSTUNREACH
+	DIAL_ERR_NETUNREACH
+)
+
+// dialReason return DIAL_ERR_* of dial error
+// timeout and name resolving failure are host unreachable
+func dialReason(err error) uint64 {
+	var nerr net.Error
+	var dnserr *net.DNSError
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return DIAL_ERR_REFUSED
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnserr):
+		return DIAL_ERR_HOSTUNREACH
+	case errors.As(err, &nerr) && nerr.Timeout():
+		return DIAL_ERR_HOSTUNREACH
+	case errors.Is(err, syscall.ENETUNREACH):
+		return DIAL_ERR_NETUNREACH
+	}
+	return DIAL_ERR_UNKNOWN
+}
+
 // tcpStream
 type tcpStream struct {
 	state   FILTER_STATE       // filter state
@@ -45,7 +76,6 @@ type tcpStream struct {
 	ioready chan struct{}      //
 }
 
-//
 func newTcpStream() *tcpStream {
 	ts := &tcpStream{
 		state:   FILTER_STATE_RESET,
@@ -54,15 +84,11 @@ func newTcpStream() *tcpStream {
 	return ts
 }
 
-//
+// close underlay io, state is keep for running Read/Write
 func (ts *tcpStream) close() {
 	if ts.rw != nil {
 		ts.rw.Close()
-		ts.rw = nil
 	}
-	ts.iobuf = nil
-	ts.ioptr = 0
-	ts.state = FILTER_STATE_UNSET
 }
 
 // max tcpStream header size
@@ -76,15 +102,27 @@ const MAX_DIALTIME time.Duration = 15e9
 // at disassemble side, read initial header(include dstinfo), create underlay io.Writer(by dstinfo)
 // and forward raw stream to underlay io.Writer
 // initial header will encrypt by aes
+// dstinfo with UDP_DST_PREFIX is dialed as datagram flow, check UDPFilter
+// disassemble side reply dial result in header format, CMsg with code 0 for success,
+// body is discarded and EOF after failure reply
+// assemble side read reply before body, pass dial result to onReply
+// dial reply is disabled for peer older than version 5, check SetDialReply
 type TCPFilter struct {
-	ssid       uint64        //
-	aes        *keyaes.AES   // aes use for dst info crypt
-	dstinfo    string        //
-	hdrlen     int           // header len for marshal header
-	encryptlen uint32        // stream initial info length after encrypt(without prefix header)
-	closed     chan struct{} //
-	in         *tcpStream    // assemble side
-	out        *tcpStream    // disassemble side
+	ssid       uint64            //
+	key        []byte            // key for aes
+	aes        *keyaes.AES       // aes use for dst info crypt
+	mutex      sync.Mutex        // lock for underlay io and close
+	dstinfo    string            //
+	udpIdle    time.Duration     // idle timeout of dialed datagram flow
+	hdrlen     int               // header len for marshal header
+	encryptlen uint32            // stream initial info length after encrypt(without prefix header)
+	assemble   bool              // assemble side, read dial reply before body
+	onReply    func(error) error // called once with dial result of peer at assemble side, nil error for success
+	replied    bool              // onReply called
+	noReply    bool              // peer never send/read dial reply
+	closed     chan struct{}     //
+	in         *tcpStream        // assemble side
+	out        *tcpStream        // disassemble side
 }
 
 // NewTCPFilter return *TCPFilter
@@ -95,6 +133,7 @@ func NewTCPFilter(key []byte, dstinfo string) *TCPFilter {
 		dstinfo = dstinfo[:MAX_HEADERLEN]
 	}
 	tf := &TCPFilter{
+		key:     key,
 		aes:     keyaes.NewAES(key, nil),
 		in:      newTcpStream(),
 		out:     newTcpStream(),
@@ -108,21 +147,29 @@ func NewTCPFilter(key []byte, dstinfo string) *TCPFilter {
 // New return new *TCPFilter work with ssid/rw
 // if use for disassemble side, pass rw == nil
 func (tf *TCPFilter) New(ssid uint64, rw io.ReadWriteCloser) Filter {
+	// aes is closed by Close, do not share it
 	ntf := &TCPFilter{
 		ssid:    ssid,
 		in:      newTcpStream(),
 		out:     newTcpStream(),
 		closed:  make(chan struct{}, 1),
-		aes:     tf.aes,
+		key:     tf.key,
+		aes:     keyaes.NewAES(tf.key, nil),
 		hdrlen:  tf.hdrlen,
 		dstinfo: tf.dstinfo,
+		udpIdle: tf.udpIdle,
+		onReply: tf.onReply,
 	}
 	if rw != nil {
-		// assemble side
-		tf.in.rw = rw
+		// assemble side, data from peer write to rw after dial reply
+		ntf.assemble = true
+		ntf.in.rw = rw
+		ntf.out.rw = rw
+		ntf.out.state = FILTER_STATE_RESET
 		ntf.marshalHeader()
 	} else {
-		// disassemble side
+		// disassemble side, read after dst dialed by Write
+		ntf.in.state = FILTER_STATE_SENDWAITIO
 	}
 	return ntf
 }
@@ -143,23 +190,145 @@ func (tf *TCPFilter) marshalHeader() {
 	fmt.Printf("TCPFilter, marshalInHeader: %d => %d, %x => %x\n", len(dstbuf), len(tf.in.iobuf), dstbuf, tf.in.iobuf)
 }
 
+// marshalReply return marshalled dial reply, format: uint32(encryptlen)+[]byte(CMsg)
+func (tf *TCPFilter) marshalReply(err error) []byte {
+	mc := &CMsg{}
+	if err != nil {
+		mc.Code = errCode(err, IO_ERR_DIAL)
+		mc.Err = err
+		if e, ok := err.(*CMsg); ok {
+			mc.Id = e.Id
+		}
+	}
+	buf, _ := mc.Marshal()
+	encryptlen := uint32(tf.aes.EncryptSize(len(buf)))
+	out := make([]byte, tf.hdrlen+int(encryptlen))
+	tf.aes.Encrypt(out[tf.hdrlen:], buf)
+	binary.Write(misc.NewBRWC(out[:tf.hdrlen]), CMTP_ENDIAN, &encryptlen)
+	return out
+}
+
+// recvReply unmarshal dial reply from peer and pass it to onReply
+// return error if peer dial failed
+func (tf *TCPFilter) recvReply(buf []byte) error {
+	mc := &CMsg{}
+	if _, err := mc.UnMarshal(buf); err != nil {
+		return &CMsg{
+			Code: UNMARSHAL_ERR_OPTION,
+			Err:  fmt.Errorf("TCPFilter, unmarshal reply failed: %s", err.Error()),
+		}
+	}
+	var err error
+	if mc.Code != 0 {
+		err = &CMsg{
+			Code: mc.Code,
+			Id:   mc.Id,
+			Err:  fmt.Errorf("TCPFilter, peer dial dst failed(%s): %s", tf.dstinfo, mc.Msg),
+		}
+	}
+	tf.mutex.Lock()
+	defer tf.mutex.Unlock()
+	if herr := tf.reply(err); herr != nil && err == nil {
+		err = herr
+	}
+	return err
+}
+
+// reply call onReply once
+// caller should hold tf.mutex
+func (tf *TCPFilter) reply(err error) error {
+	if tf.replied || tf.onReply == nil {
+		return nil
+	}
+	tf.replied = true
+	return tf.onReply(err)
+}
+
+// SetDialReply enable or disable dial reply, enabled by default
+// without dial reply, assemble side call onReply with nil error at once
+func (tf *TCPFilter) SetDialReply(enable bool) {
+	tf.mutex.Lock()
+	defer tf.mutex.Unlock()
+	tf.noReply = enable == false
+	if tf.noReply && tf.assemble {
+		tf.out.state = FILTER_STATE_FILLBODY
+		tf.reply(nil)
+	}
+}
+
+// SetUDPIdle set idle timeout of datagram flow, 0 for CMTP_UDP_IDLE
+func (tf *TCPFilter) SetUDPIdle(idle time.Duration) {
+	tf.udpIdle = idle
+}
+
+// dial connect to dstinfo, datagram flow for dstinfo with UDP_DST_PREFIX
+func (tf *TCPFilter) dial(dstinfo string) (io.ReadWriteCloser, error) {
+	network, addr := splitDst(dstinfo)
+	if network == "udp" {
+		return dialUDPFlow(addr, tf.udpIdle)
+	}
+	return net.DialTimeout("tcp", addr, MAX_DIALTIME)
+}
+
 // Close discard all internal resource
 // will close underlay io.Reader
 func (tf *TCPFilter) Close() {
+	tf.mutex.Lock()
+	defer tf.mutex.Unlock()
 	select {
 	case <-tf.closed:
 		return
 	default:
 		close(tf.closed)
 	}
+	if tf.assemble {
+		// closed before dial reply
+		tf.reply(&CMsg{Code: IO_ERR_CLOSED, Err: fmt.Errorf("TCPFilter, closed before dial reply")})
+	}
 	tf.aes.Close()
 	tf.in.close()
 	tf.out.close()
 }
 
+// CloseWrite half-close underlay io.Writer, underlay io.Reader is still readable
+func (tf *TCPFilter) CloseWrite() error {
+	tf.mutex.Lock()
+	defer tf.mutex.Unlock()
+	if tf.isClosed() {
+		return &CMsg{
+			Code: IO_ERR_CLOSED,
+			Err:  fmt.Errorf("TCPFilter, half-close failed: closed"),
+		}
+	}
+	hc, ok := tf.out.rw.(halfCloser)
+	if ok == false {
+		return &CMsg{
+			Code: IO_ERR_WRITE,
+			Err:  fmt.Errorf("TCPFilter, half-close failed: not supported by underlay io"),
+		}
+	}
+	return hc.CloseWrite()
+}
+
+// isClosed return true if Close called
+func (tf *TCPFilter) isClosed() bool {
+	select {
+	case <-tf.closed:
+		return true
+	default:
+	}
+	return false
+}
+
 // Read fill p []byte with marshalled header + stream from underlay io.Reader
 // have to trace the io state machine from marshalled header to underlay io.Reader and EOF
 func (tf *TCPFilter) Read(p []byte) (n int, err error) {
+	if tf.isClosed() {
+		return 0, &CMsg{
+			Code: IO_ERR_CLOSED,
+			Err:  fmt.Errorf("TCPFilter, read failed: closed"),
+		}
+	}
 	for {
 		switch tf.in.state {
 		case FILTER_STATE_RESET:
@@ -207,14 +376,31 @@ func (tf *TCPFilter) Read(p []byte) (n int, err error) {
 					Err:  fmt.Errorf("TCPFilter, read failed: closed"),
 				}
 			}
-			if tf.in.rw == nil {
-				return 0, &CMsg{
-					Code: IO_ERR_READ,
-					Err:  fmt.Errorf("TCPFilter, read failed: io.Reader no ready when try to read"),
+			if tf.noReply {
+				// peer never read dial reply
+				tf.in.state = FILTER_STATE_SENDBODY
+				if tf.in.rw == nil {
+					tf.in.state = FILTER_STATE_FAILED
 				}
+				continue
 			}
-			tf.in.state = FILTER_STATE_SENDBODY
+			tf.in.state = FILTER_STATE_SENDREPLY
 			fallthrough
+		case FILTER_STATE_SENDREPLY:
+			// copy marshelled dial reply out
+			outbyte, _ := misc.NewBRWC(p).Write(tf.in.iobuf[tf.in.ioptr:])
+			tf.in.ioptr += outbyte
+			if tf.in.ioptr == len(tf.in.iobuf) {
+				if tf.in.rw == nil {
+					// dial failed
+					tf.in.state = FILTER_STATE_FAILED
+				} else {
+					tf.in.state = FILTER_STATE_SENDBODY
+				}
+			}
+			return outbyte, nil
+		case FILTER_STATE_FAILED:
+			return 0, io.EOF
 		case FILTER_STATE_SENDBODY:
 			// copy underlay io.Reader until EOF
 			return tf.in.rw.Read(p)
@@ -228,6 +414,12 @@ func (tf *TCPFilter) Read(p []byte) (n int, err error) {
 // Write unmarshal p []byte (marshalled header + stream) and write to underlay io.Writer
 // have to trace the io state machine from marshalled header to underlay io.Writer and EOF
 func (tf *TCPFilter) Write(p []byte) (n int, err error) {
+	if tf.isClosed() {
+		return 0, &CMsg{
+			Code: IO_ERR_CLOSED,
+			Err:  fmt.Errorf("TCPFilter, write failed: closed"),
+		}
+	}
 	var pren int
 	for {
 		switch tf.out.state {
@@ -284,25 +476,51 @@ func (tf *TCPFilter) Write(p []byte) (n int, err error) {
 				}
 			}
 			fmt.Printf("TCPFilter, unmarshalInHeader: %d <= %d, %x <= %x\n", len(dstbuf), len(tf.out.iobuf), dstbuf, tf.out.iobuf)
-			tf.out.dstinfo = string(dstbuf)
-			//
-			rw, derr := net.DialTimeout("tcp", tf.out.dstinfo, MAX_DIALTIME)
-			if derr != nil {
-				return pren, &CMsg{
-					Code: IO_ERR_DIAL,
-					Err:  fmt.Errorf("TCPFilter, dial dst failed(%s): %s", tf.out.dstinfo, derr.Error()),
+			if tf.assemble {
+				// dial reply from peer
+				if err := tf.recvReply(dstbuf); err != nil {
+					return pren, err
+				}
+			} else {
+				tf.out.dstinfo = string(dstbuf)
+				//
+				rw, derr := tf.dial(tf.out.dstinfo)
+				if derr != nil {
+					derr = &CMsg{
+						Code: IO_ERR_DIAL,
+						Id:   dialReason(derr),
+						Err:  fmt.Errorf("TCPFilter, dial dst failed(%s): %s", tf.out.dstinfo, derr.Error()),
+					}
+					fmt.Printf("%s\n", derr.Error())
+					// reply failure to peer, discard body
+					tf.in.iobuf = tf.marshalReply(derr)
+					tf.in.ioptr = 0
+					tf.in.ioready <- struct{}{}
+					tf.out.state = FILTER_STATE_FAILED
+					return pren, nil
 				}
+				//
+				tf.mutex.Lock()
+				if tf.isClosed() {
+					tf.mutex.Unlock()
+					rw.Close()
+					return pren, &CMsg{
+						Code: IO_ERR_CLOSED,
+						Err:  fmt.Errorf("TCPFilter, write failed: closed"),
+					}
+				}
+				tf.out.rw = rw
+				//
+				// prepare read side
+				//
+				tf.in.iobuf = tf.marshalReply(nil)
+				tf.in.ioptr = 0
+				tf.in.rw = rw
+				tf.mutex.Unlock()
+				// active read goroutine
+				tf.in.ioready <- struct{}{}
 			}
 			//
-			tf.out.rw = rw.(*net.TCPConn)
-			//
-			// prepare read side
-			//
-			tf.in.rw = rw.(*net.TCPConn)
-			tf.in.state = FILTER_STATE_SENDWAITIO
-			// active read goroutine
-			tf.in.ioready <- struct{}{}
-			//
 			if len(tf.out.iobuf[tf.out.ioptr:]) == 0 {
 				tf.out.state = FILTER_STATE_FILLBODY
 				return pren, nil
@@ -329,6 +547,9 @@ func (tf *TCPFilter) Write(p []byte) (n int, err error) {
 		case FILTER_STATE_FILLBODY:
 			// write pain body to io.Writer
 			return tf.out.rw.Write(p)
+		case FILTER_STATE_FAILED:
+			// dial failed, discard body
+			return len(p), nil
 		default:
 			panic(fmt.Sprintf("invalid TCPFilter state %d in Write", tf.out.state))
 		}
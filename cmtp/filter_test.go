@@ -0,0 +1,101 @@
+package cmtp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/wheelcomplex/preinit/keyaes"
+)
+
+// filterPair return assemble and disassemble side of TCPFilter to dest, and local end of assemble side
+func filterPair(dest string, reply bool, onReply func(error) error) (*TCPFilter, *TCPFilter, net.Conn) {
+	proto := NewTCPFilter(keyaes.FnvUintExpend(9999, keyaes.AES_KEYLEN), dest)
+	proto.onReply = onReply
+	local, remote := net.Pipe()
+	as := proto.New(1, remote).(*TCPFilter)
+	ds := proto.New(1, nil).(*TCPFilter)
+	as.SetDialReply(reply)
+	ds.SetDialReply(reply)
+	return as, ds, local
+}
+
+// pump copy header of as to ds, return first read of ds after ping written to dest
+func pump(t *testing.T, as, ds *TCPFilter) []byte {
+	buf := make([]byte, 4096)
+	n, err := as.Read(buf)
+	if err != nil {
+		t.Fatalf("read header: %s", err)
+	}
+	if _, err := ds.Write(buf[:n]); err != nil {
+		t.Fatalf("write header: %s", err)
+	}
+	if _, err := ds.Write([]byte("ping")); err != nil {
+		t.Fatalf("write body: %s", err)
+	}
+	n, err = ds.Read(buf)
+	if err != nil {
+		t.Fatalf("read reply: %s", err)
+	}
+	return buf[:n]
+}
+
+func TestTCPFilterDialReply(t *testing.T) {
+	dest, stop := echoServer(t)
+	defer stop()
+
+	// version 5, reply before body
+	var replied []error
+	as, ds, local := filterPair(dest, true, func(err error) error {
+		replied = append(replied, err)
+		return nil
+	})
+	p := pump(t, as, ds)
+	if bytes.Equal(p, []byte("ping")) {
+		t.Fatalf("body read before dial reply")
+	}
+	if len(replied) != 0 {
+		t.Fatalf("replied before dial reply from peer")
+	}
+	if _, err := as.Write(p); err != nil || len(replied) != 1 || replied[0] != nil {
+		t.Fatalf("dial reply failed: %v, %v", err, replied)
+	}
+	as.Close()
+	ds.Close()
+	local.Close()
+
+	// version 4 peer, no reply
+	replied = nil
+	as, ds, local = filterPair(dest, false, func(err error) error {
+		replied = append(replied, err)
+		return nil
+	})
+	defer local.Close()
+	defer as.Close()
+	defer ds.Close()
+	if len(replied) != 1 || replied[0] != nil {
+		t.Fatalf("should reply success at once without dial reply: %v", replied)
+	}
+	body := make([]byte, 0, 4)
+	body = append(body, pump(t, as, ds)...)
+	for len(body) < 4 {
+		buf := make([]byte, 4)
+		n, err := ds.Read(buf)
+		if err != nil {
+			t.Fatalf("read body: %s", err)
+		}
+		body = append(body, buf[:n]...)
+	}
+	if string(body) != "ping" {
+		t.Fatalf("body should be read without dial reply: %q", body)
+	}
+	// body from peer write to local at once
+	go as.Write([]byte("pong"))
+	local.SetDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(local, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("body from peer: %q, %v", buf, err)
+	}
+}
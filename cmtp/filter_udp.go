@@ -0,0 +1,355 @@
+//
+// UDPFilter for Common Multiplexing Transport Proxy (CMTP)
+//
+// datagram flow keyed by client addr:port is tunneled as session,
+// each datagram is marshalled as uint16(length)+datagram in session stream, boundary is kept after reassemble,
+// flow without datagram in idle timeout is half-closed
+//
+
+//
+package cmtp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// datagram flow without io is half-closed after CMTP_UDP_IDLE
+const CMTP_UDP_IDLE time.Duration = 60e9
+
+// max size of datagram
+const UDP_MAX_DATAGRAM int = 65535
+
+// datagram queued for each flow, datagram is dropped if queue full
+const UDP_FLOW_QUEUE int = 64
+
+// dstinfo prefix of datagram flow, check TCPFilter.dial
+const UDP_DST_PREFIX string = "udp://"
+
+// UDPFilter is TCPFilter tunneling datagram flow
+// at assemble side, underlay io is flow accepted by ListenClientUDP
+// at disassemble side, destination is dialed by TCPFilter with UDP_DST_PREFIX in dstinfo
+type UDPFilter struct {
+	*TCPFilter
+}
+
+// NewUDPFilter return *UDPFilter forward datagram to dstinfo
+// idle is timeout of flow without io, 0 for CMTP_UDP_IDLE
+func NewUDPFilter(key []byte, dstinfo string, idle time.Duration) *UDPFilter {
+	tf := NewTCPFilter(key, UDP_DST_PREFIX+dstinfo)
+	tf.SetUDPIdle(idle)
+	return &UDPFilter{TCPFilter: tf}
+}
+
+// New return new *UDPFilter work with ssid/rw
+func (uf *UDPFilter) New(ssid uint64, rw io.ReadWriteCloser) Filter {
+	return &UDPFilter{TCPFilter: uf.TCPFilter.New(ssid, rw).(*TCPFilter)}
+}
+
+// splitDst return network and address of dstinfo
+func splitDst(dstinfo string) (string, string) {
+	if strings.HasPrefix(dstinfo, UDP_DST_PREFIX) {
+		return "udp", dstinfo[len(UDP_DST_PREFIX):]
+	}
+	return "tcp", dstinfo
+}
+
+// udpFlow is datagram flow implemented net.Conn
+// Read return marshalled datagram, Write unmarshal datagram and send it
+type udpFlow struct {
+	local   net.Addr                    //
+	remote  net.Addr                    //
+	inCh    chan []byte                 // datagram received
+	send    func(p []byte) (int, error) // send datagram to remote
+	release func()                      // stop receiving, called once
+	idle    time.Duration               // timeout without io
+	mutex   sync.Mutex                  // lock for last and done
+	last    time.Time                   // last io time
+	done    chan struct{}               // closed by CloseWrite/Close/idle timeout
+	once    sync.Once                   //
+	rbuf    []byte                      // marshalled datagram pending for Read
+	wbuf    []byte                      // partial marshalled datagram of Write
+}
+
+// newUDPFlow return *udpFlow, idle <= 0 for CMTP_UDP_IDLE
+func newUDPFlow(local, remote net.Addr, send func(p []byte) (int, error), release func(), idle time.Duration) *udpFlow {
+	if idle <= 0 {
+		idle = CMTP_UDP_IDLE
+	}
+	return &udpFlow{
+		local:   local,
+		remote:  remote,
+		inCh:    make(chan []byte, UDP_FLOW_QUEUE),
+		send:    send,
+		release: release,
+		idle:    idle,
+		last:    time.Now(),
+		done:    make(chan struct{}),
+	}
+}
+
+// dialUDPFlow return *udpFlow connected to addr
+func dialUDPFlow(addr string, idle time.Duration) (*udpFlow, error) {
+	conn, err := net.DialTimeout("udp", addr, MAX_DIALTIME)
+	if err != nil {
+		return nil, err
+	}
+	uc := conn.(*net.UDPConn)
+	f := newUDPFlow(uc.LocalAddr(), uc.RemoteAddr(), uc.Write, func() { uc.Close() }, idle)
+	go func() {
+		buf := make([]byte, UDP_MAX_DATAGRAM)
+		for {
+			n, err := uc.Read(buf)
+			if err != nil {
+				if f.isDone() {
+					return
+				}
+				if errors.Is(err, syscall.ECONNREFUSED) {
+					// icmp port unreachable of previous datagram
+					fmt.Printf("udpFlow, %s, read failed: %s\n", addr, err.Error())
+					continue
+				}
+				fmt.Printf("udpFlow, %s, end flow for read failed: %s\n", addr, err.Error())
+				f.CloseWrite()
+				return
+			}
+			f.push(append([]byte(nil), buf[:n]...))
+		}
+	}()
+	return f, nil
+}
+
+// push queue datagram for Read, drop it if queue full
+func (f *udpFlow) push(p []byte) {
+	select {
+	case f.inCh <- p:
+	default:
+	}
+}
+
+// touch update last io time
+func (f *udpFlow) touch() {
+	f.mutex.Lock()
+	f.last = time.Now()
+	f.mutex.Unlock()
+}
+
+// remain return time to idle timeout
+func (f *udpFlow) remain() time.Duration {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.last.Add(f.idle).Sub(time.Now())
+}
+
+// isDone return true if flow half-closed
+func (f *udpFlow) isDone() bool {
+	select {
+	case <-f.done:
+		return true
+	default:
+	}
+	return false
+}
+
+// Read fill p with uint16(length)+datagram, return io.EOF after half-closed or idle timeout
+func (f *udpFlow) Read(p []byte) (n int, err error) {
+	for len(f.rbuf) == 0 {
+		remain := f.remain()
+		if remain <= 0 {
+			fmt.Printf("udpFlow, %s, idle timeout(%v)\n", f.remote.String(), f.idle)
+			f.CloseWrite()
+			return 0, io.EOF
+		}
+		timer := time.NewTimer(remain)
+		select {
+		case dg := <-f.inCh:
+			f.touch()
+			f.rbuf = make([]byte, 2+len(dg))
+			CMTP_ENDIAN.PutUint16(f.rbuf, uint16(len(dg)))
+			copy(f.rbuf[2:], dg)
+		case <-f.done:
+			timer.Stop()
+			return 0, io.EOF
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+	n = copy(p, f.rbuf)
+	f.rbuf = f.rbuf[n:]
+	return n, nil
+}
+
+// Write unmarshal p and send completed datagram
+func (f *udpFlow) Write(p []byte) (n int, err error) {
+	f.wbuf = append(f.wbuf, p...)
+	ptr := 0
+	for len(f.wbuf)-ptr >= 2 {
+		size := int(CMTP_ENDIAN.Uint16(f.wbuf[ptr:]))
+		if len(f.wbuf)-ptr < 2+size {
+			break
+		}
+		if _, err = f.send(f.wbuf[ptr+2 : ptr+2+size]); err != nil {
+			return len(p), &CMsg{
+				Code: IO_ERR_WRITE,
+				Err:  fmt.Errorf("udpFlow, %s, send failed: %s", f.remote.String(), err.Error()),
+			}
+		}
+		ptr += 2 + size
+	}
+	f.wbuf = append(f.wbuf[:0], f.wbuf[ptr:]...)
+	f.touch()
+	return len(p), nil
+}
+
+// CloseWrite end flow, Read return io.EOF after it
+func (f *udpFlow) CloseWrite() error {
+	f.once.Do(func() {
+		close(f.done)
+		f.release()
+	})
+	return nil
+}
+
+// Close end flow and stop receiving
+func (f *udpFlow) Close() error {
+	return f.CloseWrite()
+}
+
+// LocalAddr return local address of flow
+func (f *udpFlow) LocalAddr() net.Addr {
+	return f.local
+}
+
+// RemoteAddr return remote address of flow
+func (f *udpFlow) RemoteAddr() net.Addr {
+	return f.remote
+}
+
+// SetDeadline is not supported, flow is ended by idle timeout
+func (f *udpFlow) SetDeadline(t time.Time) error {
+	return errors.New("udpFlow, deadline not supported")
+}
+
+// SetReadDeadline is not supported, flow is ended by idle timeout
+func (f *udpFlow) SetReadDeadline(t time.Time) error {
+	return errors.New("udpFlow, deadline not supported")
+}
+
+// SetWriteDeadline is not supported, flow is ended by idle timeout
+func (f *udpFlow) SetWriteDeadline(t time.Time) error {
+	return errors.New("udpFlow, deadline not supported")
+}
+
+// udpListener implemented net.Listener, accept new datagram flow keyed by client addr:port
+type udpListener struct {
+	conn     *net.UDPConn        //
+	idle     time.Duration       // idle timeout of flow
+	mutex    sync.Mutex          // lock for flows
+	flows    map[string]*udpFlow // running flow by client addr:port
+	acceptCh chan *udpFlow       // new flow
+	closed   chan struct{}       //
+	once     sync.Once           //
+}
+
+// listenUDP return *udpListener listening on addr
+func listenUDP(addr string, idle time.Duration) (*udpListener, error) {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	ul := &udpListener{
+		conn:     conn,
+		idle:     idle,
+		flows:    make(map[string]*udpFlow),
+		acceptCh: make(chan *udpFlow, UDP_FLOW_QUEUE),
+		closed:   make(chan struct{}),
+	}
+	go ul.readLoop()
+	return ul, nil
+}
+
+// readLoop dispatch datagram to flow of client, create new flow for new client
+func (ul *udpListener) readLoop() {
+	buf := make([]byte, UDP_MAX_DATAGRAM)
+	for {
+		n, raddr, err := ul.conn.ReadFromUDP(buf)
+		if err != nil {
+			fmt.Printf("udpListener, %s, exit for read failed: %s\n", ul.conn.LocalAddr().String(), err.Error())
+			ul.Close()
+			return
+		}
+		key := raddr.String()
+		ul.mutex.Lock()
+		f, ok := ul.flows[key]
+		if ok == false {
+			f = newUDPFlow(ul.conn.LocalAddr(), raddr, func(p []byte) (int, error) {
+				return ul.conn.WriteToUDP(p, raddr)
+			}, func() {
+				ul.remove(key)
+			}, ul.idle)
+			ul.flows[key] = f
+		}
+		ul.mutex.Unlock()
+		f.push(append([]byte(nil), buf[:n]...))
+		if ok == false {
+			select {
+			case ul.acceptCh <- f:
+			case <-ul.closed:
+				return
+			}
+		}
+	}
+}
+
+// remove delete flow of client
+func (ul *udpListener) remove(key string) {
+	ul.mutex.Lock()
+	defer ul.mutex.Unlock()
+	delete(ul.flows, key)
+}
+
+// Accept return new flow
+func (ul *udpListener) Accept() (net.Conn, error) {
+	select {
+	case f := <-ul.acceptCh:
+		return f, nil
+	case <-ul.closed:
+	}
+	return nil, &CMsg{
+		Code: IO_ERR_CLOSED,
+		Err:  fmt.Errorf("udpListener, accept failed: closed"),
+	}
+}
+
+// Close stop listening and end all flows
+func (ul *udpListener) Close() error {
+	ul.once.Do(func() {
+		close(ul.closed)
+		ul.conn.Close()
+	})
+	ul.mutex.Lock()
+	flows := make([]*udpFlow, 0, len(ul.flows))
+	for _, f := range ul.flows {
+		flows = append(flows, f)
+	}
+	ul.mutex.Unlock()
+	for _, f := range flows {
+		f.Close()
+	}
+	return nil
+}
+
+// Addr return local address
+func (ul *udpListener) Addr() net.Addr {
+	return ul.conn.LocalAddr()
+}
@@ -0,0 +1,117 @@
+package cmtp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPFlow(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+	sent := make([][]byte, 0)
+	released := 0
+	f := newUDPFlow(addr, addr, func(p []byte) (int, error) {
+		sent = append(sent, append([]byte(nil), p...))
+		return len(p), nil
+	}, func() { released++ }, 200*time.Millisecond)
+
+	// datagram boundary kept after split/merge of stream
+	dgs := [][]byte{[]byte("a"), {}, bytes.Repeat([]byte("b"), 3000), []byte("cd")}
+	stream := make([]byte, 0)
+	for _, dg := range dgs {
+		f.push(dg)
+		rec := make([]byte, 0)
+		buf := make([]byte, 7)
+		for len(rec) < 2+len(dg) {
+			n, err := f.Read(buf)
+			if err != nil {
+				t.Fatalf("read: %s", err)
+			}
+			rec = append(rec, buf[:n]...)
+		}
+		stream = append(stream, rec...)
+	}
+	for len(stream) > 0 {
+		n := 5
+		if n > len(stream) {
+			n = len(stream)
+		}
+		if _, err := f.Write(stream[:n]); err != nil {
+			t.Fatalf("write: %s", err)
+		}
+		stream = stream[n:]
+	}
+	if len(sent) != len(dgs) {
+		t.Fatalf("sent %d datagram, should be %d", len(sent), len(dgs))
+	}
+	for i := range dgs {
+		if bytes.Equal(sent[i], dgs[i]) == false {
+			t.Fatalf("datagram %d mismatch: %d != %d bytes", i, len(sent[i]), len(dgs[i]))
+		}
+	}
+
+	// idle timeout
+	start := time.Now()
+	if _, err := f.Read(make([]byte, 10)); err != io.EOF {
+		t.Fatalf("idle flow should return EOF: %v", err)
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Fatalf("idle timeout too early: %v", time.Since(start))
+	}
+	f.Close()
+	if released != 1 {
+		t.Fatalf("flow released %d times, should be 1", released)
+	}
+}
+
+func TestUDPFlowDial(t *testing.T) {
+	// nothing listening at destination
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+	f, err := dialUDPFlow(addr, time.Second)
+	if err != nil {
+		t.Fatalf("dial flow: %s", err)
+	}
+	defer f.Close()
+	dg := []byte{0, 5, 'h', 'e', 'l', 'l', 'o'}
+	if _, err := f.Write(dg); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if f.isDone() {
+		t.Fatalf("flow ended by icmp port unreachable")
+	}
+
+	// destination started, flow kept receiving
+	conn, err = net.ListenUDP("udp", f.RemoteAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer conn.Close()
+	if _, err := f.Write(dg); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, UDP_MAX_DATAGRAM)
+	n, raddr, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("read datagram: %s", err)
+	}
+	conn.WriteToUDP(buf[:n], raddr)
+	rec := make([]byte, len(dg))
+	if _, err := io.ReadFull(f, rec); err != nil || bytes.Equal(rec, dg) == false {
+		t.Fatalf("read flow: %q, %v", rec, err)
+	}
+
+	// other read error end flow
+	f.release()
+	if _, err := f.Read(rec); err != io.EOF {
+		t.Fatalf("flow not ended by read error: %v", err)
+	}
+}
@@ -0,0 +1,229 @@
+//
+// flow control for Common Multiplexing Transport Proxy (CMTP)
+//
+// each session can send frames up to a limit index granted by peer,
+// initial limit is INIT_INDEX + CMTP_FLOW_WINDOW,
+// WriteTo of peer announce new limit by FRAME_MSGWINDOW after frames drained,
+// ReadFrom stall when limit reached, other sessions are not affected
+// peer older than version 2 never grant window, flow control is disabled for it
+//
+
+//
+package cmtp
+
+import (
+	"fmt"
+	"sync"
+)
+
+// max frames in flight of one session
+const CMTP_FLOW_WINDOW uint64 = 64
+
+// flowCredit is send credit of one session
+type flowCredit struct {
+	mutex  sync.Mutex
+	limit  uint64        // max frame index allowed to send
+	notify chan struct{} // limit grown
+}
+
+// newFlowCredit return *flowCredit allow window frames from first index of session
+func newFlowCredit(window uint64) *flowCredit {
+	return &flowCredit{
+		limit:  INIT_INDEX + window,
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// grant raise limit, limit from duplicated or delayed frame is ignored
+func (fc *flowCredit) grant(limit uint64) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	if limit <= fc.limit {
+		return
+	}
+	fc.limit = limit
+	select {
+	case fc.notify <- struct{}{}:
+	default:
+	}
+}
+
+// wait block until index allowed to send
+// return false if closing or ssclosing closed
+func (fc *flowCredit) wait(index uint64, closing, ssclosing chan struct{}) bool {
+	for {
+		fc.mutex.Lock()
+		ok := index <= fc.limit
+		fc.mutex.Unlock()
+		if ok {
+			return true
+		}
+		select {
+		case <-fc.notify:
+		case <-closing:
+			return false
+		case <-ssclosing:
+			return false
+		}
+	}
+}
+
+// flowControl return false if peer older than version 2
+func (tf *CodecMixer) flowControl() bool {
+	return tf.peerVersion() >= 2
+}
+
+// waitCredit block until next frame of ssid allowed to send
+// return false if session closed
+func (tf *CodecMixer) waitCredit(ssid uint64) bool {
+	if tf.flowControl() == false {
+		_, _, ok := tf.sessionCh(ssid)
+		return ok
+	}
+	tf.mutex.Lock()
+	fc, ok := tf.sscredit[ssid]
+	index := tf.ssindex[ssid] + 1
+	ssclosing := tf.ssclosing[ssid]
+	tf.mutex.Unlock()
+	if ok == false {
+		return false
+	}
+	return fc.wait(index, tf.closing, ssclosing)
+}
+
+// sendWindow announce limit index of ssid to peer
+func (tf *CodecMixer) sendWindow(ssid, limit uint64, ssclosing chan struct{}) error {
+	if tf.flowControl() == false {
+		return nil
+	}
+	return tf.sendCtrl(FRAME_MSGWINDOW, ssid, &CMsg{Id: limit}, ssclosing)
+}
+
+// sendCtrl send control frame carrying mc to peer
+// control frame is not encoded by session codec, it is sealed by control key when codec is FrameCodec
+func (tf *CodecMixer) sendCtrl(frametype, ssid uint64, mc *CMsg, ssclosing chan struct{}) error {
+	var aead *ctrlAEAD
+	if tf.sealCtrl() {
+		tf.mutex.Lock()
+		aead = tf.ctrl
+		tf.mutex.Unlock()
+	}
+	mf, err := tf.ctrlFrame(frametype, ssid, 0, mc, aead)
+	if err != nil {
+		return err
+	}
+	select {
+	case tf.assembleFastCh <- mf:
+		return nil
+	case <-tf.closing:
+	case <-ssclosing:
+	}
+	tf.putFrame(mf)
+	return &CMsg{Code: IO_ERR_CLOSED, Err: fmt.Errorf("send control frame %d of ssid %d failed: closed", frametype, ssid)}
+}
+
+// ctrlFrame return marshalled control frame carrying mc, sealed by aead if not nil
+// bodylen is length of marshalled mc
+func (tf *CodecMixer) ctrlFrame(frametype, ssid, index uint64, mc *CMsg, aead *ctrlAEAD) (*mixerFrame, error) {
+	buf, err := mc.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	mf := tf.getFrame()
+	size := mf.hdrlen + len(buf)
+	if aead != nil {
+		size += CTRL_SEAL_OVERHEAD
+	}
+	if size > len(mf.framebuf) {
+		mf.framebuf = make([]byte, size)
+	}
+	mf.frametype = frametype
+	mf.ssid = ssid
+	mf.index = index
+	mf.bodylen = uint64(len(buf))
+	payload := buf
+	if aead != nil {
+		payload = aead.seal(mf.framebuf[mf.hdrlen:mf.hdrlen], buf, mf.aad())
+	} else {
+		copy(mf.framebuf[mf.hdrlen:], buf)
+	}
+	mf.payloadlen = uint64(len(payload))
+	mf.frameptr = mf.hdrlen + len(payload)
+	mf.MarshalHeader(tf.frameChecksum(), 0)
+	return mf, nil
+}
+
+// sealCtrl return true if control/link frame should be sealed, codec is FrameCodec
+func (tf *CodecMixer) sealCtrl() bool {
+	tf.mutex.Lock()
+	defer tf.mutex.Unlock()
+	_, ok := tf.codec.(FrameCodec)
+	return ok
+}
+
+// linkAEAD return *ctrlAEAD for link frame of link, keyed by handshake nonce of link
+func (tf *CodecMixer) linkAEAD(hs *handshakeInfo) *ctrlAEAD {
+	enckey, deckey := linkKeys(sessionSecret(tf.key, hs.cmixer, hs.smixer), hs.cnonce, hs.snonce)
+	if hs.server {
+		enckey, deckey = deckey, enckey
+	}
+	aead, err := newCtrlAEAD(enckey, deckey, true)
+	if err != nil {
+		panic(fmt.Sprintf("link key failed: %s", err.Error()))
+	}
+	return aead
+}
+
+// openCtrl authenticate and decrypt control/link frame read from link in place
+// unauthenticated frame is rejected when codec is FrameCodec
+// return false if frame should be dropped
+func (tf *CodecMixer) openCtrl(link *mixerLink, mf *mixerFrame, count int) bool {
+	if tf.sealCtrl() == false {
+		return true
+	}
+	aead := link.aead
+	if isLinkFrame(mf.frametype) == false {
+		tf.mutex.Lock()
+		aead = tf.ctrl
+		tf.mutex.Unlock()
+	}
+	if aead == nil {
+		fmt.Printf("readLoop#%d, %d, drop control frame %d: no key\n", count, mf.ssid, mf.frametype)
+		return false
+	}
+	plain, err := aead.open(mf.framebuf[mf.hdrlen:mf.frameptr], mf.aad())
+	if err != nil || uint64(len(plain)) != mf.bodylen {
+		fmt.Printf("readLoop#%d, %d, drop unauthenticated control frame %d: %v\n", count, mf.ssid, mf.frametype, err)
+		return false
+	}
+	// CMsg after header
+	copy(mf.framebuf[mf.hdrlen:], plain)
+	mf.frameptr = mf.hdrlen + len(plain)
+	return true
+}
+
+// recvCtrl handle control frame from peer
+func (tf *CodecMixer) recvCtrl(mf *mixerFrame, count int) {
+	mc := &CMsg{}
+	if _, err := mc.UnMarshal(mf.framebuf[mf.hdrlen:mf.frameptr]); err != nil {
+		fmt.Printf("readLoop#%d, %d, invalid control frame %d: %s\n", count, mf.ssid, mf.frametype, err.Error())
+		return
+	}
+	switch mf.frametype {
+	case FRAME_MSGWINDOW:
+		tf.mutex.Lock()
+		fc, ok := tf.sscredit[mf.ssid]
+		tf.mutex.Unlock()
+		if ok {
+			fc.grant(mc.Id)
+		}
+	case FRAME_MSGNEWSSID:
+		if tf.acceptSession(mf.ssid) == false {
+			fmt.Printf("readLoop#%d, %d, refused session: %s\n", count, mf.ssid, mc.Msg)
+		}
+	case FRAME_MSGDELSSID:
+		tf.recvDelssid(mf.ssid, mc, count)
+	default:
+		fmt.Printf("readLoop#%d, %d, ignored control frame %d\n", count, mf.ssid, mf.frametype)
+	}
+}
@@ -0,0 +1,47 @@
+package cmtp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFlowOldPeer(t *testing.T) {
+	tf := newCodecMixer(1234, NewNoopCodec(), NewXxhash(0), nil)
+	defer tf.Close()
+	exhaust := func() uint64 {
+		ssid := tf.initssid(0)
+		tf.mutex.Lock()
+		tf.ssindex[ssid] = INIT_INDEX + CMTP_FLOW_WINDOW
+		tf.mutex.Unlock()
+		return ssid
+	}
+
+	// window exhausted
+	ssid := exhaust()
+	done := make(chan bool, 1)
+	go func() {
+		done <- tf.waitCredit(ssid)
+	}()
+	select {
+	case <-done:
+		t.Fatalf("waitCredit should block without window")
+	case <-time.After(100 * time.Millisecond):
+	}
+	tf.clearssid(ssid)
+	if <-done {
+		t.Fatalf("waitCredit should fail after session closed")
+	}
+
+	// version 1 peer never grant window
+	tf.mutex.Lock()
+	tf.version = 1
+	tf.mutex.Unlock()
+	ssid = exhaust()
+	if tf.waitCredit(ssid) == false {
+		t.Fatalf("waitCredit should not wait window of version 1 peer")
+	}
+	queued := len(tf.assembleFastCh)
+	if err := tf.sendWindow(ssid, INIT_INDEX+CMTP_FLOW_WINDOW*2, nil); err != nil || len(tf.assembleFastCh) != queued {
+		t.Fatalf("window frame should not be sent to version 1 peer: %v", err)
+	}
+}
@@ -0,0 +1,376 @@
+//
+// SOCKS5 and HTTP CONNECT front-end for Common Multiplexing Transport Proxy (CMTP)
+//
+// destination is taken from request of local client and carried by encrypted header of TCPFilter/UDPFilter,
+// local client is replied after dial result from peer, check TCPFilter.onReply
+//
+
+//
+package cmtp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// timeout for reading request of local client
+const FRONTEND_TIMEOUT time.Duration = 10e9
+
+// readSOCKSAddr return errSOCKSAtyp for unknown address type, replied by SOCKS5_REP_ATYPNOTSUPPORTED
+var errSOCKSAtyp = errors.New("SOCKS, unsupported address type")
+
+// SOCKS5 version, method, command, address type and reply code
+const (
+	SOCKS5_VERSION              byte = 5
+	SOCKS5_AUTH_NONE            byte = 0
+	SOCKS5_AUTH_NOACCEPT        byte = 0xFF
+	SOCKS5_CMD_CONNECT          byte = 1
+	SOCKS5_CMD_ASSOCIATE        byte = 3
+	SOCKS5_ATYP_IPV4            byte = 1
+	SOCKS5_ATYP_DOMAIN          byte = 3
+	SOCKS5_ATYP_IPV6            byte = 4
+	SOCKS5_REP_OK               byte = 0
+	SOCKS5_REP_FAIL             byte = 1
+	SOCKS5_REP_NETUNREACH       byte = 3
+	SOCKS5_REP_HOSTUNREACH      byte = 4
+	SOCKS5_REP_REFUSED          byte = 5
+	SOCKS5_REP_CMDNOTSUPPORTED  byte = 7
+	SOCKS5_REP_ATYPNOTSUPPORTED byte = 8
+)
+
+// frontConn is local client connection, read from buffered reader of request
+type frontConn struct {
+	*net.TCPConn
+	rd *bufio.Reader
+}
+
+// Read read buffered bytes after request first
+func (fc *frontConn) Read(p []byte) (int, error) {
+	return fc.rd.Read(p)
+}
+
+// ListenSOCKS listen on addr for SOCKS5 client(assemble side)
+// CONNECT and UDP ASSOCIATE are supported, udpIdle is idle timeout of associated flow, 0 for CMTP_UDP_IDLE
+func (tf *CodecMixer) ListenSOCKS(addr string, udpIdle time.Duration) (net.Addr, error) {
+	nl, err := tf.listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	go tf.acceptFront(nl, func(conn *net.TCPConn) error {
+		return tf.serveSOCKS(conn, udpIdle)
+	})
+	return nl.Addr(), nil
+}
+
+// ListenHTTP listen on addr for HTTP CONNECT client(assemble side)
+func (tf *CodecMixer) ListenHTTP(addr string) (net.Addr, error) {
+	nl, err := tf.listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	go tf.acceptFront(nl, tf.serveHTTP)
+	return nl.Addr(), nil
+}
+
+// acceptFront (assamble side), running in goroutine, call serve for new client
+// client is closed if serve failed
+func (tf *CodecMixer) acceptFront(nl *net.TCPListener, serve func(conn *net.TCPConn) error) {
+	for {
+		rw, err := nl.AcceptTCP()
+		if err != nil {
+			fmt.Printf("acceptFront, %s, exit for accept failed: %s\n", nl.Addr().String(), err.Error())
+			return
+		}
+		go func() {
+			if err := serve(rw); err != nil {
+				fmt.Printf("acceptFront, %s, serve failed: %s\n", rw.RemoteAddr().String(), err.Error())
+				rw.Close()
+			}
+		}()
+	}
+}
+
+// serveSOCKS read SOCKS5 request and open session to destination
+func (tf *CodecMixer) serveSOCKS(conn *net.TCPConn, udpIdle time.Duration) error {
+	conn.SetDeadline(time.Now().Add(FRONTEND_TIMEOUT))
+	rd := bufio.NewReader(conn)
+	// greeting: VER NMETHODS METHODS
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(rd, hdr); err != nil {
+		return err
+	}
+	if hdr[0] != SOCKS5_VERSION {
+		return fmt.Errorf("SOCKS, unsupported version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(rd, methods); err != nil {
+		return err
+	}
+	if bytes.IndexByte(methods, SOCKS5_AUTH_NONE) < 0 {
+		conn.Write([]byte{SOCKS5_VERSION, SOCKS5_AUTH_NOACCEPT})
+		return errors.New("SOCKS, no acceptable auth method")
+	}
+	if _, err := conn.Write([]byte{SOCKS5_VERSION, SOCKS5_AUTH_NONE}); err != nil {
+		return err
+	}
+	// request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	req := make([]byte, 3)
+	if _, err := io.ReadFull(rd, req); err != nil {
+		return err
+	}
+	if req[0] != SOCKS5_VERSION {
+		writeSOCKSReply(conn, SOCKS5_REP_FAIL, nil)
+		return fmt.Errorf("SOCKS, unsupported request version %d", req[0])
+	}
+	dst, err := readSOCKSAddr(rd)
+	if err == errSOCKSAtyp {
+		writeSOCKSReply(conn, SOCKS5_REP_ATYPNOTSUPPORTED, nil)
+		return err
+	}
+	if err != nil {
+		// truncated request, closed without reply
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	switch req[1] {
+	case SOCKS5_CMD_CONNECT:
+		proto := NewTCPFilter(tf.key, dst)
+		proto.onReply = func(err error) error {
+			return writeSOCKSReply(conn, socksRep(err), nil)
+		}
+		return tf.newSession(&frontConn{TCPConn: conn, rd: rd}, proto)
+	case SOCKS5_CMD_ASSOCIATE:
+		return tf.serveAssociate(conn, rd, udpIdle)
+	}
+	writeSOCKSReply(conn, SOCKS5_REP_CMDNOTSUPPORTED, nil)
+	return fmt.Errorf("SOCKS, unsupported command %d", req[1])
+}
+
+// socksRep return SOCKS5 reply code of dial result
+func socksRep(err error) byte {
+	if err == nil {
+		return SOCKS5_REP_OK
+	}
+	mc, ok := err.(*CMsg)
+	if ok == false || mc.Code != IO_ERR_DIAL {
+		return SOCKS5_REP_FAIL
+	}
+	switch mc.Id {
+	case DIAL_ERR_REFUSED:
+		return SOCKS5_REP_REFUSED
+	case DIAL_ERR_HOSTUNREACH:
+		return SOCKS5_REP_HOSTUNREACH
+	case DIAL_ERR_NETUNREACH:
+		return SOCKS5_REP_NETUNREACH
+	}
+	return SOCKS5_REP_FAIL
+}
+
+// readSOCKSAddr return host:port of ATYP DST.ADDR DST.PORT
+// return errSOCKSAtyp for unknown ATYP, io error for truncated address
+func readSOCKSAddr(rd io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(rd, atyp); err != nil {
+		return "", err
+	}
+	var host []byte
+	switch atyp[0] {
+	case SOCKS5_ATYP_IPV4:
+		host = make([]byte, net.IPv4len)
+	case SOCKS5_ATYP_IPV6:
+		host = make([]byte, net.IPv6len)
+	case SOCKS5_ATYP_DOMAIN:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(rd, size); err != nil {
+			return "", err
+		}
+		host = make([]byte, size[0])
+	default:
+		return "", errSOCKSAtyp
+	}
+	if _, err := io.ReadFull(rd, host); err != nil {
+		return "", err
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(rd, port); err != nil {
+		return "", err
+	}
+	hoststr := string(host)
+	if atyp[0] != SOCKS5_ATYP_DOMAIN {
+		hoststr = net.IP(host).String()
+	}
+	return net.JoinHostPort(hoststr, strconv.Itoa(int(CMTP_ENDIAN.Uint16(port)))), nil
+}
+
+// socksAddr return ATYP DST.ADDR DST.PORT of host:port
+func socksAddr(addr string) []byte {
+	host, portstr, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, portstr = "0.0.0.0", "0"
+	}
+	port, _ := strconv.Atoi(portstr)
+	buf := make([]byte, 0, 4+len(host)+2)
+	if ip := net.ParseIP(host); ip == nil {
+		buf = append(buf, SOCKS5_ATYP_DOMAIN, byte(len(host)))
+		buf = append(buf, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		buf = append(buf, SOCKS5_ATYP_IPV4)
+		buf = append(buf, ip4...)
+	} else {
+		buf = append(buf, SOCKS5_ATYP_IPV6)
+		buf = append(buf, ip.To16()...)
+	}
+	return append(buf, byte(port>>8), byte(port))
+}
+
+// writeSOCKSReply write VER REP RSV ATYP BND.ADDR BND.PORT, nil bind for 0.0.0.0:0
+func writeSOCKSReply(conn net.Conn, rep byte, bind net.Addr) error {
+	addr := "0.0.0.0:0"
+	if bind != nil {
+		addr = bind.String()
+	}
+	buf := append([]byte{SOCKS5_VERSION, rep, 0}, socksAddr(addr)...)
+	_, err := conn.Write(buf)
+	return err
+}
+
+// serveAssociate relay datagram of SOCKS5 UDP ASSOCIATE
+// one session is opened for each destination, association is ended after control connection closed
+func (tf *CodecMixer) serveAssociate(conn *net.TCPConn, rd *bufio.Reader, udpIdle time.Duration) error {
+	local := conn.LocalAddr().(*net.TCPAddr)
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		writeSOCKSReply(conn, SOCKS5_REP_FAIL, nil)
+		return err
+	}
+	if err := writeSOCKSReply(conn, SOCKS5_REP_OK, relay.LocalAddr()); err != nil {
+		relay.Close()
+		return err
+	}
+	sa := &socksAssociate{
+		relay:  relay,
+		client: conn.RemoteAddr().(*net.TCPAddr).IP,
+		idle:   udpIdle,
+		flows:  make(map[string]*udpFlow),
+	}
+	go func() {
+		// control connection carry nothing after request
+		io.Copy(ioutil.Discard, rd)
+		sa.close()
+		conn.Close()
+	}()
+	go tf.relayAssociate(sa)
+	return nil
+}
+
+// socksAssociate is relay of SOCKS5 UDP ASSOCIATE
+type socksAssociate struct {
+	relay  *net.UDPConn        // relay socket replied to client
+	client net.IP              // datagram from other ip is dropped
+	from   *net.UDPAddr        // client addr:port of first datagram
+	idle   time.Duration       // idle timeout of flow
+	mutex  sync.Mutex          // lock for flows
+	flows  map[string]*udpFlow // running flow by destination
+}
+
+// close stop relay and end all flows
+func (sa *socksAssociate) close() {
+	sa.relay.Close()
+	sa.mutex.Lock()
+	flows := make([]*udpFlow, 0, len(sa.flows))
+	for _, f := range sa.flows {
+		flows = append(flows, f)
+	}
+	sa.mutex.Unlock()
+	for _, f := range flows {
+		f.Close()
+	}
+}
+
+// relayAssociate dispatch datagram of client to flow of destination, open session for new destination
+// datagram: RSV(2) FRAG ATYP DST.ADDR DST.PORT DATA, fragment is not supported
+func (tf *CodecMixer) relayAssociate(sa *socksAssociate) {
+	buf := make([]byte, UDP_MAX_DATAGRAM)
+	for {
+		n, raddr, err := sa.relay.ReadFromUDP(buf)
+		if err != nil {
+			fmt.Printf("relayAssociate, %s, exit for read failed: %s\n", sa.relay.LocalAddr().String(), err.Error())
+			sa.close()
+			return
+		}
+		if raddr.IP.Equal(sa.client) == false || n < 4 || buf[2] != 0 {
+			continue
+		}
+		if sa.from == nil {
+			sa.from = raddr
+		} else if raddr.String() != sa.from.String() {
+			continue
+		}
+		rd := bytes.NewReader(buf[3:n])
+		dst, err := readSOCKSAddr(rd)
+		if err != nil {
+			continue
+		}
+		data := make([]byte, rd.Len())
+		rd.Read(data)
+		sa.mutex.Lock()
+		f, ok := sa.flows[dst]
+		if ok == false {
+			header := append([]byte{0, 0, 0}, socksAddr(dst)...)
+			f = newUDPFlow(sa.relay.LocalAddr(), raddr, func(p []byte) (int, error) {
+				return sa.relay.WriteToUDP(append(header[:len(header):len(header)], p...), raddr)
+			}, func() {
+				sa.mutex.Lock()
+				delete(sa.flows, dst)
+				sa.mutex.Unlock()
+			}, sa.idle)
+			sa.flows[dst] = f
+		}
+		sa.mutex.Unlock()
+		f.push(data)
+		if ok == false {
+			if err := tf.newSession(f, NewUDPFilter(tf.key, dst, sa.idle)); err != nil {
+				fmt.Printf("relayAssociate, %s, new session failed: %s\n", dst, err.Error())
+				f.Close()
+			}
+		}
+	}
+}
+
+// serveHTTP read HTTP CONNECT request and open session to destination
+func (tf *CodecMixer) serveHTTP(conn *net.TCPConn) error {
+	conn.SetDeadline(time.Now().Add(FRONTEND_TIMEOUT))
+	rd := bufio.NewReader(conn)
+	req, err := http.ReadRequest(rd)
+	if err != nil {
+		return err
+	}
+	if req.Method != "CONNECT" {
+		io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\nConnection: close\r\n\r\n")
+		return fmt.Errorf("HTTP, unsupported method %s", req.Method)
+	}
+	if _, _, err := net.SplitHostPort(req.Host); err != nil {
+		io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n")
+		return fmt.Errorf("HTTP, invalid CONNECT host %s: %s", req.Host, err.Error())
+	}
+	conn.SetDeadline(time.Time{})
+	proto := NewTCPFilter(tf.key, req.Host)
+	proto.onReply = func(err error) error {
+		if err != nil {
+			_, werr := io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nConnection: close\r\n\r\n")
+			return werr
+		}
+		_, werr := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		return werr
+	}
+	return tf.newSession(&frontConn{TCPConn: conn, rd: rd}, proto)
+}
@@ -0,0 +1,263 @@
+package cmtp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// frontLoopback return SOCKS5 and HTTP CONNECT address of cmtp client/server
+func frontLoopback(t *testing.T) (string, string, func()) {
+	server, err := NewServer(&Config_t{Token: 9999, Listen: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatalf("new server: %s", err)
+	}
+	client, err := NewClient(&Config_t{
+		Token: 9999,
+		Peers: []string{server.Addrs()[0].String()},
+		Links: 2,
+		SOCKS: "127.0.0.1:0",
+		HTTP:  "127.0.0.1:0",
+	})
+	if err != nil {
+		server.Close()
+		t.Fatalf("new client: %s", err)
+	}
+	addrs := client.Addrs()
+	return addrs[0].String(), addrs[1].String(), func() {
+		client.Close()
+		server.Close()
+	}
+}
+
+// socksRequest send SOCKS5 request of cmd to dst, return reply code and bind address
+func socksRequest(conn net.Conn, cmd byte, dst string) (byte, string, error) {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write([]byte{SOCKS5_VERSION, 1, SOCKS5_AUTH_NONE}); err != nil {
+		return 0, "", err
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return 0, "", err
+	}
+	req := append([]byte{SOCKS5_VERSION, cmd, 0}, socksAddr(dst)...)
+	if _, err := conn.Write(req); err != nil {
+		return 0, "", err
+	}
+	rep := make([]byte, 3)
+	if _, err := io.ReadFull(conn, rep); err != nil {
+		return 0, "", err
+	}
+	bind, err := readSOCKSAddr(conn)
+	return rep[1], bind, err
+}
+
+func TestSOCKSConnect(t *testing.T) {
+	dest, stop := echoServer(t)
+	defer stop()
+	socks, _, closer := frontLoopback(t)
+	defer closer()
+
+	// domain destination is resolved by server
+	_, port, _ := net.SplitHostPort(dest)
+	for _, dst := range []string{dest, net.JoinHostPort("localhost", port)} {
+		conn, err := net.Dial("tcp", socks)
+		if err != nil {
+			t.Fatalf("dial: %s", err)
+		}
+		rep, _, err := socksRequest(conn, SOCKS5_CMD_CONNECT, dst)
+		if err != nil || rep != SOCKS5_REP_OK {
+			conn.Close()
+			t.Fatalf("connect %s: rep %d, %v", dst, rep, err)
+		}
+		data := bytes.Repeat([]byte("socks"), 10000)
+		go conn.Write(data)
+		buf := make([]byte, len(data))
+		_, err = io.ReadFull(conn, buf)
+		conn.Close()
+		if err != nil || bytes.Equal(buf, data) == false {
+			t.Fatalf("echo %s: %v", dst, err)
+		}
+	}
+
+	// nothing listening at destination
+	conn, err := net.Dial("tcp", socks)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer conn.Close()
+	rep, _, err := socksRequest(conn, SOCKS5_CMD_CONNECT, "127.0.0.1:1")
+	if err != nil || rep != SOCKS5_REP_REFUSED {
+		t.Fatalf("connect refused: rep %d, %v", rep, err)
+	}
+	checkClosed(t, conn, 5*time.Second)
+
+	// request of other version
+	conn, err = net.Dial("tcp", socks)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	conn.Write([]byte{SOCKS5_VERSION, 1, SOCKS5_AUTH_NONE})
+	io.ReadFull(conn, make([]byte, 2))
+	conn.Write(append([]byte{4, SOCKS5_CMD_CONNECT, 0}, socksAddr(dest)...))
+	resp := make([]byte, 3)
+	if _, err := io.ReadFull(conn, resp); err != nil || resp[1] != SOCKS5_REP_FAIL {
+		t.Fatalf("request version 4: rep %d, %v", resp[1], err)
+	}
+	checkClosed(t, conn, 5*time.Second)
+
+	// unknown address type
+	conn, err = net.Dial("tcp", socks)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	conn.Write([]byte{SOCKS5_VERSION, 1, SOCKS5_AUTH_NONE})
+	io.ReadFull(conn, make([]byte, 2))
+	conn.Write([]byte{SOCKS5_VERSION, SOCKS5_CMD_CONNECT, 0, 2, 127, 0, 0, 1, 0, 80})
+	if _, err := io.ReadFull(conn, resp); err != nil || resp[1] != SOCKS5_REP_ATYPNOTSUPPORTED {
+		t.Fatalf("address type 2: rep %d, %v", resp[1], err)
+	}
+	checkClosed(t, conn, 5*time.Second)
+
+	// truncated address, closed without reply
+	conn, err = net.Dial("tcp", socks)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	conn.Write([]byte{SOCKS5_VERSION, 1, SOCKS5_AUTH_NONE})
+	io.ReadFull(conn, make([]byte, 2))
+	conn.Write([]byte{SOCKS5_VERSION, SOCKS5_CMD_CONNECT, 0, SOCKS5_ATYP_IPV4, 127, 0})
+	conn.(*net.TCPConn).CloseWrite()
+	if n, err := conn.Read(resp); err != io.EOF {
+		t.Fatalf("truncated address: reply %v, %v", resp[:n], err)
+	}
+}
+
+func TestSOCKSRep(t *testing.T) {
+	_, err := net.DialTimeout("tcp", "127.0.0.1:1", time.Second)
+	if dialReason(err) != DIAL_ERR_REFUSED {
+		t.Fatalf("dial reason of %v: %d", err, dialReason(err))
+	}
+	for reason, rep := range map[uint64]byte{
+		DIAL_ERR_UNKNOWN:     SOCKS5_REP_FAIL,
+		DIAL_ERR_REFUSED:     SOCKS5_REP_REFUSED,
+		DIAL_ERR_HOSTUNREACH: SOCKS5_REP_HOSTUNREACH,
+		DIAL_ERR_NETUNREACH:  SOCKS5_REP_NETUNREACH,
+	} {
+		// reason survive dial reply
+		as, _, _ := filterPair("127.0.0.1:1", true, nil)
+		reply := as.marshalReply(&CMsg{Code: IO_ERR_DIAL, Id: reason, Err: errors.New("refused")})
+		var got error
+		as.onReply = func(err error) error {
+			got = err
+			return nil
+		}
+		buf, err := as.aes.Decrypt(nil, reply[as.hdrlen:])
+		if err != nil {
+			t.Fatalf("decrypt reply: %s", err)
+		}
+		as.recvReply(buf)
+		as.Close()
+		if socksRep(got) != rep {
+			t.Fatalf("reason %d: rep %d, should be %d", reason, socksRep(got), rep)
+		}
+	}
+	if socksRep(nil) != SOCKS5_REP_OK || socksRep(&CMsg{Code: IO_ERR_CLOSED}) != SOCKS5_REP_FAIL {
+		t.Fatalf("rep of non-dial error")
+	}
+}
+
+func TestSOCKSAssociate(t *testing.T) {
+	dest, stop := udpEchoServer(t)
+	defer stop()
+	socks, _, closer := frontLoopback(t)
+	defer closer()
+
+	conn, err := net.Dial("tcp", socks)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer conn.Close()
+	rep, bind, err := socksRequest(conn, SOCKS5_CMD_ASSOCIATE, "0.0.0.0:0")
+	if err != nil || rep != SOCKS5_REP_OK {
+		t.Fatalf("associate: rep %d, %v", rep, err)
+	}
+	uc, err := net.Dial("udp", bind)
+	if err != nil {
+		t.Fatalf("dial relay: %s", err)
+	}
+	defer uc.Close()
+	header := append([]byte{0, 0, 0}, socksAddr(dest)...)
+	buf := make([]byte, UDP_MAX_DATAGRAM)
+	for i, size := range []int{1, 1400, 8000} {
+		data := bytes.Repeat([]byte{byte(i)}, size)
+		for retry := 0; ; retry++ {
+			if _, err := uc.Write(append(header, data...)); err != nil {
+				t.Fatalf("write relay: %s", err)
+			}
+			uc.SetReadDeadline(time.Now().Add(time.Second))
+			n, err := uc.Read(buf)
+			if err != nil {
+				if retry < 5 {
+					continue
+				}
+				t.Fatalf("read relay: %s", err)
+			}
+			// reply carry destination as source
+			if bytes.Equal(buf[:len(header)], header) == false || bytes.Equal(buf[len(header):n], data) == false {
+				t.Fatalf("datagram %d mismatch, %d bytes", i, n)
+			}
+			break
+		}
+	}
+}
+
+func TestHTTPConnect(t *testing.T) {
+	dest, stop := echoServer(t)
+	defer stop()
+	_, proxy, closer := frontLoopback(t)
+	defer closer()
+
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	// data after request is forwarded
+	io.WriteString(conn, "CONNECT "+dest+" HTTP/1.1\r\nHost: "+dest+"\r\n\r\nhello")
+	rd := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(rd, nil)
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("connect: %v, %v", resp, err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(rd, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("echo: %q, %v", buf, err)
+	}
+
+	// nothing listening at destination
+	conn, err = net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	io.WriteString(conn, "CONNECT 127.0.0.1:1 HTTP/1.1\r\nHost: 127.0.0.1:1\r\n\r\n")
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || strings.Contains(line, "502") == false {
+		t.Fatalf("connect refused: %q, %v", line, err)
+	}
+}
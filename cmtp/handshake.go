@@ -0,0 +1,499 @@
+//
+// peer handshake for Common Multiplexing Transport Proxy (CMTP)
+//
+//
+
+package cmtp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// handshake between client(dial side) and server(accept side) of peer link
+// all messages are marshalled CMsg
+//
+// client -> server: HANDSHAKE_HELLO, Id: version, Msg: client nonce + "codec,codec;checksum,checksum"
+// server -> client: HANDSHAKE_CHALLENGE, Id: version, Msg: server nonce + server mixer nonce + "codec;checksum"
+// client -> server: HANDSHAKE_PROOF, Msg: client mixer nonce + client proof
+// server -> client: HANDSHAKE_OK, Msg: server proof
+//
+// version in CHALLENGE is min of client and server, HELLO is same for all versions,
+// mixer nonce is sent only for version 4 and later, FrameCodec is not negotiated for older version
+// server proof is sent only after client proof verified, client without token learn nothing can be checked offline
+//
+// proof = HMAC-SHA256(token key, role + client nonce + server nonce + client mixer nonce + server mixer nonce + version + "codec;checksum")
+// mixer nonce is same for all links of mixer, session secret = HMAC-SHA256(token key, "session" + client mixer nonce + server mixer nonce)
+// on failure, HANDSHAKE_ERR_* CMsg is sent to remote peer and connection closed
+//
+
+// protocol version of CMTP
+// version 2: per-session flow window(FRAME_MSGWINDOW)
+// version 3: link keepalive and ack(FRAME_LINKNOOP/FRAME_LINKACK)
+// version 4: mixer nonce in handshake for session key of FrameCodec
+// version 5: dial reply of session from disassemble side(TCPFilter)
+const CMTP_VERSION uint64 = 5
+
+// oldest protocol version accepted, feature of newer version is disabled for older peer, check CodecMixer.version
+const CMTP_MIN_VERSION uint64 = 1
+
+// timeout for whole handshake
+const HANDSHAKE_TIMEOUT time.Duration = 10e9
+
+// length of handshake nonce
+const HANDSHAKE_NONCELEN int = 16
+
+// handshake msg code and error code
+const (
+	HANDSHAKE_UNSET uint64 = 0xDD00 + iota
+	HANDSHAKE_HELLO
+	HANDSHAKE_CHALLENGE
+	HANDSHAKE_PROOF
+	HANDSHAKE_OK
+	HANDSHAKE_ERR_INVALID
+	HANDSHAKE_ERR_VERSION
+	HANDSHAKE_ERR_CODEC
+	HANDSHAKE_ERR_CHECKSUM
+	HANDSHAKE_ERR_TOKEN
+	HANDSHAKE_ERR_TIMEOUT
+	HANDSHAKE_LAST
+)
+
+// registered codec and checksum, used for negotiation
+var (
+	nameMutex  sync.Mutex
+	codecNames = map[string]Codec{
+		"noop":          NewNoopCodec(),
+		"snappy":        NewSnappyCodec(),
+		"aesgcm":        NewAESGCMCodec(NewNoopCodec()),
+		"snappy+aesgcm": NewAESGCMCodec(NewSnappyCodec()),
+	}
+	checksumNames = map[string]Checksum{"noop": NewNoopChecksum(0), "xxhash": NewXxhash(0), "murmur3": NewMurmur3(0)}
+)
+
+// RegisterCodec register codec by name for handshake negotiation
+func RegisterCodec(name string, codec Codec) {
+	nameMutex.Lock()
+	defer nameMutex.Unlock()
+	codecNames[name] = codec
+}
+
+// RegisterChecksum register checksum by name for handshake negotiation
+func RegisterChecksum(name string, checksum Checksum) {
+	nameMutex.Lock()
+	defer nameMutex.Unlock()
+	checksumNames[name] = checksum
+}
+
+// CodecByName return registered codec
+func CodecByName(name string) (Codec, bool) {
+	nameMutex.Lock()
+	defer nameMutex.Unlock()
+	codec, ok := codecNames[name]
+	return codec, ok
+}
+
+// ChecksumByName return registered checksum
+func ChecksumByName(name string) (Checksum, bool) {
+	nameMutex.Lock()
+	defer nameMutex.Unlock()
+	checksum, ok := checksumNames[name]
+	return checksum, ok
+}
+
+// codecName return registered name of codec, empty if not registered
+func codecName(codec Codec) string {
+	nameMutex.Lock()
+	defer nameMutex.Unlock()
+	for name, c := range codecNames {
+		if sameCodec(c, codec) {
+			return name
+		}
+	}
+	return ""
+}
+
+// sameCodec return true if a and b are same type, inner codec of wrapCodec is checked too
+func sameCodec(a, b Codec) bool {
+	if reflect.TypeOf(a) != reflect.TypeOf(b) {
+		return false
+	}
+	wa, ok := a.(wrapCodec)
+	if ok == false {
+		return true
+	}
+	return sameCodec(wa.Inner(), b.(wrapCodec).Inner())
+}
+
+// checksumName return registered name of checksum, empty if not registered
+func checksumName(checksum Checksum) string {
+	nameMutex.Lock()
+	defer nameMutex.Unlock()
+	for name, c := range checksumNames {
+		if reflect.TypeOf(c) == reflect.TypeOf(checksum) {
+			return name
+		}
+	}
+	return ""
+}
+
+// handshake result of peer link
+type handshakeInfo struct {
+	version  uint64 // negotiated version, min of client and server
+	codec    string // negotiated codec name
+	checksum string // negotiated checksum name
+	cnonce   []byte // client nonce
+	snonce   []byte // server nonce
+	cmixer   []byte // client mixer nonce
+	smixer   []byte // server mixer nonce
+	server   bool   // handshake as server
+}
+
+// SetHandshakeTimeout set timeout for whole peer handshake, default is HANDSHAKE_TIMEOUT
+func (tf *CodecMixer) SetHandshakeTimeout(timeout time.Duration) {
+	tf.mutex.Lock()
+	defer tf.mutex.Unlock()
+	if timeout <= 0 {
+		timeout = HANDSHAKE_TIMEOUT
+	}
+	tf.hsTimeout = timeout
+}
+
+// SetCodecs set codec names accepted in handshake, ordered by preference
+// default is name of codec passed to newCodecMixer
+func (tf *CodecMixer) SetCodecs(names ...string) error {
+	for _, name := range names {
+		if _, ok := CodecByName(name); ok == false {
+			return fmt.Errorf("codec %s not registered", name)
+		}
+	}
+	if len(names) == 0 {
+		return errors.New("empty codec list")
+	}
+	tf.mutex.Lock()
+	defer tf.mutex.Unlock()
+	tf.codecs = names
+	return nil
+}
+
+// SetChecksums set checksum names accepted in handshake, ordered by preference
+// default is name of checksum passed to newCodecMixer
+func (tf *CodecMixer) SetChecksums(names ...string) error {
+	for _, name := range names {
+		if _, ok := ChecksumByName(name); ok == false {
+			return fmt.Errorf("checksum %s not registered", name)
+		}
+	}
+	if len(names) == 0 {
+		return errors.New("empty checksum list")
+	}
+	tf.mutex.Lock()
+	defer tf.mutex.Unlock()
+	tf.checksums = names
+	return nil
+}
+
+// useCodec switch mixer to negotiated version, codec/checksum and session secret
+// codec of session is re-created after switched, session secret is changed after peer mixer restarted
+func (tf *CodecMixer) useCodec(hs *handshakeInfo) {
+	codec, _ := CodecByName(hs.codec)
+	checksum, _ := ChecksumByName(hs.checksum)
+	secret := sessionSecret(tf.key, hs.cmixer, hs.smixer)
+	tf.mutex.Lock()
+	defer tf.mutex.Unlock()
+	tf.version = hs.version
+	renew := false
+	if codecName(tf.codec) != hs.codec {
+		tf.codec = codec.New()
+		renew = true
+	}
+	if hmac.Equal(tf.sssecret, secret) == false || tf.hsServer != hs.server {
+		tf.sssecret = secret
+		tf.hsServer = hs.server
+		// sequence and replay window of control key restart only with new key
+		enckey, deckey := controlKeys(secret)
+		if hs.server {
+			enckey, deckey = deckey, enckey
+		}
+		ctrl, err := newCtrlAEAD(enckey, deckey, true)
+		if err != nil {
+			panic(fmt.Sprintf("control key failed: %s", err.Error()))
+		}
+		tf.ctrl = ctrl
+		renew = true
+	}
+	if renew {
+		for ssid, _ := range tf.sscodecList {
+			tf.sscodecList[ssid] = tf.newSessionCodec(ssid)
+		}
+	}
+	if checksumName(tf.checksum) != hs.checksum {
+		tf.checksum = checksum.New(0)
+	}
+}
+
+// handshakeProof return proof of token for role
+func (tf *CodecMixer) handshakeProof(role string, hs *handshakeInfo) []byte {
+	mac := hmac.New(sha256.New, tf.key)
+	mac.Write([]byte(role))
+	mac.Write(hs.cnonce)
+	mac.Write(hs.snonce)
+	mac.Write(hs.cmixer)
+	mac.Write(hs.smixer)
+	fmt.Fprintf(mac, "%d%s;%s", hs.version, hs.codec, hs.checksum)
+	return mac.Sum(nil)
+}
+
+// readCMsg read one marshalled CMsg from rd
+func readCMsg(rd io.Reader) (*CMsg, error) {
+	mc := &CMsg{}
+	buf := make([]byte, mc.MarshalSize(), mc.MarshalSize()+1024)
+	if _, err := io.ReadFull(rd, buf); err != nil {
+		return nil, err
+	}
+	size, err := mc.UnMarshalSize(buf)
+	if err != nil {
+		return nil, err
+	}
+	if size > cap(buf) {
+		return nil, fmt.Errorf("CMsg too large: %d > %d", size, cap(buf))
+	}
+	if _, err := io.ReadFull(rd, buf[len(buf):size]); err != nil {
+		return nil, err
+	}
+	if _, err := mc.UnMarshal(buf[:size]); err != nil {
+		return nil, err
+	}
+	return mc, nil
+}
+
+// writeCMsg write marshalled CMsg to w
+func writeCMsg(w io.Writer, mc *CMsg) error {
+	buf, err := mc.Marshal()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+// expectCMsg read one CMsg from rw, return error if code mismatch
+func expectCMsg(rw net.Conn, code uint64) (*CMsg, error) {
+	mc, err := readCMsg(rw)
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil, &CMsg{Code: HANDSHAKE_ERR_TIMEOUT, Err: fmt.Errorf("handshake timeout: %s", err.Error())}
+		}
+		return nil, &CMsg{Code: IO_ERR_READ, Err: fmt.Errorf("handshake read failed: %s", err.Error())}
+	}
+	if mc.Code == code {
+		return mc, nil
+	}
+	if mc.Code > HANDSHAKE_OK && mc.Code < HANDSHAKE_LAST {
+		// rejected by remote peer
+		return nil, &CMsg{Code: mc.Code, Err: fmt.Errorf("handshake rejected by remote peer: %s", mc.Msg)}
+	}
+	return nil, &CMsg{Code: HANDSHAKE_ERR_INVALID, Err: fmt.Errorf("handshake failed: unexpected msg code %x, should be %x", mc.Code, code)}
+}
+
+// handshakeFailed send error CMsg to remote peer and close rw
+func handshakeFailed(rw net.Conn, err error) error {
+	mc, ok := err.(*CMsg)
+	if ok == false {
+		mc = &CMsg{Code: HANDSHAKE_ERR_INVALID, Err: err}
+	}
+	if mc.Code != HANDSHAKE_ERR_TIMEOUT && mc.Code != IO_ERR_READ && mc.Code != IO_ERR_WRITE {
+		// tell remote peer why
+		rw.SetWriteDeadline(time.Now().Add(time.Second))
+		writeCMsg(rw, &CMsg{Code: mc.Code, Err: mc.Err})
+	}
+	rw.Close()
+	return mc
+}
+
+// newNonce return random nonce
+func newNonce() []byte {
+	nonce := make([]byte, HANDSHAKE_NONCELEN)
+	if _, err := rand.Read(nonce); err != nil {
+		panic(fmt.Sprintf("handshake nonce failed: %s", err.Error()))
+	}
+	return nonce
+}
+
+// pickName return first name of prefer in offer
+func pickName(prefer []string, offer []string) string {
+	for _, name := range prefer {
+		for _, o := range offer {
+			if name == o {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// hsConfig return timeout and accepted codec/checksum names
+func (tf *CodecMixer) hsConfig() (time.Duration, []string, []string) {
+	tf.mutex.Lock()
+	defer tf.mutex.Unlock()
+	return tf.hsTimeout, tf.codecs, tf.checksums
+}
+
+// hsMaxVersion return max protocol version offered in handshake
+func (tf *CodecMixer) hsMaxVersion() uint64 {
+	tf.mutex.Lock()
+	defer tf.mutex.Unlock()
+	return tf.hsVersion
+}
+
+// peerVersion return protocol version negotiated with peer mixer
+func (tf *CodecMixer) peerVersion() uint64 {
+	tf.mutex.Lock()
+	defer tf.mutex.Unlock()
+	return tf.version
+}
+
+// plainCodecs return codec names not implemented FrameCodec
+// FrameCodec need session secret from mixer nonce, not negotiated with peer older than version 4
+func plainCodecs(names []string) []string {
+	list := make([]string, 0, len(names))
+	for _, name := range names {
+		codec, _ := CodecByName(name)
+		if _, ok := codec.(FrameCodec); ok == false {
+			list = append(list, name)
+		}
+	}
+	return list
+}
+
+// serverHandshake do server side handshake
+func (tf *CodecMixer) serverHandshake(rw net.Conn, codecs, checksums []string) (*handshakeInfo, error) {
+	mc, err := expectCMsg(rw, HANDSHAKE_HELLO)
+	if err != nil {
+		return nil, err
+	}
+	if mc.Id < CMTP_MIN_VERSION || len(mc.Msg) < HANDSHAKE_NONCELEN {
+		return nil, &CMsg{Code: HANDSHAKE_ERR_VERSION, Err: fmt.Errorf("handshake failed: unsupported version %d, accept %d - %d", mc.Id, CMTP_MIN_VERSION, CMTP_VERSION)}
+	}
+	hs := &handshakeInfo{
+		version: mc.Id,
+		cnonce:  append([]byte(nil), mc.Msg[:HANDSHAKE_NONCELEN]...),
+		snonce:  newNonce(),
+		server:  true,
+	}
+	if max := tf.hsMaxVersion(); hs.version > max {
+		hs.version = max
+	}
+	if hs.version >= 4 {
+		hs.smixer = tf.nonce
+	} else {
+		codecs = plainCodecs(codecs)
+	}
+	offer := strings.SplitN(string(mc.Msg[HANDSHAKE_NONCELEN:]), ";", 2)
+	if len(offer) != 2 {
+		return nil, &CMsg{Code: HANDSHAKE_ERR_INVALID, Err: errors.New("handshake failed: invalid hello msg")}
+	}
+	hs.codec = pickName(codecs, strings.Split(offer[0], ","))
+	if hs.codec == "" {
+		return nil, &CMsg{Code: HANDSHAKE_ERR_CODEC, Err: fmt.Errorf("handshake failed: no common codec in %s, accept %s", offer[0], strings.Join(codecs, ","))}
+	}
+	hs.checksum = pickName(checksums, strings.Split(offer[1], ","))
+	if hs.checksum == "" {
+		return nil, &CMsg{Code: HANDSHAKE_ERR_CHECKSUM, Err: fmt.Errorf("handshake failed: no common checksum in %s, accept %s", offer[1], strings.Join(checksums, ","))}
+	}
+	msg := append([]byte(nil), hs.snonce...)
+	msg = append(msg, hs.smixer...)
+	msg = append(msg, hs.codec+";"+hs.checksum...)
+	if err := writeCMsg(rw, &CMsg{Code: HANDSHAKE_CHALLENGE, Id: hs.version, Msg: msg}); err != nil {
+		return nil, &CMsg{Code: IO_ERR_WRITE, Err: fmt.Errorf("handshake write failed: %s", err.Error())}
+	}
+	mc, err = expectCMsg(rw, HANDSHAKE_PROOF)
+	if err != nil {
+		return nil, err
+	}
+	proof := mc.Msg
+	if hs.version >= 4 {
+		if len(mc.Msg) < HANDSHAKE_NONCELEN {
+			return nil, &CMsg{Code: HANDSHAKE_ERR_INVALID, Err: errors.New("handshake failed: invalid proof msg")}
+		}
+		hs.cmixer = append([]byte(nil), mc.Msg[:HANDSHAKE_NONCELEN]...)
+		proof = mc.Msg[HANDSHAKE_NONCELEN:]
+	}
+	if hmac.Equal(proof, tf.handshakeProof("client", hs)) == false {
+		return nil, &CMsg{Code: HANDSHAKE_ERR_TOKEN, Err: errors.New("handshake failed: token mismatch")}
+	}
+	if err := writeCMsg(rw, &CMsg{Code: HANDSHAKE_OK, Id: hs.version, Msg: tf.handshakeProof("server", hs)}); err != nil {
+		return nil, &CMsg{Code: IO_ERR_WRITE, Err: fmt.Errorf("handshake write failed: %s", err.Error())}
+	}
+	return hs, nil
+}
+
+// clientHandshake do client side handshake
+func (tf *CodecMixer) clientHandshake(rw net.Conn, codecs, checksums []string) (*handshakeInfo, error) {
+	hs := &handshakeInfo{
+		version: tf.hsMaxVersion(),
+		cnonce:  newNonce(),
+	}
+	msg := append([]byte(nil), hs.cnonce...)
+	msg = append(msg, strings.Join(codecs, ",")+";"+strings.Join(checksums, ",")...)
+	if err := writeCMsg(rw, &CMsg{Code: HANDSHAKE_HELLO, Id: hs.version, Msg: msg}); err != nil {
+		return nil, &CMsg{Code: IO_ERR_WRITE, Err: fmt.Errorf("handshake write failed: %s", err.Error())}
+	}
+	mc, err := expectCMsg(rw, HANDSHAKE_CHALLENGE)
+	if err != nil {
+		return nil, err
+	}
+	if mc.Id < CMTP_MIN_VERSION || mc.Id > hs.version {
+		return nil, &CMsg{Code: HANDSHAKE_ERR_VERSION, Err: fmt.Errorf("handshake failed: unsupported version %d, accept %d - %d", mc.Id, CMTP_MIN_VERSION, hs.version)}
+	}
+	hs.version = mc.Id
+	noncelen := HANDSHAKE_NONCELEN
+	if hs.version >= 4 {
+		noncelen += HANDSHAKE_NONCELEN
+	}
+	if len(mc.Msg) < noncelen {
+		return nil, &CMsg{Code: HANDSHAKE_ERR_INVALID, Err: errors.New("handshake failed: invalid challenge msg")}
+	}
+	hs.snonce = append([]byte(nil), mc.Msg[:HANDSHAKE_NONCELEN]...)
+	if hs.version >= 4 {
+		hs.cmixer = tf.nonce
+		hs.smixer = append([]byte(nil), mc.Msg[HANDSHAKE_NONCELEN:noncelen]...)
+	} else {
+		codecs = plainCodecs(codecs)
+	}
+	picked := strings.SplitN(string(mc.Msg[noncelen:]), ";", 2)
+	if len(picked) != 2 {
+		return nil, &CMsg{Code: HANDSHAKE_ERR_INVALID, Err: errors.New("handshake failed: invalid challenge msg")}
+	}
+	hs.codec, hs.checksum = picked[0], picked[1]
+	if pickName([]string{hs.codec}, codecs) == "" {
+		return nil, &CMsg{Code: HANDSHAKE_ERR_CODEC, Err: fmt.Errorf("handshake failed: server picked codec %s not in %s", hs.codec, strings.Join(codecs, ","))}
+	}
+	if pickName([]string{hs.checksum}, checksums) == "" {
+		return nil, &CMsg{Code: HANDSHAKE_ERR_CHECKSUM, Err: fmt.Errorf("handshake failed: server picked checksum %s not in %s", hs.checksum, strings.Join(checksums, ","))}
+	}
+	msg = append([]byte(nil), hs.cmixer...)
+	msg = append(msg, tf.handshakeProof("client", hs)...)
+	if err := writeCMsg(rw, &CMsg{Code: HANDSHAKE_PROOF, Id: hs.version, Msg: msg}); err != nil {
+		return nil, &CMsg{Code: IO_ERR_WRITE, Err: fmt.Errorf("handshake write failed: %s", err.Error())}
+	}
+	mc, err = expectCMsg(rw, HANDSHAKE_OK)
+	if err != nil {
+		return nil, err
+	}
+	// server picked codec is covered by proof
+	if hmac.Equal(mc.Msg, tf.handshakeProof("server", hs)) == false {
+		return nil, &CMsg{Code: HANDSHAKE_ERR_TOKEN, Err: errors.New("handshake failed: token mismatch")}
+	}
+	return hs, nil
+}
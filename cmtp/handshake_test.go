@@ -0,0 +1,200 @@
+package cmtp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// handshake run server/client handshake over pipe, return server error and client error
+func handshake(server, client *CodecMixer) (error, error) {
+	sc, cc := net.Pipe()
+	defer sc.Close()
+	defer cc.Close()
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := server.peerServerHandshake(sc)
+		errCh <- err
+	}()
+	_, cerr := client.peerClientHandshake(cc)
+	return <-errCh, cerr
+}
+
+func handshakeCode(err error) uint64 {
+	if mc, ok := err.(*CMsg); ok {
+		return mc.Code
+	}
+	return 0
+}
+
+func TestHandshake(t *testing.T) {
+	server := newCodecMixer(1234, NewNoopCodec(), NewXxhash(0), nil)
+	client := newCodecMixer(1234, NewSnappyCodec(), NewXxhash(0), nil)
+	server.SetCodecs("snappy", "noop")
+	client.SetCodecs("noop", "snappy")
+	serr, cerr := handshake(server, client)
+	if serr != nil || cerr != nil {
+		t.Fatalf("handshake failed: server %v, client %v", serr, cerr)
+	}
+	// server preference wins
+	if codecName(client.codec) != "snappy" || codecName(server.codec) != "snappy" {
+		t.Fatalf("negotiated codec mismatch: server %s, client %s", codecName(server.codec), codecName(client.codec))
+	}
+
+	// token mismatch
+	client = newCodecMixer(4321, NewNoopCodec(), NewXxhash(0), nil)
+	serr, cerr = handshake(server, client)
+	if handshakeCode(cerr) != HANDSHAKE_ERR_TOKEN || handshakeCode(serr) != HANDSHAKE_ERR_TOKEN {
+		t.Fatalf("token mismatch should fail: server %v, client %v", serr, cerr)
+	}
+
+	// no common checksum
+	client = newCodecMixer(1234, NewNoopCodec(), NewMurmur3(0), nil)
+	serr, cerr = handshake(server, client)
+	if handshakeCode(serr) != HANDSHAKE_ERR_CHECKSUM || handshakeCode(cerr) != HANDSHAKE_ERR_CHECKSUM {
+		t.Fatalf("checksum mismatch should fail: server %v, client %v", serr, cerr)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	server := newCodecMixer(1234, NewNoopCodec(), NewXxhash(0), nil)
+	server.SetHandshakeTimeout(100 * time.Millisecond)
+	sc, cc := net.Pipe()
+	defer cc.Close()
+	_, err := server.peerServerHandshake(sc)
+	if handshakeCode(err) != HANDSHAKE_ERR_TIMEOUT {
+		t.Fatalf("silent client should timeout: %v", err)
+	}
+	// connection closed by server
+	if _, err := cc.Write([]byte{0}); err == nil {
+		t.Fatalf("connection should be closed after handshake failed")
+	}
+}
+
+func TestHandshakeSessionKey(t *testing.T) {
+	server := newCodecMixer(1234, NewAESGCMCodec(NewSnappyCodec()), NewXxhash(0), nil)
+	client := newCodecMixer(1234, NewAESGCMCodec(NewSnappyCodec()), NewXxhash(0), nil)
+	defer server.Close()
+	defer client.Close()
+	serr, cerr := handshake(server, client)
+	if serr != nil || cerr != nil {
+		t.Fatalf("handshake failed: server %v, client %v", serr, cerr)
+	}
+	if codecName(client.codec) != "snappy+aesgcm" {
+		t.Fatalf("negotiated codec mismatch: %s", codecName(client.codec))
+	}
+	client.initssid(5)
+	server.initssid(5)
+	enc := client.sessionCodec(5).(FrameCodec)
+	dec := server.sessionCodec(5).(FrameCodec)
+	aad := []byte("header")
+	buf := make([]byte, enc.MaxEncodedLen(5))
+	p, err := enc.EncodeFrame(buf, []byte("hello"), aad, 2)
+	if err != nil {
+		t.Fatalf("encode failed: %s", err)
+	}
+	out := make([]byte, 5)
+	if p, err = dec.DecodeFrame(out, p, aad, 2); err != nil || string(p) != "hello" {
+		t.Fatalf("decode failed: %q, %v", p, err)
+	}
+
+	// peer mixer restarted, new session secret
+	other := newCodecMixer(1234, NewAESGCMCodec(NewSnappyCodec()), NewXxhash(0), nil)
+	defer other.Close()
+	if serr, cerr = handshake(server, other); serr != nil || cerr != nil {
+		t.Fatalf("handshake failed: server %v, client %v", serr, cerr)
+	}
+	other.initssid(5)
+	p, _ = other.sessionCodec(5).(FrameCodec).EncodeFrame(buf, []byte("hello"), aad, 2)
+	if _, err = server.sessionCodec(5).(FrameCodec).DecodeFrame(out, p, aad, 2); err != nil {
+		t.Fatalf("decode after peer restarted failed: %s", err)
+	}
+}
+
+func TestHandshakeNoServerProof(t *testing.T) {
+	server := newCodecMixer(1234, NewNoopCodec(), NewXxhash(0), nil)
+	defer server.Close()
+	sc, cc := net.Pipe()
+	defer cc.Close()
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := server.peerServerHandshake(sc)
+		errCh <- err
+	}()
+	// client without token
+	cnonce := newNonce()
+	msg := append(append([]byte(nil), cnonce...), "noop;xxhash"...)
+	if err := writeCMsg(cc, &CMsg{Code: HANDSHAKE_HELLO, Id: CMTP_VERSION, Msg: msg}); err != nil {
+		t.Fatalf("write hello failed: %s", err)
+	}
+	challenge, err := readCMsg(cc)
+	if err != nil || challenge.Code != HANDSHAKE_CHALLENGE {
+		t.Fatalf("read challenge failed: %v, %v", challenge, err)
+	}
+	hs := &handshakeInfo{
+		version:  challenge.Id,
+		codec:    "noop",
+		checksum: "xxhash",
+		cnonce:   cnonce,
+		snonce:   challenge.Msg[:HANDSHAKE_NONCELEN],
+		cmixer:   make([]byte, HANDSHAKE_NONCELEN),
+		smixer:   challenge.Msg[HANDSHAKE_NONCELEN : HANDSHAKE_NONCELEN*2],
+	}
+	proof := server.handshakeProof("server", hs)
+	if bytes.Contains(challenge.Msg, proof) || len(challenge.Msg) != HANDSHAKE_NONCELEN*2+len("noop;xxhash") {
+		t.Fatalf("server proof sent before client verified: %x", challenge.Msg)
+	}
+	if err := writeCMsg(cc, &CMsg{Code: HANDSHAKE_PROOF, Id: hs.version, Msg: make([]byte, HANDSHAKE_NONCELEN+len(proof))}); err != nil {
+		t.Fatalf("write proof failed: %s", err)
+	}
+	reply, err := readCMsg(cc)
+	if err != nil || reply.Code != HANDSHAKE_ERR_TOKEN {
+		t.Fatalf("wrong proof should be rejected: %v, %v", reply, err)
+	}
+	if bytes.Contains(reply.Msg, proof) {
+		t.Fatalf("server proof sent to client without token")
+	}
+	if err := <-errCh; handshakeCode(err) != HANDSHAKE_ERR_TOKEN {
+		t.Fatalf("server should fail with token mismatch: %v", err)
+	}
+}
+
+func TestHandshakeVersion(t *testing.T) {
+	server := newCodecMixer(1234, NewAESGCMCodec(NewSnappyCodec()), NewXxhash(0), nil)
+	client := newCodecMixer(1234, NewAESGCMCodec(NewSnappyCodec()), NewXxhash(0), nil)
+	defer server.Close()
+	defer client.Close()
+	server.SetCodecs("snappy+aesgcm", "snappy")
+	client.SetCodecs("snappy+aesgcm", "snappy")
+	for version := CMTP_MIN_VERSION; version <= CMTP_VERSION; version++ {
+		server.mutex.Lock()
+		server.hsVersion = version
+		server.mutex.Unlock()
+		serr, cerr := handshake(server, client)
+		if serr != nil || cerr != nil {
+			t.Fatalf("version %d, handshake failed: server %v, client %v", version, serr, cerr)
+		}
+		if client.peerVersion() != version || server.peerVersion() != version {
+			t.Fatalf("version %d, negotiated client %d, server %d", version, client.peerVersion(), server.peerVersion())
+		}
+		// no session secret without mixer nonce
+		codec := "snappy+aesgcm"
+		if version < 4 {
+			codec = "snappy"
+		}
+		if codecName(client.codec) != codec || codecName(server.codec) != codec {
+			t.Fatalf("version %d, negotiated codec server %s, client %s, should be %s", version, codecName(server.codec), codecName(client.codec), codec)
+		}
+	}
+
+	// only FrameCodec
+	server.mutex.Lock()
+	server.hsVersion = 3
+	server.mutex.Unlock()
+	client.SetCodecs("snappy+aesgcm")
+	serr, cerr := handshake(server, client)
+	if handshakeCode(serr) != HANDSHAKE_ERR_CODEC || handshakeCode(cerr) != HANDSHAKE_ERR_CODEC {
+		t.Fatalf("FrameCodec should not be negotiated for version 3: server %v, client %v", serr, cerr)
+	}
+}
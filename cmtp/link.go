@@ -0,0 +1,449 @@
+//
+// link keepalive and failover for Common Multiplexing Transport Proxy (CMTP)
+//
+// FRAME_LINKNOOP is sent every keepalive interval on each link, peer reply FRAME_LINKACK on same link,
+// link without any frame received in keepalive timeout is dead.
+// FRAME_LINKACK carry number of frames received from link(index is noop sequence for RTT, 0 for plain ack),
+// frames written to link are kept until acked, and retransmitted on remaining links after link failed.
+// link dialed by DialPeer is redialed with backoff.
+// peer older than version 3 never ack, keepalive and ack is disabled for it.
+//
+
+//
+package cmtp
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// interval of FRAME_LINKNOOP
+const CMTP_LINK_KEEPALIVE time.Duration = 1e9
+
+// link without frame received in CMTP_LINK_TIMEOUT is dead
+const CMTP_LINK_TIMEOUT time.Duration = 5e9
+
+// send FRAME_LINKACK after CMTP_ACK_FRAMES frames received
+const CMTP_ACK_FRAMES uint64 = 32
+
+// min/max delay of redial
+const (
+	CMTP_REDIAL_MIN time.Duration = 1e8
+	CMTP_REDIAL_MAX time.Duration = 30e9
+)
+
+// LinkStat_t is statistics of one mixer link
+type LinkStat_t struct {
+	Id          int           // link id
+	Local       string        // local address
+	Remote      string        // remote address
+	RTT         time.Duration // round trip time of last FRAME_LINKNOOP
+	TxBytes     uint64        // bytes written
+	RxBytes     uint64        // bytes read
+	Retransmits uint64        // frames retransmitted on this link
+	Unacked     int           // frames written and not acked
+	Queued      int           // bytes queued by scheduler and not written
+	Throughput  uint64        // bytes/second of write, moving average
+}
+
+// mixerLink is one underlay io between peers
+type mixerLink struct {
+	id          int                // link id
+	rw          io.ReadWriteCloser // underlay io
+	addr        string             // dialed peer address for redial, empty for accepted link
+	ctrlCh      chan *mixerFrame   // FRAME_LINKNOOP/FRAME_LINKACK of this link
+	fastCh      chan *mixerFrame   // small frames dispatched by scheduler
+	dataCh      chan *mixerFrame   // frames dispatched by scheduler
+	local       string             // local address
+	remote      string             // remote address
+	closed      chan struct{}      // link closed
+	mutex       sync.Mutex         // lock for ack and stats
+	unacked     []*mixerFrame      // written frames waiting for ack
+	acked       uint64             // frames acked by peer
+	received    uint64             // frames read
+	ackSent     uint64             // received in last FRAME_LINKACK
+	noopSeq     uint64             // sequence of last FRAME_LINKNOOP
+	noopTime    time.Time          // send time of last FRAME_LINKNOOP
+	lastRecv    time.Time          // time of last frame read
+	queued      int                // bytes in fastCh and dataCh
+	throughput  uint64             // bytes/second of write, moving average
+	rtt         time.Duration      //
+	txBytes     uint64             //
+	rxBytes     uint64             //
+	retransmits uint64             //
+	noAck       bool               // peer never send FRAME_LINKNOOP/FRAME_LINKACK
+	aead        *ctrlAEAD          // seal link frame when codec is FrameCodec, keyed by handshake of link
+}
+
+// newMixerLink return *mixerLink
+func newMixerLink(id int, rw io.ReadWriteCloser, addr string) *mixerLink {
+	l := &mixerLink{
+		id:       id,
+		rw:       rw,
+		addr:     addr,
+		ctrlCh:   make(chan *mixerFrame, CHANNEL_INIT_SIZE),
+		fastCh:   make(chan *mixerFrame, CMTP_LINK_QUEUE),
+		dataCh:   make(chan *mixerFrame, CMTP_LINK_QUEUE),
+		closed:   make(chan struct{}),
+		lastRecv: time.Now(),
+	}
+	if conn, ok := rw.(net.Conn); ok {
+		l.local = conn.LocalAddr().String()
+		l.remote = conn.RemoteAddr().String()
+	}
+	return l
+}
+
+// isLinkFrame return true if frame is handled by link, not tracked by ack
+func isLinkFrame(frametype uint64) bool {
+	return frametype > FRAME_LINKSTART && frametype < FRAME_LINKLAST
+}
+
+// close close underlay io, return false if already closed
+func (l *mixerLink) close() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	select {
+	case <-l.closed:
+		return false
+	default:
+	}
+	close(l.closed)
+	l.rw.Close()
+	return true
+}
+
+// enqueue queue frame dispatched by scheduler, small frame to fastCh
+// return false if link closed or queue full
+func (l *mixerLink) enqueue(mf *mixerFrame) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	select {
+	case <-l.closed:
+		return false
+	default:
+	}
+	ch := l.dataCh
+	if mf.payloadlen < CMTP_SMALL_PKG_SIZE {
+		ch = l.fastCh
+	}
+	select {
+	case ch <- mf:
+		l.queued += mf.frameptr
+		return true
+	default:
+	}
+	return false
+}
+
+// dequeued record frame fetched from fastCh/dataCh
+func (l *mixerLink) dequeued(mf *mixerFrame) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.queued -= mf.frameptr
+}
+
+// drainQueue return frames in fastCh and dataCh of closed link
+func (l *mixerLink) drainQueue() []*mixerFrame {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	frames := make([]*mixerFrame, 0, len(l.fastCh)+len(l.dataCh))
+	for {
+		select {
+		case mf := <-l.fastCh:
+			frames = append(frames, mf)
+		case mf := <-l.dataCh:
+			frames = append(frames, mf)
+		default:
+			l.queued = 0
+			return frames
+		}
+	}
+}
+
+// written record frame written to link in duration
+// return false if frame is not kept for ack, caller should recycle it
+func (l *mixerLink) written(mf *mixerFrame, duration time.Duration) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.txBytes += uint64(mf.frameptr)
+	if duration > 0 {
+		rate := uint64(float64(mf.frameptr) / duration.Seconds())
+		if l.throughput == 0 {
+			l.throughput = rate
+		} else {
+			l.throughput = l.throughput - l.throughput/8 + rate/8
+		}
+	}
+	if mf.resend {
+		l.retransmits++
+		mf.resend = false
+	}
+	if isLinkFrame(mf.frametype) || l.noAck {
+		return false
+	}
+	l.unacked = append(l.unacked, mf)
+	return true
+}
+
+// recv record frame read from link
+// return true if FRAME_LINKACK should be sent
+func (l *mixerLink) recv(mf *mixerFrame) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.lastRecv = time.Now()
+	l.rxBytes += uint64(mf.frameptr)
+	if isLinkFrame(mf.frametype) || l.noAck {
+		return false
+	}
+	l.received++
+	return l.received-l.ackSent >= CMTP_ACK_FRAMES
+}
+
+// ack release frames acked by peer, return them for recycle
+func (l *mixerLink) ack(received uint64) []*mixerFrame {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	n := 0
+	for l.acked < received && n < len(l.unacked) {
+		l.acked++
+		n++
+	}
+	frames := l.unacked[:n]
+	l.unacked = l.unacked[n:]
+	return frames
+}
+
+// drain return all unacked frames
+func (l *mixerLink) drain() []*mixerFrame {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	frames := l.unacked
+	l.unacked = nil
+	return frames
+}
+
+// stat return LinkStat_t of link
+func (l *mixerLink) stat() LinkStat_t {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return LinkStat_t{
+		Id:          l.id,
+		Local:       l.local,
+		Remote:      l.remote,
+		RTT:         l.rtt,
+		TxBytes:     l.txBytes,
+		RxBytes:     l.rxBytes,
+		Retransmits: l.retransmits,
+		Unacked:     len(l.unacked),
+		Queued:      l.queued,
+		Throughput:  l.throughput,
+	}
+}
+
+// sendLink queue link frame to ctrlCh of link, dropped if ctrlCh full
+func (tf *CodecMixer) sendLink(link *mixerLink, frametype, index uint64, mc *CMsg) {
+	var aead *ctrlAEAD
+	if tf.sealCtrl() {
+		aead = link.aead
+	}
+	mf, err := tf.ctrlFrame(frametype, INIT_SSID, index, mc, aead)
+	if err != nil {
+		fmt.Printf("link#%d, marshal frame %d failed: %s\n", link.id, frametype, err.Error())
+		return
+	}
+	select {
+	case link.ctrlCh <- mf:
+	default:
+		tf.putFrame(mf)
+	}
+}
+
+// sendNoop send FRAME_LINKNOOP for RTT
+func (tf *CodecMixer) sendNoop(link *mixerLink) {
+	link.mutex.Lock()
+	link.noopSeq++
+	link.noopTime = time.Now()
+	seq := link.noopSeq
+	link.mutex.Unlock()
+	tf.sendLink(link, FRAME_LINKNOOP, seq, &CMsg{})
+}
+
+// sendAck send FRAME_LINKACK with frames received, index is sequence of FRAME_LINKNOOP replied
+func (tf *CodecMixer) sendAck(link *mixerLink, index uint64) {
+	link.mutex.Lock()
+	link.ackSent = link.received
+	received := link.received
+	link.mutex.Unlock()
+	tf.sendLink(link, FRAME_LINKACK, index, &CMsg{Id: received})
+}
+
+// recvLink handle link frame from peer
+func (tf *CodecMixer) recvLink(link *mixerLink, mf *mixerFrame) {
+	switch mf.frametype {
+	case FRAME_LINKNOOP:
+		tf.sendAck(link, mf.index)
+	case FRAME_LINKACK:
+		mc := &CMsg{}
+		if _, err := mc.UnMarshal(mf.framebuf[mf.hdrlen:mf.frameptr]); err != nil {
+			fmt.Printf("readLoop#%d, invalid ack: %s\n", link.id, err.Error())
+			return
+		}
+		for _, af := range link.ack(mc.Id) {
+			tf.putFrame(af)
+		}
+		if mf.index == 0 {
+			return
+		}
+		link.mutex.Lock()
+		if mf.index == link.noopSeq {
+			link.rtt = time.Since(link.noopTime)
+		}
+		link.mutex.Unlock()
+	}
+}
+
+// keepLoop send FRAME_LINKNOOP and close dead link
+func (tf *CodecMixer) keepLoop(link *mixerLink) {
+	if link.noAck {
+		return
+	}
+	tf.mutex.Lock()
+	interval, timeout := tf.keepalive, tf.keeptimeout
+	tf.mutex.Unlock()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	tf.sendNoop(link)
+	for {
+		select {
+		case <-ticker.C:
+		case <-link.closed:
+			return
+		case <-tf.closing:
+			return
+		}
+		link.mutex.Lock()
+		idle := time.Since(link.lastRecv)
+		link.mutex.Unlock()
+		if idle > timeout {
+			fmt.Printf("keepLoop#%d, %s, dead link, no frame in %v\n", link.id, link.addr, idle)
+			tf.delLink(link)
+			return
+		}
+		tf.sendNoop(link)
+	}
+}
+
+// delLink remove link from running links
+func (tf *CodecMixer) delLink(link *mixerLink) {
+	if link.close() == false {
+		return
+	}
+	tf.mutex.Lock()
+	for i, l := range tf.links {
+		if l == link {
+			tf.links = append(tf.links[:i], tf.links[i+1:]...)
+			break
+		}
+	}
+	if len(tf.links) == 0 {
+		tf.unlinked = time.Now()
+	}
+	tf.mutex.Unlock()
+	tf.notifyLink()
+}
+
+// requeue send frame to remaining links, frame of failed link is dropped
+// resend is true for frame already written to failed link
+func (tf *CodecMixer) requeue(mf *mixerFrame, resend bool) {
+	if isLinkFrame(mf.frametype) {
+		tf.putFrame(mf)
+		return
+	}
+	mf.resend = resend
+	ch := tf.assembleCh
+	if mf.payloadlen < CMTP_SMALL_PKG_SIZE {
+		ch = tf.assembleFastCh
+	}
+	select {
+	case ch <- mf:
+	case <-tf.closing:
+		tf.putFrame(mf)
+	}
+}
+
+// resend retransmit unacked frames of failed link, and dispatch queued frames to other links
+func (tf *CodecMixer) resend(link *mixerLink) {
+	frames := link.drain()
+	queued := link.drainQueue()
+	select {
+	case <-tf.closing:
+		for _, mf := range append(frames, queued...) {
+			tf.putFrame(mf)
+		}
+		return
+	default:
+	}
+	if len(frames) > 0 {
+		fmt.Printf("link#%d, retransmit %d unacked frames\n", link.id, len(frames))
+	}
+	for _, mf := range frames {
+		tf.requeue(mf, true)
+	}
+	for _, mf := range queued {
+		tf.requeue(mf, false)
+	}
+}
+
+// redial dial addr until success or mixer closed
+func (tf *CodecMixer) redial(addr string) {
+	for delay := CMTP_REDIAL_MIN; ; delay += delay {
+		if delay > CMTP_REDIAL_MAX {
+			delay = CMTP_REDIAL_MAX
+		}
+		select {
+		case <-time.After(delay):
+		case <-tf.closing:
+			return
+		}
+		err := tf.DialPeer(addr)
+		if err == nil {
+			return
+		}
+		fmt.Printf("redial %s failed: %s\n", addr, err.Error())
+	}
+}
+
+// SetKeepalive set interval of FRAME_LINKNOOP and timeout of dead link for new link
+// interval/timeout <= 0 for CMTP_LINK_KEEPALIVE/CMTP_LINK_TIMEOUT
+func (tf *CodecMixer) SetKeepalive(interval, timeout time.Duration) {
+	tf.mutex.Lock()
+	defer tf.mutex.Unlock()
+	if interval <= 0 {
+		interval = CMTP_LINK_KEEPALIVE
+	}
+	if timeout <= 0 {
+		timeout = CMTP_LINK_TIMEOUT
+	}
+	tf.keepalive = interval
+	tf.keeptimeout = timeout
+}
+
+// LinkStats return statistics of running links, including links of peer mixers on server
+func (tf *CodecMixer) LinkStats() []LinkStat_t {
+	tf.mutex.Lock()
+	links := make([]*mixerLink, len(tf.links))
+	copy(links, tf.links)
+	tf.mutex.Unlock()
+	stats := make([]LinkStat_t, 0, len(links))
+	for _, link := range links {
+		stats = append(stats, link.stat())
+	}
+	for _, peer := range tf.peerMixers() {
+		stats = append(stats, peer.LinkStats()...)
+	}
+	return stats
+}
@@ -0,0 +1,93 @@
+//
+// client mixer of server for Common Multiplexing Transport Proxy (CMTP)
+//
+// ssid and session secret belong to one client mixer, server accept links of many client mixers,
+// so links of one client mixer are run by one peer mixer of server, keyed by mixer nonce of client.
+// client older than version 4 send no mixer nonce, keyed by remote host instead,
+// old clients behind one host share one peer mixer.
+// peer mixer without link in CMTP_PEER_LINGER is closed, client may redial in this time.
+//
+
+//
+package cmtp
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// peer mixer without link is closed after CMTP_PEER_LINGER, longer than CMTP_REDIAL_MAX
+const CMTP_PEER_LINGER time.Duration = 60e9
+
+// peerKey return key of client mixer of hs
+func peerKey(rw net.Conn, hs *handshakeInfo) string {
+	if len(hs.cmixer) > 0 {
+		return fmt.Sprintf("mixer/%x", hs.cmixer)
+	}
+	host, _, err := net.SplitHostPort(rw.RemoteAddr().String())
+	if err != nil {
+		host = rw.RemoteAddr().String()
+	}
+	return "host/" + host
+}
+
+// peerMixer return peer mixer of client mixer in hs, new one with config of tf if not exist
+// return nil if tf closed
+func (tf *CodecMixer) peerMixer(rw net.Conn, hs *handshakeInfo) *CodecMixer {
+	key := peerKey(rw, hs)
+	tf.mutex.Lock()
+	defer tf.mutex.Unlock()
+	if tf.state == MIXER_STATE_CLOSED {
+		return nil
+	}
+	if peer, ok := tf.peers[key]; ok {
+		return peer
+	}
+	peer := newCodecMixer(tf.token, tf.codec.New(), tf.checksum.New(0), tf.filter)
+	peer.mutex.Lock()
+	peer.nonce = tf.nonce
+	peer.hsVersion = tf.hsVersion
+	peer.idleTimeout = tf.idleTimeout
+	peer.passive = true
+	peer.scheduler = tf.scheduler.New()
+	peer.keepalive = tf.keepalive
+	peer.keeptimeout = tf.keeptimeout
+	peer.hsTimeout = tf.hsTimeout
+	peer.reorderWindow = tf.reorderWindow
+	peer.reorderTimeout = tf.reorderTimeout
+	peer.codecs = tf.codecs
+	peer.checksums = tf.checksums
+	peer.unlinked = time.Now()
+	peer.mutex.Unlock()
+	tf.peers[key] = peer
+	fmt.Printf("peerMixer, %s, new peer mixer for %s\n", rw.RemoteAddr().String(), key)
+	return peer
+}
+
+// peerMixers return running peer mixers
+func (tf *CodecMixer) peerMixers() []*CodecMixer {
+	tf.mutex.Lock()
+	defer tf.mutex.Unlock()
+	peers := make([]*CodecMixer, 0, len(tf.peers))
+	for _, peer := range tf.peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// lingerPeers close peer mixer without link in CMTP_PEER_LINGER
+func (tf *CodecMixer) lingerPeers(now time.Time) {
+	tf.mutex.Lock()
+	defer tf.mutex.Unlock()
+	for key, peer := range tf.peers {
+		peer.mutex.Lock()
+		idle := len(peer.links) == 0 && now.Sub(peer.unlinked) > CMTP_PEER_LINGER
+		peer.mutex.Unlock()
+		if idle {
+			fmt.Printf("lingerPeers, %s, close peer mixer without link\n", key)
+			peer.Close()
+			delete(tf.peers, key)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+//
+// client/server of Common Multiplexing Transport Proxy (CMTP)
+//
+//
+
+//
+package cmtp
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/wheelcomplex/preinit/toml"
+)
+
+// default links to each peer
+const CMTP_DEFAULT_LINKS int = 2
+
+// Config_t is setting of cmtp client/server, can be load from toml file
+//
+// client: listen on Listen for local connection, forward to Dest by Links links to each server in Peers
+// listen on UDPListen for datagram flow, forward to UDPDest
+// listen on SOCKS/HTTP for SOCKS5/HTTP CONNECT client, forward to destination of request
+// server: listen on Listen for client links, dial destination carried by session
+type Config_t struct {
+	Token     uint64   `toml:"token"`     // shared token of client and server
+	Listen    string   `toml:"listen"`    // local listen address of client, or peer listen address of server
+	Peers     []string `toml:"peers"`     // address of servers, client only
+	Links     int      `toml:"links"`     // links to each server, client only
+	Dest      string   `toml:"dest"`      // destination host:port, client only
+	Codec     []string `toml:"codec"`     // accepted codec names, ordered by preference
+	Checksum  []string `toml:"checksum"`  // accepted checksum names, ordered by preference
+	Handshake int      `toml:"handshake"` // handshake timeout in seconds
+	Idle      int      `toml:"idle"`      // idle session timeout in seconds, 0 for CMTP_IDLE_TIMEOUT
+	Scheduler string   `toml:"scheduler"` // link scheduler name(roundrobin, throughput, rtt)
+	UDPListen string   `toml:"udplisten"` // local udp listen address, client only
+	UDPDest   string   `toml:"udpdest"`   // udp destination host:port, client only
+	UDPIdle   int      `toml:"udpidle"`   // idle udp flow timeout in seconds, 0 for CMTP_UDP_IDLE
+	SOCKS     string   `toml:"socks"`     // local SOCKS5 listen address, client only
+	HTTP      string   `toml:"http"`      // local HTTP CONNECT listen address, client only
+}
+
+// LoadConfig return *Config_t decode from toml file
+func LoadConfig(path string) (*Config_t, error) {
+	cfg := &Config_t{}
+	if _, err := toml.DecodeFile(path, cfg); err != nil {
+		return nil, fmt.Errorf("load config %s failed: %s", path, err.Error())
+	}
+	return cfg, nil
+}
+
+// mixer return *CodecMixer of cfg
+func (cfg *Config_t) mixer(dstinfo string) (*CodecMixer, error) {
+	if len(cfg.Codec) == 0 {
+		cfg.Codec = []string{"snappy"}
+	}
+	if len(cfg.Checksum) == 0 {
+		cfg.Checksum = []string{"xxhash"}
+	}
+	codec, ok := CodecByName(cfg.Codec[0])
+	if ok == false {
+		return nil, fmt.Errorf("codec %s not registered", cfg.Codec[0])
+	}
+	checksum, ok := ChecksumByName(cfg.Checksum[0])
+	if ok == false {
+		return nil, fmt.Errorf("checksum %s not registered", cfg.Checksum[0])
+	}
+	tf := newCodecMixer(cfg.Token, codec.New(), checksum.New(0), nil)
+	filter := NewTCPFilter(tf.Key(), dstinfo)
+	filter.SetUDPIdle(time.Duration(cfg.UDPIdle) * time.Second)
+	tf.filter = filter
+	if err := tf.SetCodecs(cfg.Codec...); err != nil {
+		tf.Close()
+		return nil, err
+	}
+	if err := tf.SetChecksums(cfg.Checksum...); err != nil {
+		tf.Close()
+		return nil, err
+	}
+	if cfg.Scheduler != "" {
+		sched, ok := SchedulerByName(cfg.Scheduler)
+		if ok == false {
+			tf.Close()
+			return nil, fmt.Errorf("scheduler %s not registered", cfg.Scheduler)
+		}
+		tf.SetScheduler(sched.New())
+	}
+	tf.SetHandshakeTimeout(time.Duration(cfg.Handshake) * time.Second)
+	if cfg.Idle > 0 {
+		tf.SetIdleTimeout(time.Duration(cfg.Idle) * time.Second)
+	}
+	return tf, nil
+}
+
+// NewClient return *CodecMixer connected to servers and listening for local connection
+func NewClient(cfg *Config_t) (*CodecMixer, error) {
+	if cfg.Token == 0 {
+		return nil, errors.New("no token")
+	}
+	if len(cfg.Peers) == 0 {
+		return nil, errors.New("no server address")
+	}
+	if cfg.Dest == "" && cfg.UDPDest == "" && cfg.SOCKS == "" && cfg.HTTP == "" {
+		return nil, errors.New("no destination address")
+	}
+	if cfg.Dest != "" && cfg.Listen == "" {
+		return nil, errors.New("no listen address")
+	}
+	if cfg.UDPDest != "" && cfg.UDPListen == "" {
+		return nil, errors.New("no udp listen address")
+	}
+	if cfg.Links <= 0 {
+		cfg.Links = CMTP_DEFAULT_LINKS
+	}
+	tf, err := cfg.mixer(cfg.Dest)
+	if err != nil {
+		return nil, err
+	}
+	for _, peer := range cfg.Peers {
+		for i := 0; i < cfg.Links; i++ {
+			if err := tf.DialPeer(peer); err != nil {
+				tf.Close()
+				return nil, err
+			}
+		}
+	}
+	if cfg.Dest != "" {
+		if _, err := tf.ListenClient(cfg.Listen); err != nil {
+			tf.Close()
+			return nil, err
+		}
+	}
+	if cfg.UDPDest != "" {
+		filter := NewUDPFilter(tf.Key(), cfg.UDPDest, time.Duration(cfg.UDPIdle)*time.Second)
+		if _, err := tf.ListenClientUDP(cfg.UDPListen, filter); err != nil {
+			tf.Close()
+			return nil, err
+		}
+	}
+	if cfg.SOCKS != "" {
+		if _, err := tf.ListenSOCKS(cfg.SOCKS, time.Duration(cfg.UDPIdle)*time.Second); err != nil {
+			tf.Close()
+			return nil, err
+		}
+	}
+	if cfg.HTTP != "" {
+		if _, err := tf.ListenHTTP(cfg.HTTP); err != nil {
+			tf.Close()
+			return nil, err
+		}
+	}
+	return tf, nil
+}
+
+// NewServer return *CodecMixer listening for client links
+func NewServer(cfg *Config_t) (*CodecMixer, error) {
+	if cfg.Token == 0 {
+		return nil, errors.New("no token")
+	}
+	if cfg.Listen == "" {
+		return nil, errors.New("no listen address")
+	}
+	tf, err := cfg.mixer("")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tf.ListenPeer(cfg.Listen); err != nil {
+		tf.Close()
+		return nil, err
+	}
+	return tf, nil
+}
@@ -0,0 +1,756 @@
+package cmtp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// echoServer return address of tcp echo server
+func echoServer(t *testing.T) (string, func()) {
+	nl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen echo server: %s", err)
+	}
+	go func() {
+		for {
+			conn, err := nl.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return nl.Addr().String(), func() { nl.Close() }
+}
+
+// loopback return client address of cmtp client/server forward to dest
+func loopback(t *testing.T, dest string) (string, func()) {
+	return loopbackIdle(t, dest, 0)
+}
+
+// loopbackIdle return loopback with idle session timeout in seconds
+func loopbackIdle(t *testing.T, dest string, idle int) (string, func()) {
+	server, err := NewServer(&Config_t{Token: 9999, Listen: "127.0.0.1:0", Idle: idle})
+	if err != nil {
+		t.Fatalf("new server: %s", err)
+	}
+	client, err := NewClient(&Config_t{
+		Token:  9999,
+		Listen: "127.0.0.1:0",
+		Peers:  []string{server.Addrs()[0].String()},
+		Links:  3,
+		Dest:   dest,
+		Idle:   idle,
+	})
+	if err != nil {
+		server.Close()
+		t.Fatalf("new client: %s", err)
+	}
+	return client.Addrs()[0].String(), func() {
+		client.Close()
+		server.Close()
+	}
+}
+
+// echo write data to addr and check echo
+func echo(addr string, data []byte) error {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(data)
+		errCh <- err
+	}()
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if err := <-errCh; err != nil {
+		return err
+	}
+	if bytes.Equal(buf, data) == false {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+func TestProxyEcho(t *testing.T) {
+	dest, stop := echoServer(t)
+	defer stop()
+	addr, closer := loopback(t, dest)
+	defer closer()
+
+	if err := echo(addr, []byte("hello, cmtp")); err != nil {
+		t.Fatalf("echo small: %s", err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data := make([]byte, 64*1024*(i+1))
+			rand.New(rand.NewSource(int64(i))).Read(data)
+			errs <- echo(addr, data)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("echo large: %s", err)
+		}
+	}
+}
+
+func TestProxyToken(t *testing.T) {
+	server, err := NewServer(&Config_t{Token: 1, Listen: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatalf("new server: %s", err)
+	}
+	defer server.Close()
+	_, err = NewClient(&Config_t{
+		Token:  2,
+		Listen: "127.0.0.1:0",
+		Peers:  []string{server.Addrs()[0].String()},
+		Dest:   "127.0.0.1:1",
+	})
+	if handshakeCode(err) != HANDSHAKE_ERR_TOKEN {
+		t.Fatalf("client with wrong token should fail: %v", err)
+	}
+
+	// empty token
+	if _, err := NewServer(&Config_t{Listen: "127.0.0.1:0"}); err == nil {
+		t.Fatalf("server without token should fail")
+	}
+	if _, err := NewClient(&Config_t{Listen: "127.0.0.1:0", Peers: []string{server.Addrs()[0].String()}, Dest: "127.0.0.1:1"}); err == nil {
+		t.Fatalf("client without token should fail")
+	}
+}
+
+func TestProxyOldPeer(t *testing.T) {
+	dest, stop := echoServer(t)
+	defer stop()
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	for version := CMTP_MIN_VERSION; version <= CMTP_VERSION; version++ {
+		server, err := NewServer(&Config_t{Token: 9999, Listen: "127.0.0.1:0"})
+		if err != nil {
+			t.Fatalf("new server: %s", err)
+		}
+		// server of old version
+		server.mutex.Lock()
+		server.hsVersion = version
+		server.mutex.Unlock()
+		client, err := NewClient(&Config_t{
+			Token:  9999,
+			Listen: "127.0.0.1:0",
+			Peers:  []string{server.Addrs()[0].String()},
+			Dest:   dest,
+		})
+		if err != nil {
+			server.Close()
+			t.Fatalf("version %d, new client: %s", version, err)
+		}
+		if peer := peerMixerOf(t, server); client.peerVersion() != version || peer.peerVersion() != version {
+			t.Errorf("version %d, negotiated client %d, server %d", version, client.peerVersion(), peer.peerVersion())
+		}
+		addr := client.Addrs()[0].String()
+		if err := echo(addr, []byte("hello, cmtp")); err != nil {
+			t.Errorf("version %d, echo small: %s", version, err)
+		}
+		if err := echo(addr, data); err != nil {
+			t.Errorf("version %d, echo large: %s", version, err)
+		}
+		if version < 3 {
+			// no keepalive and ack
+			for _, st := range client.LinkStats() {
+				if st.RTT != 0 || st.Unacked != 0 {
+					t.Errorf("version %d, link#%d keepalive/ack used: rtt %v, unacked %d", version, st.Id, st.RTT, st.Unacked)
+				}
+			}
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestProxyStall(t *testing.T) {
+	dest, stop := echoServer(t)
+	defer stop()
+	addr, closer := loopback(t, dest)
+	defer closer()
+
+	// stalled session, write without reading echo
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatalf("dial stalled session: %s", err)
+	}
+	defer conn.Close()
+	go conn.Write(make([]byte, 32*1024*1024))
+	time.Sleep(500 * time.Millisecond)
+
+	for i := 0; i < 4; i++ {
+		data := make([]byte, 256*1024)
+		rand.New(rand.NewSource(int64(i))).Read(data)
+		if err := echo(addr, data); err != nil {
+			t.Fatalf("echo %d with stalled session: %s", i, err)
+		}
+	}
+}
+
+func TestProxyHalfClose(t *testing.T) {
+	dest, stop := echoServer(t)
+	defer stop()
+	addr, closer := loopback(t, dest)
+	defer closer()
+
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	data := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	if _, err := conn.Write(data); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	// echo is still forwarded after half-close, and EOF after echo server closed
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatalf("half-close: %s", err)
+	}
+	buf, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read after half-close: %s", err)
+	}
+	if bytes.Equal(buf, data) == false {
+		t.Fatalf("echo after half-close mismatch, %d != %d", len(buf), len(data))
+	}
+}
+
+// checkClosed check conn closed by peer in timeout
+func checkClosed(t *testing.T, conn net.Conn, timeout time.Duration) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	_, err := ioutil.ReadAll(conn)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatalf("connection not closed in %v", timeout)
+	}
+}
+
+func TestProxyReset(t *testing.T) {
+	// nothing listening at destination
+	addr, closer := loopback(t, "127.0.0.1:1")
+	defer closer()
+
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	checkClosed(t, conn, 5*time.Second)
+}
+
+func TestProxyIdle(t *testing.T) {
+	dest, stop := echoServer(t)
+	defer stop()
+	addr, closer := loopbackIdle(t, dest, 1)
+	defer closer()
+
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 5)); err != nil {
+		t.Fatalf("read echo: %s", err)
+	}
+	checkClosed(t, conn, 5*time.Second)
+}
+
+func TestProxyFailover(t *testing.T) {
+	dest, stop := echoServer(t)
+	defer stop()
+	server, err := NewServer(&Config_t{Token: 9999, Listen: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatalf("new server: %s", err)
+	}
+	defer server.Close()
+	client, err := NewClient(&Config_t{
+		Token:  9999,
+		Listen: "127.0.0.1:0",
+		Peers:  []string{server.Addrs()[0].String()},
+		Links:  3,
+		Dest:   dest,
+	})
+	if err != nil {
+		t.Fatalf("new client: %s", err)
+	}
+	defer client.Close()
+
+	conn, err := net.DialTimeout("tcp", client.Addrs()[0].String(), time.Second)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	data := make([]byte, 8*1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	go conn.Write(data)
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, buf[:1024*1024]); err != nil {
+		t.Fatalf("read before link failed: %s", err)
+	}
+	// break one link in transfer
+	peer := peerMixerOf(t, server)
+	peer.mutex.Lock()
+	peer.links[0].rw.Close()
+	peer.mutex.Unlock()
+	if _, err := io.ReadFull(conn, buf[1024*1024:]); err != nil {
+		t.Fatalf("read after link failed: %s", err)
+	}
+	if bytes.Equal(buf, data) == false {
+		t.Fatalf("echo mismatch after link failed")
+	}
+
+	// client redial
+	var stats []LinkStat_t
+	for i := 0; i < 50; i++ {
+		if stats = client.LinkStats(); len(stats) == 3 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if len(stats) != 3 {
+		t.Fatalf("client links %d after redial, want 3", len(stats))
+	}
+	var retransmits uint64
+	for _, st := range append(stats, server.LinkStats()...) {
+		retransmits += st.Retransmits
+	}
+	t.Logf("retransmits %d", retransmits)
+	for _, st := range stats {
+		if st.TxBytes == 0 || st.Remote == "" {
+			t.Fatalf("invalid link stat %+v", st)
+		}
+	}
+}
+
+// stallProxy return address of tcp proxy forward to dest, and stall function
+// after stall, forwarding of running connection is stopped without close, new connection is refused
+func stallProxy(t *testing.T, dest string) (string, func(), func()) {
+	nl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen stall proxy: %s", err)
+	}
+	stalled := make(chan struct{})
+	var mutex sync.Mutex
+	var conns []net.Conn
+	forward := func(dst, src net.Conn) {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := src.Read(buf)
+			select {
+			case <-stalled:
+				return
+			default:
+			}
+			if err != nil {
+				dst.Close()
+				return
+			}
+			if _, err := dst.Write(buf[:n]); err != nil {
+				src.Close()
+				return
+			}
+		}
+	}
+	go func() {
+		for {
+			conn, err := nl.Accept()
+			if err != nil {
+				return
+			}
+			up, err := net.Dial("tcp", dest)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			mutex.Lock()
+			conns = append(conns, conn, up)
+			mutex.Unlock()
+			go forward(up, conn)
+			go forward(conn, up)
+		}
+	}()
+	stall := func() {
+		close(stalled)
+		nl.Close()
+	}
+	stop := func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+	return nl.Addr().String(), stall, stop
+}
+
+func TestProxyDeadLink(t *testing.T) {
+	dest, stop := echoServer(t)
+	defer stop()
+	server, err := NewServer(&Config_t{Token: 9999, Listen: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatalf("new server: %s", err)
+	}
+	defer server.Close()
+	server.SetKeepalive(50*time.Millisecond, 500*time.Millisecond)
+	addr, stall, stopProxy := stallProxy(t, server.Addrs()[0].String())
+	defer stopProxy()
+	client, err := (&Config_t{Token: 9999}).mixer(dest)
+	if err != nil {
+		t.Fatalf("new client: %s", err)
+	}
+	defer client.Close()
+	client.SetKeepalive(50*time.Millisecond, 500*time.Millisecond)
+	for _, peer := range []string{addr, server.Addrs()[0].String()} {
+		if err := client.DialPeer(peer); err != nil {
+			t.Fatalf("dial peer %s: %s", peer, err)
+		}
+	}
+	laddr, err := client.ListenClient("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen client: %s", err)
+	}
+	if err := echo(laddr.String(), []byte("hello, link")); err != nil {
+		t.Fatalf("echo: %s", err)
+	}
+
+	// link stalled without close, only detected by keepalive timeout
+	stall()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(client.LinkStats()) != 1 || len(server.LinkStats()) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("dead link not removed: client links %d, server links %d", len(client.LinkStats()), len(server.LinkStats()))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	data := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := echo(laddr.String(), data); err != nil {
+		t.Fatalf("echo after dead link removed: %s", err)
+	}
+}
+
+func TestLinkStats(t *testing.T) {
+	dest, stop := echoServer(t)
+	defer stop()
+	server, err := NewServer(&Config_t{Token: 9999, Listen: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatalf("new server: %s", err)
+	}
+	defer server.Close()
+	client, err := NewClient(&Config_t{
+		Token:  9999,
+		Listen: "127.0.0.1:0",
+		Peers:  []string{server.Addrs()[0].String()},
+		Dest:   dest,
+	})
+	if err != nil {
+		t.Fatalf("new client: %s", err)
+	}
+	defer client.Close()
+	if err := echo(client.Addrs()[0].String(), []byte("hello, stats")); err != nil {
+		t.Fatalf("echo: %s", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	for _, st := range client.LinkStats() {
+		if st.RTT <= 0 || st.RxBytes == 0 {
+			t.Fatalf("link without RTT: %+v", st)
+		}
+		if st.Unacked > int(CMTP_ACK_FRAMES) {
+			t.Fatalf("link unacked %d > %d", st.Unacked, CMTP_ACK_FRAMES)
+		}
+	}
+}
+
+func TestProxyClients(t *testing.T) {
+	dest, stop := echoServer(t)
+	defer stop()
+	server, err := NewServer(&Config_t{Token: 9999, Listen: "127.0.0.1:0", Codec: []string{"aesgcm"}})
+	if err != nil {
+		t.Fatalf("new server: %s", err)
+	}
+	defer server.Close()
+	// same ssid is opened by each client, session key differ
+	clients := make([]*CodecMixer, 2)
+	for i := range clients {
+		client, err := NewClient(&Config_t{
+			Token:  9999,
+			Listen: "127.0.0.1:0",
+			Peers:  []string{server.Addrs()[0].String()},
+			Links:  2,
+			Dest:   dest,
+			Codec:  []string{"aesgcm"},
+		})
+		if err != nil {
+			t.Fatalf("client#%d, new client: %s", i, err)
+		}
+		defer client.Close()
+		clients[i] = client
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data := make([]byte, 64*1024*(i+1))
+			rand.New(rand.NewSource(int64(i))).Read(data)
+			errs <- echo(clients[i%2].Addrs()[0].String(), data)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("echo: %s", err)
+		}
+	}
+	if peers := server.peerMixers(); len(peers) != 2 {
+		t.Fatalf("server peer mixers %d, want 2", len(peers))
+	}
+	if stats := server.LinkStats(); len(stats) != 4 {
+		t.Fatalf("server links %d, want 4", len(stats))
+	}
+
+	// client closed, session of other client not effected
+	clients[0].Close()
+	if err := echo(clients[1].Addrs()[0].String(), []byte("hello, client")); err != nil {
+		t.Fatalf("echo after other client closed: %s", err)
+	}
+}
+
+func TestProxyScheduler(t *testing.T) {
+	dest, stop := echoServer(t)
+	defer stop()
+	for _, name := range []string{"roundrobin", "throughput", "rtt"} {
+		server, err := NewServer(&Config_t{Token: 9999, Listen: "127.0.0.1:0", Scheduler: name})
+		if err != nil {
+			t.Fatalf("new server: %s", err)
+		}
+		client, err := NewClient(&Config_t{
+			Token:     9999,
+			Listen:    "127.0.0.1:0",
+			Peers:     []string{server.Addrs()[0].String()},
+			Links:     3,
+			Dest:      dest,
+			Scheduler: name,
+		})
+		if err != nil {
+			server.Close()
+			t.Fatalf("new client: %s", err)
+		}
+		data := make([]byte, 1024*1024)
+		rand.New(rand.NewSource(1)).Read(data)
+		err = echo(client.Addrs()[0].String(), data)
+		client.Close()
+		server.Close()
+		if err != nil {
+			t.Fatalf("echo with scheduler %s: %s", name, err)
+		}
+	}
+	if _, err := NewServer(&Config_t{Token: 9999, Listen: "127.0.0.1:0", Scheduler: "none"}); err == nil {
+		t.Fatalf("new server with unknown scheduler should fail")
+	}
+}
+
+func TestProxyEncrypt(t *testing.T) {
+	dest, stop := echoServer(t)
+	defer stop()
+	for _, name := range []string{"aesgcm", "snappy+aesgcm"} {
+		server, err := NewServer(&Config_t{Token: 9999, Listen: "127.0.0.1:0", Codec: []string{name}})
+		if err != nil {
+			t.Fatalf("new server: %s", err)
+		}
+		client, err := NewClient(&Config_t{
+			Token:  9999,
+			Listen: "127.0.0.1:0",
+			Peers:  []string{server.Addrs()[0].String()},
+			Links:  2,
+			Dest:   dest,
+			Codec:  []string{name, "snappy"},
+		})
+		if err != nil {
+			server.Close()
+			t.Fatalf("new client: %s", err)
+		}
+		data := make([]byte, 1024*1024)
+		rand.New(rand.NewSource(1)).Read(data)
+		err = echo(client.Addrs()[0].String(), data)
+		client.Close()
+		server.Close()
+		if err != nil {
+			t.Fatalf("echo with codec %s: %s", name, err)
+		}
+	}
+}
+
+// openSessions return ssid of open sessions, including sessions of peer mixers on server
+func openSessions(tf *CodecMixer) []uint64 {
+	tf.mutex.Lock()
+	ssids := make([]uint64, 0, len(tf.ssdone))
+	for ssid := range tf.ssdone {
+		ssids = append(ssids, ssid)
+	}
+	tf.mutex.Unlock()
+	for _, peer := range tf.peerMixers() {
+		ssids = append(ssids, openSessions(peer)...)
+	}
+	return ssids
+}
+
+// peerMixerOf return the only peer mixer of server, wait for link accepted
+func peerMixerOf(t *testing.T, server *CodecMixer) *CodecMixer {
+	for i := 0; i < 50; i++ {
+		if peers := server.peerMixers(); len(peers) == 1 && len(peers[0].LinkStats()) > 0 {
+			return peers[0]
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("server peer mixers %d, want 1", len(server.peerMixers()))
+	return nil
+}
+
+// udpEchoServer return address of udp echo server
+func udpEchoServer(t *testing.T) (string, func()) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen udp echo server: %s", err)
+	}
+	go func() {
+		buf := make([]byte, UDP_MAX_DATAGRAM)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().String(), func() { conn.Close() }
+}
+
+// udpEcho send datagrams to addr by conn and check echo
+// datagram lost is retried
+func udpEcho(conn net.Conn, sizes []int) error {
+	buf := make([]byte, UDP_MAX_DATAGRAM)
+	for i, size := range sizes {
+		data := bytes.Repeat([]byte{byte(i)}, size)
+		var err error
+		for retry := 0; retry < 5; retry++ {
+			if _, err = conn.Write(data); err != nil {
+				return err
+			}
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			var n int
+			if n, err = conn.Read(buf); err != nil {
+				continue
+			}
+			if bytes.Equal(buf[:n], data) == false {
+				return fmt.Errorf("datagram %d mismatch, %d != %d bytes", i, n, size)
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestProxyUDP(t *testing.T) {
+	dest, stop := udpEchoServer(t)
+	defer stop()
+	server, err := NewServer(&Config_t{Token: 9999, Listen: "127.0.0.1:0", UDPIdle: 1})
+	if err != nil {
+		t.Fatalf("new server: %s", err)
+	}
+	defer server.Close()
+	client, err := NewClient(&Config_t{
+		Token:     9999,
+		Peers:     []string{server.Addrs()[0].String()},
+		Links:     2,
+		UDPListen: "127.0.0.1:0",
+		UDPDest:   dest,
+		UDPIdle:   1,
+	})
+	if err != nil {
+		t.Fatalf("new client: %s", err)
+	}
+	defer client.Close()
+	addr := client.Addrs()[0].String()
+
+	// flows of different client addr:port
+	var wg sync.WaitGroup
+	errCh := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := net.Dial("udp", addr)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			defer conn.Close()
+			errCh <- udpEcho(conn, []int{1, 0, 1400, 8000, 32, 60000})
+		}()
+	}
+	wg.Wait()
+	for i := 0; i < 3; i++ {
+		if err := <-errCh; err != nil {
+			t.Fatalf("udp echo: %s", err)
+		}
+	}
+
+	// flow expired after idle timeout, new session for same client addr:port
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer conn.Close()
+	if err := udpEcho(conn, []int{100}); err != nil {
+		t.Fatalf("udp echo: %s", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(openSessions(client)) > 0 || len(openSessions(server)) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("idle flow not closed: client %v, server %v", openSessions(client), openSessions(server))
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err := udpEcho(conn, []int{200}); err != nil {
+		t.Fatalf("udp echo after idle: %s", err)
+	}
+}
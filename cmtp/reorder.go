@@ -0,0 +1,119 @@
+//
+// reorder buffer for Common Multiplexing Transport Proxy (CMTP)
+//
+//
+
+//
+package cmtp
+
+import (
+	"fmt"
+	"time"
+)
+
+// max frames hold by reorder buffer of one session
+const CMTP_REORDER_WINDOW uint64 = 1024
+
+// max time waiting for missing frame, session is reset after timeout
+const CMTP_REORDER_TIMEOUT time.Duration = 30e9
+
+// reorderBuffer deliver frames of one session in order of index
+// frames from multiple links arrive out of order
+type reorderBuffer struct {
+	next      uint64                 // index of next frame to deliver
+	window    uint64                 // max index ahead of next
+	timeout   time.Duration          // max time waiting for next
+	pending   map[uint64]*mixerFrame // frames arrived before next
+	gapSince  time.Time              // time of first frame waiting for next, zero if no gap
+	dups      uint64                 // duplicated frames discarded
+	overflows uint64                 // frames out of window discarded
+}
+
+// newReorderBuffer return *reorderBuffer deliver from first index of session
+func newReorderBuffer(window uint64, timeout time.Duration) *reorderBuffer {
+	if window == 0 {
+		window = CMTP_REORDER_WINDOW
+	}
+	if window < CMTP_FLOW_WINDOW {
+		// peer may send whole flow window ahead
+		window = CMTP_FLOW_WINDOW
+	}
+	if timeout <= 0 {
+		timeout = CMTP_REORDER_TIMEOUT
+	}
+	return &reorderBuffer{
+		next:    INIT_INDEX + 1,
+		window:  window,
+		timeout: timeout,
+		pending: make(map[uint64]*mixerFrame),
+	}
+}
+
+// push add frame to buffer
+// return false if frame is discarded(duplicated or out of window), caller should recycle it
+func (rb *reorderBuffer) push(mf *mixerFrame, now time.Time) bool {
+	if mf.index < rb.next {
+		rb.dups++
+		return false
+	}
+	if mf.index >= rb.next+rb.window {
+		rb.overflows++
+		return false
+	}
+	if _, ok := rb.pending[mf.index]; ok {
+		rb.dups++
+		return false
+	}
+	rb.pending[mf.index] = mf
+	if mf.index != rb.next && rb.gapSince.IsZero() {
+		rb.gapSince = now
+	}
+	return true
+}
+
+// pop return next contiguous frame, nil if next frame not arrived
+func (rb *reorderBuffer) pop(now time.Time) *mixerFrame {
+	mf, ok := rb.pending[rb.next]
+	if ok == false {
+		return nil
+	}
+	delete(rb.pending, rb.next)
+	rb.next++
+	if len(rb.pending) == 0 {
+		rb.gapSince = time.Time{}
+	} else if _, ok := rb.pending[rb.next]; ok == false {
+		// new gap
+		rb.gapSince = now
+	}
+	return mf
+}
+
+// deadline return time to give up waiting for missing frame, zero if no gap
+func (rb *reorderBuffer) deadline() time.Time {
+	if rb.gapSince.IsZero() {
+		return time.Time{}
+	}
+	return rb.gapSince.Add(rb.timeout)
+}
+
+// expired return error if missing frame waiting longer than timeout
+func (rb *reorderBuffer) expired(now time.Time) error {
+	if rb.gapSince.IsZero() || now.Sub(rb.gapSince) < rb.timeout {
+		return nil
+	}
+	return &CMsg{
+		Code: IO_ERR_READ,
+		Err:  fmt.Errorf("reorder timeout, missing index %d for %v, %d frames pending", rb.next, now.Sub(rb.gapSince), len(rb.pending)),
+	}
+}
+
+// reset discard all pending frames, return them for recycle
+func (rb *reorderBuffer) reset() []*mixerFrame {
+	frames := make([]*mixerFrame, 0, len(rb.pending))
+	for index, mf := range rb.pending {
+		frames = append(frames, mf)
+		delete(rb.pending, index)
+	}
+	rb.gapSince = time.Time{}
+	return frames
+}
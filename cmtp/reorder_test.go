@@ -0,0 +1,81 @@
+package cmtp
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func newTestFrame(index uint64) *mixerFrame {
+	return &mixerFrame{index: index}
+}
+
+func TestReorderShuffled(t *testing.T) {
+	rb := newReorderBuffer(0, 0)
+	now := time.Now()
+	indexes := rand.New(rand.NewSource(1)).Perm(100)
+	var got []uint64
+	for _, i := range indexes {
+		if rb.push(newTestFrame(uint64(i)+INIT_INDEX+1), now) == false {
+			t.Fatalf("push index %d rejected", i)
+		}
+		for mf := rb.pop(now); mf != nil; mf = rb.pop(now) {
+			got = append(got, mf.index)
+		}
+	}
+	if len(got) != 100 {
+		t.Fatalf("delivered %d frames, want 100", len(got))
+	}
+	for i, index := range got {
+		if index != uint64(i)+INIT_INDEX+1 {
+			t.Fatalf("frame %d index %d out of order", i, index)
+		}
+	}
+	if rb.deadline().IsZero() == false {
+		t.Fatalf("gap remain after all frames delivered")
+	}
+}
+
+func TestReorderDiscard(t *testing.T) {
+	rb := newReorderBuffer(CMTP_FLOW_WINDOW, 0)
+	now := time.Now()
+	first := INIT_INDEX + 1
+	rb.push(newTestFrame(first+1), now)
+	if rb.push(newTestFrame(first+1), now) {
+		t.Fatalf("duplicated pending frame accepted")
+	}
+	if rb.push(newTestFrame(first+CMTP_FLOW_WINDOW), now) {
+		t.Fatalf("frame out of window accepted")
+	}
+	rb.push(newTestFrame(first), now)
+	for mf := rb.pop(now); mf != nil; mf = rb.pop(now) {
+	}
+	if rb.push(newTestFrame(first), now) {
+		t.Fatalf("delivered frame accepted")
+	}
+	if rb.dups != 2 || rb.overflows != 1 {
+		t.Fatalf("dups %d, overflows %d, want 2, 1", rb.dups, rb.overflows)
+	}
+}
+
+func TestReorderTimeout(t *testing.T) {
+	rb := newReorderBuffer(0, time.Second)
+	now := time.Now()
+	rb.push(newTestFrame(INIT_INDEX+3), now)
+	if rb.pop(now) != nil {
+		t.Fatalf("frame delivered before gap filled")
+	}
+	if rb.deadline() != now.Add(time.Second) {
+		t.Fatalf("deadline %v, want %v", rb.deadline(), now.Add(time.Second))
+	}
+	if err := rb.expired(now.Add(time.Second / 2)); err != nil {
+		t.Fatalf("expired before timeout: %s", err)
+	}
+	err := rb.expired(now.Add(time.Second))
+	if msg, ok := err.(*CMsg); ok == false || msg.Code != IO_ERR_READ {
+		t.Fatalf("expired after timeout: %v", err)
+	}
+	if frames := rb.reset(); len(frames) != 1 {
+		t.Fatalf("reset return %d frames, want 1", len(frames))
+	}
+}
@@ -0,0 +1,212 @@
+//
+// link scheduler for Common Multiplexing Transport Proxy (CMTP)
+//
+// frames from assembleFastCh/assembleCh are dispatched to queue of one link picked by Scheduler,
+// small frame(payload < CMTP_SMALL_PKG_SIZE) is queued to fast queue of link and written first
+//
+
+//
+package cmtp
+
+import (
+	"time"
+)
+
+// frames queued for each link, fast queue and data queue
+const CMTP_LINK_QUEUE int = 64
+
+// RTTScheduler use next link after queued bytes of link reach CMTP_SCHED_SPILL
+const CMTP_SCHED_SPILL int = CMTP_BUF_MAX
+
+// Scheduler pick link for frame
+type Scheduler interface {
+	// New return a new interface
+	New() Scheduler
+
+	// Pick return index of links to send frame with size bytes payload
+	// links is not empty, Pick is called by one goroutine
+	Pick(links []LinkStat_t, size int) int
+}
+
+// registered scheduler
+var schedulerNames = map[string]Scheduler{
+	"roundrobin": NewRoundRobinScheduler(),
+	"throughput": NewThroughputScheduler(),
+	"rtt":        NewRTTScheduler(),
+}
+
+// RegisterScheduler register scheduler by name
+func RegisterScheduler(name string, sched Scheduler) {
+	nameMutex.Lock()
+	defer nameMutex.Unlock()
+	schedulerNames[name] = sched
+}
+
+// SchedulerByName return registered scheduler
+func SchedulerByName(name string) (Scheduler, bool) {
+	nameMutex.Lock()
+	defer nameMutex.Unlock()
+	sched, ok := schedulerNames[name]
+	return sched, ok
+}
+
+// RoundRobinScheduler pick links one by one
+type RoundRobinScheduler struct {
+	next int
+}
+
+// NewRoundRobinScheduler return *RoundRobinScheduler
+func NewRoundRobinScheduler() *RoundRobinScheduler {
+	return &RoundRobinScheduler{}
+}
+
+// New return a new interface
+func (rr *RoundRobinScheduler) New() Scheduler {
+	return NewRoundRobinScheduler()
+}
+
+// Pick return next link
+func (rr *RoundRobinScheduler) Pick(links []LinkStat_t, size int) int {
+	rr.next = (rr.next + 1) % len(links)
+	return rr.next
+}
+
+// ThroughputScheduler pick link finish queued bytes first by measured throughput
+// fast link take more frames than slow link
+type ThroughputScheduler struct {
+	next int
+}
+
+// NewThroughputScheduler return *ThroughputScheduler
+func NewThroughputScheduler() *ThroughputScheduler {
+	return &ThroughputScheduler{}
+}
+
+// New return a new interface
+func (ts *ThroughputScheduler) New() Scheduler {
+	return NewThroughputScheduler()
+}
+
+// Pick return link with min (queued + size) / throughput, equal links are picked one by one
+func (ts *ThroughputScheduler) Pick(links []LinkStat_t, size int) int {
+	ts.next = (ts.next + 1) % len(links)
+	best := -1
+	var bestCost float64
+	for n := 0; n < len(links); n++ {
+		i := (ts.next + n) % len(links)
+		tput := links[i].Throughput
+		if tput == 0 {
+			// not measured, try it
+			tput = 1 << 30
+		}
+		cost := float64(links[i].Queued+size) / float64(tput)
+		if best < 0 || cost < bestCost {
+			best, bestCost = i, cost
+		}
+	}
+	return best
+}
+
+// RTTScheduler pick link with lowest RTT, spill to next link after queued bytes reach CMTP_SCHED_SPILL
+type RTTScheduler struct{}
+
+// NewRTTScheduler return *RTTScheduler
+func NewRTTScheduler() *RTTScheduler {
+	return &RTTScheduler{}
+}
+
+// New return a new interface
+func (rs *RTTScheduler) New() Scheduler {
+	return NewRTTScheduler()
+}
+
+// Pick return link with lowest RTT and queued bytes less then CMTP_SCHED_SPILL,
+// link with least queued bytes if all links spilled
+func (rs *RTTScheduler) Pick(links []LinkStat_t, size int) int {
+	best, least := -1, 0
+	for i := range links {
+		if links[i].Queued < links[least].Queued {
+			least = i
+		}
+		if links[i].Queued >= CMTP_SCHED_SPILL {
+			continue
+		}
+		if best < 0 || linkRTT(links[i]) < linkRTT(links[best]) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return least
+	}
+	return best
+}
+
+// linkRTT return RTT of link, CMTP_LINK_KEEPALIVE for not measured
+func linkRTT(st LinkStat_t) time.Duration {
+	if st.RTT <= 0 {
+		return CMTP_LINK_KEEPALIVE
+	}
+	return st.RTT
+}
+
+// SetScheduler set scheduler to pick link for frame
+func (tf *CodecMixer) SetScheduler(sched Scheduler) {
+	tf.mutex.Lock()
+	defer tf.mutex.Unlock()
+	tf.scheduler = sched
+}
+
+// scheduleLoop dispatch frames from assembleFastCh+assembleCh to link picked by scheduler
+func (tf *CodecMixer) scheduleLoop() {
+	var mf *mixerFrame
+	for {
+		// dispatch fast channel first
+		select {
+		case mf = <-tf.assembleFastCh:
+		default:
+			select {
+			case mf = <-tf.assembleFastCh:
+			case mf = <-tf.assembleCh:
+			case <-tf.closing:
+				return
+			}
+		}
+		tf.schedule(mf)
+	}
+}
+
+// schedule queue frame to link picked by scheduler
+// wait for link ready if no link or queue of picked link is full
+func (tf *CodecMixer) schedule(mf *mixerFrame) {
+	for {
+		tf.mutex.Lock()
+		links := make([]*mixerLink, len(tf.links))
+		copy(links, tf.links)
+		sched := tf.scheduler
+		tf.mutex.Unlock()
+		if len(links) > 0 {
+			stats := make([]LinkStat_t, len(links))
+			for i, link := range links {
+				stats[i] = link.stat()
+			}
+			i := sched.Pick(stats, int(mf.payloadlen))
+			if i >= 0 && i < len(links) && links[i].enqueue(mf) {
+				return
+			}
+		}
+		select {
+		case <-tf.linkReady:
+		case <-tf.closing:
+			tf.putFrame(mf)
+			return
+		}
+	}
+}
+
+// notifyLink wake up schedule waiting for link ready
+func (tf *CodecMixer) notifyLink() {
+	select {
+	case tf.linkReady <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,65 @@
+package cmtp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRoundRobinScheduler(t *testing.T) {
+	sched := NewRoundRobinScheduler().New()
+	links := make([]LinkStat_t, 3)
+	seen := make(map[int]int)
+	for i := 0; i < 30; i++ {
+		seen[sched.Pick(links, 1500)]++
+	}
+	for i := range links {
+		if seen[i] != 10 {
+			t.Fatalf("link %d picked %d times, want 10", i, seen[i])
+		}
+	}
+}
+
+func TestThroughputScheduler(t *testing.T) {
+	sched := NewThroughputScheduler().New()
+	links := []LinkStat_t{
+		{Id: 1, Throughput: 100 << 20},
+		{Id: 2, Throughput: 1 << 20},
+	}
+	// simulate queue of picked link, fast link take more frames
+	seen := make(map[int]int)
+	for i := 0; i < 101; i++ {
+		n := sched.Pick(links, 64*1024)
+		links[n].Queued += 64 * 1024
+		seen[n]++
+	}
+	if seen[0] < seen[1]*50 {
+		t.Fatalf("fast link picked %d, slow link picked %d", seen[0], seen[1])
+	}
+	// not measured link is tried
+	links = append(links, LinkStat_t{Id: 3})
+	if n := sched.Pick(links, 64*1024); n != 2 {
+		t.Fatalf("picked link %d, want not measured link 2", n)
+	}
+}
+
+func TestRTTScheduler(t *testing.T) {
+	sched := NewRTTScheduler().New()
+	links := []LinkStat_t{
+		{Id: 1, RTT: 30 * time.Millisecond},
+		{Id: 2, RTT: 10 * time.Millisecond},
+		{Id: 3, RTT: 20 * time.Millisecond},
+	}
+	if n := sched.Pick(links, 1500); n != 1 {
+		t.Fatalf("picked link %d, want lowest RTT link 1", n)
+	}
+	links[1].Queued = CMTP_SCHED_SPILL
+	if n := sched.Pick(links, 1500); n != 2 {
+		t.Fatalf("picked link %d, want spill to link 2", n)
+	}
+	for i := range links {
+		links[i].Queued = CMTP_SCHED_SPILL + i
+	}
+	if n := sched.Pick(links, 1500); n != 0 {
+		t.Fatalf("picked link %d, want least queued link 0", n)
+	}
+}
@@ -0,0 +1,171 @@
+//
+// session lifecycle for Common Multiplexing Transport Proxy (CMTP)
+//
+// open: FRAME_MSGNEWSSID sent by assemble side before first frame
+// half-close: FRAME_PAYLOADLAST sent in order of frame index after EOF of ReadFrom,
+// peer propagate it to underlay io by CloseWrite
+// close: FRAME_MSGDELSSID with code 0, sent after both direction half-closed
+// reset: FRAME_MSGDELSSID with error code, sent on io error, peer clear session immediately
+//
+
+//
+package cmtp
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// idle session is reset after CMTP_IDLE_TIMEOUT
+const CMTP_IDLE_TIMEOUT time.Duration = 300e9
+
+// half-closed direction of session
+const (
+	SESSION_READ_DONE  int = 1 << iota // FRAME_PAYLOADLAST written to peer link
+	SESSION_WRITE_DONE                 // FRAME_PAYLOADLAST from peer written
+	SESSION_DONE       = SESSION_READ_DONE | SESSION_WRITE_DONE
+)
+
+// halfCloser is Filter support half-close, check TCPFilter.CloseWrite
+type halfCloser interface {
+	CloseWrite() error
+}
+
+// dialReplier is Filter reply dial result of session, check TCPFilter.SetDialReply
+type dialReplier interface {
+	SetDialReply(enable bool)
+}
+
+// setDialReply disable dial reply of filter for peer older than version 5
+func (tf *CodecMixer) setDialReply(filter Filter) {
+	if dr, ok := filter.(dialReplier); ok {
+		dr.SetDialReply(tf.peerVersion() >= 5)
+	}
+}
+
+// errCode return code of CMsg error, code if err is not CMsg
+func errCode(err error, code uint64) uint64 {
+	switch e := err.(type) {
+	case *CMsg:
+		if e.Code != 0 {
+			return e.Code
+		}
+	case CMsg:
+		if e.Code != 0 {
+			return e.Code
+		}
+	}
+	return code
+}
+
+// touchssid update last frame time of session
+func (tf *CodecMixer) touchssid(ssid uint64) {
+	tf.mutex.Lock()
+	defer tf.mutex.Unlock()
+	if _, ok := tf.ssactive[ssid]; ok {
+		tf.ssactive[ssid] = time.Now()
+	}
+}
+
+// sendLast send FRAME_PAYLOADLAST of ssid after all frames
+// session is marked SESSION_READ_DONE by writeLoop after FRAME_PAYLOADLAST written,
+// frames before it may still be in encodeLoop, they carry session codec in mf.codec
+func (tf *CodecMixer) sendLast(ssid uint64) {
+	codec := tf.sessionCodec(ssid)
+	if codec == nil || tf.waitCredit(ssid) == false {
+		return
+	}
+	mf := tf.getFrame()
+	mf.headerInit(FRAME_PAYLOADLAST, ssid, tf.growindex(ssid))
+	mf.codec = codec
+	tf.encodeCh <- mf
+}
+
+// doneSession mark direction of session half-closed
+// session is closed after both direction half-closed
+func (tf *CodecMixer) doneSession(ssid uint64, flag int) {
+	tf.mutex.Lock()
+	done, ok := tf.ssdone[ssid]
+	if ok == false {
+		tf.mutex.Unlock()
+		return
+	}
+	done |= flag
+	tf.ssdone[ssid] = done
+	ssclosing := tf.ssclosing[ssid]
+	tf.mutex.Unlock()
+	if done != SESSION_DONE {
+		return
+	}
+	fmt.Printf("session %d, closed\n", ssid)
+	tf.sendCtrl(FRAME_MSGDELSSID, ssid, &CMsg{Err: errors.New("closed")}, ssclosing)
+	tf.clearssid(ssid)
+}
+
+// resetSession send reset to peer and clear session
+// code is used if err is not CMsg with error code
+func (tf *CodecMixer) resetSession(ssid uint64, code uint64, err error) {
+	_, ssclosing, ok := tf.sessionCh(ssid)
+	if ok == false {
+		// already cleared
+		return
+	}
+	if err == nil {
+		err = errors.New("reset")
+	}
+	fmt.Printf("session %d, reset: %s\n", ssid, err.Error())
+	tf.sendCtrl(FRAME_MSGDELSSID, ssid, &CMsg{Code: errCode(err, code), Err: err}, ssclosing)
+	tf.clearssid(ssid)
+}
+
+// recvDelssid handle close/reset from peer
+// close is ignored until FRAME_PAYLOADLAST from peer written, it may arrive from other link
+func (tf *CodecMixer) recvDelssid(ssid uint64, mc *CMsg, count int) {
+	tf.mutex.Lock()
+	defer tf.mutex.Unlock()
+	done, ok := tf.ssdone[ssid]
+	if ok == false {
+		return
+	}
+	if mc.Code == 0 && done&SESSION_WRITE_DONE == 0 {
+		fmt.Printf("readLoop#%d, %d, waiting for last frame before close\n", count, ssid)
+		return
+	}
+	fmt.Printf("readLoop#%d, %d, session cleared by peer: %s\n", count, ssid, mc.String())
+	tf.clearssidLocked(ssid)
+}
+
+// SetIdleTimeout set timeout of idle session, timeout <= 0 to disable
+func (tf *CodecMixer) SetIdleTimeout(timeout time.Duration) {
+	tf.mutex.Lock()
+	defer tf.mutex.Unlock()
+	tf.idleTimeout = timeout
+}
+
+// idleLoop reset session without frame in idleTimeout
+func (tf *CodecMixer) idleLoop() {
+	ticker := time.NewTicker(1e9)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-tf.closing:
+			return
+		}
+		now := time.Now()
+		idle := make([]uint64, 0)
+		tf.mutex.Lock()
+		timeout := tf.idleTimeout
+		for ssid, t := range tf.ssactive {
+			if timeout > 0 && now.Sub(t) > timeout {
+				idle = append(idle, ssid)
+			}
+		}
+		tf.mutex.Unlock()
+		for _, ssid := range idle {
+			tf.resetSession(ssid, IO_ERR_IDLE, fmt.Errorf("idle timeout(%v)", timeout))
+		}
+		tf.lingerPeers(now)
+	}
+}
@@ -0,0 +1,463 @@
+/*
+	shell completion and man page generator for Opts_t
+*/
+
+package getopt
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wheelcomplex/preinit/misc"
+)
+
+// hidden flags to output completion script/man page, not show in usage
+const (
+	GEN_COMPLETION_FLAG = "--pr-gen-completion" // --pr-gen-completion bash/zsh/fish
+	GEN_MAN_FLAG        = "--pr-gen-man"        // --pr-gen-man
+)
+
+// value hint for completion
+const (
+	HINT_NONE = ""     // no completion for value
+	HINT_FILE = "file" // complete value by file path
+	HINT_DIR  = "dir"  // complete value by directory path
+)
+
+// SetEnum set list of valid values for option, values will be used by shell completion
+// return string of this option, empty if option no exist
+func (op *Opts_t) SetEnum(long string, values ...string) string {
+	opt := op.getOption("options", long)
+	if opt == nil {
+		if opt = op.getOption("flags", long); opt == nil {
+			return ""
+		}
+	}
+	opt.enum = make([]string, 0, len(values))
+	opt.enum = append(opt.enum, values...)
+	return opt.String()
+}
+
+// SetHint set value hint(HINT_FILE, HINT_DIR) for option, hint will be used by shell completion
+// return string of this option, empty if option no exist
+func (op *Opts_t) SetHint(long string, hint string) string {
+	opt := op.getOption("options", long)
+	if opt == nil {
+		if opt = op.getOption("flags", long); opt == nil {
+			return ""
+		}
+	}
+	opt.hint = hint
+	return opt.String()
+}
+
+// progName return base name of executing file
+func (op *Opts_t) progName() string {
+	return filepath.Base(os.Args[0])
+}
+
+// rawText return text of __version, __desc, __notes
+func (op *Opts_t) rawText(sestion string) string {
+	if opt := op.getOption(sestion, sestion); opt != nil {
+		return opt.desc
+	}
+	return ""
+}
+
+// optionList return options declared in this command and parents, in order
+func (op *Opts_t) optionList() []*option_t {
+	list := make([]*option_t, 0, 0)
+	for p := op; p != nil; p = p.parent {
+		for _, sestion := range []string{"options", "flags"} {
+			for _, idx := range p.sestionKeys[sestion] {
+				if idx == "" {
+					continue
+				}
+				list = append(list, p.sestions[sestion][idx])
+			}
+		}
+	}
+	return list
+}
+
+// commandList return sub commands of this command, in order
+func (op *Opts_t) commandList() []*Opts_t {
+	list := make([]*Opts_t, 0, len(op.commands))
+	for _, idx := range op.sestionKeys["commands"] {
+		if cmd, ok := op.commands[idx]; ok {
+			list = append(list, cmd)
+		}
+	}
+	return list
+}
+
+// walkCommands call fn for op and all sub commands, parent first
+func (op *Opts_t) walkCommands(fn func(cmd *Opts_t)) {
+	fn(op)
+	for _, cmd := range op.commandList() {
+		cmd.walkCommands(fn)
+	}
+}
+
+// completionWords return words for complete after command, commands first
+func (op *Opts_t) completionWords() []string {
+	words := make([]string, 0, 0)
+	if len(op.commands) > 0 {
+		words = append(words, "help")
+	}
+	for _, cmd := range op.commandList() {
+		words = append(words, cmd.name)
+	}
+	for _, opt := range op.optionList() {
+		words = append(words, opt.long)
+	}
+	return words
+}
+
+// quoteSingle quote s for shell single quote string
+func quoteSingle(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// BashCompletion return bash completion script
+func (op *Opts_t) BashCompletion() string {
+	r := op.root()
+	prog := r.progName()
+	fn := "_" + strings.Replace(strings.Replace(prog, "-", "_", -1), ".", "_", -1)
+	text := "# bash completion for " + prog + ", generated by getopt\n"
+	text += fn + "()\n{\n"
+	text += "\tlocal cur prev cmd i\n"
+	text += "\tCOMPREPLY=()\n"
+	text += "\tcur=\"${COMP_WORDS[COMP_CWORD]}\"\n"
+	text += "\tprev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n"
+	text += "\tcmd=\"\"\n"
+	// resolve command path
+	paths := make([]string, 0, 0)
+	r.walkCommands(func(cmd *Opts_t) {
+		if cmd.parent != nil {
+			paths = append(paths, "\" "+cmd.CommandPath()+"\"")
+		}
+	})
+	if len(paths) > 0 {
+		text += "\tfor ((i=1; i<COMP_CWORD; i++)); do\n"
+		text += "\t\tcase \"${cmd} ${COMP_WORDS[i]}\" in\n"
+		text += "\t\t\t" + strings.Join(paths, "|") + ") cmd=\"${cmd} ${COMP_WORDS[i]}\" ;;\n"
+		text += "\t\tesac\n"
+		text += "\tdone\n"
+	}
+	// values of option
+	passed := make(map[string]struct{})
+	values := ""
+	r.walkCommands(func(cmd *Opts_t) {
+		for _, opt := range cmd.optionList() {
+			if _, ok := passed[opt.long]; ok {
+				continue
+			}
+			passed[opt.long] = struct{}{}
+			switch {
+			case len(opt.enum) > 0:
+				values += "\t\t" + opt.long + ") COMPREPLY=( $(compgen -W " + quoteSingle(strings.Join(opt.enum, " ")) + " -- \"${cur}\") ); return 0 ;;\n"
+			case opt.hint == HINT_FILE:
+				values += "\t\t" + opt.long + ") COMPREPLY=( $(compgen -f -- \"${cur}\") ); return 0 ;;\n"
+			case opt.hint == HINT_DIR:
+				values += "\t\t" + opt.long + ") COMPREPLY=( $(compgen -d -- \"${cur}\") ); return 0 ;;\n"
+			}
+		}
+	})
+	if values != "" {
+		text += "\tcase \"${prev}\" in\n" + values + "\tesac\n"
+	}
+	// words of command
+	text += "\tcase \"${cmd}\" in\n"
+	r.walkCommands(func(cmd *Opts_t) {
+		key := "\"\""
+		if cmd.parent != nil {
+			key = "\" " + cmd.CommandPath() + "\""
+		}
+		text += "\t\t" + key + ") COMPREPLY=( $(compgen -W " + quoteSingle(strings.Join(cmd.completionWords(), " ")) + " -- \"${cur}\") ) ;;\n"
+	})
+	text += "\tesac\n"
+	text += "\treturn 0\n}\n"
+	text += "complete -o default -F " + fn + " " + prog + "\n"
+	return text
+}
+
+// zshEscape escape s for zsh _arguments spec
+func zshEscape(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "'", `'\''`, -1)
+	s = strings.Replace(s, "[", `\[`, -1)
+	s = strings.Replace(s, "]", `\]`, -1)
+	s = strings.Replace(s, ":", `\:`, -1)
+	return s
+}
+
+// ZshCompletion return zsh completion script
+func (op *Opts_t) ZshCompletion() string {
+	r := op.root()
+	prog := r.progName()
+	fn := "_" + strings.Replace(strings.Replace(prog, "-", "_", -1), ".", "_", -1)
+	text := "#compdef " + prog + "\n"
+	text += "# zsh completion for " + prog + ", generated by getopt\n"
+	text += fn + "() {\n"
+	text += "\tlocal cmd=\"\" i\n"
+	paths := make([]string, 0, 0)
+	r.walkCommands(func(cmd *Opts_t) {
+		if cmd.parent != nil {
+			paths = append(paths, "\" "+cmd.CommandPath()+"\"")
+		}
+	})
+	if len(paths) > 0 {
+		text += "\tfor ((i=2; i<CURRENT; i++)); do\n"
+		text += "\t\tcase \"${cmd} ${words[i]}\" in\n"
+		text += "\t\t\t" + strings.Join(paths, "|") + ") cmd=\"${cmd} ${words[i]}\" ;;\n"
+		text += "\t\tesac\n"
+		text += "\tdone\n"
+	}
+	text += "\tcase \"${cmd}\" in\n"
+	r.walkCommands(func(cmd *Opts_t) {
+		key := "\"\""
+		if cmd.parent != nil {
+			key = "\" " + cmd.CommandPath() + "\""
+		}
+		text += "\t\t" + key + ")\n\t\t\t_arguments -s"
+		for _, opt := range cmd.optionList() {
+			action := ":value: "
+			switch {
+			case len(opt.enum) > 0:
+				action = ":value:(" + zshEscape(strings.Join(opt.enum, " ")) + ")"
+			case opt.hint == HINT_FILE:
+				action = ":file:_files"
+			case opt.hint == HINT_DIR:
+				action = ":directory:_files -/"
+			case opt.sestion == "flags":
+				action = ""
+			}
+			text += " \\\n\t\t\t\t'" + opt.long + "[" + zshEscape(opt.desc) + "]" + action + "'"
+		}
+		if len(cmd.commands) > 0 {
+			subs := "help\\:" + zshEscape("\"show help of command\"")
+			for _, sub := range cmd.commandList() {
+				subs += " " + sub.name + "\\:" + zshEscape("\""+sub.rawText("__desc")+"\"")
+			}
+			text += " \\\n\t\t\t\t'1:command:((" + subs + "))'"
+		} else {
+			text += " \\\n\t\t\t\t'*:file:_files'"
+		}
+		text += "\n\t\t\t;;\n"
+	})
+	text += "\tesac\n"
+	text += "}\n"
+	text += fn + " \"$@\"\n"
+	return text
+}
+
+// FishCompletion return fish completion script
+func (op *Opts_t) FishCompletion() string {
+	r := op.root()
+	prog := r.progName()
+	text := "# fish completion for " + prog + ", generated by getopt\n"
+	r.walkCommands(func(cmd *Opts_t) {
+		// condition of this command
+		cond := ""
+		if cmd.parent != nil {
+			cond = " -n " + quoteSingle("__fish_seen_subcommand_from "+cmd.name)
+		} else if len(cmd.commands) > 0 {
+			cond = " -n __fish_use_subcommand"
+		}
+		if len(cmd.commands) > 0 {
+			text += "complete -c " + prog + cond + " -f -a help -d " + quoteSingle("show help of command") + "\n"
+		}
+		for _, sub := range cmd.commandList() {
+			text += "complete -c " + prog + cond + " -f -a " + sub.name + " -d " + quoteSingle(sub.rawText("__desc")) + "\n"
+		}
+		optcond := ""
+		if cmd.parent != nil {
+			optcond = cond
+		}
+		for _, sestion := range []string{"options", "flags"} {
+			for _, idx := range cmd.sestionKeys[sestion] {
+				if idx == "" {
+					continue
+				}
+				opt := cmd.sestions[sestion][idx]
+				name := strings.TrimLeft(opt.long, "-")
+				if name == "" {
+					continue
+				}
+				line := "complete -c " + prog + optcond
+				if strings.HasPrefix(opt.long, "--") {
+					line += " -l " + name
+				} else {
+					line += " -o " + name
+				}
+				switch {
+				case len(opt.enum) > 0:
+					line += " -x -a " + quoteSingle(strings.Join(opt.enum, " "))
+				case opt.hint == HINT_FILE:
+					line += " -r -F"
+				case opt.hint == HINT_DIR:
+					line += " -x -a '(__fish_complete_directories)'"
+				case sestion == "options":
+					line += " -r"
+				}
+				text += line + " -d " + quoteSingle(opt.desc) + "\n"
+			}
+		}
+	})
+	return text
+}
+
+// roffEscape escape s for roff text
+func roffEscape(s string) string {
+	s = strings.Replace(s, `\`, `\e`, -1)
+	s = strings.Replace(s, "-", `\-`, -1)
+	lines := strings.Split(s, "\n")
+	for idx, line := range lines {
+		if strings.HasPrefix(line, ".") || strings.HasPrefix(line, "'") {
+			lines[idx] = `\&` + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// roffQuote return s as quoted argument of roff request, embedded quote is doubled
+func roffQuote(s string) string {
+	s = strings.Replace(roffEscape(strings.Replace(s, "\n", " ", -1)), `"`, `""`, -1)
+	return `"` + s + `"`
+}
+
+// manDate return date of man page, SOURCE_DATE_EPOCH is used if set for reproducible build
+func manDate() time.Time {
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		if sec, err := strconv.ParseInt(epoch, 10, 64); err == nil {
+			return time.Unix(sec, 0).UTC()
+		}
+	}
+	return time.Now()
+}
+
+// roffOption return man page lines of option
+func roffOption(opt *option_t) string {
+	text := ".TP\n.B " + roffEscape(opt.long)
+	if opt.sestion == "options" {
+		text = ".TP\n.BI \"" + roffEscape(opt.long) + " \" value"
+	}
+	text += "\n" + roffEscape(opt.desc)
+	if len(opt.enum) > 0 {
+		text += "\nValues: " + roffEscape(strings.Join(opt.enum, ", ")) + "."
+	}
+	if len(opt.defval) > 0 && strings.Trim(strings.Join(opt.defval, ""), " ") != "" {
+		text += "\nDefault: " + roffEscape(strings.Join(opt.defval, ",")) + "."
+	}
+	if opt.env != "" {
+		text += "\nEnvironment: " + roffEscape(opt.env) + "."
+	}
+	return text + "\n"
+}
+
+// ManPage return man page of command in roff format
+func (op *Opts_t) ManPage() string {
+	r := op.root()
+	prog := r.progName()
+	version := r.rawText("__version")
+	desc := r.rawText("__desc")
+	title := strings.SplitN(desc, "\n", 2)[0]
+	text := ".TH " + roffQuote(strings.ToUpper(prog)) + " 1 " + roffQuote(manDate().Format("2006-01-02")) + " " + roffQuote(version) + "\n"
+	text += ".SH NAME\n" + roffEscape(prog)
+	if title != "" {
+		text += ` \- ` + roffEscape(title)
+	}
+	text += "\n.SH SYNOPSIS\n"
+	r.walkCommands(func(cmd *Opts_t) {
+		line := strings.TrimPrefix(cmd.CommandLine(), misc.ExecFileOfPid(os.Getpid()))
+		text += ".B " + roffEscape(prog) + "\n" + roffEscape(strings.TrimSpace(line)) + "\n.br\n"
+	})
+	if desc != "" {
+		text += ".SH DESCRIPTION\n" + roffEscape(desc) + "\n"
+	}
+	if len(r.commands) > 0 {
+		text += ".SH COMMANDS\n"
+		r.walkCommands(func(cmd *Opts_t) {
+			if cmd.parent == nil {
+				return
+			}
+			text += ".TP\n.B " + roffEscape(cmd.CommandPath()) + "\n" + roffEscape(cmd.rawText("__desc")) + "\n"
+			for _, sestion := range []string{"options", "flags"} {
+				for _, idx := range cmd.sestionKeys[sestion] {
+					if idx != "" {
+						text += ".RS\n" + roffOption(cmd.sestions[sestion][idx]) + ".RE\n"
+					}
+				}
+			}
+		})
+	}
+	opts := ""
+	for _, sestion := range []string{"options", "flags"} {
+		for _, idx := range r.sestionKeys[sestion] {
+			if idx != "" {
+				opts += roffOption(r.sestions[sestion][idx])
+			}
+		}
+	}
+	if opts != "" {
+		text += ".SH OPTIONS\n" + opts
+	}
+	envs := ""
+	r.walkCommands(func(cmd *Opts_t) {
+		for _, sestion := range []string{"options", "flags"} {
+			for _, idx := range cmd.sestionKeys[sestion] {
+				if idx != "" && cmd.sestions[sestion][idx].env != "" {
+					opt := cmd.sestions[sestion][idx]
+					envs += ".TP\n.B " + roffEscape(opt.env) + "\nsame as " + roffEscape(opt.long) + "\n"
+				}
+			}
+		}
+	})
+	if envs != "" {
+		text += ".SH ENVIRONMENT\n" + envs
+	}
+	if notes := r.rawText("__notes"); notes != "" {
+		text += ".SH NOTES\n" + roffEscape(notes) + "\n"
+	}
+	return text
+}
+
+// GenCompletion return completion script for shell(bash, zsh, fish)
+func (op *Opts_t) GenCompletion(shell string) (string, error) {
+	switch strings.ToLower(shell) {
+	case "bash":
+		return op.BashCompletion(), nil
+	case "zsh":
+		return op.ZshCompletion(), nil
+	case "fish":
+		return op.FishCompletion(), nil
+	}
+	return "", fmt.Errorf("getopt: completion for shell %q not supported, should be bash, zsh or fish", shell)
+}
+
+// Generate output completion script/man page to stdout if hidden flags in args
+// return true if hidden flags found, caller should exit after that
+// called by Dispatch, programs without Dispatch should call it after options declared
+func (op *Opts_t) Generate() (bool, error) {
+	r := op.root()
+	for p := r; p != nil; p = p.command {
+		if _, ok := p.longArr[GEN_MAN_FLAG]; ok {
+			fmt.Fprintf(os.Stdout, "%s", r.ManPage())
+			return true, nil
+		}
+		if list, ok := p.longArr[GEN_COMPLETION_FLAG]; ok {
+			text, err := r.GenCompletion(list[0])
+			if err != nil {
+				return true, err
+			}
+			fmt.Fprintf(os.Stdout, "%s", text)
+			return true, nil
+		}
+	}
+	return false, nil
+}
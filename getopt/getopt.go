@@ -6,6 +6,7 @@ package getopt
 
 //
 import (
+	"errors"
 	"fmt"
 	"os"
 	"strconv"
@@ -20,6 +21,9 @@ type option_t struct {
 	defval  []string // default value
 	desc    string   // description of this option
 	sestion string   // sestion of this option
+	env     string   // environment variable of this option
+	enum    []string // valid values for completion
+	hint    string   // value hint for completion, check HINT_*
 }
 
 // String of option_t
@@ -38,6 +42,9 @@ func (o *option_t) String() string {
 		line = line + ", "
 	}
 	line = line + o.desc
+	if o.env != "" {
+		line = line + ", env: " + o.env
+	}
 	if len(o.defval) > 0 {
 		cnt := 0
 		defstr := ""
@@ -68,8 +75,23 @@ type Opts_t struct {
 	sestionKeys        map[string][]string             // list of --options in order
 	maxSestionTitleLen int                             // prefix lenght for usage format
 	powered            string                          // powered string
+	name               string                          // command name, empty for top level
+	parent             *Opts_t                         // parent command, nil for top level
+	commands           map[string]*Opts_t              // sub commands by name
+	command            *Opts_t                         // sub command resolved by Parse
+	handler            CommandHandler                  // handler call by Dispatch
+	helpTarget         *Opts_t                         // command to show usage for, resolved by 'help' command
+	args               []string                        // args of last Parse
+	envPrefix          string                          // prefix of environment variable name, eg,. PREINIT_
+	envStrip           string                          // prefix of long option to strip when make environment variable name, eg,. --pr-
+	envs               map[string]string               // environment variable name set by SetEnv
+	envArr             map[string][]string             // value of environment variable loaded by ApplyJSON
+	rules              []*rule_t                       // constraints of options in order, checked by Validate
 }
 
+// CommandHandler is the function call by Dispatch for resolved command
+type CommandHandler func(op *Opts_t) error
+
 // NewOptsFromString parsed line and return opt paser struct
 func NewOptsFromString(line string) *Opts_t {
 	return NewOpts(misc.LineToArgs(line))
@@ -118,6 +140,9 @@ func (op *Opts_t) setOption(sestion, long string, defval []string, format string
 		sestion: sestion,
 		defval:  defval,
 	}
+	if sestion == "options" || sestion == "flags" {
+		op.sestions[sestion][long].env = op.envName(long)
+	}
 	if _, ok := op.sestionKeys[sestion]; ok == false {
 		op.sestionKeys[sestion] = make([]string, 0, 0)
 	}
@@ -206,7 +231,11 @@ func (op *Opts_t) sestionString(sestion string) string {
 ///// __version, __desc, options, flags, lists, __notes
 
 // VersionString return version text in string
+// sub command use version text of top level
 func (op *Opts_t) VersionString() string {
+	if op.parent != nil {
+		return op.root().VersionString()
+	}
 	return op.sestionString("__version")
 }
 
@@ -234,6 +263,37 @@ func (op *Opts_t) FlagString() string {
 	return op.sestionString("flags")
 }
 
+// CommandString return sub commands text in string
+func (op *Opts_t) CommandString() string {
+	return op.sestionString("commands")
+}
+
+// GlobalOptionString return options inherited from parent commands in string
+// return empty for top level
+func (op *Opts_t) GlobalOptionString() string {
+	var text string
+	for p := op.parent; p != nil; p = p.parent {
+		for _, idx := range p.sestionKeys["options"] {
+			if idx == "" {
+				continue
+			}
+			text = text + "  " + p.sestions["options"][idx].String() + "\n"
+		}
+	}
+	if text == "" {
+		return text
+	}
+	return op.sestionTitle("global options") + text
+}
+
+// sestionTitle return padded title for usage, end with :\n
+func (op *Opts_t) sestionTitle(title string) string {
+	if padlen := op.maxSestionTitleLen - len(title); padlen > 0 {
+		return strings.Repeat(" ", padlen) + title + ":\n"
+	}
+	return title + ":\n"
+}
+
 // NoFlagString return noFlags text in string
 func (op *Opts_t) NoFlagString() string {
 	return op.sestionString("lists")
@@ -265,16 +325,20 @@ func (op *Opts_t) CommandLine() string {
 			noflag = "[f1 f2 f3 ...]"
 		}
 	}
-	text := misc.CleanArgLine(longflag + " " + longopt + " " + noflag)
-	if len(text) == 0 || text == " " {
+	cmd := ""
+	if len(op.commands) > 0 {
+		cmd = "<command>"
+	}
+	text := misc.CleanArgLine(longflag + " " + longopt + " " + cmd + " " + noflag)
+	if (len(text) == 0 || text == " ") && op.parent == nil {
 		return "\n"
 	}
-	return misc.ExecFileOfPid(os.Getpid()) + " " + text + "\n"
+	return misc.CleanArgLine(misc.ExecFileOfPid(os.Getpid())+" "+op.CommandPath()+" "+text) + "\n"
 }
 
 // UsageString return usage text in string
 func (op *Opts_t) UsageString() string {
-	return strings.Trim(op.VersionString()+"\n"+op.DescriptionString()+"\nUSAGE:\n"+op.CommandLine()+op.OptionString()+op.FlagString()+op.NoFlagString()+op.NoteString(), "\n") + "\n"
+	return strings.Trim(op.VersionString()+"\n"+op.DescriptionString()+"\nUSAGE:\n"+op.CommandLine()+op.CommandString()+op.OptionString()+op.FlagString()+op.NoFlagString()+op.ConstraintString()+op.GlobalOptionString()+op.NoteString(), "\n") + "\n"
 }
 
 // Usage output usage text to stderr
@@ -300,6 +364,292 @@ func (op *Opts_t) reset() {
 	op.sestionKeys = make(map[string][]string)
 	op.maxSestionTitleLen = 0
 	op.powered = "Powered by Go"
+	op.commands = make(map[string]*Opts_t)
+	op.envs = make(map[string]string)
+	op.envArr = make(map[string][]string)
+}
+
+// root return top level command
+func (op *Opts_t) root() *Opts_t {
+	for op.parent != nil {
+		op = op.parent
+	}
+	return op
+}
+
+// AddCommand add sub command(app name [--options value,...]) and return opt paser struct of it
+// options set to sub command only available after name, options of parent are inherited
+// sub command can has its sub command, eg,. app config check
+// will return exist one if name already added
+func (op *Opts_t) AddCommand(name string, format string, a ...interface{}) *Opts_t {
+	name = misc.CleanArgLine(name)
+	if name == "" || name == "help" || strings.HasPrefix(name, "-") {
+		return nil
+	}
+	if cmd, ok := op.commands[name]; ok {
+		return cmd
+	}
+	cmd := new(Opts_t)
+	cmd.reset()
+	cmd.powered = ""
+	cmd.name = name
+	cmd.parent = op
+	cmd.envPrefix = op.envPrefix
+	cmd.envStrip = op.envStrip
+	cmd.SetDescription(format, a...)
+	if len(op.commands) == 0 {
+		op.setOption("commands", "help", []string{}, "show help of command, eg,. help %s", name)
+	}
+	op.commands[name] = cmd
+	op.setOption("commands", name, []string{}, format, a...)
+	// re-parse for new command
+	r := op.root()
+	r.Parse(r.args)
+	return cmd
+}
+
+// envName return environment variable name of option declared in op
+// return empty if no environment variable for this option
+func (op *Opts_t) envName(long string) string {
+	if name, ok := op.envs[long]; ok {
+		return name
+	}
+	if op.envPrefix == "" || strings.HasPrefix(long, "__") {
+		return ""
+	}
+	name := long
+	if op.envStrip != "" && strings.HasPrefix(name, op.envStrip) {
+		name = name[len(op.envStrip):]
+	}
+	name = strings.Trim(name, "-")
+	if name == "" {
+		return ""
+	}
+	return op.envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// updateEnv reset environment variable name of all options
+func (op *Opts_t) updateEnv() {
+	for _, sestion := range []string{"options", "flags"} {
+		for long, opt := range op.sestions[sestion] {
+			opt.env = op.envName(long)
+		}
+	}
+}
+
+// SetEnvPrefix set environment variable name for all options
+// name is prefix + upper-cased long option(strip leading strip and -, - replace by _)
+// eg,. SetEnvPrefix("PREINIT_", "--pr-") make --pr-logdir to PREINIT_LOGDIR
+// empty prefix to disable environment variable, option set by SetEnv is not effected
+// sub commands use the same prefix
+// return old prefix
+func (op *Opts_t) SetEnvPrefix(prefix, strip string) string {
+	old := op.envPrefix
+	op.envPrefix = prefix
+	op.envStrip = strip
+	op.updateEnv()
+	for _, cmd := range op.commands {
+		cmd.SetEnvPrefix(prefix, strip)
+	}
+	return old
+}
+
+// SetEnv set environment variable name for option long
+// empty name to disable environment variable for this option
+func (op *Opts_t) SetEnv(long, name string) {
+	op.envs[long] = name
+	op.updateEnv()
+}
+
+// EnvName return environment variable name of option
+// return empty if option no declared or no environment variable for it
+func (op *Opts_t) EnvName(flag string) string {
+	if p := op.declared(flag); p != nil {
+		return p.envName(flag)
+	}
+	return ""
+}
+
+// getEnvList return list value from environment variable of option declared in op
+// if no exist or empty, return empty []string
+func (op *Opts_t) getEnvList(flag string) []string {
+	if op.getOption("options", flag) == nil && op.getOption("flags", flag) == nil {
+		return make([]string, 0, 0)
+	}
+	name := op.envName(flag)
+	if name == "" {
+		return make([]string, 0, 0)
+	}
+	if list, ok := op.envArr[flag]; ok {
+		return list
+	}
+	val := misc.CleanArgLine(os.Getenv(name))
+	if val == "" {
+		return make([]string, 0, 0)
+	}
+	return strings.Split(strings.Replace(val, " ", ",", -1), ",")
+}
+
+// Source return where value of option come from: argv, env or default
+// return empty if option no exist
+func (op *Opts_t) Source(flag string) string {
+	if len(op.getStringList(flag)) > 0 {
+		return "argv"
+	}
+	if len(op.getEnvList(flag)) > 0 {
+		return "env"
+	}
+	if op.getOption("options", flag) != nil || op.getOption("flags", flag) != nil {
+		return "default"
+	}
+	if op.parent != nil {
+		return op.parent.Source(flag)
+	}
+	return ""
+}
+
+// SetHandler set function call by Dispatch when this command resolved
+func (op *Opts_t) SetHandler(fn CommandHandler) *Opts_t {
+	op.handler = fn
+	return op
+}
+
+// Name return name of command, empty for top level
+func (op *Opts_t) Name() string {
+	return op.name
+}
+
+// CommandPath return names of command from top level, eg,. config check
+func (op *Opts_t) CommandPath() string {
+	if op.parent == nil {
+		return ""
+	}
+	return misc.CleanArgLine(op.parent.CommandPath() + " " + op.name)
+}
+
+// Command return sub command resolved by Parse
+// return nil if no sub command in args
+func (op *Opts_t) Command() *Opts_t {
+	return op.command
+}
+
+// Resolved return the deepest command resolved by Parse, return op if no sub command in args
+func (op *Opts_t) Resolved() *Opts_t {
+	for op.command != nil {
+		op = op.command
+	}
+	return op
+}
+
+// Dispatch call handler of resolved command
+// options are checked by Validate befor call handler
+// app help [command] output usage of command
+// app --pr-gen-completion bash/zsh/fish output completion script, app --pr-gen-man output man page
+// return error if command has sub command but none given and no handler for it
+func (op *Opts_t) Dispatch() error {
+	if op.parent == nil {
+		if ok, err := op.Generate(); ok {
+			return err
+		}
+		if op.helpTarget == nil {
+			if errs := op.Validate(); len(errs) > 0 {
+				text := make([]string, 0, len(errs))
+				for _, err := range errs {
+					text = append(text, err.Error())
+				}
+				return errors.New(strings.Join(text, "; "))
+			}
+		}
+	}
+	if op.helpTarget != nil {
+		op.helpTarget.Usage()
+		return nil
+	}
+	if op.command != nil {
+		return op.command.Dispatch()
+	}
+	if op.handler != nil {
+		return op.handler(op)
+	}
+	if len(op.commands) > 0 {
+		op.Usage()
+		return fmt.Errorf("%s: no command given", misc.CleanArgLine("getopt "+op.CommandPath()))
+	}
+	return nil
+}
+
+// isBoolOpt return true if flag defined as bool in op or parents
+func (op *Opts_t) isBoolOpt(flag string) bool {
+	for p := op; p != nil; p = p.parent {
+		if p.getOption("flags", flag) != nil {
+			return true
+		}
+		if opt := p.getOption("options", flag); opt != nil {
+			if len(opt.defval) == 1 {
+				val := strings.ToLower(opt.defval[0])
+				return val == "true" || val == "false"
+			}
+			return false
+		}
+	}
+	return false
+}
+
+// commandIndex return index of sub command name in args
+// return -1 if no sub command found
+func (op *Opts_t) commandIndex(args []string) int {
+	if len(op.commands) == 0 {
+		return -1
+	}
+	var newFlag string
+	for idx, val := range args {
+		if val == "-" || val == "--" {
+			continue
+		}
+		if strings.HasPrefix(val, "-") {
+			newFlag = val
+			continue
+		}
+		if newFlag != "" && op.isBoolOpt(newFlag) == false {
+			// this is value for newFlag
+			newFlag = ""
+			continue
+		}
+		newFlag = ""
+		if _, ok := op.commands[val]; ok || val == "help" {
+			return idx
+		}
+	}
+	return -1
+}
+
+// declared return opt paser struct where flag declared, search from op to top level
+// return nil if flag not declared
+func (op *Opts_t) declared(flag string) *Opts_t {
+	for p := op; p != nil; p = p.parent {
+		if p.getOption("options", flag) != nil || p.getOption("flags", flag) != nil {
+			return p
+		}
+	}
+	return nil
+}
+
+// inherit move options declared by parents from command line of sub command to parents
+func (op *Opts_t) inherit() {
+	keys := make([]string, 0, len(op.longKeys))
+	for _, k1 := range op.longKeys {
+		owner := op.declared(k1)
+		if owner == nil || owner == op {
+			keys = append(keys, k1)
+			continue
+		}
+		if misc.ArgsIndex(owner.longKeys, k1) == -1 {
+			owner.longKeys = append(owner.longKeys, k1)
+		}
+		owner.longArr[k1] = op.longArr[k1]
+		delete(op.longArr, k1)
+	}
+	op.longKeys = keys
 }
 
 // SetPowered set powered string of usage
@@ -313,7 +663,34 @@ func (op *Opts_t) SetPowered(val string) string {
 }
 
 // String convert opt paser struct to strings, include default values
+// value from environment marked as value(env:NAME), default value marked as value(default)
 func (op *Opts_t) String() string {
+	return op.mergedString(true)
+}
+
+// MergedString convert opt paser struct to strings, include default values
+// no source mark, for rebuilding command line
+func (op *Opts_t) MergedString() string {
+	return op.mergedString(false)
+}
+
+// markValue return kval with source mark of flag
+func (op *Opts_t) markValue(flag, kval string, mark bool) string {
+	if mark == false || kval == "" {
+		return kval
+	}
+	switch op.Source(flag) {
+	case "env":
+		return kval + "(env:" + op.EnvName(flag) + ")"
+	case "default":
+		return kval + "(default)"
+	}
+	return kval
+}
+
+// mergedString convert opt paser struct to strings, include default values
+// mark == true to mark source of value
+func (op *Opts_t) mergedString(mark bool) string {
 	var shortflag, shortoption, longflag, longoption string
 	passed := make(map[string]struct{})
 	// default flags/options
@@ -324,7 +701,7 @@ func (op *Opts_t) String() string {
 		}
 		kval := op.GetStrings(k1)
 		if strings.HasPrefix(k1, "--") == false && len(kval) == 0 {
-			shortflag = shortflag + " " + k1 + " " + kval
+			shortflag = shortflag + " " + k1 + " " + op.markValue(k1, kval, mark)
 			passed[k1] = struct{}{}
 		}
 	}
@@ -335,7 +712,7 @@ func (op *Opts_t) String() string {
 		}
 		kval := op.GetStrings(k1)
 		if strings.HasPrefix(k1, "--") == false && len(kval) > 0 {
-			shortoption = shortoption + " " + k1 + " " + kval
+			shortoption = shortoption + " " + k1 + " " + op.markValue(k1, kval, mark)
 			passed[k1] = struct{}{}
 		}
 	}
@@ -346,7 +723,7 @@ func (op *Opts_t) String() string {
 		}
 		kval := op.GetStrings(k1)
 		if strings.HasPrefix(k1, "--") == true && len(kval) == 0 {
-			longflag = longflag + " " + k1 + " " + kval
+			longflag = longflag + " " + k1 + " " + op.markValue(k1, kval, mark)
 			passed[k1] = struct{}{}
 		}
 	}
@@ -357,7 +734,7 @@ func (op *Opts_t) String() string {
 		}
 		kval := op.GetStrings(k1)
 		if strings.HasPrefix(k1, "--") == true && len(kval) > 0 {
-			longoption = longoption + " " + k1 + " " + kval
+			longoption = longoption + " " + k1 + " " + op.markValue(k1, kval, mark)
 			passed[k1] = struct{}{}
 		}
 	}
@@ -369,7 +746,7 @@ func (op *Opts_t) String() string {
 		}
 		kval := op.GetStrings(k1)
 		if strings.HasPrefix(k1, "--") == false && len(kval) == 0 {
-			shortflag = shortflag + " " + k1 + " " + kval
+			shortflag = shortflag + " " + k1 + " " + op.markValue(k1, kval, mark)
 			passed[k1] = struct{}{}
 		}
 	}
@@ -380,7 +757,7 @@ func (op *Opts_t) String() string {
 		}
 		kval := op.GetStrings(k1)
 		if strings.HasPrefix(k1, "--") == false && len(kval) > 0 {
-			shortoption = shortoption + " " + k1 + " " + kval
+			shortoption = shortoption + " " + k1 + " " + op.markValue(k1, kval, mark)
 			passed[k1] = struct{}{}
 		}
 	}
@@ -391,7 +768,7 @@ func (op *Opts_t) String() string {
 		}
 		kval := op.GetStrings(k1)
 		if strings.HasPrefix(k1, "--") == true && len(kval) == 0 {
-			longflag = longflag + " " + k1 + " " + kval
+			longflag = longflag + " " + k1 + " " + op.markValue(k1, kval, mark)
 			passed[k1] = struct{}{}
 		}
 	}
@@ -402,7 +779,7 @@ func (op *Opts_t) String() string {
 		}
 		kval := op.GetStrings(k1)
 		if strings.HasPrefix(k1, "--") == true && len(kval) > 0 {
-			longoption = longoption + " " + k1 + " " + kval
+			longoption = longoption + " " + k1 + " " + op.markValue(k1, kval, mark)
 			passed[k1] = struct{}{}
 		}
 	}
@@ -448,8 +825,40 @@ func (op *Opts_t) ParseString(line string) {
 	op.Parse(misc.LineToArgs(line))
 }
 
-// ParseMap get opt paser struct ready to use
+// Parse get opt paser struct ready to use
+// if sub command added, args after command name will parse by sub command
+// and no-flag list only hold no-flag args of this command
 func (op *Opts_t) Parse(args []string) {
+	op.args = make([]string, 0, len(args))
+	op.args = append(op.args, args...)
+	op.command = nil
+	op.helpTarget = nil
+	idx := op.commandIndex(args)
+	if idx == -1 {
+		op.parseArgs(args)
+		return
+	}
+	op.parseArgs(args[:idx])
+	if args[idx] == "help" {
+		// app help config check
+		op.helpTarget = op
+		for _, val := range args[idx+1:] {
+			if cmd, ok := op.helpTarget.commands[val]; ok {
+				op.helpTarget = cmd
+			}
+		}
+		return
+	}
+	op.command = op.commands[args[idx]]
+	op.command.Parse(args[idx+1:])
+	op.command.inherit()
+	// help resolved by sub command
+	op.helpTarget = op.command.helpTarget
+	op.command.helpTarget = nil
+}
+
+// parseArgs parse flags/options/no-flags of this command
+func (op *Opts_t) parseArgs(args []string) {
 	// reset
 	op.parserReset()
 	tmpList := make([]string, 0, len(args)+1)
@@ -558,15 +967,21 @@ func (op *Opts_t) OptNoFlagsLine() string {
 }
 
 // GetStringList return list value of option
-// if option no exist, return defval(if no default defined return empty list)
+// if option no exist, return value of environment variable, then defval(if no default defined return empty list)
+// option declared by parent command is inherited by sub command
 func (op *Opts_t) GetStringList(flag string) []string {
 	val := op.getStringList(flag)
+	if len(val) == 0 {
+		val = op.getEnvList(flag)
+	}
 	if len(val) == 0 {
 		// try defaut value
 		if opt := op.getOption("options", flag); opt != nil {
 			val = opt.defval
 		} else if opt := op.getOption("flags", flag); opt != nil {
 			val = opt.defval
+		} else if op.parent != nil {
+			val = op.parent.GetStringList(flag)
 		}
 	}
 	return val
@@ -681,14 +1096,23 @@ func (op *Opts_t) OptIntList(flag []int, long string, defval []string, format st
 
 // DelKeyValue modify Opts_t to match commandLine removed "key value"
 // if key is flag, value == "" will remove all value of key, otherwise remove only flag match "key value"
+// value from environment variable is keep as env source and not removed
 func (op *Opts_t) DelKeyValue(key, value string) {
-	newop := NewOptsFromString(op.String())
+	newop := NewOptsFromString(op.mergedString(false))
 	delop := NewOptsFromString(misc.CleanArgLine(key) + " " + misc.CleanArgLine(value))
+	fromEnv := make(map[string]bool)
+	for _, k1 := range newop.longKeys {
+		fromEnv[k1] = op.Source(k1) == "env"
+	}
 	op.parserReset()
 	// sync short flags
 	var match bool
 	// sync long flags
 	for _, k1 := range newop.longKeys {
+		if fromEnv[k1] {
+			// do not move to command line
+			continue
+		}
 		if _, ok := delop.longArr[k1]; ok {
 			match = true
 			if value == "" {
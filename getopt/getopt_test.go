@@ -0,0 +1,305 @@
+package getopt
+
+import (
+	"strings"
+	"testing"
+)
+
+// newCommandOpts return app [--debug] config [--file name] check [args]
+func newCommandOpts(args ...string) (*Opts_t, *Opts_t, *Opts_t) {
+	op := NewOpts(args)
+	op.SetBool("--debug", "false", "debug mode")
+	cfg := op.AddCommand("config", "manage config")
+	cfg.SetOpt("--file", "app.conf", "config file")
+	chk := cfg.AddCommand("check", "check config")
+	return op, cfg, chk
+}
+
+func TestCommandDispatch(t *testing.T) {
+	op, cfg, chk := newCommandOpts("config", "--file", "a.conf", "check", "x", "y", "--debug", "true")
+	called := ""
+	cfg.SetHandler(func(cmd *Opts_t) error {
+		called = "config"
+		return nil
+	})
+	chk.SetHandler(func(cmd *Opts_t) error {
+		called = cmd.CommandPath()
+		return nil
+	})
+	if err := op.Dispatch(); err != nil {
+		t.Fatalf("Dispatch failed: %s", err)
+	}
+	if called != "config check" || op.Resolved() != chk || op.Command() != cfg {
+		t.Errorf("resolved %q, called %q", op.Resolved().CommandPath(), called)
+	}
+	// option declared by parent is moved to parent
+	if cfg.GetString("--file") != "a.conf" || chk.GetString("--file") != "a.conf" || op.GetBool("--debug") == false {
+		t.Errorf("unexpected options: --file %q, --debug %v", chk.GetString("--file"), op.GetBool("--debug"))
+	}
+	if strings.Join(chk.GetParserNoFlags(), " ") != "x y" || len(op.GetParserNoFlags()) != 0 {
+		t.Errorf("unexpected no-flags: %v, %v", chk.GetParserNoFlags(), op.GetParserNoFlags())
+	}
+
+	// no command given
+	op, _, _ = newCommandOpts("--debug")
+	if err := op.Dispatch(); err == nil || err.Error() != "getopt: no command given" {
+		t.Errorf("Dispatch without command return %v", err)
+	}
+}
+
+func TestCommandHelp(t *testing.T) {
+	op, cfg, chk := newCommandOpts("help", "config", "check")
+	called := false
+	chk.SetHandler(func(cmd *Opts_t) error {
+		called = true
+		return nil
+	})
+	if err := op.Dispatch(); err != nil || called {
+		t.Fatalf("Dispatch of help return %v, handler called %v", err, called)
+	}
+	if op.helpTarget != chk {
+		t.Errorf("help target %q, want config check", op.helpTarget.CommandPath())
+	}
+	// help after command name
+	op, cfg, _ = newCommandOpts("config", "help")
+	if op.helpTarget != cfg || op.Command() != cfg {
+		t.Errorf("help target %v, want config", op.helpTarget)
+	}
+	if op.AddCommand("help", "reserved") != nil {
+		t.Errorf("AddCommand accept reserved name help")
+	}
+}
+
+func TestEnvPrecedence(t *testing.T) {
+	t.Setenv("GETOPT_TEST_LEVEL", "2")
+	t.Setenv("GETOPT_TEST_NAME", "")
+	for _, c := range []struct {
+		args   []string
+		flag   string
+		value  string
+		source string
+	}{
+		{[]string{}, "--level", "2", "env"},
+		{[]string{"--level", "3"}, "--level", "3", "argv"},
+		{[]string{}, "--name", "app", "default"},
+		{[]string{"--name", "x"}, "--name", "x", "argv"},
+		{[]string{}, "--nothing", "", ""},
+		// option of parent in sub command
+		{[]string{"sub"}, "--level", "2", "env"},
+		{[]string{"sub", "--level", "4"}, "--level", "4", "argv"},
+	} {
+		op := NewOpts(c.args)
+		op.SetEnvPrefix("GETOPT_TEST_", "--")
+		op.SetOpt("--level", "1", "log level")
+		op.SetOpt("--name", "app", "app name")
+		op.AddCommand("sub", "sub command")
+		rop := op.Resolved()
+		if v, src := rop.GetString(c.flag), rop.Source(c.flag); v != c.value || src != c.source {
+			t.Errorf("%v: %s = %q from %q, want %q from %q", c.args, c.flag, v, src, c.value, c.source)
+		}
+	}
+	op := NewOpts(nil)
+	op.SetEnvPrefix("GETOPT_TEST_", "--")
+	op.SetOpt("--level", "1", "log level")
+	op.SetEnv("--level", "")
+	if op.GetString("--level") != "1" || op.EnvName("--level") != "" {
+		t.Errorf("env disabled by SetEnv, got %q from %s", op.GetString("--level"), op.Source("--level"))
+	}
+}
+
+func TestMergedString(t *testing.T) {
+	t.Setenv("GETOPT_TEST_LEVEL", "2")
+	op := NewOpts([]string{"--name", "x", "--debug"})
+	op.SetEnvPrefix("GETOPT_TEST_", "--")
+	op.SetOpt("--level", "1", "log level")
+	op.SetOpt("--name", "app", "app name")
+	op.SetOpt("--dir", "/tmp", "work dir")
+	if s := op.String(); strings.Contains(s, "2(env:GETOPT_TEST_LEVEL)") == false || strings.Contains(s, "/tmp(default)") == false {
+		t.Errorf("String should mark source: %q", s)
+	}
+	if s := op.MergedString(); strings.Contains(s, "(") || strings.Contains(s, "--level 2") == false || strings.Contains(s, "--dir /tmp") == false {
+		t.Errorf("MergedString should not mark source: %q", s)
+	}
+	// env value is not moved to command line
+	op.DelKeyValue("--debug", "")
+	if op.Source("--level") != "env" || op.GetString("--level") != "2" || op.Source("--name") != "argv" || op.Source("--debug") != "" {
+		t.Errorf("after DelKeyValue: --level from %s, --name from %s, --debug from %s", op.Source("--level"), op.Source("--name"), op.Source("--debug"))
+	}
+	t.Setenv("GETOPT_TEST_LEVEL", "5")
+	if op.GetString("--level") != "5" {
+		t.Errorf("env value should follow environment, got %q", op.GetString("--level"))
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	op, cfg, _ := newCommandOpts()
+	cfg.SetEnum("--file", "a.conf", "b.conf")
+	for _, shell := range []string{"bash", "zsh", "fish"} {
+		text, err := op.GenCompletion(shell)
+		if err != nil {
+			t.Fatalf("GenCompletion(%s) failed: %s", shell, err)
+		}
+		for _, word := range []string{"config", "check", "debug", "file", "b.conf"} {
+			if strings.Contains(text, word) == false {
+				t.Errorf("%s completion without %s:\n%s", shell, word, text)
+			}
+		}
+	}
+	if _, err := op.GenCompletion("csh"); err == nil {
+		t.Errorf("GenCompletion accept csh")
+	}
+	// hidden flags without Dispatch
+	if ok, err := op.Generate(); ok || err != nil {
+		t.Errorf("Generate without hidden flags: %v, %v", ok, err)
+	}
+	op, _, _ = newCommandOpts("--pr-gen-completion", "csh")
+	if ok, err := op.Generate(); ok == false || err == nil {
+		t.Errorf("Generate for csh: %v, %v", ok, err)
+	}
+}
+
+func TestManPage(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "86400")
+	op, _, _ := newCommandOpts()
+	op.SetVersion(`v1.0 "beta" \ build`)
+	op.SetDescription("test app\nmore text")
+	text := op.ManPage()
+	lines := strings.Split(text, "\n")
+	// quote in version is doubled, no \" to start roff comment
+	want := `.TH "` + strings.ToUpper(op.progName()) + `" 1 "1970\-01\-02" "v1.0 ""beta"" \e build"`
+	if lines[0] != want {
+		t.Errorf("unexpected .TH line:\n%s\nwant:\n%s", lines[0], want)
+	}
+	if op.ManPage() != text {
+		t.Errorf("man page differ with SOURCE_DATE_EPOCH set")
+	}
+	for _, word := range []string{".SH NAME", `\- test app`, ".SH COMMANDS", ".B config check", `.BI "\-\-file " value`, ".SH OPTIONS"} {
+		if strings.Contains(text, word) == false {
+			t.Errorf("man page without %s:\n%s", word, text)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	t.Setenv("GETOPT_TEST_PEER", "")
+	newOpts := func(args ...string) *Opts_t {
+		op := NewOpts(args)
+		op.SetEnvPrefix("GETOPT_TEST_", "--")
+		op.SetOpt("--token", "0", "token")
+		op.SetOpt("--listen", "", "listen address")
+		op.SetOpt("--peer", "", "peer address")
+		op.SetOpt("--dest", "", "dest address")
+		op.Required("--token")
+		op.MutuallyExclusive("--listen", "--peer")
+		op.Requires("--peer", "--dest")
+		op.AtLeastOneOf("--listen", "--peer")
+		sub := op.AddCommand("sub", "sub command")
+		sub.SetOpt("--name", "", "name")
+		sub.Required("--name")
+		return op
+	}
+	for _, c := range []struct {
+		args []string
+		errs []string
+	}{
+		{[]string{"--token", "1", "--listen", "a"}, nil},
+		// errors in order of constraints declared
+		{[]string{}, []string{
+			"getopt: --token is required",
+			"getopt: at least one of --listen, --peer is required",
+		}},
+		{[]string{"--listen", "a", "--peer", "b"}, []string{
+			"getopt: --token is required",
+			"getopt: --listen, --peer are mutually exclusive",
+			"getopt: --peer requires --dest",
+		}},
+		// parent first
+		{[]string{"--peer", "b", "sub"}, []string{
+			"getopt: --token is required",
+			"getopt: --peer requires --dest",
+			"getopt sub: --name is required",
+		}},
+	} {
+		errs := newOpts(c.args...).Validate()
+		text := make([]string, 0, len(errs))
+		for _, err := range errs {
+			text = append(text, err.Error())
+		}
+		if strings.Join(text, "\n") != strings.Join(c.errs, "\n") {
+			t.Errorf("%v: Validate return\n%s\nwant\n%s", c.args, strings.Join(text, "\n"), strings.Join(c.errs, "\n"))
+		}
+	}
+	// value from environment is given
+	t.Setenv("GETOPT_TEST_PEER", "b")
+	errs := newOpts("--token", "1", "--dest", "c").Validate()
+	if len(errs) != 0 {
+		t.Errorf("Validate with env return %v", errs)
+	}
+	if err := newOpts("--listen", "a").Dispatch(); err == nil || strings.Contains(err.Error(), "--token is required") == false {
+		t.Errorf("Dispatch without required option return %v", err)
+	}
+}
+
+func TestSchemaRoundTrip(t *testing.T) {
+	newOpts := func(args ...string) *Opts_t {
+		op := NewOpts(args)
+		op.SetEnvPrefix("GETOPT_TEST_", "--")
+		op.SetOpt("--level", "1", "log level")
+		op.SetOpt("--name", "app", "app name")
+		op.SetOpt("--mode", "fast", "run mode")
+		op.SetEnum("--mode", "fast", "slow")
+		op.SetBool("--debug", "false", "debug mode")
+		sub := op.AddCommand("sub", "sub command")
+		sub.SetOpt("--file", "", "file name")
+		return op
+	}
+	t.Setenv("GETOPT_TEST_NAME", "env-name")
+	src := newOpts("--level", "3", "--mode", "slow", "sub", "--file", "a.conf", "x")
+	data, err := src.Schema()
+	if err != nil {
+		t.Fatalf("Schema failed: %s", err)
+	}
+	t.Setenv("GETOPT_TEST_NAME", "")
+	dst := newOpts()
+	if err := dst.ApplyJSON(data); err != nil {
+		t.Fatalf("ApplyJSON failed: %s", err)
+	}
+	for _, c := range []struct {
+		flag, value, source string
+	}{
+		{"--level", "3", "argv"},
+		{"--name", "env-name", "env"},
+		{"--mode", "slow", "argv"},
+		{"--debug", "false", "default"},
+	} {
+		if v, s := dst.GetString(c.flag), dst.Source(c.flag); v != c.value || s != c.source {
+			t.Errorf("%s = %q from %q, want %q from %q", c.flag, v, s, c.value, c.source)
+		}
+	}
+	sub := dst.commands["sub"]
+	if sub.GetString("--file") != "a.conf" || strings.Join(sub.GetParserNoFlags(), " ") != "x" {
+		t.Errorf("sub command: --file %q, args %v", sub.GetString("--file"), sub.GetParserNoFlags())
+	}
+	again, _ := dst.Schema()
+	if string(again) != string(data) {
+		t.Errorf("schema changed after round-trip:\n%s\nwant:\n%s", again, data)
+	}
+
+	// invalid value, nothing applied
+	for _, bad := range []string{
+		`{"sections":[{"name":"options","options":[{"name":"--level","value":["5"],"source":"argv"},{"name":"--mode","value":["medium"],"source":"argv"}]}]}`,
+		`{"sections":[{"name":"options","options":[{"name":"--level","value":["5"],"source":"argv"},{"name":"--debug","value":["maybe"],"source":"argv"}]}]}`,
+		`{"sections":[{"name":"options","options":[{"name":"--level","value":["x"],"source":"argv"}]}]}`,
+		`{"sections":[{"name":"options","options":[{"name":"--level","value":["5"],"source":"argv"},{"name":"--nothing","value":["1"],"source":"argv"}]}]}`,
+		`{"sections":[{"name":"options","options":[{"name":"--level","value":["5"],"source":"file"}]}]}`,
+		`{"sections":[{"name":"options","options":[{"name":"--level","value":["5"],"source":"argv"}]}],"commands":[{"command":"nothing"}]}`,
+	} {
+		op := newOpts("--level", "2")
+		if err := op.ApplyJSON([]byte(bad)); err == nil {
+			t.Errorf("ApplyJSON accept %s", bad)
+		}
+		if op.GetString("--level") != "2" {
+			t.Errorf("ApplyJSON of %s changed --level to %q", bad, op.GetString("--level"))
+		}
+	}
+}
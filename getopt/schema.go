@@ -0,0 +1,250 @@
+/*
+	machine-readable schema of Opts_t
+*/
+
+package getopt
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/wheelcomplex/preinit/misc"
+)
+
+// SchemaOption_t describe one option and current effective value
+type SchemaOption_t struct {
+	Name        string   `json:"name"`           // long option, eg,. --pr-logdir
+	Type        string   `json:"type"`           // flag, bool, int, list or string
+	Default     []string `json:"default"`        // default value
+	Env         string   `json:"env,omitempty"`  // environment variable name
+	Description string   `json:"description"`    // description text
+	Enum        []string `json:"enum,omitempty"` // valid values
+	Hint        string   `json:"hint,omitempty"` // value hint, check HINT_*
+	Value       []string `json:"value"`          // current effective value
+	Source      string   `json:"source"`         // where value come from: argv, env or default
+}
+
+// SchemaSection_t describe one sestion of options
+type SchemaSection_t struct {
+	Name    string            `json:"name"`    // sestion name, eg,. options
+	Options []*SchemaOption_t `json:"options"` // options in order
+}
+
+// Schema_t describe command, options, sub commands and current effective values
+type Schema_t struct {
+	Command     string             `json:"command,omitempty"`     // command name, empty for top level
+	Version     string             `json:"version,omitempty"`     // text of SetVersion
+	Description string             `json:"description,omitempty"` // text of SetDescription
+	Notes       string             `json:"notes,omitempty"`       // text of SetNotes
+	Sections    []*SchemaSection_t `json:"sections"`              // sestions in order
+	Constraints []string           `json:"constraints,omitempty"` // constraints of options
+	Args        []string           `json:"args"`                  // no-flag args
+	Commands    []*Schema_t        `json:"commands,omitempty"`    // sub commands in order
+}
+
+// optionType guess type of option by sestion and default value
+func optionType(opt *option_t) string {
+	if opt.sestion == "flags" {
+		return "flag"
+	}
+	if len(opt.defval) > 1 {
+		return "list"
+	}
+	if len(opt.defval) == 1 {
+		val := strings.ToLower(opt.defval[0])
+		if val == "true" || val == "false" {
+			return "bool"
+		}
+		if val != "" && misc.IsNumeric(val) {
+			return "int"
+		}
+	}
+	return "string"
+}
+
+// schemaSestions return name of sestions in order: options, flags, lists, others
+func (op *Opts_t) schemaSestions() []string {
+	list := []string{"options", "flags", "lists"}
+	others := make([]string, 0, 0)
+	for sestion, _ := range op.sestions {
+		if strings.HasPrefix(sestion, "__") || sestion == "commands" || misc.ArgsIndex(list, sestion) != -1 {
+			continue
+		}
+		others = append(others, sestion)
+	}
+	sort.Strings(others)
+	return append(list, others...)
+}
+
+// schema return *Schema_t of this command and sub commands
+func (op *Opts_t) schema() *Schema_t {
+	sc := &Schema_t{
+		Command:     op.name,
+		Description: op.rawText("__desc"),
+		Notes:       op.rawText("__notes"),
+		Sections:    make([]*SchemaSection_t, 0, 0),
+		Args:        make([]string, 0, 0),
+	}
+	if op.parent == nil {
+		sc.Version = op.rawText("__version")
+	}
+	for _, sestion := range op.schemaSestions() {
+		if len(op.sestions[sestion]) == 0 {
+			continue
+		}
+		ss := &SchemaSection_t{
+			Name:    sestion,
+			Options: make([]*SchemaOption_t, 0, len(op.sestions[sestion])),
+		}
+		for _, idx := range op.sestionKeys[sestion] {
+			if idx == "" {
+				continue
+			}
+			opt := op.sestions[sestion][idx]
+			so := &SchemaOption_t{
+				Name:        opt.long,
+				Type:        optionType(opt),
+				Default:     append(make([]string, 0, len(opt.defval)), opt.defval...),
+				Env:         opt.env,
+				Description: opt.desc,
+				Enum:        opt.enum,
+				Hint:        opt.hint,
+			}
+			if sestion == "lists" {
+				so.Type = "list"
+				so.Value = append(make([]string, 0, 0), op.OptNoFlags()...)
+				so.Source = "default"
+				if len(op.GetParserNoFlags()) > 0 {
+					so.Source = "argv"
+				}
+			} else {
+				so.Value = append(make([]string, 0, 0), op.GetStringList(opt.long)...)
+				so.Source = op.Source(opt.long)
+			}
+			ss.Options = append(ss.Options, so)
+		}
+		sc.Sections = append(sc.Sections, ss)
+	}
+	for _, r := range op.rules {
+		sc.Constraints = append(sc.Constraints, r.String())
+	}
+	sc.Args = append(sc.Args, op.GetParserNoFlags()...)
+	for _, cmd := range op.commandList() {
+		sc.Commands = append(sc.Commands, cmd.schema())
+	}
+	return sc
+}
+
+// Schema return JSON document describing every sestion, option, sub command and current effective values
+func (op *Opts_t) Schema() ([]byte, error) {
+	return json.MarshalIndent(op.schema(), "", "  ")
+}
+
+// checkValue return error if value is invalid for type or enum of option
+func checkValue(opt *option_t, value []string) error {
+	typ := optionType(opt)
+	for _, val := range value {
+		if len(opt.enum) > 0 && misc.ArgsIndex(opt.enum, val) == -1 {
+			return fmt.Errorf("invalid value %q of %s, should be one of %s", val, opt.long, strings.Join(opt.enum, ", "))
+		}
+		switch typ {
+		case "int":
+			if misc.IsNumeric(val) == false {
+				return fmt.Errorf("invalid value %q of %s, should be int", val, opt.long)
+			}
+		case "bool":
+			if lval := strings.ToLower(val); lval != "true" && lval != "false" && lval != "disable" && lval != "" {
+				return fmt.Errorf("invalid value %q of %s, should be true or false", val, opt.long)
+			}
+		}
+	}
+	return nil
+}
+
+// planSchema check *Schema_t and return setters of values for this command and sub commands
+// option value with source == default or empty value is ignored
+// nothing is changed by planSchema, so invalid schema will not leave half applied values
+func (op *Opts_t) planSchema(sc *Schema_t) ([]func(), error) {
+	prefix := misc.CleanArgLine("getopt " + op.CommandPath())
+	setters := make([]func(), 0, 0)
+	for _, ss := range sc.Sections {
+		for _, so := range ss.Options {
+			if so == nil || len(so.Value) == 0 || so.Source == "default" {
+				continue
+			}
+			value := append(make([]string, 0, len(so.Value)), so.Value...)
+			if ss.Name == "lists" {
+				setters = append(setters, func() {
+					op.noFlagList = value
+				})
+				continue
+			}
+			opt := op.getOption(ss.Name, so.Name)
+			if opt == nil {
+				return nil, fmt.Errorf("%s: option %s no exist in sestion %s", prefix, so.Name, ss.Name)
+			}
+			if err := checkValue(opt, value); err != nil {
+				return nil, fmt.Errorf("%s: %s", prefix, err.Error())
+			}
+			name := so.Name
+			switch so.Source {
+			case "env":
+				// keep source of value
+				setters = append(setters, func() {
+					op.envArr[name] = value
+				})
+			case "argv", "":
+				setters = append(setters, func() {
+					if misc.ArgsIndex(op.longKeys, name) == -1 {
+						op.longKeys = append(op.longKeys, name)
+					}
+					op.longArr[name] = value
+				})
+			default:
+				return nil, fmt.Errorf("%s: invalid source %q of option %s, should be argv, env or default", prefix, so.Source, so.Name)
+			}
+		}
+	}
+	if len(sc.Args) > 0 {
+		args := append(make([]string, 0, len(sc.Args)), sc.Args...)
+		setters = append(setters, func() {
+			op.noFlagList = args
+		})
+	}
+	for _, sub := range sc.Commands {
+		if sub == nil {
+			continue
+		}
+		cmd, ok := op.commands[sub.Command]
+		if ok == false {
+			return nil, fmt.Errorf("%s: command %s no exist", prefix, sub.Command)
+		}
+		list, err := cmd.planSchema(sub)
+		if err != nil {
+			return nil, err
+		}
+		setters = append(setters, list...)
+	}
+	return setters, nil
+}
+
+// ApplyJSON load values of options from JSON document in format of Schema()
+// option value with source "default" or empty value is ignored,
+// value with source "env" is treat as from environment variable, other applied value is treat as from command line
+// all values are checked befor apply, nothing changed if error returned
+func (op *Opts_t) ApplyJSON(data []byte) error {
+	sc := &Schema_t{}
+	if err := json.Unmarshal(data, sc); err != nil {
+		return fmt.Errorf("getopt: unmarshal schema failed: %s", err.Error())
+	}
+	setters, err := op.planSchema(sc)
+	if err != nil {
+		return err
+	}
+	for _, set := range setters {
+		set()
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+/*
+	constraints of options for Opts_t
+*/
+
+package getopt
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/wheelcomplex/preinit/misc"
+)
+
+// kind of option constraint
+const (
+	RULE_REQUIRED  = iota // option must be given
+	RULE_EXCLUSIVE        // only one of options can be given
+	RULE_REQUIRES         // first option need second option
+	RULE_ATLEAST          // at less one of options must be given
+)
+
+// rule_t save one constraint of options
+type rule_t struct {
+	kind  int      // kind of rule, check RULE_*
+	flags []string // options of this rule
+}
+
+// String of rule_t for usage
+func (r *rule_t) String() string {
+	switch r.kind {
+	case RULE_REQUIRED:
+		return strings.Join(r.flags, ", ") + " required"
+	case RULE_EXCLUSIVE:
+		return strings.Join(r.flags, ", ") + " are mutually exclusive"
+	case RULE_REQUIRES:
+		return r.flags[0] + " requires " + r.flags[1]
+	case RULE_ATLEAST:
+		return "at least one of " + strings.Join(r.flags, ", ") + " required"
+	}
+	return ""
+}
+
+// addRule append rule to constraint list
+func (op *Opts_t) addRule(kind int, flags []string) {
+	list := make([]string, 0, len(flags))
+	for _, flag := range flags {
+		flag = misc.CleanArgLine(flag)
+		if flag != "" {
+			list = append(list, flag)
+		}
+	}
+	if len(list) == 0 {
+		return
+	}
+	op.rules = append(op.rules, &rule_t{
+		kind:  kind,
+		flags: list,
+	})
+}
+
+// Required make options must be given from command line or environment
+func (op *Opts_t) Required(long ...string) {
+	for _, flag := range long {
+		op.addRule(RULE_REQUIRED, []string{flag})
+	}
+}
+
+// MutuallyExclusive make options a, b... can not be given at the same time
+func (op *Opts_t) MutuallyExclusive(a string, b ...string) {
+	if len(b) == 0 {
+		return
+	}
+	op.addRule(RULE_EXCLUSIVE, append([]string{a}, b...))
+}
+
+// Requires make option a need option b when a is given
+func (op *Opts_t) Requires(a, b string) {
+	if misc.CleanArgLine(a) == "" || misc.CleanArgLine(b) == "" {
+		return
+	}
+	op.addRule(RULE_REQUIRES, []string{a, b})
+}
+
+// AtLeastOneOf make at less one of options must be given
+func (op *Opts_t) AtLeastOneOf(long ...string) {
+	op.addRule(RULE_ATLEAST, long)
+}
+
+// given return true if option given from command line or environment
+func (op *Opts_t) given(flag string) bool {
+	src := op.Source(flag)
+	return src == "argv" || src == "env"
+}
+
+// Validate check constraints of options and sub command resolved by Parse
+// errors return in order of constraints declared, parent first
+// return empty list if all constraints satisfied
+func (op *Opts_t) Validate() []error {
+	errs := make([]error, 0, 0)
+	prefix := misc.CleanArgLine("getopt " + op.CommandPath())
+	for _, r := range op.rules {
+		switch r.kind {
+		case RULE_REQUIRED:
+			if op.given(r.flags[0]) == false {
+				errs = append(errs, fmt.Errorf("%s: %s is required", prefix, r.flags[0]))
+			}
+		case RULE_EXCLUSIVE:
+			list := make([]string, 0, len(r.flags))
+			for _, flag := range r.flags {
+				if op.given(flag) {
+					list = append(list, flag)
+				}
+			}
+			if len(list) > 1 {
+				errs = append(errs, fmt.Errorf("%s: %s are mutually exclusive", prefix, strings.Join(list, ", ")))
+			}
+		case RULE_REQUIRES:
+			if op.given(r.flags[0]) && op.given(r.flags[1]) == false {
+				errs = append(errs, fmt.Errorf("%s: %s requires %s", prefix, r.flags[0], r.flags[1]))
+			}
+		case RULE_ATLEAST:
+			found := false
+			for _, flag := range r.flags {
+				if op.given(flag) {
+					found = true
+					break
+				}
+			}
+			if found == false {
+				errs = append(errs, fmt.Errorf("%s: at least one of %s is required", prefix, strings.Join(r.flags, ", ")))
+			}
+		}
+	}
+	if op.command != nil {
+		errs = append(errs, op.command.Validate()...)
+	}
+	return errs
+}
+
+// ConstraintString return constraints text in string
+func (op *Opts_t) ConstraintString() string {
+	if len(op.rules) == 0 {
+		return ""
+	}
+	text := op.sestionTitle("constraints")
+	for _, r := range op.rules {
+		text = text + "  " + r.String() + "\n"
+	}
+	return text
+}
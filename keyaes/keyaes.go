@@ -23,6 +23,9 @@ import (
 // The length of the AES key, either 16, 24, or 32 bytes to select AES-128, AES-192, or AES-256
 const AES_KEYLEN int = 16
 
+// errInvalidPack returned by Decrypt for invalid padding or checksum
+var errInvalidPack = fmt.Errorf("decryptUnPack, invalid input")
+
 // IVSCOUNT size of iv map, 1k * aes.BlockSize
 // must > 8
 const IVSCOUNT int = 1024
@@ -39,6 +42,7 @@ type AES struct {
 	sumlen       int              // length of binary sum
 	hdrlen       int              // length of binary nonce
 	uuid         chan uint64      // uuid output for nonce
+	done         chan struct{}    // stop uuid output
 	eniv         []byte           // iv for encrypt
 	deiv         []byte           // iv for decrypt
 	block        cipher.Block     //
@@ -103,12 +107,12 @@ func (ae *AES) keyinitial(key []byte) {
 }
 
 func (ae *AES) uuidGen(r *rand.Rand) {
-	defer func() {
-		// handle close
-		recover()
-	}()
 	for {
-		ae.uuid <- uint64(r.Int63())
+		select {
+		case ae.uuid <- uint64(r.Int63()):
+		case <-ae.done:
+			return
+		}
 	}
 }
 
@@ -118,6 +122,7 @@ func (ae *AES) uuidinitial() {
 		return
 	}
 	ae.uuid = make(chan uint64, 2048)
+	ae.done = make(chan struct{})
 	h := fnv.New64a()
 	h.Write(ae.key)
 	h.Write([]byte(strconv.FormatInt(int64(time.Now().UnixNano()), 10) + ":" + strconv.Itoa(os.Getpid()) + ":" + strconv.Itoa(os.Getppid())))
@@ -184,26 +189,30 @@ func (ae *AES) encryptPack(dst, src []byte) []byte {
 }
 
 // decryptUnPack implemented PKCS7Padding
+// all invalid input return the same error, no hint of padding or checksum for padding oracle
 func (ae *AES) decryptUnPack(plainText []byte) ([]byte, error) {
 	length := len(plainText)
-	if length < ae.hdrlen {
-		return nil, fmt.Errorf("decryptUnPack, invalid input: invalid length")
+	if length < ae.sumlen+1 {
+		return nil, errInvalidPack
 	}
 	unpadding := int(plainText[length-1])
 	offset := (length - unpadding)
-	if offset > aes.BlockSize || offset <= 0 {
-		//return nil, fmt.Errorf("decryptUnPack, invalid input: length %d unpadding %d offset %d", length, unpadding, offset)
-		return nil, fmt.Errorf("decryptUnPack, invalid input: invalid offset")
+	if unpadding > aes.BlockSize || unpadding <= 0 || offset < ae.sumlen {
+		return nil, errInvalidPack
+	}
+	// all padding bytes must be the same
+	var bad byte
+	for _, v := range plainText[offset:] {
+		bad |= v ^ byte(unpadding)
 	}
-	if offset < ae.sumlen {
-		return nil, fmt.Errorf("decryptUnPack, invalid input: invalid unpadding length")
+	if bad != 0 {
+		return nil, errInvalidPack
 	}
 	//ae.decryptsum = uint64(ByteUUID(plainText[ae.hdrlen:offset]))
 	ae.decryptsum = ae.checksum(plainText[ae.sumlen:offset])
 	ae.encryptsum = binary.BigEndian.Uint32(plainText[:ae.sumlen])
 	if ae.decryptsum != ae.encryptsum {
-		return nil, fmt.Errorf("decryptUnPack, invalid input: checksum mismatch, need %x, got %x", ae.decryptsum, ae.encryptsum)
-		//return nil, fmt.Errorf("decryptUnPack, invalid input: checksum mismatch")
+		return nil, errInvalidPack
 	}
 	return plainText[ae.sumlen:offset], nil
 }
@@ -240,8 +249,8 @@ func (ae *AES) Decrypt(decryptText []byte, src []byte) ([]byte, error) {
 	ae.mutex.Lock()
 	defer ae.mutex.Unlock()
 	srclen := len(src) - ae.hdrlen
-	if srclen%aes.BlockSize != 0 {
-		return nil, fmt.Errorf("AES Decrypt, invalid input length, %d % %d = %d(should be zero, nonce cut off)", srclen, aes.BlockSize, srclen%aes.BlockSize)
+	if srclen <= 0 || srclen%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("AES Decrypt, invalid input length, %d %% %d = %d(should be zero, nonce cut off)", srclen, aes.BlockSize, srclen%aes.BlockSize)
 	}
 	if len(decryptText) < srclen {
 		decryptText = make([]byte, srclen)
@@ -271,7 +280,7 @@ func (ae *AES) Close() {
 	}
 	ae.ivs = nil
 	ae.hash.Reset()
-	close(ae.uuid)
+	close(ae.done)
 }
 
 //
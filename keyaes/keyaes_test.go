@@ -0,0 +1,56 @@
+package keyaes
+
+import (
+	"bytes"
+	"crypto/aes"
+	"testing"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	ae := NewAES([]byte("keyaes test key"), nil)
+	defer ae.Close()
+	for size := 0; size < 100; size++ {
+		src := bytes.Repeat([]byte{byte(size)}, size)
+		dst, err := ae.Decrypt(nil, ae.Encrypt(nil, src))
+		if err != nil || bytes.Equal(dst, src) == false {
+			t.Fatalf("size %d, decrypt failed: %v", size, err)
+		}
+	}
+}
+
+func TestInvalidPadding(t *testing.T) {
+	ae := NewAES([]byte("keyaes test key"), nil)
+	defer ae.Close()
+	msg := ae.Encrypt(nil, []byte("padding oracle"))
+	var errText string
+	// flip every bit of previous block to change last block plaintext, include padding
+	last := len(msg) - 2*aes.BlockSize
+	for i := last; i < last+aes.BlockSize; i++ {
+		for bit := uint(0); bit < 8; bit++ {
+			p := append([]byte(nil), msg...)
+			p[i] ^= 1 << bit
+			_, err := ae.Decrypt(nil, p)
+			if err == nil {
+				t.Fatalf("byte %d bit %d, tampered input decrypted", i, bit)
+			}
+			// padding error is not distinguishable from checksum error
+			if errText == "" {
+				errText = err.Error()
+			} else if err.Error() != errText {
+				t.Fatalf("byte %d bit %d, error %q differ from %q", i, bit, err.Error(), errText)
+			}
+		}
+	}
+	for _, size := range []int{0, 4, 8 + aes.BlockSize - 1} {
+		if _, err := ae.Decrypt(nil, make([]byte, size)); err == nil {
+			t.Errorf("input of %d bytes decrypted", size)
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	ae := NewAES([]byte("keyaes test key"), nil)
+	ae.Encrypt(nil, []byte("close"))
+	ae.Close()
+	ae.Close()
+}
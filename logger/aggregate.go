@@ -0,0 +1,275 @@
+// forward log records from worker process to master process
+
+package logger
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// max size of one forwarded record
+const FORWARD_MAX_RECORD = 1 << 20
+
+// retry interval after master connection lost
+const FORWARD_RETRY_INTERVAL = 5 * time.Second
+
+// RecordWriter is io.Writer accept Record_t without encoding, eg,. channel of *LogForwarder_t
+type RecordWriter interface {
+	WriteRecord(r *Record_t) error
+}
+
+// wire format of forwarded record
+// frame: 4 bytes big-endian length + JSON of forwardRecord_t
+type forwardRecord_t struct {
+	Channel string        `json:"ch"`
+	Time    time.Time     `json:"t"`
+	Level   Level         `json:"lv"`
+	Pid     int           `json:"pid"`
+	Fork    string        `json:"fork,omitempty"`
+	Caller  string        `json:"caller,omitempty"`
+	Msg     string        `json:"msg"`
+	Tagged  bool          `json:"tag,omitempty"`
+	Fields  []interface{} `json:"f,omitempty"`
+}
+
+// LogForwarder_t send records of worker to master by pipe or unix socket
+// records are written to stderr if master gone
+type LogForwarder_t struct {
+	mu       sync.Mutex
+	network  string         // network to redial, empty for pipe
+	addr     string         // address to redial
+	conn     io.WriteCloser // connection to master, nil if lost
+	retry    time.Time      // no redial before retry
+	fallback io.Writer      // write here if master gone
+	buf      []byte         // frame buffer
+	closed   bool           //
+}
+
+// DialLogMaster connect to master listening at network/addr(eg,. unix /path/to/log.sock)
+// connection is redialed after lost
+func DialLogMaster(network, addr string) (*LogForwarder_t, error) {
+	f := &LogForwarder_t{
+		network:  network,
+		addr:     addr,
+		fallback: os.Stderr,
+		buf:      make([]byte, 0, 512),
+	}
+	conn, err := net.DialTimeout(network, addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	f.conn = conn
+	return f, nil
+}
+
+// NewLogForwarder return *LogForwarder_t write to w, eg,. pipe inherited from master
+// w is not reopened after write error
+func NewLogForwarder(w io.WriteCloser) *LogForwarder_t {
+	return &LogForwarder_t{
+		conn:     w,
+		fallback: os.Stderr,
+		buf:      make([]byte, 0, 512),
+	}
+}
+
+// SetFallback set writer for records when master gone, default is os.Stderr
+func (f *LogForwarder_t) SetFallback(w io.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fallback = w
+}
+
+// forwardValue return value can be encoded by json
+func forwardValue(val interface{}) interface{} {
+	switch val.(type) {
+	case nil, string, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return val
+	}
+	return fieldString(val)
+}
+
+// send write record of channel to master
+func (f *LogForwarder_t) send(name string, r *Record_t) error {
+	fr := &forwardRecord_t{
+		Channel: name,
+		Time:    r.Time,
+		Level:   r.Level,
+		Pid:     r.Pid,
+		Fork:    r.Fork,
+		Caller:  r.Caller,
+		Msg:     r.Msg,
+		Tagged:  r.Tagged,
+	}
+	if len(r.Fields) > 0 {
+		fr.Fields = make([]interface{}, len(r.Fields))
+		for i, val := range r.Fields {
+			fr.Fields[i] = forwardValue(val)
+		}
+	}
+	data, err := json.Marshal(fr)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return errors.New("log forwarder closed")
+	}
+	if f.conn == nil && f.network != "" && f.retry.Before(time.Now()) {
+		conn, err := net.DialTimeout(f.network, f.addr, time.Second)
+		if err == nil {
+			f.conn = conn
+		} else {
+			f.retry = time.Now().Add(FORWARD_RETRY_INTERVAL)
+		}
+	}
+	if f.conn != nil {
+		f.buf = f.buf[:4]
+		binary.BigEndian.PutUint32(f.buf, uint32(len(data)))
+		f.buf = append(f.buf, data...)
+		if _, err = f.conn.Write(f.buf); err == nil {
+			return nil
+		}
+		// master gone
+		f.conn.Close()
+		f.conn = nil
+		f.retry = time.Now().Add(FORWARD_RETRY_INTERVAL)
+	}
+	f.buf = humanEncoder.Encode(f.buf[:0], r, "", int(LOGFLAG_INFO))
+	f.fallback.Write(f.buf)
+	return err
+}
+
+// Close close connection to master
+func (f *LogForwarder_t) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	if f.conn == nil {
+		return nil
+	}
+	err := f.conn.Close()
+	f.conn = nil
+	return err
+}
+
+// forwardChannel_t is log write channel of LogForwarder_t
+type forwardChannel_t struct {
+	f    *LogForwarder_t
+	name string
+}
+
+// WriteRecord forward r to master
+func (c *forwardChannel_t) WriteRecord(r *Record_t) error {
+	return c.f.send(c.name, r)
+}
+
+// Write forward p to master as notice record
+func (c *forwardChannel_t) Write(p []byte) (n int, err error) {
+	r := &Record_t{
+		Time:  time.Now(),
+		Level: LEVEL_NOTICE,
+		Pid:   os.Getpid(),
+		Msg:   string(p),
+	}
+	return len(p), c.f.send(c.name, r)
+}
+
+// Channel return io.Writer forward to channel name of master
+func (f *LogForwarder_t) Channel(name string) io.Writer {
+	return &forwardChannel_t{f: f, name: name}
+}
+
+// ForwardTo forward log write channels to master by f
+// default channels are debug, app and err, which own files in master
+// channel not exist in master is dropped by master
+func (l *LoggerT) ForwardTo(f *LogForwarder_t, names ...string) error {
+	if len(names) == 0 {
+		names = []string{"debug", "app", "err"}
+	}
+	for _, name := range names {
+		if err := l.SetWriter(name, f.Channel(name)); err != nil {
+			return fmt.Errorf("forward channel %s: %s", name, err.Error())
+		}
+	}
+	return nil
+}
+
+// writeRecord write record from worker to log write channel
+func (l *LoggerT) writeRecord(name string, r *Record_t) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.logChs[name]; ok == false {
+		return
+	}
+	if l.closed[name] || r.Level < l.levels[name] {
+		return
+	}
+	l.output(name, r)
+}
+
+// ServeWorker read records from worker and write to log write channel until EOF
+func (l *LoggerT) ServeWorker(rd io.Reader) error {
+	br := bufio.NewReader(rd)
+	var hdr [4]byte
+	buf := make([]byte, 0, 512)
+	for {
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		size := binary.BigEndian.Uint32(hdr[:])
+		if size > FORWARD_MAX_RECORD {
+			return fmt.Errorf("forwarded record too large: %d", size)
+		}
+		if cap(buf) < int(size) {
+			buf = make([]byte, size)
+		}
+		buf = buf[:size]
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return err
+		}
+		fr := &forwardRecord_t{}
+		if err := json.Unmarshal(buf, fr); err != nil {
+			return fmt.Errorf("invalid forwarded record: %s", err.Error())
+		}
+		l.writeRecord(fr.Channel, &Record_t{
+			Time:   fr.Time,
+			Level:  fr.Level,
+			Pid:    fr.Pid,
+			Fork:   fr.Fork,
+			Caller: fr.Caller,
+			Msg:    fr.Msg,
+			Tagged: fr.Tagged,
+			Fields: fr.Fields,
+			Remote: true,
+		})
+	}
+}
+
+// ServeWorkers accept worker connections from ln and serve each by ServeWorker
+// return when ln closed
+func (l *LoggerT) ServeWorkers(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if err := l.ServeWorker(conn); err != nil {
+				l.write(LEVEL_WARN, []string{"stderr"}, "log worker "+conn.RemoteAddr().String()+": "+err.Error())
+			}
+		}()
+	}
+}
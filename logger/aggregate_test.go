@@ -0,0 +1,63 @@
+package logger
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// lockedBuffer is bytes.Buffer safe for concurrent use
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestForwardToMaster(t *testing.T) {
+	master := NewLogger("[master]", LOGFLAG_NONE)
+	app := &lockedBuffer{}
+	master.SetWriter("app", app)
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- master.ServeWorker(pr)
+	}()
+
+	worker := NewLogger("[worker]", LOGFLAG_NONE)
+	worker.SetForkState("worker")
+	f := NewLogForwarder(pw)
+	fallback := &lockedBuffer{}
+	f.SetFallback(fallback)
+	if err := worker.ForwardTo(f); err != nil {
+		t.Fatalf("ForwardTo failed: %s", err)
+	}
+	worker.With("conn", 3).Info("accepted")
+	pw.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("ServeWorker failed: %s", err)
+	}
+	want := "[" + strconv.Itoa(worker.pid) + " worker] [INFO] accepted conn=3"
+	if strings.Contains(app.String(), want) == false {
+		t.Errorf("master app channel got %q, want %q", app.String(), want)
+	}
+
+	// master gone
+	worker.Infof("after master exit")
+	if strings.Contains(fallback.String(), "after master exit") == false {
+		t.Errorf("record not written to fallback: %q", fallback.String())
+	}
+}
@@ -0,0 +1,361 @@
+// asynchronous log write channel
+
+package logger
+
+import (
+	"errors"
+	"io"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// policy of AsyncWriter_t when buffer is full
+type AsyncPolicy int
+
+const (
+	ASYNC_BLOCK       AsyncPolicy = iota // wait for free slot
+	ASYNC_DROP_NEWEST                    // drop incoming message
+	ASYNC_DROP_OLDEST                    // drop oldest message in buffer
+)
+
+// name of AsyncPolicy
+var asyncPolicyStrings = map[AsyncPolicy]string{
+	ASYNC_BLOCK:       "block",
+	ASYNC_DROP_NEWEST: "drop-newest",
+	ASYNC_DROP_OLDEST: "drop-oldest",
+}
+
+// String return name of policy
+func (p AsyncPolicy) String() string {
+	if _, ok := asyncPolicyStrings[p]; ok {
+		return asyncPolicyStrings[p]
+	}
+	return ""
+}
+
+// ParseAsyncPolicy return AsyncPolicy by name(block/drop-newest/drop-oldest)
+func ParseAsyncPolicy(name string) (AsyncPolicy, error) {
+	for p, s := range asyncPolicyStrings {
+		if s == name {
+			return p, nil
+		}
+	}
+	return ASYNC_BLOCK, errors.New("invalid async policy: " + name)
+}
+
+// default size of async buffer
+const ASYNC_BUFFER_SIZE = 1024
+
+// default flush timeout of LoggerT.Close
+const ASYNC_FLUSH_TIMEOUT = 5 * time.Second
+
+// AsyncWriter_t buffer messages in ring and write to io.Writer in background goroutine
+type AsyncWriter_t struct {
+	mu       sync.Mutex
+	notEmpty *sync.Cond  // signal writer goroutine
+	notFull  *sync.Cond  // signal blocked Write
+	idle     *sync.Cond  // signal Flush
+	w        io.Writer   // underlying writer
+	policy   AsyncPolicy // full buffer policy
+	ring     [][]byte    // message slots
+	levels   []Level     // level of message slots, levelNone for Write
+	head     int         // index of oldest message
+	count    int         // messages in ring
+	writing  bool        // writer goroutine is writing
+	closing  bool        // no more Write accepted
+	dropped  uint64      // dropped messages
+	done     chan struct{}
+}
+
+// NewAsyncWriter return *AsyncWriter_t write to w with size slots
+// size <= 0 to use ASYNC_BUFFER_SIZE
+func NewAsyncWriter(w io.Writer, size int, policy AsyncPolicy) *AsyncWriter_t {
+	if size <= 0 {
+		size = ASYNC_BUFFER_SIZE
+	}
+	a := &AsyncWriter_t{
+		w:      w,
+		policy: policy,
+		ring:   make([][]byte, size),
+		levels: make([]Level, size),
+		done:   make(chan struct{}),
+	}
+	a.notEmpty = sync.NewCond(&a.mu)
+	a.notFull = sync.NewCond(&a.mu)
+	a.idle = sync.NewCond(&a.mu)
+	go a.loop()
+	return a
+}
+
+// level of message from Write
+const levelNone Level = -1
+
+// Write copy p into buffer, never return error
+// message is dropped and counted when buffer full(drop policy) or writer closed
+func (a *AsyncWriter_t) Write(p []byte) (n int, err error) {
+	return a.WriteLevel(levelNone, p)
+}
+
+// WriteLevel copy p and level into buffer, never return error
+// level is passed to underlying writer if it is LevelWriter
+func (a *AsyncWriter_t) WriteLevel(level Level, p []byte) (n int, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for a.policy == ASYNC_BLOCK && a.count == len(a.ring) && a.closing == false {
+		a.notFull.Wait()
+	}
+	if a.closing {
+		a.dropped++
+		return len(p), nil
+	}
+	if a.count == len(a.ring) {
+		a.dropped++
+		if a.policy == ASYNC_DROP_NEWEST {
+			return len(p), nil
+		}
+		// ASYNC_DROP_OLDEST
+		a.head = (a.head + 1) % len(a.ring)
+		a.count--
+	}
+	idx := (a.head + a.count) % len(a.ring)
+	a.ring[idx] = append(a.ring[idx][:0], p...)
+	a.levels[idx] = level
+	a.count++
+	a.notEmpty.Signal()
+	return len(p), nil
+}
+
+// loop write messages in ring to underlying writer
+func (a *AsyncWriter_t) loop() {
+	defer close(a.done)
+	var buf []byte
+	lw, _ := a.w.(LevelWriter)
+	a.mu.Lock()
+	for {
+		for a.count == 0 && a.closing == false {
+			a.idle.Broadcast()
+			a.notEmpty.Wait()
+		}
+		if a.count == 0 {
+			// closing and empty
+			a.idle.Broadcast()
+			a.mu.Unlock()
+			return
+		}
+		// swap slot with spare buffer, keep slot memory for reuse
+		buf, a.ring[a.head] = a.ring[a.head], buf[:0]
+		level := a.levels[a.head]
+		a.head = (a.head + 1) % len(a.ring)
+		a.count--
+		a.writing = true
+		a.notFull.Signal()
+		a.mu.Unlock()
+		if lw != nil && level != levelNone {
+			lw.WriteLevel(level, buf)
+		} else {
+			a.w.Write(buf)
+		}
+		a.mu.Lock()
+		a.writing = false
+	}
+}
+
+// Dropped return count of dropped messages
+func (a *AsyncWriter_t) Dropped() uint64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.dropped
+}
+
+// Buffered return count of messages waiting in buffer
+func (a *AsyncWriter_t) Buffered() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.count
+}
+
+// Writer return underlying writer
+func (a *AsyncWriter_t) Writer() io.Writer {
+	return a.w
+}
+
+// Flush wait for buffered messages written, until timeout
+func (a *AsyncWriter_t) Flush(timeout time.Duration) error {
+	ok := make(chan struct{})
+	expired := false
+	go func() {
+		a.mu.Lock()
+		for (a.count > 0 || a.writing) && a.closing == false && expired == false {
+			a.idle.Wait()
+		}
+		a.mu.Unlock()
+		close(ok)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ok:
+		return nil
+	case <-a.done:
+		return nil
+	case <-timer.C:
+		// wake up waiter
+		a.mu.Lock()
+		expired = true
+		left := a.count
+		a.idle.Broadcast()
+		a.mu.Unlock()
+		return errors.New("async writer flush timeout, " + strconv.Itoa(left) + " messages left")
+	}
+}
+
+// CloseDeadline stop accepting Write and wait for buffered messages written, until deadline
+// messages still in buffer after deadline are dropped
+// underlying writer is not closed
+func (a *AsyncWriter_t) CloseDeadline(deadline time.Time) error {
+	a.mu.Lock()
+	if a.closing == false {
+		a.closing = true
+		a.notEmpty.Broadcast()
+		a.notFull.Broadcast()
+		a.idle.Broadcast()
+	}
+	a.mu.Unlock()
+	timer := time.NewTimer(deadline.Sub(time.Now()))
+	defer timer.Stop()
+	select {
+	case <-a.done:
+		return nil
+	case <-timer.C:
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	left := a.count
+	a.dropped += uint64(left)
+	a.head = 0
+	a.count = 0
+	a.notEmpty.Broadcast()
+	return errors.New("async writer close timeout, " + strconv.Itoa(left) + " messages dropped")
+}
+
+// Close stop accepting Write and wait for buffered messages written, until ASYNC_FLUSH_TIMEOUT
+func (a *AsyncWriter_t) Close() error {
+	return a.CloseDeadline(time.Now().Add(ASYNC_FLUSH_TIMEOUT))
+}
+
+// async setting of log write channel
+type asyncConf_t struct {
+	size   int         // buffer size
+	policy AsyncPolicy // full buffer policy
+}
+
+// wrapAsync replace writer of log write channel with AsyncWriter_t if async enabled
+// channel closed, write to DummyOut or RecordWriter is not wrapped
+// caller should hold l.mu
+func (l *LoggerT) wrapAsync(name string) {
+	cfg, ok := l.asyncCfg[name]
+	if ok == false || l.closed[name] {
+		return
+	}
+	if _, ok := l.asyncs[name]; ok {
+		return
+	}
+	ch := l.logChs[name]
+	if ch.Writer() == io.Writer(DummyOut) {
+		return
+	}
+	if _, ok := ch.Writer().(RecordWriter); ok {
+		return
+	}
+	aw := NewAsyncWriter(ch.Writer(), cfg.size, cfg.policy)
+	l.asyncs[name] = aw
+	l.logChs[name] = log.New(aw, ch.Prefix(), ch.Flags())
+}
+
+// unwrapAsync flush and stop AsyncWriter_t of log write channel until deadline
+// restore underlying writer of channel
+// caller should hold l.mu
+func (l *LoggerT) unwrapAsync(name string, deadline time.Time) error {
+	aw, ok := l.asyncs[name]
+	if ok == false {
+		return nil
+	}
+	err := aw.CloseDeadline(deadline)
+	l.dropped[name] += aw.Dropped()
+	ch := l.logChs[name]
+	l.logChs[name] = log.New(aw.Writer(), ch.Prefix(), ch.Flags())
+	delete(l.asyncs, name)
+	return err
+}
+
+// SetAsync enable async mode of log write channel
+// message is buffered in size slots and written by background goroutine
+// policy control what to do when buffer is full
+func (l *LoggerT) SetAsync(name string, size int, policy AsyncPolicy) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.logChs[name]; ok == false {
+		return errors.New("logger channel no exited")
+	}
+	if _, ok := asyncPolicyStrings[policy]; ok == false {
+		return errors.New("invalid async policy: " + strconv.Itoa(int(policy)))
+	}
+	l.unwrapAsync(name, time.Now().Add(l.flushTime))
+	l.asyncCfg[name] = asyncConf_t{size: size, policy: policy}
+	l.wrapAsync(name)
+	return nil
+}
+
+// SetSync disable async mode of log write channel, buffered messages is flushed
+func (l *LoggerT) SetSync(name string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.logChs[name]; ok == false {
+		return errors.New("logger channel no exited")
+	}
+	delete(l.asyncCfg, name)
+	return l.unwrapAsync(name, time.Now().Add(l.flushTime))
+}
+
+// SetFlushTimeout set flush timeout of async channel for Close and Fatal
+// return old timeout
+func (l *LoggerT) SetFlushTimeout(timeout time.Duration) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	old := l.flushTime
+	if timeout > 0 {
+		l.flushTime = timeout
+	}
+	return old
+}
+
+// Dropped return count of dropped messages of log write channel in async mode
+func (l *LoggerT) Dropped(name string) uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := l.dropped[name]
+	if aw, ok := l.asyncs[name]; ok {
+		n += aw.Dropped()
+	}
+	return n
+}
+
+// Flush wait for buffered messages of all async channel written, until timeout
+func (l *LoggerT) Flush(timeout time.Duration) error {
+	l.mu.Lock()
+	list := make([]*AsyncWriter_t, 0, len(l.asyncs))
+	for _, aw := range l.asyncs {
+		list = append(list, aw)
+	}
+	l.mu.Unlock()
+	deadline := time.Now().Add(timeout)
+	var err error
+	for _, aw := range list {
+		if e := aw.Flush(deadline.Sub(time.Now())); e != nil {
+			err = e
+		}
+	}
+	return err
+}
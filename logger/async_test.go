@@ -0,0 +1,78 @@
+package logger
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stallWriter block Write until release closed
+type stallWriter struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	release chan struct{}
+}
+
+func (w *stallWriter) Write(p []byte) (int, error) {
+	<-w.release
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+func (w *stallWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.String()
+}
+
+func TestAsyncDropNewest(t *testing.T) {
+	w := &stallWriter{release: make(chan struct{})}
+	a := NewAsyncWriter(w, 2, ASYNC_DROP_NEWEST)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			a.Write([]byte("line\n"))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Write blocked by stalled writer")
+	}
+	if a.Dropped() == 0 {
+		t.Errorf("no message dropped with stalled writer")
+	}
+	close(w.release)
+	if err := a.CloseDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Errorf("CloseDeadline failed: %s", err)
+	}
+	if n := uint64(strings.Count(w.String(), "line\n")) + a.Dropped(); n != 10 {
+		t.Errorf("written + dropped = %d, want 10", n)
+	}
+}
+
+func TestAsyncCloseDeadline(t *testing.T) {
+	w := &stallWriter{release: make(chan struct{})}
+	defer close(w.release)
+	l := NewLogger("[test]", LOGFLAG_NONE)
+	l.SetWriter("app", w)
+	if err := l.SetAsync("app", 8, ASYNC_BLOCK); err != nil {
+		t.Fatalf("SetAsync failed: %s", err)
+	}
+	l.SetFlushTimeout(100 * time.Millisecond)
+	for i := 0; i < 4; i++ {
+		l.Infof("msg %d", i)
+	}
+	start := time.Now()
+	l.Close()
+	if time.Since(start) > time.Second {
+		t.Errorf("Close wait %s for stalled writer", time.Since(start))
+	}
+	if l.Dropped("app") == 0 {
+		t.Errorf("no message dropped after close timeout")
+	}
+}
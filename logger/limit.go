@@ -0,0 +1,248 @@
+// keyed rate limiter of log write channel
+
+package logger
+
+import (
+	"errors"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// key of rate limiter
+type LimitKey int
+
+const (
+	LIMIT_BY_CALLSITE LimitKey = iota // file:line of caller
+	LIMIT_BY_FORMAT                   // format string of *f wrappers or msg of structured record, call site for others
+	LIMIT_BY_MESSAGE                  // formated message text
+)
+
+// max keys in one limiter, idle keys are removed when exceeded
+const LIMIT_MAX_KEYS = 4096
+
+// interval to write summary of suppressed messages
+const LIMIT_SUMMARY_INTERVAL = 5 * time.Second
+
+// setting of SetChannelDedup, one message per 5 seconds for same text
+const (
+	dedupRate  = 0.2
+	dedupBurst = 1
+)
+
+// key of token bucket
+type limitKey_t struct {
+	pc  uintptr // call site
+	str string  // format or message
+}
+
+// token bucket of one key
+type bucket_t struct {
+	tokens     float64   // available tokens
+	last       time.Time // last refill
+	suppressed int       // suppressed messages since last summary
+	level      Level     // level of last suppressed message
+	first      time.Time // first suppressed time since last summary
+}
+
+// limiter_t is keyed token bucket rate limiter of one channel
+type limiter_t struct {
+	rate    float64 // tokens per second
+	burst   int     // bucket size
+	by      LimitKey
+	buckets map[limitKey_t]*bucket_t
+	total   uint64 // total suppressed messages
+}
+
+// newLimiter return *limiter_t with rate/burst
+func newLimiter(rate float64, burst int, by LimitKey) *limiter_t {
+	if burst < 1 {
+		burst = 1
+	}
+	return &limiter_t{
+		rate:    rate,
+		burst:   burst,
+		by:      by,
+		buckets: make(map[limitKey_t]*bucket_t),
+	}
+}
+
+// allow return true if message of key can be written
+// suppressed > 0 if summary of key should be written before message
+func (lm *limiter_t) allow(key limitKey_t, level Level, now time.Time) (ok bool, suppressed int) {
+	b, exist := lm.buckets[key]
+	if exist == false {
+		if len(lm.buckets) >= LIMIT_MAX_KEYS {
+			lm.expire(now)
+		}
+		b = &bucket_t{tokens: float64(lm.burst), last: now}
+		lm.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * lm.rate
+	if b.tokens > float64(lm.burst) {
+		b.tokens = float64(lm.burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		if b.suppressed == 0 {
+			b.first = now
+		}
+		b.suppressed++
+		b.level = level
+		lm.total++
+		return false, 0
+	}
+	b.tokens--
+	suppressed = b.suppressed
+	b.suppressed = 0
+	return true, suppressed
+}
+
+// expire remove idle keys
+func (lm *limiter_t) expire(now time.Time) {
+	for key, b := range lm.buckets {
+		if b.suppressed == 0 && now.Sub(b.last) > time.Minute {
+			delete(lm.buckets, key)
+		}
+	}
+	if len(lm.buckets) >= LIMIT_MAX_KEYS {
+		// too many active keys, restart
+		lm.buckets = make(map[limitKey_t]*bucket_t)
+	}
+}
+
+// keyString return text of key for summary
+func (key limitKey_t) String() string {
+	if key.str != "" {
+		return key.str
+	}
+	fn := runtime.FuncForPC(key.pc)
+	if fn == nil {
+		return "???"
+	}
+	file, line := fn.FileLine(key.pc - 1)
+	return file + ":" + strconv.Itoa(line)
+}
+
+// summary return record of suppressed messages
+func summary(key limitKey_t, level Level, n int, now time.Time) Record_t {
+	text := key.String()
+	if len(text) > 64 {
+		text = text[:64] + "..."
+	}
+	return Record_t{
+		Time:  now,
+		Level: level,
+		Msg:   "suppressed " + strconv.Itoa(n) + " similar messages: " + text,
+	}
+}
+
+// SetRateLimit set token bucket rate limit of log write channel
+// rate is messages per second of one key, burst is bucket size
+// suppressed messages are reported by "suppressed N similar messages" summary
+// rate <= 0 to disable rate limit
+func (l *LoggerT) SetRateLimit(name string, rate float64, burst int, by LimitKey) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.logChs[name]; ok == false {
+		return errors.New("logger channel no exited")
+	}
+	if by < LIMIT_BY_CALLSITE || by > LIMIT_BY_MESSAGE {
+		return errors.New("invalid limit key: " + strconv.Itoa(int(by)))
+	}
+	if lm, ok := l.limiters[name]; ok {
+		l.flushSummary(name, lm, true)
+	}
+	if rate <= 0 {
+		delete(l.limiters, name)
+		return nil
+	}
+	l.limiters[name] = newLimiter(rate, burst, by)
+	return nil
+}
+
+// Suppressed return total suppressed messages of log write channel
+func (l *LoggerT) Suppressed(name string) uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if lm, ok := l.limiters[name]; ok {
+		return lm.total
+	}
+	return 0
+}
+
+// flushSummary write summary of suppressed messages of channel
+// only keys suppressed longer than LIMIT_SUMMARY_INTERVAL if all == false
+// caller should hold l.mu
+func (l *LoggerT) flushSummary(name string, lm *limiter_t, all bool) {
+	for key, b := range lm.buckets {
+		if b.suppressed == 0 {
+			continue
+		}
+		if all == false && l.curTime.Sub(b.first) < LIMIT_SUMMARY_INTERVAL {
+			continue
+		}
+		if l.closed[name] == false {
+			r := summary(key, b.level, b.suppressed, l.curTime)
+			r.Pid = l.pid
+			r.Fork = l.fork
+			r.Caller = "-"
+			l.output(name, &r)
+		}
+		b.suppressed = 0
+	}
+}
+
+// sweepSummary write summary of suppressed messages of all channel, at most once per second
+// called by emit and sweepLoop
+// caller should hold l.mu
+func (l *LoggerT) sweepSummary() {
+	if l.curTime.Before(l.nextSweep) {
+		return
+	}
+	l.nextSweep = l.curTime.Add(time.Second)
+	for name, lm := range l.limiters {
+		l.flushSummary(name, lm, false)
+	}
+}
+
+// pending return true if any suppressed message not reported by summary
+// caller should hold l.mu
+func (l *LoggerT) pending() bool {
+	for _, lm := range l.limiters {
+		for _, b := range lm.buckets {
+			if b.suppressed > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// startSweep start sweepLoop if not running
+// caller should hold l.mu
+func (l *LoggerT) startSweep() {
+	if l.sweeping {
+		return
+	}
+	l.sweeping = true
+	go l.sweepLoop()
+}
+
+// sweepLoop write summary every second until all suppressed messages reported
+// summary of channel gone quiet after burst is written without next message
+func (l *LoggerT) sweepLoop() {
+	tk := time.NewTicker(time.Second)
+	defer tk.Stop()
+	for _ = range tk.C {
+		l.mu.Lock()
+		l.curTime = time.Now()
+		l.sweepSummary()
+		if l.pending() == false {
+			l.sweeping = false
+			l.mu.Unlock()
+			return
+		}
+		l.mu.Unlock()
+	}
+}
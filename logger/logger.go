@@ -4,16 +4,22 @@
 package logger
 
 import (
+	"compress/gzip"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
-	"log/syslog"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -22,16 +28,20 @@ import (
 
 //// base logging support ////
 /*
-0. five logging file: stdout,stderr,debuglogfile, applogfile, errlogfile + syslog
+0. five logging file: stdout,stderr,debuglogfile, applogfile, errlogfile + syslog(local or remote udp/tcp/tls, RFC3164/RFC5424)
 0.1 send stdout to applogfile(if enabled), stderr to errlogfile(if enabled) after daemon
-0.2 no level support
+0.2 level support(trace/debug/info/notice/warn/error/fatal), min level per channel, adjustable at runtime
 0.3 if debug enabled, applog will send to debuglog too
-4. output file rotation by size
+4. output file rotation by size, rotated file compressed, retention by count/size/age
 4. default logger contorl by commandline args(--errlogfile, --applogfile, --debuglogfile, --logrotation, --logmaxsize)
-5. no Drop-in compatibility with code using the standard log package
-6. fixed output format
-7. dup line reduce
+4.1 reopen output file for external logrotate(ReopenAll/ReopenSignal/RotFile_t.SetReopenCheck)
+5. no Drop-in compatibility with code using the standard log package, use adapters(StdLogger/RedirectStdLog/SlogHandler)
+6. per channel output format: human, logfmt or JSON lines, with key/value fields
+7. dup line reduce, keyed rate limit per channel with summary of suppressed messages
 8. no thread safed
+8.1 worker process forward records to master(ForwardTo/ServeWorkers), master own log files
+8.2 ring channel keep last records of all level in memory, dump on signal/Fatal/Panic(EnableRing/DumpRing)
+9. optional async write channel with bounded buffer, slow output will not block caller
 */
 
 // OpenFile flags
@@ -57,6 +67,74 @@ const (
 	LOGFLAG_NONE   LogFlag = 0
 )
 
+// Level of log message
+type Level int32
+
+// log levels, message below channel level will be dropped
+const (
+	LEVEL_TRACE Level = iota
+	LEVEL_DEBUG
+	LEVEL_INFO
+	LEVEL_NOTICE
+	LEVEL_WARN
+	LEVEL_ERROR
+	LEVEL_FATAL
+	LEVEL_OFF // disable channel
+)
+
+// name of Level
+var levelStrings = map[Level]string{
+	LEVEL_TRACE:  "trace",
+	LEVEL_DEBUG:  "debug",
+	LEVEL_INFO:   "info",
+	LEVEL_NOTICE: "notice",
+	LEVEL_WARN:   "warn",
+	LEVEL_ERROR:  "error",
+	LEVEL_FATAL:  "fatal",
+	LEVEL_OFF:    "off",
+}
+
+// String return name of level
+// return empty string for invalid level
+func (lv Level) String() string {
+	if _, ok := levelStrings[lv]; ok {
+		return levelStrings[lv]
+	}
+	return ""
+}
+
+// ParseLevel return Level by name(trace/debug/info/notice/warn/error/fatal/off)
+func ParseLevel(name string) (Level, error) {
+	for lv, s := range levelStrings {
+		if s == name {
+			return lv, nil
+		}
+	}
+	return LEVEL_OFF, errors.New("invalid log level: " + name)
+}
+
+// write channels of level wrappers
+var levelChannels = map[Level][]string{
+	LEVEL_TRACE:  []string{"debug"},
+	LEVEL_DEBUG:  []string{"debug"},
+	LEVEL_INFO:   []string{"debug", "app"},
+	LEVEL_NOTICE: []string{"debug", "app", "sys"},
+	LEVEL_WARN:   []string{"debug", "app", "err", "stderr"},
+	LEVEL_ERROR:  []string{"debug", "err", "sys", "stderr"},
+	LEVEL_FATAL:  []string{"debug", "err", "sys", "stderr"},
+}
+
+// message prefix of level wrappers
+var levelTags = map[Level]string{
+	LEVEL_TRACE:  "[TRACE] ",
+	LEVEL_DEBUG:  "[DEBUG] ",
+	LEVEL_INFO:   "[INFO] ",
+	LEVEL_NOTICE: "[NOTICE] ",
+	LEVEL_WARN:   "[WARN] ",
+	LEVEL_ERROR:  "[ERROR] ",
+	LEVEL_FATAL:  "[FATAL] ",
+}
+
 // six logging file: stdout,stderr,debuglogfile, applogfile, errlogfile, syslog
 
 // preinit logger
@@ -70,17 +148,23 @@ type LoggerT struct {
 	logChs    map[string]*log.Logger    // Loggers
 	closers   map[string]io.WriteCloser // records for SetWriteCloser
 	list      map[string]struct{}       // default list for ListLog
-	dupCount  int                       // dup msg counter
-	preCount  int                       // dup msg counter
-	last      []byte                    // dup buffer
-	dupHint   []byte                    // dup hint buffer
-	hint      bool                      //
-	dedup     bool                      // is we dedup msg
 	curTime   time.Time                 // update time.Now()
-	dupTime   time.Time                 // max dup time
-	dedups    map[string]bool           //is this channel need dedup
+	limiters  map[string]*limiter_t     // rate limiter of channel
+	nextSweep time.Time                 // next time to write summary of suppressed messages
+	sweeping  bool                      // sweepLoop running
 	writeOnce map[string]bool           // is channel writed
 	closed    map[string]bool           // is channel closed
+	levels    map[string]Level          // min level of channel
+	minLevel  int32                     // min level of all enabled channel, atomic access
+	encoders  map[string]Encoder        // encoder of channel, nil for human format
+	pid       int                       // pid in record
+	fork      string                    // fork state in record
+	buf       []byte                    // encode buffer
+	asyncs    map[string]*AsyncWriter_t // async writer of channel
+	asyncCfg  map[string]asyncConf_t    // async setting of channel
+	dropped   map[string]uint64         // dropped messages of closed async writer
+	flushTime time.Duration             // flush timeout of async channel
+	ringDump  io.Writer                 // writer for automatic dump of ring channel
 	// Logger for stdout
 	// Logger for stderr
 	// Logger for debug
@@ -90,7 +174,7 @@ type LoggerT struct {
 }
 
 // NewLogger create a new LoggerT and initial to default
-// flag default to syslog.LOG_DAEMON
+// syslog channel default to local syslog with syslog.LOG_DAEMON, check SetSyslog
 func NewLogger(prefix string, flag LogFlag) *LoggerT {
 	if flag <= 0 {
 		flag = LOGFLAG_APP
@@ -98,13 +182,10 @@ func NewLogger(prefix string, flag LogFlag) *LoggerT {
 	if len(prefix) == 0 {
 		prefix = "loggerDefault"
 	}
-	sysl, err := syslog.NewLogger(syslog.LOG_NOTICE, int(LOGFLAG_NONE))
-	if err != nil {
-		panic("NewLogger(syslog) failed: " + err.Error())
-	}
+	// local syslog connected at first write, message dropped if syslog unavailable
+	sysw, _ := NewSyslog(nil)
 	l := &LoggerT{
-		dedup:     true,
-		calldepth: 4,
+		calldepth: 3,
 		prefix:    prefix,
 		flag:      int(flag),
 		logChs: map[string]*log.Logger{
@@ -113,20 +194,25 @@ func NewLogger(prefix string, flag LogFlag) *LoggerT {
 			"debug":  log.New(DummyOut, prefix, int(LOGFLAG_DEBUG)),
 			"app":    log.New(DummyOut, prefix, int(flag)),
 			"err":    log.New(DummyOut, prefix, int(flag)),
-			"sys":    sysl,
+			"sys":    log.New(sysw, "", int(LOGFLAG_NONE)),
+			"ring":   log.New(DummyOut, prefix, int(LOGFLAG_DEBUG)),
 		},
-		closers: make(map[string]io.WriteCloser),
-		list:    make(map[string]struct{}),
-		last:    make([]byte, 0, 256),
-		dupHint: make([]byte, 0, 256),
-		curTime: time.Now(),
-		dedups: map[string]bool{
-			"stdout": true,
-			"stderr": true,
-			"debug":  false,
-			"app":    false,
-			"err":    true,
-			"sys":    true,
+		closers:   map[string]io.WriteCloser{"sys": sysw},
+		encoders:  make(map[string]Encoder),
+		pid:       os.Getpid(),
+		buf:       make([]byte, 0, 512),
+		asyncs:    make(map[string]*AsyncWriter_t),
+		asyncCfg:  make(map[string]asyncConf_t),
+		dropped:   make(map[string]uint64),
+		flushTime: ASYNC_FLUSH_TIMEOUT,
+		ringDump:  os.Stderr,
+		list:      make(map[string]struct{}),
+		curTime:   time.Now(),
+		limiters: map[string]*limiter_t{
+			"stdout": newLimiter(dedupRate, dedupBurst, LIMIT_BY_MESSAGE),
+			"stderr": newLimiter(dedupRate, dedupBurst, LIMIT_BY_MESSAGE),
+			"err":    newLimiter(dedupRate, dedupBurst, LIMIT_BY_MESSAGE),
+			"sys":    newLimiter(dedupRate, dedupBurst, LIMIT_BY_MESSAGE),
 		},
 		closed: map[string]bool{
 			"stdout": false,
@@ -135,6 +221,7 @@ func NewLogger(prefix string, flag LogFlag) *LoggerT {
 			"app":    false,
 			"err":    false,
 			"sys":    false,
+			"ring":   false,
 		},
 		writeOnce: map[string]bool{
 			"stdout": false,
@@ -143,15 +230,175 @@ func NewLogger(prefix string, flag LogFlag) *LoggerT {
 			"app":    false,
 			"err":    false,
 			"sys":    false,
+			"ring":   false,
+		},
+		levels: map[string]Level{
+			"stdout": LEVEL_INFO,
+			"stderr": LEVEL_INFO,
+			"debug":  LEVEL_TRACE,
+			"app":    LEVEL_INFO,
+			"err":    LEVEL_INFO,
+			"sys":    LEVEL_INFO,
+			"ring":   LEVEL_TRACE,
 		},
 	}
-	l.dupTime = l.curTime.Add(5e9)
+	l.updateMinLevel()
 	return l
 }
 
+// updateMinLevel update min level of all enabled channel
+// channel closed or write to DummyOut is disabled
+// caller should hold l.mu
+func (l *LoggerT) updateMinLevel() {
+	min := LEVEL_OFF
+	for name, _ := range l.logChs {
+		if l.closed[name] || l.logChs[name].Writer() == io.Writer(DummyOut) {
+			continue
+		}
+		if l.levels[name] < min {
+			min = l.levels[name]
+		}
+	}
+	atomic.StoreInt32(&l.minLevel, int32(min))
+}
+
+// Enabled return false if message of level will be dropped by all channels
+// use to guard expensive arguments in hot path, the only zero allocation path for disabled level
+func (l *LoggerT) Enabled(level Level) bool {
+	return level >= Level(atomic.LoadInt32(&l.minLevel))
+}
+
+// SetLevel set min level of log write channel and return old level
+// return LEVEL_OFF if channel no exist
+func (l *LoggerT) SetLevel(name string, level Level) Level {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.logChs[name]; ok == false {
+		return LEVEL_OFF
+	}
+	old := l.levels[name]
+	l.levels[name] = level
+	l.updateMinLevel()
+	return old
+}
+
+// SetLevelString set min level of log write channel by level name, for admin command
+func (l *LoggerT) SetLevelString(name string, level string) error {
+	lv, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	_, ok := l.logChs[name]
+	l.mu.Unlock()
+	if ok == false {
+		return errors.New("logger channel no exited")
+	}
+	l.SetLevel(name, lv)
+	return nil
+}
+
+// SetLevels set min level of all log write channel
+func (l *LoggerT) SetLevels(level Level) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for name, _ := range l.logChs {
+		l.levels[name] = level
+	}
+	l.updateMinLevel()
+}
+
+// GetLevel return min level of log write channel
+// return LEVEL_OFF if channel no exist
+func (l *LoggerT) GetLevel(name string) Level {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.logChs[name]; ok == false {
+		return LEVEL_OFF
+	}
+	return l.levels[name]
+}
+
+// LevelSignal lower min level of channel one step when signal received
+// level restore to level of calling time after LEVEL_TRACE
+// eg,. LevelSignal("debug", syscall.SIGUSR2)
+func (l *LoggerT) LevelSignal(name string, sig ...os.Signal) error {
+	if len(sig) == 0 {
+		return errors.New("no signal for LevelSignal")
+	}
+	orig := l.GetLevel(name)
+	if orig == LEVEL_OFF {
+		if _, ok := l.logChs[name]; ok == false {
+			return errors.New("logger channel no exited")
+		}
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sig...)
+	go func() {
+		for _ = range ch {
+			level := l.GetLevel(name)
+			if level <= LEVEL_TRACE {
+				level = orig
+			} else {
+				level--
+			}
+			l.SetLevel(name, level)
+			l.write(LEVEL_NOTICE, []string{"stderr", name}, fmt.Sprintf("log level of channel %s changed to %s", name, level))
+		}
+	}()
+	return nil
+}
+
+// Reopener is io.Writer can reopen output file, eg,. *RotFile_t
+type Reopener interface {
+	Reopen() error
+}
+
+// ReopenAll reopen output file of all log write channel which writer is Reopener
+// return last error
+func (l *LoggerT) ReopenAll() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var err error
+	for name, _ := range l.logChs {
+		if l.closed[name] {
+			continue
+		}
+		w := l.logChs[name].Writer()
+		if aw, ok := w.(*AsyncWriter_t); ok {
+			w = aw.Writer()
+		}
+		if rw, ok := w.(Reopener); ok {
+			if e := rw.Reopen(); e != nil {
+				err = fmt.Errorf("reopen channel %s failed: %s", name, e.Error())
+			}
+		}
+	}
+	return err
+}
+
+// ReopenSignal call ReopenAll when signal received
+// default signal is syscall.SIGUSR1
+func (l *LoggerT) ReopenSignal(sig ...os.Signal) {
+	if len(sig) == 0 {
+		sig = []os.Signal{syscall.SIGUSR1}
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sig...)
+	go func() {
+		for _ = range ch {
+			if err := l.ReopenAll(); err != nil {
+				l.write(LEVEL_ERROR, []string{"stderr"}, err.Error())
+			}
+		}
+	}()
+}
+
 // SetCalldepth set call depth for logger
 // calldepth == -1 to return current call depth
-// default is 4
+// calldepth is frames from internal writer to user code: 1 is internal writer, 2 is wrapper(eg,. Infof), 3 is caller of wrapper
+// set to 4 if wrap LoggerT methods in your own function
+// default is 3
 func (l *LoggerT) SetCalldepth(calldepth int) int {
 	old := l.calldepth
 	if calldepth > 0 {
@@ -160,33 +407,62 @@ func (l *LoggerT) SetCalldepth(calldepth int) int {
 	return old
 }
 
+// SetEncoder set Encoder of log write channel
+// nil Encoder to use human format
+func (l *LoggerT) SetEncoder(name string, enc Encoder) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.logChs[name]; ok == false {
+		return errors.New("logger channel no exited")
+	}
+	if enc == nil {
+		delete(l.encoders, name)
+		return nil
+	}
+	l.encoders[name] = enc
+	return nil
+}
+
+// SetEncoderString set Encoder of log write channel by name(human/logfmt/json)
+func (l *LoggerT) SetEncoderString(name string, encoder string) error {
+	enc, err := ParseEncoder(encoder)
+	if err != nil {
+		return err
+	}
+	return l.SetEncoder(name, enc)
+}
+
+// SetForkState set fork state in record and return old state
+func (l *LoggerT) SetForkState(state string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	old := l.fork
+	l.fork = state
+	return old
+}
+
 // LogChannelList return list of log channel
 func (l *LoggerT) LogChannelList() map[string]*log.Logger {
 	return l.logChs
 }
 
-// SetDedup control simple dedup of logger
-// default is no-dedup for channel
+// SetChannelDedup control simple dedup of logger
+// same message text is written once per 5 seconds, check SetRateLimit
+// default is dedup for stdout, stderr, err and sys channel
 func (l *LoggerT) SetChannelDedup(name string, dedup bool) bool {
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	old := false
-	if _, ok := l.logChs[name]; ok {
-		old = l.dedups[name]
-		l.dedups[name] = dedup
-	} else {
-		return old
+	if _, ok := l.logChs[name]; ok == false {
+		return false
 	}
-	// update
-	l.dedup = false
-	for name, _ = range l.dedups {
-		if l.closed[name] {
-			continue
-		}
-		if l.dedups[name] {
-			l.dedup = true
-			break
-		}
+	lm, old := l.limiters[name]
+	if old {
+		l.flushSummary(name, lm, true)
+	}
+	if dedup {
+		l.limiters[name] = newLimiter(dedupRate, dedupBurst, LIMIT_BY_MESSAGE)
+	} else {
+		delete(l.limiters, name)
 	}
 	return old
 }
@@ -199,9 +475,11 @@ func (l *LoggerT) SetWriter(name string, output io.Writer) error {
 	if _, ok := l.logChs[name]; ok == false {
 		return errors.New("logger channel no exited")
 	}
-	l.CloseLogChannel(name)
+	l.closeLogChannel(name)
 	l.logChs[name] = log.New(output, l.prefix, l.flag)
 	l.closed[name] = false
+	l.wrapAsync(name)
+	l.updateMinLevel()
 	return nil
 }
 
@@ -213,26 +491,35 @@ func (l *LoggerT) SetWriteCloser(name string, output io.WriteCloser) error {
 	if _, ok := l.logChs[name]; ok == false {
 		return errors.New("logger channel no exited")
 	}
-	l.CloseLogChannel(name)
+	l.closeLogChannel(name)
 	l.closers[name] = output
 	l.logChs[name] = log.New(output, l.prefix, l.flag)
 	l.closed[name] = false
+	l.wrapAsync(name)
+	l.updateMinLevel()
 	return nil
 }
 
 // closeLogChannel close io.WriteCloser of log write channel
 func (l *LoggerT) closeLogChannel(name string) {
+	l.closeLogChannelDeadline(name, time.Now().Add(l.flushTime))
+}
+
+// closeLogChannelDeadline flush async writer until deadline and close io.WriteCloser of log write channel
+func (l *LoggerT) closeLogChannelDeadline(name string, deadline time.Time) {
 	if _, ok := l.logChs[name]; ok == false {
 		return
 	}
 	if l.closed[name] {
 		return
 	}
+	l.unwrapAsync(name, deadline)
 	if _, ok := l.closers[name]; ok {
 		l.closers[name].Close()
 		delete(l.closers, name)
 	}
 	l.closed[name] = true
+	l.updateMinLevel()
 	return
 }
 
@@ -245,165 +532,242 @@ func (l *LoggerT) CloseLogChannel(name string) {
 }
 
 // Close close All log write channel
+// async channel is flushed until flush timeout(SetFlushTimeout)
 func (l *LoggerT) Close() {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	l.curTime = time.Now()
+	for name, lm := range l.limiters {
+		l.flushSummary(name, lm, true)
+	}
+	deadline := time.Now().Add(l.flushTime)
 	for name, _ := range l.logChs {
-		l.closeLogChannel(name)
+		l.closeLogChannelDeadline(name, deadline)
 	}
 	return
 }
 
-// dupcheck check dup msg and return true for dup
-// dup hint msg --- last message repleat %d times --- will be output befor next no-dup msg
-func (l *LoggerT) dupcheck(s string) bool {
-	if misc.CompareByteString(l.last, s) == 0 {
-		l.dupCount++
-		l.preCount = 0
-		if l.dupTime.Before(l.curTime) {
-			l.preCount = l.dupCount
-		} else if l.dupCount > 199 {
-			l.preCount = l.dupCount
-		}
-		if l.preCount > 0 {
-			// insert to output
-			l.dupHint = l.dupHint[:0]
-			l.dupHint = append(l.dupHint, []byte(fmt.Sprintf("last message repleat %d times", l.dupCount))...)
-			l.hint = true
-			l.dupCount = 0
-			l.dupTime = l.curTime.Add(5e9)
+// WriteToList write msg to list of log write channel
+func (l *LoggerT) WriteToList(names []string, v string) {
+	// same call depth as wrappers
+	l.write(LEVEL_INFO, names, v)
+}
+
+// WriteLevel write msg to list of log write channel which level <= level
+func (l *LoggerT) WriteLevel(level Level, names []string, v string) {
+	l.write(level, names, v)
+}
+
+// write write msg to list of log write channel which level <= level
+func (l *LoggerT) write(level Level, names []string, v string) {
+	l.emit(level, names, v, false, nil, "", "")
+}
+
+// writef format msg and write to list of log write channel which level <= level
+// format is key of rate limiter
+func (l *LoggerT) writef(level Level, names []string, tagged bool, format string, v []interface{}) {
+	l.emit(level, names, fmt.Sprintf(format, v...), tagged, nil, format, "")
+}
+
+// writeTagged write msg with level tag to list of log write channel which level <= level
+func (l *LoggerT) writeTagged(level Level, names []string, v string) {
+	l.emit(level, names, v, true, nil, "", "")
+}
+
+// Logw write msg and key/value pairs to channels of level
+func (l *LoggerT) Logw(level Level, msg string, kv ...interface{}) {
+	if l.Enabled(level) == false {
+		return
+	}
+	if _, ok := levelChannels[level]; ok == false {
+		return
+	}
+	// same call depth as Entry_t
+	(&Entry_t{l: l, fields: kv}).log(level, msg, nil)
+}
+
+// output encode record and write to log write channel
+// caller should hold l.mu
+func (l *LoggerT) output(name string, r *Record_t) {
+	ch := l.logChs[name]
+	enc := l.encoders[name]
+	if enc == nil {
+		enc = humanEncoder
+	}
+	rw, forward := ch.Writer().(RecordWriter)
+	if r.Caller == "" && (forward || enc.NeedCaller(ch.Flags())) {
+		_, file, line, ok := runtime.Caller(l.calldepth + 1)
+		if ok == false {
+			file = "???"
+			line = 0
 		}
-		return true
+		r.Caller = file + ":" + strconv.Itoa(line)
 	}
-	if l.dupCount > 0 {
-		// insert to output
-		l.dupHint = l.dupHint[:0]
-		l.dupHint = append(l.dupHint, []byte(fmt.Sprintf("last message repleat %d times", l.dupCount))...)
-		l.hint = true
-		l.dupCount = 0
-		l.dupTime = l.curTime.Add(5e9)
+	if forward {
+		// encoded by master
+		rw.WriteRecord(r)
+		return
+	}
+	l.buf = enc.Encode(l.buf[:0], r, ch.Prefix(), ch.Flags())
+	if lw, ok := ch.Writer().(LevelWriter); ok {
+		lw.WriteLevel(r.Level, l.buf)
+		return
 	}
-	l.last = l.last[:0]
-	l.last = append(l.last, []byte(s)...)
-	return false
+	ch.Writer().Write(l.buf)
 }
 
-// WriteToList write msg to list of log write channel
-func (l *LoggerT) WriteToList(names []string, v string) {
+// emit write record to list of log write channel which level <= level
+// key is format string for rate limiter, empty to use call site
+// caller is file:line of caller, empty to find by l.calldepth
+// all writers(write/writef/Entry_t) should call emit at same call depth
+func (l *LoggerT) emit(level Level, names []string, v string, tagged bool, fields []interface{}, key string, caller string) {
+	if level < Level(atomic.LoadInt32(&l.minLevel)) {
+		return
+	}
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	var isDup bool
 	l.curTime = time.Now()
-	if l.dedup {
-		isDup = l.dupcheck(v)
+	r := Record_t{
+		Time:   l.curTime,
+		Level:  level,
+		Pid:    l.pid,
+		Fork:   l.fork,
+		Msg:    v,
+		Tagged: tagged,
+		Fields: fields,
+		Caller: caller,
 	}
 	for name, _ := range l.writeOnce {
 		l.writeOnce[name] = false
 	}
-	if l.hint {
-		// write hint to dedup-enabled channel
-		for _, name := range names {
-			if l.closed[name] {
-				continue
-			}
-			if l.dedups[name] && l.writeOnce[name] == false {
-				l.logChs[name].Output(l.calldepth, string(l.dupHint))
-				l.writeOnce[name] = true
-			}
-		}
-		l.hint = false
-		for name, _ := range l.writeOnce {
-			l.writeOnce[name] = false
-		}
-	}
+	var pc [1]uintptr
 	for _, name := range names {
-		if l.closed[name] {
-			continue
-		}
-		if isDup && l.dedups[name] {
-			//fmt.Printf("isDup %v, l.dedups[%s] %v, l.closed[%s] %v: %s\n", isDup, name, l.dedups[name], name, l.closed[name], v)
+		if l.closed[name] || level < l.levels[name] || l.writeOnce[name] {
 			continue
 		}
-		if l.writeOnce[name] == false {
-			l.logChs[name].Output(l.calldepth, v)
-			l.writeOnce[name] = true
+		if lm, ok := l.limiters[name]; ok {
+			var lk limitKey_t
+			switch {
+			case lm.by == LIMIT_BY_MESSAGE:
+				lk.str = v
+				if len(fields) > 0 {
+					lk.str = v + fmt.Sprint(fields...)
+				}
+			case lm.by == LIMIT_BY_FORMAT && key != "":
+				lk.str = key
+			case caller != "":
+				lk.str = caller
+			default:
+				if pc[0] == 0 {
+					runtime.Callers(l.calldepth+1, pc[:])
+				}
+				lk.pc = pc[0]
+			}
+			allow, suppressed := lm.allow(lk, level, l.curTime)
+			if suppressed > 0 {
+				sr := summary(lk, level, suppressed, l.curTime)
+				sr.Pid = l.pid
+				sr.Fork = l.fork
+				l.output(name, &sr)
+			}
+			if allow == false {
+				// summary written by sweepLoop if channel gone quiet
+				l.startSweep()
+				continue
+			}
 		}
+		l.output(name, &r)
+		l.writeOnce[name] = true
+	}
+	// ring channel receive all records
+	if l.writeOnce["ring"] == false && l.closed["ring"] == false && level >= l.levels["ring"] && l.logChs["ring"].Writer() != io.Writer(DummyOut) {
+		l.output("ring", &r)
 	}
+	l.sweepSummary()
 }
 
 // wrappers
 
-// Fatal write msg to err logger and call to os.Exit(1)
+// Fatal write msg to err logger, flush async channel, dump ring channel and call to os.Exit(1)
 func (l *LoggerT) Fatal(v ...interface{}) {
-	l.Errlog(v...)
+	l.write(LEVEL_FATAL, levelChannels[LEVEL_FATAL], fmt.Sprint(v...))
+	l.Flush(l.flushTime)
+	l.autoDump()
 	os.Exit(1)
 }
 
 func (l *LoggerT) Fatalf(format string, v ...interface{}) {
-	l.Errlog(fmt.Sprintf(format, v...))
+	l.writef(LEVEL_FATAL, levelChannels[LEVEL_FATAL], false, format, v)
+	l.Flush(l.flushTime)
+	l.autoDump()
 	os.Exit(1)
 }
 
 func (l *LoggerT) Fatalln(v ...interface{}) {
-	l.Errlog(fmt.Sprintln(v...))
+	l.write(LEVEL_FATAL, levelChannels[LEVEL_FATAL], fmt.Sprintln(v...))
+	l.Flush(l.flushTime)
+	l.autoDump()
 	os.Exit(1)
 }
 
-// Panic write msg to err logger and call to panic().
+// Panic write msg to err logger, dump ring channel and call to panic().
 func (l *LoggerT) Panic(v ...interface{}) {
 	s := fmt.Sprint(v...)
-	l.Errlog(s)
+	l.write(LEVEL_FATAL, levelChannels[LEVEL_FATAL], s)
+	l.autoDump()
 	panic(s)
 
 }
 func (l *LoggerT) Panicf(format string, v ...interface{}) {
 	s := fmt.Sprintf(format, v...)
-	l.Errlog(s)
+	l.write(LEVEL_FATAL, levelChannels[LEVEL_FATAL], s)
+	l.autoDump()
 	panic(s)
 }
 func (l *LoggerT) Panicln(v ...interface{}) {
 	s := fmt.Sprintln(v...)
-	l.Errlog(s)
+	l.write(LEVEL_FATAL, levelChannels[LEVEL_FATAL], s)
+	l.autoDump()
 	panic(s)
 }
 
 // Print write msg to debug+stdout
 func (l *LoggerT) Print(v ...interface{}) {
-	l.WriteToList([]string{"debug", "stdout"}, fmt.Sprint(v...))
+	l.write(LEVEL_INFO, []string{"debug", "stdout"}, fmt.Sprint(v...))
 }
 
 func (l *LoggerT) Printf(format string, v ...interface{}) {
-	l.WriteToList([]string{"debug", "stdout"}, fmt.Sprintf(format, v...))
+	l.writef(LEVEL_INFO, []string{"debug", "stdout"}, false, format, v)
 }
 
 func (l *LoggerT) Println(v ...interface{}) {
-	l.WriteToList([]string{"debug", "stdout"}, fmt.Sprintln(v...))
+	l.write(LEVEL_INFO, []string{"debug", "stdout"}, fmt.Sprintln(v...))
 }
 
 // Stdout write msg to debug+stdout
 func (l *LoggerT) Stdout(v ...interface{}) {
-	l.WriteToList([]string{"debug", "stdout"}, fmt.Sprint(v...))
+	l.write(LEVEL_INFO, []string{"debug", "stdout"}, fmt.Sprint(v...))
 }
 
 func (l *LoggerT) Stdoutf(format string, v ...interface{}) {
-	l.WriteToList([]string{"debug", "stdout"}, fmt.Sprintf(format, v...))
+	l.writef(LEVEL_INFO, []string{"debug", "stdout"}, false, format, v)
 }
 
 func (l *LoggerT) Stdoutln(v ...interface{}) {
-	l.WriteToList([]string{"debug", "stdout"}, fmt.Sprintln(v...))
+	l.write(LEVEL_INFO, []string{"debug", "stdout"}, fmt.Sprintln(v...))
 }
 
 // Stderr write msg to debug+stderr
 func (l *LoggerT) Stderr(v ...interface{}) {
-	l.WriteToList([]string{"debug", "stderr"}, fmt.Sprint(v...))
+	l.write(LEVEL_NOTICE, []string{"debug", "stderr"}, fmt.Sprint(v...))
 }
 
 func (l *LoggerT) Stderrf(format string, v ...interface{}) {
-	l.WriteToList([]string{"debug", "stderr"}, fmt.Sprintf(format, v...))
+	l.writef(LEVEL_NOTICE, []string{"debug", "stderr"}, false, format, v)
 }
 
 func (l *LoggerT) Stderrln(v ...interface{}) {
-	l.WriteToList([]string{"debug", "stderr"}, fmt.Sprintln(v...))
+	l.write(LEVEL_NOTICE, []string{"debug", "stderr"}, fmt.Sprintln(v...))
 }
 
 func (l *LoggerT) Prefix() string {
@@ -421,54 +785,187 @@ func (l *LoggerT) SetPrefix(prefix string) {
 
 // Applog write msg to app+debug
 func (l *LoggerT) Applog(v ...interface{}) {
-	l.WriteToList([]string{"debug", "app"}, fmt.Sprint(v...))
+	l.write(LEVEL_INFO, []string{"debug", "app"}, fmt.Sprint(v...))
 }
 
 func (l *LoggerT) Applogf(format string, v ...interface{}) {
-	l.WriteToList([]string{"debug", "app"}, fmt.Sprintf(format, v...))
+	l.writef(LEVEL_INFO, []string{"debug", "app"}, false, format, v)
 }
 
 func (l *LoggerT) Applogln(v ...interface{}) {
-	l.WriteToList([]string{"debug", "app"}, fmt.Sprintln(v...))
+	l.write(LEVEL_INFO, []string{"debug", "app"}, fmt.Sprintln(v...))
 }
 
 // Errlog write msg to err+debug+syslog+stderr
 func (l *LoggerT) Errlog(v ...interface{}) {
-	l.WriteToList([]string{"debug", "err", "sys", "stderr"}, fmt.Sprint(v...))
+	l.write(LEVEL_ERROR, []string{"debug", "err", "sys", "stderr"}, fmt.Sprint(v...))
 }
 
 func (l *LoggerT) Errlogf(format string, v ...interface{}) {
-	l.WriteToList([]string{"debug", "err", "sys", "stderr"}, fmt.Sprintf(format, v...))
+	l.writef(LEVEL_ERROR, []string{"debug", "err", "sys", "stderr"}, false, format, v)
 }
 
 func (l *LoggerT) Errlogln(v ...interface{}) {
-	l.WriteToList([]string{"debug", "err", "sys", "stderr"}, fmt.Sprintln(v...))
+	l.write(LEVEL_ERROR, []string{"debug", "err", "sys", "stderr"}, fmt.Sprintln(v...))
 }
 
 // Syslog write msg to debug+syslog
 func (l *LoggerT) Syslog(v ...interface{}) {
-	l.WriteToList([]string{"debug", "sys"}, fmt.Sprint(v...))
+	l.write(LEVEL_NOTICE, []string{"debug", "sys"}, fmt.Sprint(v...))
 }
 
 func (l *LoggerT) Syslogf(format string, v ...interface{}) {
-	l.WriteToList([]string{"debug", "sys"}, fmt.Sprintf(format, v...))
+	l.writef(LEVEL_NOTICE, []string{"debug", "sys"}, false, format, v)
 }
 
 func (l *LoggerT) Syslogln(v ...interface{}) {
-	l.WriteToList([]string{"debug", "sys"}, fmt.Sprintln(v...))
+	l.write(LEVEL_NOTICE, []string{"debug", "sys"}, fmt.Sprintln(v...))
 }
 
 // Debug write msg to debug
+// return without format msg if debug level disabled
+// non-constant arguments are still boxed to interface{} by caller, eg,. Debugf("conn %d peer %s", id, name) cost 1 alloc/op,
+// guard with Enabled(LEVEL_DEBUG) for zero allocation in hot path
 func (l *LoggerT) Debug(v ...interface{}) {
-	l.WriteToList([]string{"debug"}, "[DEBUG] "+fmt.Sprint(v...))
+	if l.Enabled(LEVEL_DEBUG) == false {
+		return
+	}
+	l.writeTagged(LEVEL_DEBUG, levelChannels[LEVEL_DEBUG], fmt.Sprint(v...))
 }
 
 func (l *LoggerT) Debugf(format string, v ...interface{}) {
-	l.WriteToList([]string{"debug"}, "[DEBUG] "+fmt.Sprintf(format, v...))
+	if l.Enabled(LEVEL_DEBUG) == false {
+		return
+	}
+	l.writef(LEVEL_DEBUG, levelChannels[LEVEL_DEBUG], true, format, v)
 }
 
 func (l *LoggerT) Debugln(v ...interface{}) {
-	l.WriteToList([]string{"debug"}, "[DEBUG] "+fmt.Sprintln(v...))
+	if l.Enabled(LEVEL_DEBUG) == false {
+		return
+	}
+	l.writeTagged(LEVEL_DEBUG, levelChannels[LEVEL_DEBUG], fmt.Sprintln(v...))
+}
+
+// Trace write msg to debug
+func (l *LoggerT) Trace(v ...interface{}) {
+	if l.Enabled(LEVEL_TRACE) == false {
+		return
+	}
+	l.writeTagged(LEVEL_TRACE, levelChannels[LEVEL_TRACE], fmt.Sprint(v...))
+}
+
+func (l *LoggerT) Tracef(format string, v ...interface{}) {
+	if l.Enabled(LEVEL_TRACE) == false {
+		return
+	}
+	l.writef(LEVEL_TRACE, levelChannels[LEVEL_TRACE], true, format, v)
+}
+
+func (l *LoggerT) Traceln(v ...interface{}) {
+	if l.Enabled(LEVEL_TRACE) == false {
+		return
+	}
+	l.writeTagged(LEVEL_TRACE, levelChannels[LEVEL_TRACE], fmt.Sprintln(v...))
+}
+
+// Info write msg to app+debug
+func (l *LoggerT) Info(v ...interface{}) {
+	if l.Enabled(LEVEL_INFO) == false {
+		return
+	}
+	l.writeTagged(LEVEL_INFO, levelChannels[LEVEL_INFO], fmt.Sprint(v...))
+}
+
+func (l *LoggerT) Infof(format string, v ...interface{}) {
+	if l.Enabled(LEVEL_INFO) == false {
+		return
+	}
+	l.writef(LEVEL_INFO, levelChannels[LEVEL_INFO], true, format, v)
+}
+
+func (l *LoggerT) Infoln(v ...interface{}) {
+	if l.Enabled(LEVEL_INFO) == false {
+		return
+	}
+	l.writeTagged(LEVEL_INFO, levelChannels[LEVEL_INFO], fmt.Sprintln(v...))
+}
+
+// Notice write msg to app+debug+syslog
+func (l *LoggerT) Notice(v ...interface{}) {
+	if l.Enabled(LEVEL_NOTICE) == false {
+		return
+	}
+	l.writeTagged(LEVEL_NOTICE, levelChannels[LEVEL_NOTICE], fmt.Sprint(v...))
+}
+
+func (l *LoggerT) Noticef(format string, v ...interface{}) {
+	if l.Enabled(LEVEL_NOTICE) == false {
+		return
+	}
+	l.writef(LEVEL_NOTICE, levelChannels[LEVEL_NOTICE], true, format, v)
+}
+
+func (l *LoggerT) Noticeln(v ...interface{}) {
+	if l.Enabled(LEVEL_NOTICE) == false {
+		return
+	}
+	l.writeTagged(LEVEL_NOTICE, levelChannels[LEVEL_NOTICE], fmt.Sprintln(v...))
+}
+
+// Warn write msg to app+err+debug+stderr
+func (l *LoggerT) Warn(v ...interface{}) {
+	if l.Enabled(LEVEL_WARN) == false {
+		return
+	}
+	l.writeTagged(LEVEL_WARN, levelChannels[LEVEL_WARN], fmt.Sprint(v...))
+}
+
+func (l *LoggerT) Warnf(format string, v ...interface{}) {
+	if l.Enabled(LEVEL_WARN) == false {
+		return
+	}
+	l.writef(LEVEL_WARN, levelChannels[LEVEL_WARN], true, format, v)
+}
+
+func (l *LoggerT) Warnln(v ...interface{}) {
+	if l.Enabled(LEVEL_WARN) == false {
+		return
+	}
+	l.writeTagged(LEVEL_WARN, levelChannels[LEVEL_WARN], fmt.Sprintln(v...))
+}
+
+// Error write msg to err+debug+syslog+stderr
+func (l *LoggerT) Error(v ...interface{}) {
+	if l.Enabled(LEVEL_ERROR) == false {
+		return
+	}
+	l.writeTagged(LEVEL_ERROR, levelChannels[LEVEL_ERROR], fmt.Sprint(v...))
+}
+
+func (l *LoggerT) Errorf(format string, v ...interface{}) {
+	if l.Enabled(LEVEL_ERROR) == false {
+		return
+	}
+	l.writef(LEVEL_ERROR, levelChannels[LEVEL_ERROR], true, format, v)
+}
+
+func (l *LoggerT) Errorln(v ...interface{}) {
+	if l.Enabled(LEVEL_ERROR) == false {
+		return
+	}
+	l.writeTagged(LEVEL_ERROR, levelChannels[LEVEL_ERROR], fmt.Sprintln(v...))
+}
+
+// Logf write msg to channels of level
+func (l *LoggerT) Logf(level Level, format string, v ...interface{}) {
+	if l.Enabled(level) == false {
+		return
+	}
+	if _, ok := levelChannels[level]; ok == false {
+		return
+	}
+	l.writef(level, levelChannels[level], true, format, v)
 }
 
 // AddListlog add ListLog write channel with io.Writer
@@ -481,9 +978,14 @@ func (l *LoggerT) AddListlog(name string, output io.Writer) {
 	}
 	l.logChs[name] = log.New(output, l.prefix, l.flag)
 	l.list[name] = struct{}{}
-	l.dedups[name] = false
+	delete(l.limiters, name)
 	l.closed[name] = false
 	l.writeOnce[name] = false
+	if _, ok := l.levels[name]; ok == false {
+		l.levels[name] = LEVEL_INFO
+	}
+	l.wrapAsync(name)
+	l.updateMinLevel()
 	return
 }
 
@@ -498,9 +1000,14 @@ func (l *LoggerT) AddListlogCloser(name string, output io.WriteCloser) {
 	l.closers[name] = output
 	l.logChs[name] = log.New(output, l.prefix, l.flag)
 	l.list[name] = struct{}{}
-	l.dedups[name] = false
+	delete(l.limiters, name)
 	l.closed[name] = false
 	l.writeOnce[name] = false
+	if _, ok := l.levels[name]; ok == false {
+		l.levels[name] = LEVEL_INFO
+	}
+	l.wrapAsync(name)
+	l.updateMinLevel()
 	return
 }
 
@@ -522,15 +1029,15 @@ func (l *LoggerT) RemoveListLog(list []string) {
 
 // Listlog write msg to listed write channel
 func (l *LoggerT) Listlog(v ...interface{}) {
-	l.WriteToList(misc.ListToSlice(l.list), fmt.Sprint(v...))
+	l.write(LEVEL_INFO, misc.ListToSlice(l.list), fmt.Sprint(v...))
 }
 
 func (l *LoggerT) Listlogf(format string, v ...interface{}) {
-	l.WriteToList(misc.ListToSlice(l.list), fmt.Sprintf(format, v...))
+	l.writef(LEVEL_INFO, misc.ListToSlice(l.list), false, format, v)
 }
 
 func (l *LoggerT) Listlogln(v ...interface{}) {
-	l.WriteToList(misc.ListToSlice(l.list), fmt.Sprintln(v...))
+	l.write(LEVEL_INFO, misc.ListToSlice(l.list), fmt.Sprintln(v...))
 }
 
 //
@@ -612,29 +1119,40 @@ type FileLogWriter struct {
 */
 
 // file WriteCloser, with rotation, copy from log4go
-// using mutx,no go routine
+// rotated file renamed with timestamp and compressed by background go routine
 type RotFile_t struct {
-	mu         sync.Mutex  // Writer mutex
-	filename   string      // file name with full path
-	curFile    string      // current file to write
-	mode       os.FileMode // mode of new log file
-	file       *os.File    // os.File of curFile
-	num        int         // max file for rotation, <= 0 for no rotation
-	curNum     int         //
-	size       int         // max file size for rotation
-	curSize    int         //
-	line       int         // max line for rotation
-	curLine    int         //
-	format     string      // date string format to insert into filename
-	nextTime   time.Time   //
-	errDummy   bool        // drop all msg if writer error
-	openNext   bool        // should we open next file
-	msgSize    int         // size of one message
-	errTryTime time.Time   // retry when io error
+	mu         sync.Mutex    // Writer mutex
+	filename   string        // file name with full path
+	curFile    string        // current file to write
+	mode       os.FileMode   // mode of new log file
+	file       *os.File      // os.File of curFile
+	num        int           // max rotated file to keep, <= 0 for no limit
+	size       int           // max file size for rotation
+	curSize    int           //
+	line       int           // max line for rotation
+	curLine    int           //
+	format     string        // date string format to insert into filename
+	nextTime   time.Time     //
+	errDummy   bool          // drop all msg if writer error
+	openNext   bool          // should we open next file
+	msgSize    int           // size of one message
+	errTryTime time.Time     // retry when io error
+	compress   bool          // gzip rotated file
+	maxTotal   int64         // max total size of rotated files, <= 0 for no limit
+	maxAge     time.Duration // max age of rotated files, <= 0 for no limit
+	link       string        // symlink to current file, empty to disable
+	checkEvery int           // check rename/truncate of current file every N writes, <= 0 to disable
+	writes     int           // writes since last check
+	closed     bool          // no more write
+	jobs       chan string   // rotated file to compress, empty for retention check only
+	done       chan struct{} // closed when background go routine exited
+	errlog     *LoggerT      // rotation error is written to err channel of errlog, nil to discard
+	errs       chan string   // rotation error to report by background go routine
 }
 
 // NewRotFile create a new RotFile WriteCloser
 // date format chars must inside 0-9 A-Z a-z _ - /, invalid char will replace by _
+// max is the max number of rotated files to keep, rotated files are gziped and filename.current link to current file
 func NewRotFile(filename string, mode os.FileMode, max int, size int, line int, format string) *RotFile_t {
 	var err error
 	filename, err = filepath.Abs(filepath.Clean(filename))
@@ -648,28 +1166,141 @@ func NewRotFile(filename string, mode os.FileMode, max int, size int, line int,
 		num:      max,
 		size:     size,
 		line:     line,
-		format:   misc.SafeFileName(format),
+		compress: true,
+		jobs:     make(chan string, 64),
+		done:     make(chan struct{}),
+		errlog:   L,
+		errs:     make(chan string, 64),
+	}
+	if len(format) > 0 {
+		// SafeFileName return . for empty string
+		r.format = misc.SafeFileName(format)
 	}
+	r.link = r.filename + ".current"
+	go r.worker()
+	r.mu.Lock()
 	r.openFile()
+	r.mu.Unlock()
 	return r
 }
 
-// reset flush buffer and close opened file
-func (r *RotFile_t) reset() {
+// SetCompress enable/disable gzip of rotated file, default is enabled
+func (r *RotFile_t) SetCompress(compress bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.compress = compress
+}
+
+// SetRetention set max total size and max age of rotated files
+// <= 0 for no limit
+func (r *RotFile_t) SetRetention(maxTotal int64, maxAge time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.maxTotal = maxTotal
+	r.maxAge = maxAge
+	r.queue("")
+}
+
+// SetErrorLog set logger to report rotation, compression and symlink error, nil to discard
+// error is written to err channel by background go routine, default is L
+func (r *RotFile_t) SetErrorLog(l *LoggerT) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.errlog = l
+}
+
+// report send error to background go routine, never block
+// RotFile_t may be writer of errlog, so error is not written with r.mu held
+func (r *RotFile_t) report(format string, v ...interface{}) {
+	select {
+	case r.errs <- fmt.Sprintf(format, v...):
+	default:
+	}
+}
+
+// logError write error to err channel of errlog
+func (r *RotFile_t) logError(msg string) {
+	r.mu.Lock()
+	l := r.errlog
+	r.mu.Unlock()
+	if l != nil {
+		l.Errorf("RotFile %s, %s", r.filename, msg)
+	}
+}
+
+// SetSymlink set path of symlink to current file, empty to disable
+// default is filename.current
+func (r *RotFile_t) SetSymlink(link string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.link = link
+	r.updateLink()
+}
+
+// SetReopenCheck check external rename or truncate of current file every n writes
+// file is reopened if renamed or truncated, <= 0 to disable
+func (r *RotFile_t) SetReopenCheck(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checkEvery = n
+	r.writes = 0
+}
+
+// Reopen close and reopen current file without rotation
+// call after external logrotate rename current file
+func (r *RotFile_t) Reopen() error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	if r.closed {
+		return errors.New("reopen closed file " + r.filename)
+	}
+	return r.reopen()
+}
+
+// reopen close and reopen current file
+// caller should hold r.mu
+func (r *RotFile_t) reopen() error {
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+	if r.curFile == "" {
+		r.logFilename()
+	}
+	return r.openCur()
+}
+
+// changed return true if current file renamed, removed or truncated
+// caller should hold r.mu
+func (r *RotFile_t) changed() bool {
+	if r.file == nil {
+		return false
+	}
+	fi, err := os.Stat(r.curFile)
+	if err != nil {
+		return true
+	}
+	cur, err := r.file.Stat()
+	if err != nil {
+		return true
+	}
+	return os.SameFile(fi, cur) == false || fi.Size() < int64(r.curSize)
+}
+
+// reset flush buffer and close opened file
+// caller should hold r.mu
+func (r *RotFile_t) reset() {
 	if r.file != nil {
 		r.file.Close()
 		r.file = nil
 	}
 	r.curLine = 0
-	r.curNum = 0
 	r.curSize = 0
 	r.nextTime = time.Time{}
 	r.curFile = ""
 }
 
-// logFilename try to find next/rotation filename for logging
+// logFilename try to find current filename for logging
 //
 func (r *RotFile_t) logFilename() {
 	// only call by openFile
@@ -677,7 +1308,6 @@ func (r *RotFile_t) logFilename() {
 	base := path.Dir(r.filename)
 	name := path.Base(r.filename)
 	prefix := ""
-	rot := ""
 	// update next time
 	r.nextTime = misc.TimeFormatNext(r.format, time.Time{})
 	// use: http://golang.org/pkg/time/#Time.Before at logwrite
@@ -687,25 +1317,98 @@ func (r *RotFile_t) logFilename() {
 	} else if len(r.format) > 0 {
 		prefix = r.format + "."
 	}
-	if r.num > 0 {
-		if r.curNum >= r.num {
-			r.curNum = 0
+	r.curFile = filepath.Clean(base + "/" + prefix + name)
+}
+
+// timestamp layout of rotated file, file.<stamp>[-N][.gz], check rotateName
+const ROTATE_STAMP = "20060102-150405.000000"
+
+// rotateName return unused timestamped filename for rotation of file
+func rotateName(file string) string {
+	stamp := file + "." + time.Now().Format(ROTATE_STAMP)
+	name := stamp
+	for i := 1; ; i++ {
+		_, err1 := os.Lstat(name)
+		_, err2 := os.Lstat(name + ".gz")
+		if os.IsNotExist(err1) && os.IsNotExist(err2) {
+			return name
+		}
+		name = stamp + "-" + strconv.Itoa(i)
+	}
+}
+
+// rotate close current file, rename it with timestamp if need and send to background go routine
+// caller should hold r.mu
+func (r *RotFile_t) rotate() {
+	old := r.curFile
+	opened := r.file != nil
+	r.reset()
+	if old == "" || opened == false {
+		return
+	}
+	r.logFilename()
+	if r.curFile == old {
+		// same name, rotate by size or line
+		rot := rotateName(old)
+		if err := os.Rename(old, rot); err != nil {
+			r.report("rotate %s failed: %s", old, err.Error())
+			return
 		}
-		// start from  zero
-		rot = "." + strconv.Itoa(r.curNum)
-		r.curNum++
+		old = rot
+	}
+	r.queue(old)
+}
+
+// queue send rotated file to background go routine
+// caller should hold r.mu
+func (r *RotFile_t) queue(file string) {
+	if r.closed {
+		return
+	}
+	select {
+	case r.jobs <- file:
+	default:
+		// worker busy, file will be compressed by next retention check
+		r.report("rotation queue full, skip %s", file)
+	}
+}
+
+// updateLink point symlink to current file
+// caller should hold r.mu
+func (r *RotFile_t) updateLink() {
+	if r.link == "" || r.curFile == "" || r.link == r.curFile {
+		return
+	}
+	tmp := r.link + ".tmp"
+	os.Remove(tmp)
+	target := r.curFile
+	if filepath.Dir(r.link) == filepath.Dir(r.curFile) {
+		target = filepath.Base(r.curFile)
+	}
+	if err := os.Symlink(target, tmp); err != nil {
+		r.report("symlink %s failed: %s", r.link, err.Error())
+		return
+	}
+	if err := os.Rename(tmp, r.link); err != nil {
+		os.Remove(tmp)
+		r.report("symlink %s failed: %s", r.link, err.Error())
 	}
-	r.curFile = filepath.Clean(base + "/" + prefix + name + rot)
 }
 
 // openFile open current file
-//
+// caller should hold r.mu
 func (r *RotFile_t) openFile() error {
-	// no threadsafe, call by Write or NewRotFile, caller is threadsafe
 	// curFile closed
-	r.reset()
-	r.logFilename()
-	// try to open current file
+	r.rotate()
+	if r.curFile == "" {
+		r.logFilename()
+	}
+	return r.openCur()
+}
+
+// openCur open r.curFile for append
+// caller should hold r.mu
+func (r *RotFile_t) openCur() error {
 	var err error
 	r.file, err = os.OpenFile(r.curFile, O_CREATE|O_APPEND|O_WRONLY, r.mode)
 	if err != nil {
@@ -719,17 +1422,186 @@ func (r *RotFile_t) openFile() error {
 	fmt.Printf("open %s ok\n", r.curFile)
 	r.curLine = 0
 	r.curSize = 0
+	if fi, err := r.file.Stat(); err == nil {
+		// appending to existed file
+		r.curSize = int(fi.Size())
+	}
 	r.errDummy = false
 	r.openNext = false
+	r.writes = 0
+	r.updateLink()
 	return err
 }
 
+// isStamp return true if s is <stamp>[-N] made by rotateName
+func isStamp(s string) bool {
+	if len(s) < len(ROTATE_STAMP) {
+		return false
+	}
+	if _, err := time.Parse(ROTATE_STAMP, s[:len(ROTATE_STAMP)]); err != nil {
+		return false
+	}
+	rest := s[len(ROTATE_STAMP):]
+	if rest == "" {
+		return true
+	}
+	return len(rest) > 1 && rest[0] == '-' && misc.IsNumeric(rest[1:])
+}
+
+// isRotated return true if name is rotated file of logfile
+// rotated file: [prefix.]name.<stamp>[-N][.gz] or <date>.name[.gz], prefix is date or format string, check logFilename
+// other file in the same directory(eg,. other.name, name.bak) is not rotated file
+func (r *RotFile_t) isRotated(name string, cur string, link string) bool {
+	if name == cur || name == link {
+		return false
+	}
+	name = strings.TrimSuffix(name, ".gz")
+	base := path.Base(r.filename)
+	dated := false
+	if len(r.format) > 0 {
+		idx := strings.Index(name, "."+base)
+		if idx <= 0 {
+			return false
+		}
+		prefix := name[:idx]
+		if misc.TimeFormatNext(r.format, time.Time{}).Equal(time.Time{}) == false {
+			if _, err := time.Parse(r.format, prefix); err != nil {
+				return false
+			}
+			dated = true
+		} else if prefix != r.format {
+			return false
+		}
+		name = name[idx+1:]
+	}
+	if strings.HasPrefix(name, base) == false {
+		return false
+	}
+	rest := name[len(base):]
+	if rest == "" {
+		// file of previous date
+		return dated
+	}
+	return rest[0] == '.' && isStamp(rest[1:])
+}
+
+// isCurrent return true if file is current file or symlink
+func (r *RotFile_t) isCurrent(file string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return file == r.curFile || file == r.link
+}
+
+// gzipFile compress file to file.gz and remove file
+// file.gz keep modify time of file for retention order
+func gzipFile(file string, mode os.FileMode) error {
+	src, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	tmp := file + ".gz.tmp"
+	dst, err := os.OpenFile(tmp, O_CREATE|O_TRUNC|O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	zw.Name = filepath.Base(file)
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err1 := dst.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Chtimes(tmp, fi.ModTime(), fi.ModTime())
+	}
+	if err == nil {
+		err = os.Rename(tmp, file+".gz")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(file)
+}
+
+// retention remove rotated files out of count, total size or age limit, and compress left
+func (r *RotFile_t) retention() {
+	r.mu.Lock()
+	num, maxTotal, maxAge, compress := r.num, r.maxTotal, r.maxAge, r.compress
+	cur, link := path.Base(r.curFile), path.Base(r.link)
+	r.mu.Unlock()
+	dir := path.Dir(r.filename)
+	list, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	files := make([]os.FileInfo, 0, len(list))
+	for _, fi := range list {
+		if fi.Mode().IsRegular() && r.isRotated(fi.Name(), cur, link) {
+			files = append(files, fi)
+		}
+	}
+	// newest first
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().After(files[j].ModTime())
+	})
+	var total int64
+	now := time.Now()
+	for i, fi := range files {
+		file := dir + "/" + fi.Name()
+		if r.isCurrent(file) {
+			// opened after list
+			continue
+		}
+		total += fi.Size()
+		if (num > 0 && i >= num) || (maxTotal > 0 && total > maxTotal) || (maxAge > 0 && now.Sub(fi.ModTime()) > maxAge) {
+			os.Remove(file)
+			continue
+		}
+		if compress && strings.HasSuffix(file, ".gz") == false {
+			if err := gzipFile(file, fi.Mode().Perm()); err != nil {
+				r.report("compress %s failed: %s", file, err.Error())
+			}
+		}
+	}
+}
+
+// worker compress rotated file, apply retention and report error in background
+func (r *RotFile_t) worker() {
+	defer close(r.done)
+	for {
+		select {
+		case _, ok := <-r.jobs:
+			if ok == false {
+				// error reported by last retention
+				for len(r.errs) > 0 {
+					r.logError(<-r.errs)
+				}
+				return
+			}
+			r.retention()
+		case msg := <-r.errs:
+			r.logError(msg)
+		}
+	}
+}
+
 // Write write msg to logfile
 func (r *RotFile_t) Write(p []byte) (n int, err error) {
 	// thread safe
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	r.msgSize = len(p)
+	if r.closed {
+		return r.msgSize, nil
+	}
 	if r.errDummy {
 		if r.errTryTime.After(time.Now()) {
 			return r.msgSize, nil
@@ -755,6 +1627,18 @@ func (r *RotFile_t) Write(p []byte) (n int, err error) {
 		if r.errDummy {
 			return r.msgSize, nil
 		}
+	} else if r.checkEvery > 0 {
+		r.writes++
+		if r.writes >= r.checkEvery {
+			r.writes = 0
+			if r.changed() {
+				// renamed or truncated by external logrotate
+				r.reopen()
+				if r.errDummy {
+					return r.msgSize, nil
+				}
+			}
+		}
 	}
 	// udate counter
 	r.curSize = r.msgSize + r.curSize
@@ -771,9 +1655,19 @@ func (r *RotFile_t) Write(p []byte) (n int, err error) {
 }
 
 // Close flush buffer and close opened file
+// wait for background compression finished
 func (r *RotFile_t) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
 	r.reset()
 	r.errDummy = true
+	r.closed = true
+	close(r.jobs)
+	r.mu.Unlock()
+	<-r.done
 	return nil
 }
 
@@ -0,0 +1,254 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLevelFilter(t *testing.T) {
+	l := NewLogger("[test]", LOGFLAG_NONE)
+	var app, debug bytes.Buffer
+	l.SetWriter("app", &app)
+	l.SetWriter("debug", &debug)
+	l.SetLevel("app", LEVEL_WARN)
+	l.Infof("info %d", 1)
+	l.Warnf("warn %d", 2)
+	if strings.Contains(app.String(), "info 1") {
+		t.Errorf("app channel got message below level: %q", app.String())
+	}
+	if strings.Contains(app.String(), "warn 2") == false {
+		t.Errorf("app channel missing warn message: %q", app.String())
+	}
+	if strings.Contains(debug.String(), "info 1") == false {
+		t.Errorf("debug channel missing info message: %q", debug.String())
+	}
+	if old := l.SetLevel("app", LEVEL_TRACE); old != LEVEL_WARN {
+		t.Errorf("SetLevel return %s, want %s", old, LEVEL_WARN)
+	}
+	if err := l.SetLevelString("app", "verbose"); err == nil {
+		t.Errorf("SetLevelString accept invalid level")
+	}
+}
+
+func TestDebugfDisabledNoAlloc(t *testing.T) {
+	l := NewLogger("[test]", LOGFLAG_NONE)
+	if l.Enabled(LEVEL_DEBUG) {
+		t.Fatalf("debug enabled by default, min level %d", l.minLevel)
+	}
+	id, name := 100000, "peer"
+	// guarded by Enabled, nothing boxed
+	allocs := testing.AllocsPerRun(100, func() {
+		id++
+		if l.Enabled(LEVEL_DEBUG) {
+			l.Debugf("conn %d peer %s", id, name)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("guarded Debugf below threshold allocated %v times", allocs)
+	}
+	// no formatting, only boxing of non-constant arguments at call site, 1 alloc/op by gc
+	allocs = testing.AllocsPerRun(100, func() {
+		id++
+		l.Debugf("conn %d peer %s", id, name)
+	})
+	if allocs > 2 {
+		t.Errorf("Debugf below threshold allocated %v times, more than boxing of 2 arguments", allocs)
+	}
+}
+
+func TestEncoders(t *testing.T) {
+	l := NewLogger("[test]", LOGFLAG_NONE)
+	var app, debug bytes.Buffer
+	l.SetWriter("app", &app)
+	l.SetWriter("debug", &debug)
+	l.SetForkState("worker")
+	if err := l.SetEncoderString("app", "json"); err != nil {
+		t.Fatalf("SetEncoderString failed: %s", err)
+	}
+	l.SetEncoderString("debug", "logfmt")
+	l.With("conn", 7).Info("accepted", "peer", "10.0.0.1:80", "note", "a b")
+	var rec map[string]interface{}
+	if err := json.Unmarshal(app.Bytes(), &rec); err != nil {
+		t.Fatalf("invalid JSON record %q: %s", app.String(), err)
+	}
+	if rec["msg"] != "accepted" || rec["level"] != "info" || rec["fork"] != "worker" || rec["conn"] != float64(7) || rec["peer"] != "10.0.0.1:80" {
+		t.Errorf("unexpected JSON record: %q", app.String())
+	}
+	if _, ok := rec["caller"]; ok == false {
+		t.Errorf("JSON record without caller: %q", app.String())
+	}
+	if strings.Contains(debug.String(), ` level=info `) == false || strings.Contains(debug.String(), ` msg=accepted conn=7 peer=10.0.0.1:80 note="a b"`) == false {
+		t.Errorf("unexpected logfmt record: %q", debug.String())
+	}
+	if err := l.SetEncoderString("app", "xml"); err == nil {
+		t.Errorf("SetEncoderString accept invalid encoder")
+	}
+}
+
+// nextLine return file:line of line after caller
+func nextLine() string {
+	_, file, line, _ := runtime.Caller(1)
+	return file + ":" + strconv.Itoa(line+1)
+}
+
+func TestCaller(t *testing.T) {
+	l := NewLogger("[test]", LOGFLAG_NONE)
+	var app bytes.Buffer
+	l.SetWriter("app", &app)
+	l.SetEncoderString("app", "json")
+	check := func(name, want string) {
+		var rec map[string]interface{}
+		if err := json.Unmarshal(app.Bytes(), &rec); err != nil {
+			t.Fatalf("%s, invalid JSON record %q: %s", name, app.String(), err)
+		}
+		if rec["caller"] != want {
+			t.Errorf("%s, caller %v, want %s", name, rec["caller"], want)
+		}
+		app.Reset()
+	}
+	want := nextLine()
+	l.Infof("conn %d", 1)
+	check("Infof", want)
+	want = nextLine()
+	l.With("conn", 1).Info("accepted")
+	check("Entry_t", want)
+	want = nextLine()
+	l.Logw(LEVEL_INFO, "accepted", "conn", 1)
+	check("Logw", want)
+	want = nextLine()
+	l.WriteToList([]string{"app"}, "accepted")
+	check("WriteToList", want)
+}
+
+func TestRateLimitInterleaved(t *testing.T) {
+	l := NewLogger("[test]", LOGFLAG_NONE)
+	var app bytes.Buffer
+	l.SetWriter("app", &app)
+	if err := l.SetRateLimit("app", 0.001, 2, LIMIT_BY_FORMAT); err != nil {
+		t.Fatalf("SetRateLimit failed: %s", err)
+	}
+	for i := 0; i < 50; i++ {
+		l.Applogf("source a %d", i)
+		l.Applogf("source b %d", i)
+	}
+	l.Close()
+	out := app.String()
+	// 2 messages + 1 summary
+	if n := strings.Count(out, "source a"); n != 3 {
+		t.Errorf("source a written %d times, want 3: %q", n, out)
+	}
+	if n := strings.Count(out, "source b"); n != 3 {
+		t.Errorf("source b written %d times, want 3: %q", n, out)
+	}
+	if strings.Contains(out, "suppressed 48 similar messages: source a %d") == false {
+		t.Errorf("missing summary of source a: %q", out)
+	}
+	if n := l.Suppressed("app"); n != 96 {
+		t.Errorf("Suppressed return %d, want 96", n)
+	}
+}
+
+func TestRingDump(t *testing.T) {
+	l := NewLogger("[test]", LOGFLAG_NONE)
+	if err := l.DumpRing(&bytes.Buffer{}); err == nil {
+		t.Errorf("DumpRing succeed with ring disabled")
+	}
+	if err := l.EnableRing(3); err != nil {
+		t.Fatalf("EnableRing failed: %s", err)
+	}
+	for i := 0; i < 5; i++ {
+		l.Debugf("step %d", i)
+	}
+	var out bytes.Buffer
+	if err := l.DumpRing(&out); err != nil {
+		t.Fatalf("DumpRing failed: %s", err)
+	}
+	if strings.Contains(out.String(), "step 1") || strings.Contains(out.String(), "[DEBUG] step 2") == false || strings.Contains(out.String(), "step 4") == false {
+		t.Errorf("unexpected ring dump: %q", out.String())
+	}
+}
+
+func TestStdAdapters(t *testing.T) {
+	l := NewLogger("[test]", LOGFLAG_NONE)
+	var app bytes.Buffer
+	l.SetWriter("app", &app)
+	l.logChs["app"].SetFlags(int(log.Lshortfile))
+	l.StdLogger("app").Printf("std %d", 1)
+	l.Slog().With("conn", 2).Info("slog", "peer", "a")
+	out := app.String()
+	if strings.Contains(out, "logger_test.go:") == false || strings.Contains(out, "std 1") == false {
+		t.Errorf("unexpected StdLogger output: %q", out)
+	}
+	if strings.Contains(out, "[INFO] slog conn=2 peer=a") == false || strings.Contains(out, "stdlog.go") {
+		t.Errorf("unexpected slog output: %q", out)
+	}
+}
+
+func TestJSONEscape(t *testing.T) {
+	l := NewLogger("[test]", LOGFLAG_NONE)
+	var app bytes.Buffer
+	l.SetWriter("app", &app)
+	l.SetEncoderString("app", "json")
+	l.With("k\x01ey", "a\x00b\u2028c\x7f\"\\").Info("red \x1b[31m\ttab", "bad", "x\xffy", "err", errors.New("e\x02"))
+	var rec map[string]interface{}
+	if err := json.Unmarshal(app.Bytes(), &rec); err != nil {
+		t.Fatalf("invalid JSON record %q: %s", app.String(), err)
+	}
+	for key, want := range map[string]string{
+		"k\x01ey": "a\x00b\u2028c\x7f\"\\",
+		"msg":     "red \x1b[31m\ttab",
+		"bad":     "x�y",
+		"err":     "e\x02",
+	} {
+		if rec[key] != want {
+			t.Errorf("%q = %q, want %q", key, rec[key], want)
+		}
+	}
+	if bytes.Contains(app.Bytes(), []byte(`\x`)) {
+		t.Errorf("Go escape in JSON record: %q", app.String())
+	}
+}
+
+func TestRateLimitQuietSummary(t *testing.T) {
+	l := NewLogger("[test]", LOGFLAG_NONE)
+	var app lockedBuffer
+	l.SetWriter("app", &app)
+	if err := l.SetRateLimit("app", 0.001, 1, LIMIT_BY_CALLSITE); err != nil {
+		t.Fatalf("SetRateLimit failed: %s", err)
+	}
+	for i := 0; i < 10; i++ {
+		l.Applogf("burst %d", i)
+	}
+	// channel gone quiet, summary is due
+	l.mu.Lock()
+	for _, b := range l.limiters["app"].buckets {
+		b.first = b.first.Add(-LIMIT_SUMMARY_INTERVAL)
+	}
+	l.mu.Unlock()
+	deadline := time.Now().Add(3 * time.Second)
+	for strings.Contains(app.String(), "suppressed 9 similar messages: ") == false {
+		if time.Now().After(deadline) {
+			t.Fatalf("no summary without next message: %q", app.String())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	l.mu.Lock()
+	sweeping := l.sweeping
+	l.mu.Unlock()
+	for i := 0; sweeping && i < 40; i++ {
+		time.Sleep(50 * time.Millisecond)
+		l.mu.Lock()
+		sweeping = l.sweeping
+		l.mu.Unlock()
+	}
+	if sweeping {
+		t.Errorf("sweep loop still running without suppressed message")
+	}
+}
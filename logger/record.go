@@ -0,0 +1,408 @@
+// structured log record and encoders for LoggerT
+
+package logger
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Record_t is one log message with context
+type Record_t struct {
+	Time   time.Time     // time of message
+	Level  Level         // level of message
+	Pid    int           // pid of writer
+	Fork   string        // fork state of writer, eg,. worker
+	Caller string        // file:line of caller, empty if not need
+	Msg    string        // message text
+	Tagged bool          // show level tag in human format
+	Fields []interface{} // key/value pairs
+	Remote bool          // record from worker process, human format tag it with pid and fork state
+}
+
+// Encoder format Record_t for log write channel
+type Encoder interface {
+	// Encode append formated r to buf and return it
+	// prefix and flag are settings of log write channel
+	Encode(buf []byte, r *Record_t, prefix string, flag int) []byte
+
+	// NeedCaller return true if Record_t.Caller used with flag
+	NeedCaller(flag int) bool
+}
+
+// ParseEncoder return Encoder by name(human/logfmt/json)
+func ParseEncoder(name string) (Encoder, error) {
+	switch name {
+	case "human", "":
+		return NewHumanEncoder(), nil
+	case "logfmt":
+		return NewLogfmtEncoder(), nil
+	case "json":
+		return NewJSONEncoder(), nil
+	}
+	return nil, errors.New("invalid log encoder: " + name)
+}
+
+// itoa append fixed-width decimal i to buf, copy from log package
+func itoa(buf []byte, i int, wid int) []byte {
+	var b [20]byte
+	bp := len(b) - 1
+	for i >= 10 || wid > 1 {
+		wid--
+		q := i / 10
+		b[bp] = byte('0' + i - q*10)
+		bp--
+		i = q
+	}
+	// i < 10
+	b[bp] = byte('0' + i)
+	return append(buf, b[bp:]...)
+}
+
+// fieldKey return string key of key/value pairs
+func fieldKey(k interface{}) string {
+	if s, ok := k.(string); ok {
+		return s
+	}
+	return fmt.Sprint(k)
+}
+
+// eachField call fn with key/value pairs of fields
+// value without key use key !BADKEY
+func eachField(fields []interface{}, fn func(key string, val interface{})) {
+	for i := 0; i < len(fields); i += 2 {
+		if i+1 == len(fields) {
+			fn("!BADKEY", fields[i])
+			break
+		}
+		fn(fieldKey(fields[i]), fields[i+1])
+	}
+}
+
+// fieldString return text of field value
+func fieldString(val interface{}) string {
+	switch v := val.(type) {
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return fmt.Sprint(val)
+}
+
+// default encoder of log write channel
+var humanEncoder = NewHumanEncoder()
+
+// HumanEncoder format record like standard log package, with key=value fields at end
+type HumanEncoder struct{}
+
+// NewHumanEncoder return new *HumanEncoder
+func NewHumanEncoder() *HumanEncoder {
+	return &HumanEncoder{}
+}
+
+// NeedCaller return true if flag has log.Llongfile or log.Lshortfile
+func (e *HumanEncoder) NeedCaller(flag int) bool {
+	return flag&(log.Lshortfile|log.Llongfile) != 0
+}
+
+// Encode append formated r to buf
+func (e *HumanEncoder) Encode(buf []byte, r *Record_t, prefix string, flag int) []byte {
+	if flag&log.Lmsgprefix == 0 {
+		buf = append(buf, prefix...)
+	}
+	if flag&(log.Ldate|log.Ltime|log.Lmicroseconds) != 0 {
+		t := r.Time
+		if flag&log.LUTC != 0 {
+			t = t.UTC()
+		}
+		if flag&log.Ldate != 0 {
+			year, month, day := t.Date()
+			buf = itoa(buf, year, 4)
+			buf = append(buf, '/')
+			buf = itoa(buf, int(month), 2)
+			buf = append(buf, '/')
+			buf = itoa(buf, day, 2)
+			buf = append(buf, ' ')
+		}
+		if flag&(log.Ltime|log.Lmicroseconds) != 0 {
+			hour, min, sec := t.Clock()
+			buf = itoa(buf, hour, 2)
+			buf = append(buf, ':')
+			buf = itoa(buf, min, 2)
+			buf = append(buf, ':')
+			buf = itoa(buf, sec, 2)
+			if flag&log.Lmicroseconds != 0 {
+				buf = append(buf, '.')
+				buf = itoa(buf, t.Nanosecond()/1e3, 6)
+			}
+			buf = append(buf, ' ')
+		}
+	}
+	if flag&(log.Lshortfile|log.Llongfile) != 0 {
+		caller := r.Caller
+		if flag&log.Lshortfile != 0 {
+			caller = filepath.Base(caller)
+		}
+		buf = append(buf, caller...)
+		buf = append(buf, ": "...)
+	}
+	if flag&log.Lmsgprefix != 0 {
+		buf = append(buf, prefix...)
+	}
+	if r.Remote {
+		buf = append(buf, '[')
+		buf = strconv.AppendInt(buf, int64(r.Pid), 10)
+		if r.Fork != "" {
+			buf = append(buf, ' ')
+			buf = append(buf, r.Fork...)
+		}
+		buf = append(buf, "] "...)
+	}
+	if r.Tagged {
+		buf = append(buf, levelTags[r.Level]...)
+	}
+	buf = append(buf, strings.TrimRight(r.Msg, "\n")...)
+	eachField(r.Fields, func(key string, val interface{}) {
+		buf = append(buf, ' ')
+		buf = appendLogfmt(buf, key, fieldString(val))
+	})
+	return append(buf, '\n')
+}
+
+// appendLogfmt append key=value to buf, value quoted if need
+func appendLogfmt(buf []byte, key, val string) []byte {
+	buf = append(buf, key...)
+	buf = append(buf, '=')
+	if val == "" || strings.ContainsAny(val, " =\"\t\r\n\\") || strconv.CanBackquote(val) == false {
+		return strconv.AppendQuote(buf, val)
+	}
+	return append(buf, val...)
+}
+
+// LogfmtEncoder format record in logfmt(key=value ...)
+type LogfmtEncoder struct{}
+
+// NewLogfmtEncoder return new *LogfmtEncoder
+func NewLogfmtEncoder() *LogfmtEncoder {
+	return &LogfmtEncoder{}
+}
+
+// NeedCaller return true
+func (e *LogfmtEncoder) NeedCaller(flag int) bool {
+	return true
+}
+
+// Encode append formated r to buf
+func (e *LogfmtEncoder) Encode(buf []byte, r *Record_t, prefix string, flag int) []byte {
+	buf = appendLogfmt(buf, "time", r.Time.Format(time.RFC3339Nano))
+	buf = append(buf, ' ')
+	buf = appendLogfmt(buf, "level", r.Level.String())
+	buf = append(buf, ' ')
+	buf = appendLogfmt(buf, "pid", strconv.Itoa(r.Pid))
+	if r.Fork != "" {
+		buf = append(buf, ' ')
+		buf = appendLogfmt(buf, "fork", r.Fork)
+	}
+	if r.Caller != "" {
+		buf = append(buf, ' ')
+		buf = appendLogfmt(buf, "caller", r.Caller)
+	}
+	buf = append(buf, ' ')
+	buf = appendLogfmt(buf, "msg", strings.TrimRight(r.Msg, "\n"))
+	eachField(r.Fields, func(key string, val interface{}) {
+		buf = append(buf, ' ')
+		buf = appendLogfmt(buf, key, fieldString(val))
+	})
+	return append(buf, '\n')
+}
+
+// JSONEncoder format record in JSON lines
+type JSONEncoder struct{}
+
+// NewJSONEncoder return new *JSONEncoder
+func NewJSONEncoder() *JSONEncoder {
+	return &JSONEncoder{}
+}
+
+// NeedCaller return true
+func (e *JSONEncoder) NeedCaller(flag int) bool {
+	return true
+}
+
+// appendJSONString append s as JSON string to buf, same escaping as encoding/json without HTML escape
+// invalid UTF-8 is replaced by U+FFFD
+func appendJSONString(buf []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	buf = append(buf, '"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"' || c == '\\':
+				buf = append(buf, '\\', c)
+			case c == '\n':
+				buf = append(buf, '\\', 'n')
+			case c == '\r':
+				buf = append(buf, '\\', 'r')
+			case c == '\t':
+				buf = append(buf, '\\', 't')
+			case c < 0x20:
+				buf = append(buf, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+			default:
+				buf = append(buf, c)
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			buf = append(buf, `\ufffd`...)
+		case r == '\u2028' || r == '\u2029':
+			// valid JSON, escaped for JavaScript like encoding/json
+			buf = append(buf, '\\', 'u', '2', '0', '2', hex[r&0xf])
+		default:
+			buf = append(buf, s[i:i+size]...)
+		}
+		i += size
+	}
+	return append(buf, '"')
+}
+
+// appendJSON append "key":value to buf
+func appendJSON(buf []byte, key string, val interface{}) []byte {
+	buf = appendJSONString(buf, key)
+	buf = append(buf, ':')
+	switch v := val.(type) {
+	case string:
+		return appendJSONString(buf, v)
+	case error:
+		return appendJSONString(buf, v.Error())
+	case fmt.Stringer:
+		return appendJSONString(buf, v.String())
+	}
+	b, err := json.Marshal(val)
+	if err != nil {
+		return appendJSONString(buf, fmt.Sprint(val))
+	}
+	return append(buf, b...)
+}
+
+// Encode append formated r to buf
+func (e *JSONEncoder) Encode(buf []byte, r *Record_t, prefix string, flag int) []byte {
+	buf = append(buf, '{')
+	buf = appendJSON(buf, "time", r.Time.Format(time.RFC3339Nano))
+	buf = append(buf, ',')
+	buf = appendJSON(buf, "level", r.Level.String())
+	buf = append(buf, ',')
+	buf = appendJSON(buf, "pid", r.Pid)
+	if r.Fork != "" {
+		buf = append(buf, ',')
+		buf = appendJSON(buf, "fork", r.Fork)
+	}
+	if r.Caller != "" {
+		buf = append(buf, ',')
+		buf = appendJSON(buf, "caller", r.Caller)
+	}
+	buf = append(buf, ',')
+	buf = appendJSON(buf, "msg", strings.TrimRight(r.Msg, "\n"))
+	eachField(r.Fields, func(key string, val interface{}) {
+		buf = append(buf, ',')
+		buf = appendJSON(buf, key, val)
+	})
+	return append(buf, '}', '\n')
+}
+
+// Entry_t carry fields for structured logging
+// l.With("conn", id).Info("accepted", "peer", addr)
+type Entry_t struct {
+	l      *LoggerT      // logger to write
+	fields []interface{} // key/value pairs
+}
+
+// With return *Entry_t with key/value pairs
+func (l *LoggerT) With(kv ...interface{}) *Entry_t {
+	return &Entry_t{
+		l:      l,
+		fields: append(make([]interface{}, 0, len(kv)), kv...),
+	}
+}
+
+// With return new *Entry_t with fields of e and key/value pairs
+func (e *Entry_t) With(kv ...interface{}) *Entry_t {
+	fields := make([]interface{}, 0, len(e.fields)+len(kv))
+	fields = append(fields, e.fields...)
+	return &Entry_t{
+		l:      e.l,
+		fields: append(fields, kv...),
+	}
+}
+
+// log write msg with fields of e and key/value pairs to channels of level
+func (e *Entry_t) log(level Level, msg string, kv []interface{}) {
+	fields := e.fields
+	if len(kv) > 0 {
+		fields = make([]interface{}, 0, len(e.fields)+len(kv))
+		fields = append(fields, e.fields...)
+		fields = append(fields, kv...)
+	}
+	e.l.emit(level, levelChannels[level], msg, true, fields, msg, "")
+}
+
+// Trace write msg and key/value pairs to debug
+func (e *Entry_t) Trace(msg string, kv ...interface{}) {
+	if e.l.Enabled(LEVEL_TRACE) == false {
+		return
+	}
+	e.log(LEVEL_TRACE, msg, kv)
+}
+
+// Debug write msg and key/value pairs to debug
+func (e *Entry_t) Debug(msg string, kv ...interface{}) {
+	if e.l.Enabled(LEVEL_DEBUG) == false {
+		return
+	}
+	e.log(LEVEL_DEBUG, msg, kv)
+}
+
+// Info write msg and key/value pairs to app+debug
+func (e *Entry_t) Info(msg string, kv ...interface{}) {
+	if e.l.Enabled(LEVEL_INFO) == false {
+		return
+	}
+	e.log(LEVEL_INFO, msg, kv)
+}
+
+// Notice write msg and key/value pairs to app+debug+syslog
+func (e *Entry_t) Notice(msg string, kv ...interface{}) {
+	if e.l.Enabled(LEVEL_NOTICE) == false {
+		return
+	}
+	e.log(LEVEL_NOTICE, msg, kv)
+}
+
+// Warn write msg and key/value pairs to app+err+debug+stderr
+func (e *Entry_t) Warn(msg string, kv ...interface{}) {
+	if e.l.Enabled(LEVEL_WARN) == false {
+		return
+	}
+	e.log(LEVEL_WARN, msg, kv)
+}
+
+// Error write msg and key/value pairs to err+debug+syslog+stderr
+func (e *Entry_t) Error(msg string, kv ...interface{}) {
+	if e.l.Enabled(LEVEL_ERROR) == false {
+		return
+	}
+	e.log(LEVEL_ERROR, msg, kv)
+}
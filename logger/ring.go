@@ -0,0 +1,157 @@
+// in-memory ring buffer channel for post-mortem log dump
+
+package logger
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+)
+
+// default records of ring buffer
+const RING_BUFFER_SIZE = 1000
+
+// RingBuffer_t is io.Writer keep last N messages in memory
+type RingBuffer_t struct {
+	mu    sync.Mutex
+	ring  [][]byte // message slots
+	head  int      // index of oldest message
+	count int      // messages in ring
+}
+
+// NewRingBuffer return *RingBuffer_t keep last size messages
+// size <= 0 to use RING_BUFFER_SIZE
+func NewRingBuffer(size int) *RingBuffer_t {
+	if size <= 0 {
+		size = RING_BUFFER_SIZE
+	}
+	return &RingBuffer_t{
+		ring: make([][]byte, size),
+	}
+}
+
+// Write copy p into ring, oldest message is overwrited when ring full
+func (b *RingBuffer_t) Write(p []byte) (n int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	idx := (b.head + b.count) % len(b.ring)
+	if b.count == len(b.ring) {
+		b.head = (b.head + 1) % len(b.ring)
+	} else {
+		b.count++
+	}
+	b.ring[idx] = append(b.ring[idx][:0], p...)
+	return len(p), nil
+}
+
+// Len return count of messages in ring
+func (b *RingBuffer_t) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.count
+}
+
+// Reset drop all messages in ring
+func (b *RingBuffer_t) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.head = 0
+	b.count = 0
+}
+
+// Dump write messages in ring to w, oldest first
+func (b *RingBuffer_t) Dump(w io.Writer) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var total int64
+	for i := 0; i < b.count; i++ {
+		n, err := w.Write(b.ring[(b.head+i)%len(b.ring)])
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// ringBuffer return *RingBuffer_t of ring channel, nil if disabled
+func (l *LoggerT) ringBuffer() *RingBuffer_t {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed["ring"] {
+		return nil
+	}
+	w := l.logChs["ring"].Writer()
+	if aw, ok := w.(*AsyncWriter_t); ok {
+		w = aw.Writer()
+	}
+	rb, _ := w.(*RingBuffer_t)
+	return rb
+}
+
+// EnableRing set ring channel to new *RingBuffer_t keep last size records
+// ring channel receive records of all level(default level is LEVEL_TRACE) even not in write list
+// same as SetWriter("ring", NewRingBuffer(size))
+func (l *LoggerT) EnableRing(size int) error {
+	return l.SetWriter("ring", NewRingBuffer(size))
+}
+
+// SetRingDump set writer for automatic ring dump(Fatal/Panic/DumpOnPanic), default is os.Stderr
+func (l *LoggerT) SetRingDump(w io.Writer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ringDump = w
+}
+
+// DumpRing write records in ring channel to w, oldest first
+func (l *LoggerT) DumpRing(w io.Writer) error {
+	rb := l.ringBuffer()
+	if rb == nil {
+		return errors.New("ring channel disabled")
+	}
+	l.Flush(l.flushTime)
+	if _, err := io.WriteString(w, "--- ring dump begin, "+strconv.Itoa(rb.Len())+" records ---\n"); err != nil {
+		return err
+	}
+	if _, err := rb.Dump(w); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "--- ring dump end ---\n")
+	return err
+}
+
+// autoDump write records in ring channel to ring dump writer, if ring enabled
+func (l *LoggerT) autoDump() {
+	l.mu.Lock()
+	w := l.ringDump
+	l.mu.Unlock()
+	l.DumpRing(w)
+}
+
+// RingSignal dump ring channel to ring dump writer when signal received
+// eg,. RingSignal(syscall.SIGUSR2)
+func (l *LoggerT) RingSignal(sig ...os.Signal) error {
+	if len(sig) == 0 {
+		return errors.New("no signal for RingSignal")
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sig...)
+	go func() {
+		for _ = range ch {
+			l.autoDump()
+		}
+	}()
+	return nil
+}
+
+// DumpOnPanic dump ring channel to ring dump writer and panic again
+// usage: defer l.DumpOnPanic()
+func (l *LoggerT) DumpOnPanic() {
+	if r := recover(); r != nil {
+		l.autoDump()
+		panic(r)
+	}
+}
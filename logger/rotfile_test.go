@@ -0,0 +1,248 @@
+package logger
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rotatedFiles return sorted names of rotated files in dir
+func rotatedFiles(t *testing.T, dir string) []string {
+	list, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("read dir: %s", err)
+	}
+	names := make([]string, 0, len(list))
+	for _, fi := range list {
+		if strings.HasPrefix(fi.Name(), "app.log.2") {
+			names = append(names, fi.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestRotatedName(t *testing.T) {
+	stamp := time.Now().Format(ROTATE_STAMP)
+	for _, c := range []struct {
+		format string
+		name   string
+		want   bool
+	}{
+		{"", "app.log." + stamp, true},
+		{"", "app.log." + stamp + ".gz", true},
+		{"", "app.log." + stamp + "-2.gz", true},
+		{"", "app.log", false},
+		{"", "app.log.current", false},
+		{"", "app.log.bak", false},
+		{"", "app.log.20060102", false},
+		{"", "app.log." + stamp + "-x", false},
+		{"", "other.app.log", false},
+		{"", "other.app.log." + stamp, false},
+		{"", "myapp.log." + stamp, false},
+		{"2006-01-02", "2016-05-06.app.log", true},
+		{"2006-01-02", "2016-05-06.app.log.gz", true},
+		{"2006-01-02", "2016-05-06.app.log." + stamp, true},
+		{"2006-01-02", "other.app.log", false},
+		{"2006-01-02", "app.log." + stamp, false},
+		{"web", "web.app.log." + stamp, true},
+		{"web", "web.app.log", false},
+		{"web", "other.app.log." + stamp, false},
+	} {
+		r := &RotFile_t{filename: "/var/log/app.log", format: c.format}
+		if got := r.isRotated(c.name, "app.log", "app.log.current"); got != c.want {
+			t.Errorf("format %q, isRotated(%s) = %v, want %v", c.format, c.name, got, c.want)
+		}
+	}
+}
+
+func TestRotFileCompress(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "app.log")
+	// unrelated files in the same directory
+	for _, name := range []string{"other.app.log", "app.log.bak"} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte("keep\n"), 0644)
+	}
+	r := NewRotFile(file, 0644, 0, 10, 0, "")
+	lines := []string{"line 1 ....\n", "line 2 ....\n", "line 3 ....\n"}
+	for _, line := range lines {
+		r.Write([]byte(line))
+	}
+	r.Close()
+	names := rotatedFiles(t, dir)
+	if len(names) != 2 {
+		t.Fatalf("rotated files %v, want 2", names)
+	}
+	got := ""
+	for _, name := range names {
+		if strings.HasSuffix(name, ".gz") == false {
+			t.Fatalf("rotated file %s not compressed", name)
+		}
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("open %s: %s", name, err)
+		}
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("gzip %s: %s", name, err)
+		}
+		b, _ := ioutil.ReadAll(zr)
+		f.Close()
+		got += string(b)
+	}
+	if got != lines[0]+lines[1] {
+		t.Errorf("rotated content %q", got)
+	}
+	if b, _ := ioutil.ReadFile(file); string(b) != lines[2] {
+		t.Errorf("current content %q", b)
+	}
+	if target, err := os.Readlink(file + ".current"); err != nil || target != "app.log" {
+		t.Errorf("symlink to %q, %v", target, err)
+	}
+	for _, name := range []string{"other.app.log", "app.log.bak"} {
+		if b, err := ioutil.ReadFile(filepath.Join(dir, name)); err != nil || string(b) != "keep\n" {
+			t.Errorf("unrelated file %s changed: %q, %v", name, b, err)
+		}
+	}
+}
+
+func TestRotFileRetention(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "app.log")
+	// old rotated file and unrelated old files
+	old := time.Now().Add(-48 * time.Hour)
+	for _, name := range []string{"app.log.20000102-150405.000000.gz", "app.log.bak", "other.app.log"} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte("old\n"), 0644)
+		os.Chtimes(filepath.Join(dir, name), old, old)
+	}
+	r := NewRotFile(file, 0644, 2, 10, 0, "")
+	r.SetCompress(false)
+	r.SetRetention(0, time.Hour)
+	for i := 0; i < 5; i++ {
+		r.Write([]byte("line .......\n"))
+		// files sorted by modify time
+		time.Sleep(10 * time.Millisecond)
+	}
+	r.Close()
+	names := rotatedFiles(t, dir)
+	// 4 rotated, 2 kept by count, old one removed by age
+	if len(names) != 2 {
+		t.Errorf("rotated files %v, want 2", names)
+	}
+	for _, name := range names {
+		if strings.HasSuffix(name, ".gz") {
+			t.Errorf("rotated file %s compressed", name)
+		}
+	}
+	for _, name := range []string{"app.log.bak", "other.app.log"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("unrelated file %s removed", name)
+		}
+	}
+}
+
+func TestRotFileRetentionCompressLate(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "app.log")
+	// old rotated file left uncompressed by previous run
+	oldName := "app.log.20000102-150405.000000"
+	old := time.Now().Add(-48 * time.Hour)
+	ioutil.WriteFile(filepath.Join(dir, oldName), []byte("old\n"), 0644)
+	os.Chtimes(filepath.Join(dir, oldName), old, old)
+	r := NewRotFile(file, 0644, 2, 10, 0, "")
+	for i := 0; i < 4; i++ {
+		r.Write([]byte("line .......\n"))
+		time.Sleep(10 * time.Millisecond)
+	}
+	r.Close()
+	names := rotatedFiles(t, dir)
+	// compressed late, still oldest
+	if len(names) != 2 || strings.HasPrefix(names[0], oldName) {
+		t.Errorf("rotated files %v, want 2 newest", names)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, names[len(names)-1])); err != nil || time.Since(fi.ModTime()) > time.Hour {
+		t.Errorf("compressed file lost modify time: %v", err)
+	}
+}
+
+func TestRotFileErrorLog(t *testing.T) {
+	dir := t.TempDir()
+	l := NewLogger("[test]", LOGFLAG_NONE)
+	var errlog lockedBuffer
+	l.SetWriter("err", &errlog)
+	l.SetWriter("stderr", DummyOut)
+	r := NewRotFile(filepath.Join(dir, "app.log"), 0644, 0, 0, 0, "")
+	r.SetErrorLog(l)
+	// no such directory for symlink
+	r.SetSymlink(filepath.Join(dir, "nodir", "app.log.current"))
+	r.Close()
+	if strings.Contains(errlog.String(), "symlink") == false {
+		t.Errorf("symlink error not reported to err channel: %q", errlog.String())
+	}
+}
+
+func TestRotFileReopen(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "app.log")
+	r := NewRotFile(file, 0644, 0, 0, 0, "")
+	defer r.Close()
+	r.Write([]byte("before rename\n"))
+	// external logrotate rename current file
+	if err := os.Rename(file, file+".1"); err != nil {
+		t.Fatalf("rename: %s", err)
+	}
+	if err := r.Reopen(); err != nil {
+		t.Fatalf("Reopen failed: %s", err)
+	}
+	r.Write([]byte("after rename\n"))
+	if b, _ := ioutil.ReadFile(file + ".1"); string(b) != "before rename\n" {
+		t.Errorf("renamed file content %q", b)
+	}
+	if b, _ := ioutil.ReadFile(file); string(b) != "after rename\n" {
+		t.Errorf("new file content %q", b)
+	}
+}
+
+func TestRotFileReopenCheck(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "app.log")
+	r := NewRotFile(file, 0644, 0, 0, 0, "")
+	defer r.Close()
+	r.SetReopenCheck(1)
+	r.Write([]byte("before rename\n"))
+	// renamed, found by next write
+	os.Rename(file, file+".1")
+	r.Write([]byte("after rename\n"))
+	if b, _ := ioutil.ReadFile(file); string(b) != "after rename\n" {
+		t.Errorf("file content after rename %q", b)
+	}
+	if b, _ := ioutil.ReadFile(file + ".1"); string(b) != "before rename\n" {
+		t.Errorf("renamed file content %q", b)
+	}
+	// truncated by copytruncate, found by next write
+	if err := os.Truncate(file, 0); err != nil {
+		t.Fatalf("truncate: %s", err)
+	}
+	r.Write([]byte("after truncate\n"))
+	if b, _ := ioutil.ReadFile(file); string(b) != "after truncate\n" {
+		t.Errorf("file content after truncate %q", b)
+	}
+	// size counter reset for rotation
+	if r.curSize != len("after truncate\n") {
+		t.Errorf("size %d after truncate", r.curSize)
+	}
+	// removed, recreated by next write
+	os.Remove(file)
+	r.Write([]byte("after remove\n"))
+	if b, _ := ioutil.ReadFile(file); string(b) != "after remove\n" {
+		t.Errorf("file content after remove %q", b)
+	}
+	if target, err := os.Readlink(file + ".current"); err != nil || target != "app.log" {
+		t.Errorf("symlink to %q, %v", target, err)
+	}
+}
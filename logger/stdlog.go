@@ -0,0 +1,182 @@
+// adapters for standard log and log/slog package
+
+package logger
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// function name prefix of this package, eg,. github.com/wheelcomplex/preinit/logger.
+var thisPackage = func() string {
+	name := runtime.FuncForPC(reflect.ValueOf(NewLogger).Pointer()).Name()
+	return name[:strings.LastIndex(name, ".")+1]
+}()
+
+// externalCaller return file:line of first frame outside log, log/slog and this package
+func externalCaller(skip int) string {
+	var pcs [32]uintptr
+	n := runtime.Callers(skip+1, pcs[:])
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		f, more := frames.Next()
+		if strings.HasPrefix(f.Function, "log.") == false && strings.HasPrefix(f.Function, "log/slog.") == false && strings.HasPrefix(f.Function, thisPackage) == false {
+			return f.File + ":" + strconv.Itoa(f.Line)
+		}
+		if more == false {
+			break
+		}
+	}
+	return "???:0"
+}
+
+// stdWriter_t is io.Writer for standard *log.Logger
+type stdWriter_t struct {
+	l     *LoggerT
+	level Level
+	names []string
+}
+
+// Write write message of standard logger to channels
+func (w *stdWriter_t) Write(p []byte) (n int, err error) {
+	if w.l.Enabled(w.level) {
+		w.l.emit(w.level, w.names, string(p), false, nil, "", externalCaller(2))
+	}
+	return len(p), nil
+}
+
+// stdWriter return *stdWriter_t for channel or level name
+func (l *LoggerT) stdWriter(channel string) *stdWriter_t {
+	if level, err := ParseLevel(channel); err == nil && level != LEVEL_OFF {
+		return &stdWriter_t{l: l, level: level, names: levelChannels[level]}
+	}
+	return &stdWriter_t{l: l, level: LEVEL_INFO, names: []string{channel}}
+}
+
+// StdLogger return standard *log.Logger write to log write channel at LEVEL_INFO
+// channel can be level name(trace/debug/info/notice/warn/error/fatal) to write to channels of level
+// format, prefix and caller are handled by LoggerT
+func (l *LoggerT) StdLogger(channel string) *log.Logger {
+	return log.New(l.stdWriter(channel), "", 0)
+}
+
+// RedirectStdLog redirect output of standard log package to log write channel
+// channel can be level name, check StdLogger
+// return function to restore standard log package
+func (l *LoggerT) RedirectStdLog(channel string) func() {
+	w, flags, prefix := log.Writer(), log.Flags(), log.Prefix()
+	log.SetOutput(l.stdWriter(channel))
+	log.SetFlags(0)
+	log.SetPrefix("")
+	return func() {
+		log.SetOutput(w)
+		log.SetFlags(flags)
+		log.SetPrefix(prefix)
+	}
+}
+
+// LEVEL_NOTICE in slog
+const SlogLevelNotice = slog.Level(2)
+
+// SlogLevel return Level of slog.Level
+func SlogLevel(level slog.Level) Level {
+	switch {
+	case level < slog.LevelDebug:
+		return LEVEL_TRACE
+	case level < slog.LevelInfo:
+		return LEVEL_DEBUG
+	case level < SlogLevelNotice:
+		return LEVEL_INFO
+	case level < slog.LevelWarn:
+		return LEVEL_NOTICE
+	case level < slog.LevelError:
+		return LEVEL_WARN
+	case level < slog.LevelError+4:
+		return LEVEL_ERROR
+	}
+	return LEVEL_FATAL
+}
+
+// SlogHandler_t is slog.Handler write to channels of level
+// record of LEVEL_FATAL do not call os.Exit
+type SlogHandler_t struct {
+	l      *LoggerT
+	fields []interface{} // key/value pairs of WithAttrs
+	group  string        // prefix of keys, eg,. "req."
+}
+
+// SlogHandler return slog.Handler of l
+func (l *LoggerT) SlogHandler() *SlogHandler_t {
+	return &SlogHandler_t{l: l}
+}
+
+// Slog return *slog.Logger write to l
+func (l *LoggerT) Slog() *slog.Logger {
+	return slog.New(l.SlogHandler())
+}
+
+// Enabled return true if any channel accept level
+func (h *SlogHandler_t) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.l.Enabled(SlogLevel(level))
+}
+
+// appendAttr append key/value pairs of a to fields, group is flatten to prefix.key
+func appendAttr(fields []interface{}, prefix string, a slog.Attr) []interface{} {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return fields
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix = prefix + a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			fields = appendAttr(fields, prefix, ga)
+		}
+		return fields
+	}
+	return append(fields, prefix+a.Key, a.Value.Any())
+}
+
+// Handle write slog.Record to channels of level
+func (h *SlogHandler_t) Handle(ctx context.Context, r slog.Record) error {
+	level := SlogLevel(r.Level)
+	fields := make([]interface{}, 0, len(h.fields)+r.NumAttrs()*2)
+	fields = append(fields, h.fields...)
+	r.Attrs(func(a slog.Attr) bool {
+		fields = appendAttr(fields, h.group, a)
+		return true
+	})
+	caller := ""
+	if r.PC != 0 {
+		f, _ := runtime.CallersFrames([]uintptr{r.PC}).Next()
+		caller = f.File + ":" + strconv.Itoa(f.Line)
+	} else {
+		caller = externalCaller(2)
+	}
+	h.l.emit(level, levelChannels[level], r.Message, true, fields, r.Message, caller)
+	return nil
+}
+
+// WithAttrs return new handler with attrs
+func (h *SlogHandler_t) WithAttrs(attrs []slog.Attr) slog.Handler {
+	fields := make([]interface{}, 0, len(h.fields)+len(attrs)*2)
+	fields = append(fields, h.fields...)
+	for _, a := range attrs {
+		fields = appendAttr(fields, h.group, a)
+	}
+	return &SlogHandler_t{l: h.l, fields: fields, group: h.group}
+}
+
+// WithGroup return new handler with keys prefixed by name
+func (h *SlogHandler_t) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &SlogHandler_t{l: h.l, fields: h.fields, group: h.group + name + "."}
+}
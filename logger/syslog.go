@@ -0,0 +1,341 @@
+// syslog write channel, local or remote over udp/tcp/tls
+
+package logger
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/syslog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// syslog message format
+const (
+	SYSLOG_RFC3164 = iota // BSD syslog, <PRI>Mmm dd hh:mm:ss host tag[pid]: msg
+	SYSLOG_RFC5424        // <PRI>1 timestamp host tag pid - - msg
+)
+
+// retry interval after syslog connect failed
+const SYSLOG_RETRY_INTERVAL = 5 * time.Second
+
+// path of local syslog socket, tried in order
+var syslogLocalPaths = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// LevelWriter is io.Writer which need level of message, eg,. *Syslog_t
+type LevelWriter interface {
+	WriteLevel(level Level, p []byte) (n int, err error)
+}
+
+// name of syslog facility
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// ParseFacility return syslog facility by name(kern/user/daemon/local0...)
+func ParseFacility(name string) (syslog.Priority, error) {
+	if f, ok := syslogFacilities[name]; ok {
+		return f, nil
+	}
+	return syslog.LOG_DAEMON, errors.New("invalid syslog facility: " + name)
+}
+
+// default syslog severity of level
+var syslogSeverities = map[Level]syslog.Priority{
+	LEVEL_TRACE:  syslog.LOG_DEBUG,
+	LEVEL_DEBUG:  syslog.LOG_DEBUG,
+	LEVEL_INFO:   syslog.LOG_INFO,
+	LEVEL_NOTICE: syslog.LOG_NOTICE,
+	LEVEL_WARN:   syslog.LOG_WARNING,
+	LEVEL_ERROR:  syslog.LOG_ERR,
+	LEVEL_FATAL:  syslog.LOG_CRIT,
+}
+
+// SyslogConfig_t is setting of Syslog_t
+type SyslogConfig_t struct {
+	Network   string                    // empty for local syslog, udp, tcp, tls, unix or unixgram
+	Addr      string                    // host:port of remote syslog, or path of unix socket
+	Facility  syslog.Priority           // zero(LOG_KERN) for syslog.LOG_DAEMON
+	Tag       string                    // default is program name
+	Format    int                       // SYSLOG_RFC3164 or SYSLOG_RFC5424
+	Hostname  string                    // default is os.Hostname()
+	Severity  map[Level]syslog.Priority // severity of level, missing level use default mapping
+	TLSConfig *tls.Config               // for tls network
+	Timeout   time.Duration             // dial and write timeout, default is 5s
+}
+
+// Syslog_t is io.WriteCloser send message to syslog
+// connection is created at first write and reconnected after error
+type Syslog_t struct {
+	mu       sync.Mutex
+	cfg      SyslogConfig_t
+	local    bool      // local syslog, no hostname in RFC3164 header
+	stream   bool      // tcp/tls/unix, need framing
+	conn     net.Conn  // current connection
+	retry    time.Time // no connect before retry
+	pid      string    // pid in header
+	buf      []byte    // message buffer
+	frame    []byte    // framing buffer
+	closed   bool      //
+	dropped  uint64    // messages dropped by connect error
+	lastErr  error     // last connect/write error
+	severity map[Level]syslog.Priority
+}
+
+// NewSyslog return *Syslog_t with cfg, nil cfg for local syslog
+// no connection is created, check Connect()
+func NewSyslog(cfg *SyslogConfig_t) (*Syslog_t, error) {
+	s := &Syslog_t{
+		pid:      strconv.Itoa(os.Getpid()),
+		buf:      make([]byte, 0, 512),
+		severity: make(map[Level]syslog.Priority),
+	}
+	if cfg != nil {
+		s.cfg = *cfg
+	}
+	switch s.cfg.Network {
+	case "":
+		s.local = true
+	case "udp", "udp4", "udp6":
+	case "tcp", "tcp4", "tcp6", "tls", "unix":
+		s.stream = true
+	case "unixgram":
+	default:
+		return nil, errors.New("invalid syslog network: " + s.cfg.Network)
+	}
+	if s.cfg.Network != "" && s.cfg.Addr == "" {
+		return nil, errors.New("no syslog address for network " + s.cfg.Network)
+	}
+	if s.cfg.Format != SYSLOG_RFC3164 && s.cfg.Format != SYSLOG_RFC5424 {
+		return nil, errors.New("invalid syslog format: " + strconv.Itoa(s.cfg.Format))
+	}
+	if s.cfg.Facility == 0 {
+		s.cfg.Facility = syslog.LOG_DAEMON
+	}
+	if s.cfg.Facility < 0 || s.cfg.Facility > syslog.LOG_LOCAL7 || s.cfg.Facility&7 != 0 {
+		return nil, errors.New("invalid syslog facility: " + strconv.Itoa(int(s.cfg.Facility)))
+	}
+	if s.cfg.Tag == "" {
+		s.cfg.Tag = filepath.Base(os.Args[0])
+	}
+	if s.cfg.Hostname == "" {
+		s.cfg.Hostname, _ = os.Hostname()
+		if s.cfg.Hostname == "" {
+			s.cfg.Hostname = "-"
+		}
+	}
+	if s.cfg.Timeout <= 0 {
+		s.cfg.Timeout = 5 * time.Second
+	}
+	for lv, pri := range syslogSeverities {
+		s.severity[lv] = pri
+	}
+	for lv, pri := range s.cfg.Severity {
+		s.severity[lv] = pri & 7
+	}
+	return s, nil
+}
+
+// dial connect to syslog
+// caller should hold s.mu
+func (s *Syslog_t) dial() error {
+	if s.conn != nil {
+		return nil
+	}
+	var err error
+	switch s.cfg.Network {
+	case "":
+		for _, network := range []string{"unixgram", "unix"} {
+			for _, path := range syslogLocalPaths {
+				s.conn, err = net.DialTimeout(network, path, s.cfg.Timeout)
+				if err == nil {
+					s.stream = network == "unix"
+					return nil
+				}
+			}
+		}
+		err = errors.New("unix syslog delivery error")
+	case "tls":
+		d := &net.Dialer{Timeout: s.cfg.Timeout}
+		s.conn, err = tls.DialWithDialer(d, "tcp", s.cfg.Addr, s.cfg.TLSConfig)
+	default:
+		s.conn, err = net.DialTimeout(s.cfg.Network, s.cfg.Addr, s.cfg.Timeout)
+	}
+	if err != nil {
+		s.conn = nil
+	}
+	return err
+}
+
+// Connect connect to syslog now, connection error is returned
+func (s *Syslog_t) Connect() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errors.New("syslog closed")
+	}
+	s.lastErr = s.dial()
+	if s.lastErr != nil {
+		s.retry = time.Now().Add(SYSLOG_RETRY_INTERVAL)
+	}
+	return s.lastErr
+}
+
+// format append syslog message to s.buf
+// caller should hold s.mu
+func (s *Syslog_t) format(pri syslog.Priority, p []byte) {
+	msg := strings.TrimRight(string(p), "\n")
+	now := time.Now()
+	s.buf = s.buf[:0]
+	s.buf = append(s.buf, '<')
+	s.buf = strconv.AppendInt(s.buf, int64(pri), 10)
+	s.buf = append(s.buf, '>')
+	if s.cfg.Format == SYSLOG_RFC5424 {
+		s.buf = append(s.buf, "1 "...)
+		s.buf = now.AppendFormat(s.buf, "2006-01-02T15:04:05.000000Z07:00")
+		s.buf = append(s.buf, ' ')
+		s.buf = append(s.buf, s.cfg.Hostname...)
+		s.buf = append(s.buf, ' ')
+		s.buf = append(s.buf, s.cfg.Tag...)
+		s.buf = append(s.buf, ' ')
+		s.buf = append(s.buf, s.pid...)
+		s.buf = append(s.buf, " - - "...)
+		s.buf = append(s.buf, msg...)
+	} else {
+		s.buf = now.AppendFormat(s.buf, time.Stamp)
+		s.buf = append(s.buf, ' ')
+		if s.local == false {
+			s.buf = append(s.buf, s.cfg.Hostname...)
+			s.buf = append(s.buf, ' ')
+		}
+		s.buf = append(s.buf, s.cfg.Tag...)
+		s.buf = append(s.buf, '[')
+		s.buf = append(s.buf, s.pid...)
+		s.buf = append(s.buf, "]: "...)
+		s.buf = append(s.buf, msg...)
+	}
+	if s.stream == false {
+		return
+	}
+	if s.cfg.Format == SYSLOG_RFC5424 {
+		// octet counting framing(RFC6587)
+		s.frame = strconv.AppendInt(s.frame[:0], int64(len(s.buf)), 10)
+		s.frame = append(s.frame, ' ')
+		s.frame = append(s.frame, s.buf...)
+		s.buf, s.frame = s.frame, s.buf
+		return
+	}
+	// non-transparent framing
+	s.buf = append(s.buf, '\n')
+}
+
+// WriteLevel send p to syslog with severity of level
+// message is dropped if syslog unavailable, and reconnect after SYSLOG_RETRY_INTERVAL
+func (s *Syslog_t) WriteLevel(level Level, p []byte) (n int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return len(p), nil
+	}
+	pri, ok := s.severity[level]
+	if ok == false {
+		pri = syslog.LOG_NOTICE
+	}
+	// try twice, reconnect if first write failed
+	for i := 0; i < 2; i++ {
+		if s.conn == nil {
+			if s.retry.After(time.Now()) {
+				break
+			}
+			if err = s.dial(); err != nil {
+				s.retry = time.Now().Add(SYSLOG_RETRY_INTERVAL)
+				break
+			}
+		}
+		// framing depend on transport of local syslog, format after dial
+		s.format(s.cfg.Facility|pri, p)
+		s.conn.SetWriteDeadline(time.Now().Add(s.cfg.Timeout))
+		if _, err = s.conn.Write(s.buf); err == nil {
+			return len(p), nil
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+	s.dropped++
+	if err != nil {
+		s.lastErr = err
+	}
+	// never block caller with syslog error
+	return len(p), nil
+}
+
+// Write send p to syslog with LOG_NOTICE
+func (s *Syslog_t) Write(p []byte) (n int, err error) {
+	return s.WriteLevel(LEVEL_NOTICE, p)
+}
+
+// Dropped return count of messages dropped by syslog error and last error
+func (s *Syslog_t) Dropped() (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped, s.lastErr
+}
+
+// Close close connection to syslog
+func (s *Syslog_t) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// SetSyslog replace sys channel with new *Syslog_t of cfg, nil cfg for local syslog
+// connect error is returned, but channel is set and will reconnect on write
+func (l *LoggerT) SetSyslog(cfg *SyslogConfig_t) error {
+	s, err := NewSyslog(cfg)
+	if err != nil {
+		return err
+	}
+	if err = l.SetWriteCloser("sys", s); err != nil {
+		s.Close()
+		return err
+	}
+	l.mu.Lock()
+	l.logChs["sys"].SetFlags(int(LOGFLAG_NONE))
+	l.logChs["sys"].SetPrefix("")
+	l.mu.Unlock()
+	if err = s.Connect(); err != nil {
+		return fmt.Errorf("connect syslog failed: %s", err.Error())
+	}
+	return nil
+}
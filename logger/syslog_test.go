@@ -0,0 +1,339 @@
+package logger
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// localStreamSyslog return reader of local syslog on unix stream socket
+func localStreamSyslog(t *testing.T) *bufio.Reader {
+	path := filepath.Join(t.TempDir(), "log")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	old := syslogLocalPaths
+	syslogLocalPaths = []string{path}
+	t.Cleanup(func() { syslogLocalPaths = old })
+	connCh := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			connCh <- conn
+		}
+	}()
+	// reader wait for connection at first read
+	return bufio.NewReader(&lazyConn{ch: connCh, t: t})
+}
+
+// lazyConn is io.Reader of accepted connection
+type lazyConn struct {
+	ch   chan net.Conn
+	conn net.Conn
+	t    *testing.T
+}
+
+func (c *lazyConn) Read(p []byte) (int, error) {
+	if c.conn == nil {
+		select {
+		case c.conn = <-c.ch:
+			c.t.Cleanup(func() { c.conn.Close() })
+		case <-time.After(5 * time.Second):
+			c.t.Fatalf("no syslog connection")
+		}
+	}
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return c.conn.Read(p)
+}
+
+func TestSyslogLocalStream(t *testing.T) {
+	rd := localStreamSyslog(t)
+	s, err := NewSyslog(nil)
+	if err != nil {
+		t.Fatalf("NewSyslog failed: %s", err)
+	}
+	defer s.Close()
+	// first message is framed after fallback to unix stream
+	s.WriteLevel(LEVEL_ERROR, []byte("first\n"))
+	s.WriteLevel(LEVEL_INFO, []byte("second"))
+	for _, want := range []string{"<27>", "<30>"} {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read syslog: %s", err)
+		}
+		if strings.HasPrefix(line, want) == false || strings.Count(line, "<") != 1 {
+			t.Errorf("unexpected syslog message %q, want prefix %s", line, want)
+		}
+	}
+}
+
+func TestSyslogLocalStreamRFC5424(t *testing.T) {
+	rd := localStreamSyslog(t)
+	s, err := NewSyslog(&SyslogConfig_t{Format: SYSLOG_RFC5424, Tag: "test"})
+	if err != nil {
+		t.Fatalf("NewSyslog failed: %s", err)
+	}
+	defer s.Close()
+	s.WriteLevel(LEVEL_WARN, []byte("first"))
+	s.WriteLevel(LEVEL_WARN, []byte("second"))
+	for _, msg := range []string{"first", "second"} {
+		// octet counting: MSG-LEN SP SYSLOG-MSG
+		size, err := rd.ReadString(' ')
+		if err != nil {
+			t.Fatalf("read syslog: %s", err)
+		}
+		n := 0
+		for _, c := range strings.TrimSuffix(size, " ") {
+			if c < '0' || c > '9' {
+				t.Fatalf("invalid octet count %q", size)
+			}
+			n = n*10 + int(c-'0')
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			t.Fatalf("read syslog: %s", err)
+		}
+		if strings.HasPrefix(string(buf), "<28>1 ") == false || strings.HasSuffix(string(buf), " test "+s.pid+" - - "+msg) == false {
+			t.Errorf("unexpected syslog message %q", buf)
+		}
+	}
+}
+
+// readPacket return next datagram of syslog listener
+func readPacket(t *testing.T, pc net.PacketConn) string {
+	buf := make([]byte, 2048)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("read syslog: %s", err)
+	}
+	return string(buf[:n])
+}
+
+func TestSyslogUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer pc.Close()
+	for _, c := range []struct {
+		format int
+		prefix string
+		suffix string
+	}{
+		// RFC3164 with hostname for remote syslog, no framing for datagram
+		{SYSLOG_RFC3164, "<27>", " host1 test[%s]: first"},
+		{SYSLOG_RFC5424, "<27>1 ", " host1 test %s - - first"},
+	} {
+		s, err := NewSyslog(&SyslogConfig_t{Network: "udp", Addr: pc.LocalAddr().String(), Format: c.format, Tag: "test", Hostname: "host1"})
+		if err != nil {
+			t.Fatalf("NewSyslog failed: %s", err)
+		}
+		s.WriteLevel(LEVEL_ERROR, []byte("first\n"))
+		s.Close()
+		msg := readPacket(t, pc)
+		suffix := strings.Replace(c.suffix, "%s", s.pid, 1)
+		if strings.HasPrefix(msg, c.prefix) == false || strings.HasSuffix(msg, suffix) == false {
+			t.Errorf("format %d, unexpected syslog message %q", c.format, msg)
+		}
+		if c.format == SYSLOG_RFC3164 {
+			// Mmm dd hh:mm:ss
+			stamp := msg[len(c.prefix) : len(c.prefix)+len(time.Stamp)]
+			if _, err := time.Parse(time.Stamp, stamp); err != nil {
+				t.Errorf("invalid RFC3164 timestamp %q", stamp)
+			}
+		}
+	}
+}
+
+// acceptLine return first line of next connection accepted by ln
+func acceptLine(t *testing.T, ln net.Listener) (net.Conn, string) {
+	ln.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accept: %s", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		conn.Close()
+		t.Fatalf("read syslog: %s", err)
+	}
+	return conn, line
+}
+
+func TestSyslogTCPReconnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	addr := ln.Addr().String()
+	s, err := NewSyslog(&SyslogConfig_t{Network: "tcp", Addr: addr, Tag: "test", Hostname: "host1"})
+	if err != nil {
+		t.Fatalf("NewSyslog failed: %s", err)
+	}
+	defer s.Close()
+	s.WriteLevel(LEVEL_INFO, []byte("first"))
+	conn, line := acceptLine(t, ln)
+	if strings.HasSuffix(line, " host1 test["+s.pid+"]: first\n") == false {
+		t.Errorf("unexpected syslog message %q", line)
+	}
+
+	// syslog server gone, messages dropped until retry
+	conn.Close()
+	ln.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.WriteLevel(LEVEL_INFO, []byte("lost"))
+		if n, err := s.Dropped(); n > 0 && err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("write to closed syslog not dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// syslog server back, reconnect after retry interval
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("listen again at %s: %s", addr, err)
+	}
+	defer ln.Close()
+	s.mu.Lock()
+	if s.conn != nil || s.retry.After(time.Now()) == false {
+		t.Errorf("no retry interval after connect failed")
+	}
+	s.retry = time.Time{}
+	s.mu.Unlock()
+	s.WriteLevel(LEVEL_INFO, []byte("second"))
+	conn, line = acceptLine(t, ln)
+	if strings.HasSuffix(line, "]: second\n") == false {
+		t.Errorf("unexpected syslog message after reconnect %q", line)
+	}
+
+	// connection closed by server, reconnect in the same write
+	conn.Close()
+	dropped, _ := s.Dropped()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+				s.WriteLevel(LEVEL_INFO, []byte("third"))
+			}
+		}
+	}()
+	conn, line = acceptLine(t, ln)
+	defer conn.Close()
+	if strings.HasSuffix(line, "]: third\n") == false {
+		t.Errorf("unexpected syslog message after reconnect %q", line)
+	}
+	if n, _ := s.Dropped(); n != dropped {
+		t.Errorf("%d messages dropped by reconnect", n-dropped)
+	}
+}
+
+// selfSigned return server certificate and pool trust it for 127.0.0.1
+func selfSigned(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "syslog test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %s", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestSyslogTLS(t *testing.T) {
+	cert, pool := selfSigned(t)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer ln.Close()
+	s, err := NewSyslog(&SyslogConfig_t{
+		Network:   "tls",
+		Addr:      ln.Addr().String(),
+		Format:    SYSLOG_RFC5424,
+		Tag:       "test",
+		Hostname:  "host1",
+		TLSConfig: &tls.Config{RootCAs: pool},
+	})
+	if err != nil {
+		t.Fatalf("NewSyslog failed: %s", err)
+	}
+	defer s.Close()
+	type result struct {
+		msg string
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			ch <- result{err: err}
+			return
+		}
+		defer conn.Close()
+		// handshake at first read
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		rd := bufio.NewReader(conn)
+		size, err := rd.ReadString(' ')
+		if err != nil {
+			ch <- result{err: err}
+			return
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(size, " "))
+		if err != nil {
+			ch <- result{err: err}
+			return
+		}
+		buf := make([]byte, n)
+		_, err = io.ReadFull(rd, buf)
+		ch <- result{string(buf), err}
+	}()
+	if err := s.Connect(); err != nil {
+		t.Fatalf("connect: %s", err)
+	}
+	s.WriteLevel(LEVEL_NOTICE, []byte("secure"))
+	r := <-ch
+	if r.err != nil {
+		t.Fatalf("read syslog: %s", r.err)
+	}
+	buf := r.msg
+	if strings.HasPrefix(buf, "<29>1 ") == false || strings.HasSuffix(buf, " host1 test "+s.pid+" - - secure") == false {
+		t.Errorf("unexpected syslog message %q", buf)
+	}
+}
@@ -654,7 +654,7 @@ func (brw *ByteRWCloser) Write(p []byte) (n int, err error) {
 	}
 	lb := len(brw.Bytes[brw.wptr:])
 	lp := len(p)
-	if lb > lp {
+	if lb >= lp {
 		n = lp
 	} else {
 		n = lb
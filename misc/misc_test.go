@@ -0,0 +1,25 @@
+package misc
+
+import (
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func TestByteRWCloserWrite(t *testing.T) {
+	buf := make([]byte, 8)
+	// write fill buffer exactly
+	if err := binary.Write(NewBRWC(buf), binary.BigEndian, uint64(0x0102030405060708)); err != nil {
+		t.Fatalf("exact write failed: %s", err)
+	}
+	if buf[0] != 1 || buf[7] != 8 {
+		t.Errorf("unexpected buffer: %x", buf)
+	}
+	brw := NewBRWC(buf[:4])
+	if n, err := brw.Write(buf); n != 4 || err != io.ErrShortWrite {
+		t.Errorf("overflow write return %d, %v", n, err)
+	}
+	if n, err := brw.Write(buf); n != 0 || err != io.ErrShortWrite {
+		t.Errorf("write to full buffer return %d, %v", n, err)
+	}
+}
@@ -15,6 +15,7 @@ package preinit
 import "C"
 
 import (
+	"fmt"
 	"os"
 	"path"
 	"runtime"
@@ -43,7 +44,7 @@ var OrigProcTitle string
 func setproctitle_init() {
 	opts = getopt.NewOpts(os.Args[1:])
 	if len(OrigProcTitle) == 0 {
-		OrigProcTitle = misc.CleanArgLine(os.Args[0] + " " + opts.String())
+		OrigProcTitle = misc.CleanArgLine(os.Args[0] + " " + opts.MergedString())
 	}
 	HaveSetProcTitle = int(C.spt_init1())
 
@@ -149,7 +150,7 @@ func argsInit() {
 	Args = append(Args, os.Args...)
 	ExecFile = getopt.ExecFileOfPid(os.Getpid())
 	ArgLine = getopt.ArgsToSpLine(Args)
-	ArgFullLine = getopt.CleanArgLine(os.Args[0] + " " + opts.String())
+	ArgFullLine = getopt.CleanArgLine(os.Args[0] + " " + opts.MergedString())
 	//
 }
 
@@ -198,6 +199,7 @@ func GetForkState() ForkStateT {
 func SetForkState(state ForkStateT) ForkStateT {
 	old := forkState
 	forkState = state
+	l.SetForkState(state.String())
 	return old
 }
 
@@ -415,6 +417,8 @@ func init() {
 	opts.SetVersion("Go lang package preinit, version \"%s\"", "0.0.1")
 	opts.SetDescription(`Provides utils for go daemon programing.
 such as daemonize, proc respawn, drop privileges of proc, pass FDs to child proc.`)
+	// --pr-logdir can be set by PREINIT_LOGDIR
+	opts.SetEnvPrefix("PREINIT_", "--pr-")
 
 	opts.SetOption("--pr-chroot", "", "(available for root only)set proc chroot directory, proc will chroot befor do any thing, default: no chroot")
 	opts.SetOption("--pr-user", "www-data", "(available for root only)set dispatcher/worker running user name or user id, empty to run as current user")
@@ -428,7 +432,7 @@ such as daemonize, proc respawn, drop privileges of proc, pass FDs to child proc
 	opts.SetOption("--pr-errlogfile", "", "set proc error log filename, if path is not absolute, file will be --logdir + logfile, default: disable error logging")
 	opts.SetOption("--pr-applogfile", "", "set proc app log file name, if path is not absolute, file will be --logdir + logfile, default: disable app logging")
 	opts.SetOption("--pr-debuglogfile", "", "set proc debug log file name, if path is not absolute, file will be --logdir + logfile, default: disable debug logging")
-	opts.SetOption("--pr-logrotation", "10", "set proc logging rotation, existed logfile will be overwrited")
+	opts.SetOption("--pr-logrotation", "10", "set proc logging rotation, max number of rotated logfiles to keep, rotated logfile is gziped")
 	opts.SetOption("--pr-logmaxsize", "2G", "set proc max logfile size, K/M/G suffix is identifyed, zero to disable file size rotation")
 	opts.SetOption("--pr-logmaxline", "2G", "set proc max logfile line, K/M/G suffix is identifyed, zero to disable file line rotation")
 
@@ -446,6 +450,14 @@ such as daemonize, proc respawn, drop privileges of proc, pass FDs to child proc
 	opts.SetFlag("--pr-help", "show help of preinit options")
 
 	opts.SetNotes("this is internal command line args to contorl Go lang proc")
+	// --pr-gen-completion bash/zsh/fish, --pr-gen-man
+	if ok, err := opts.Generate(); ok {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			CleanExit(1)
+		}
+		CleanExit(0)
+	}
 	//
 	// TODO: here
 	//println("opts.init() end.")